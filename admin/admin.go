@@ -0,0 +1,492 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/core"
+	"github.com/maxpert/marmot/db"
+	"github.com/maxpert/marmot/logstream"
+	"github.com/maxpert/marmot/snapshot"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultListLimit = 100
+const defaultSnapshotTimeout = 5 * time.Minute
+const recreateConsumerTimeout = 30 * time.Second
+const defaultWaitTimeout = 5 * time.Second
+
+type Server struct {
+	replicator *logstream.Replicator
+	health     *logstream.HealthGossip
+	streamDB   *db.SqliteStreamDB
+	mux        *http.ServeMux
+}
+
+func NewServer(replicator *logstream.Replicator, health *logstream.HealthGossip, streamDB *db.SqliteStreamDB) *Server {
+	s := &Server{
+		replicator: replicator,
+		health:     health,
+		streamDB:   streamDB,
+		mux:        http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/health", s.handleHealth)
+	s.mux.HandleFunc("/consumers", s.handleConsumers)
+	s.mux.HandleFunc("/consumers/recreate", s.handleRecreateConsumer)
+	s.mux.HandleFunc("/dead-letters", s.handleDeadLetters)
+	s.mux.HandleFunc("/dead-letters/replay", s.handleReplayDeadLetter)
+	s.mux.HandleFunc("/promote", s.handlePromote)
+	s.mux.HandleFunc("/events", s.handleEvents)
+	s.mux.HandleFunc("/snapshot", s.handleSnapshot)
+	s.mux.HandleFunc("/watermarks", s.handleWatermarks)
+	s.mux.HandleFunc("/tables", s.handleTables)
+	s.mux.HandleFunc("/tokens", s.handleToken)
+	s.mux.HandleFunc("/wait", s.handleWait)
+	return s
+}
+
+// Start serves admin API in background if enabled in configuration, until done is closed.
+func (s *Server) Start(done <-chan struct{}) {
+	if !cfg.Config.Admin.Enable {
+		return
+	}
+
+	server := &http.Server{
+		Addr:    cfg.Config.Admin.Bind,
+		Handler: s.mux,
+	}
+
+	go func() {
+		log.Info().Str("bind", cfg.Config.Admin.Bind).Msg("Starting admin API")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Msg("Unable to start admin listener")
+		}
+	}()
+
+	go func() {
+		<-done
+		ctx, cancel := context.WithTimeout(context.Background(), probeShutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			log.Warn().Err(err).Msg("Unable to shutdown admin listener")
+		}
+	}()
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := s.health.Status()
+	if status.Degraded {
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *Server) handleConsumers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	consumers, err := s.replicator.Consumers()
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to fetch consumer info")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, consumers)
+}
+
+func (s *Server) handleRecreateConsumer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	shard, err := strconv.ParseUint(r.URL.Query().Get("shard"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid shard", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), recreateConsumerTimeout)
+	defer cancel()
+
+	err = s.replicator.RecreateConsumer(ctx, shard)
+	if errors.Is(err, logstream.ErrUnknownShard) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if errors.Is(err, logstream.ErrShardNotListening) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Uint64("shard", shard).Msg("Unable to recreate consumer")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	consumers, err := s.replicator.Consumers()
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to fetch consumer info")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, consumers)
+}
+
+func (s *Server) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := defaultListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+
+		limit = n
+	}
+
+	letters, err := s.replicator.DeadLetters(limit)
+	if errors.Is(err, logstream.ErrDeadLetterDisabled) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to list dead letters")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, letters)
+}
+
+func (s *Server) handleReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	seq, err := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid seq", http.StatusBadRequest)
+		return
+	}
+
+	token, err := s.replicator.ReplayDeadLetter(seq)
+	if errors.Is(err, logstream.ErrDeadLetterDisabled) || errors.Is(err, nats.ErrMsgNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Uint64("seq", seq).Msg("Unable to replay dead letter")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, token)
+}
+
+func (s *Server) handlePromote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := s.streamDB.Promote()
+	if errors.Is(err, db.ErrNotReplica) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to promote node")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"role": cfg.RolePrimary})
+}
+
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	timeout := defaultSnapshotTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+
+		timeout = d
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	info, err := s.replicator.SaveSnapshotSync(ctx)
+	if errors.Is(err, logstream.ErrSnapshotsDisabled) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if errors.Is(err, logstream.ErrSnapshotLocked) || errors.Is(err, snapshot.ErrPendingSnapshot) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to save snapshot")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+// handleWatermarks lists applied watermarks on GET and forcibly sets watermark of a shard on POST.
+func (s *Server) handleWatermarks(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, s.replicator.Watermarks())
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	var shard uint64
+	var err error
+	if table := query.Get("table"); table != "" {
+		shard, err = s.replicator.WatermarkShard(table)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		shard, err = strconv.ParseUint(query.Get("shard"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid shard", http.StatusBadRequest)
+			return
+		}
+	}
+
+	seq, err := strconv.ParseUint(query.Get("seq"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid seq", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), recreateConsumerTimeout)
+	defer cancel()
+
+	err = s.replicator.SetWatermark(ctx, shard, seq, query.Get("confirm"))
+	if errors.Is(err, logstream.ErrUnknownShard) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if errors.Is(err, logstream.ErrWatermarkTokenMismatch) || errors.Is(err, logstream.ErrShardNotListening) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Uint64("shard", shard).Msg("Unable to set watermark")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.replicator.Watermarks())
+}
+
+// handleToken returns token of latest change this node published for table, clients pass it
+// to /wait of a replica to read their own writes.
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, ok := s.replicator.LastPublished(r.URL.Query().Get("table"))
+	if !ok {
+		http.Error(w, "no change published for table", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, token)
+}
+
+// handleWait blocks until change identified by stream and seq is applied locally or timeout
+// passes.
+func (s *Server) handleWait(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	token := logstream.SequenceToken{Stream: query.Get("stream")}
+	if token.Stream == "" {
+		http.Error(w, "missing stream", http.StatusBadRequest)
+		return
+	}
+
+	seq, err := strconv.ParseUint(query.Get("seq"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid seq", http.StatusBadRequest)
+		return
+	}
+	token.Sequence = seq
+
+	timeout := defaultWaitTimeout
+	if v := query.Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+
+		timeout = d
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	err = s.replicator.WaitForSequence(ctx, token)
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, token)
+}
+
+// handleTables lists captured tables on GET, starts capturing table on POST and stops on DELETE.
+func (s *Server) handleTables(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, s.streamDB.ReplicatedTables())
+		return
+	}
+
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if r.Method == http.MethodPost {
+		err = s.streamDB.AddTable(name)
+	} else {
+		err = s.streamDB.RemoveTable(name)
+	}
+
+	if errors.Is(err, db.ErrTableNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if errors.Is(err, db.ErrTableExcluded) || errors.Is(err, db.ErrTableRequiresRestart) || errors.Is(err, logstream.ErrTableShardMissing) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Str("table", name).Msg("Unable to update captured tables")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.streamDB.ReplicatedTables())
+}
+
+// handleEvents streams lifecycle events as JSON lines until client disconnects.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events, unsubscribe := core.Lifecycle.Subscribe(core.DefaultSubscriberBuffer)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case ev := <-events:
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Warn().Err(err).Msg("Unable to write admin response")
+	}
+}
@@ -0,0 +1,217 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/db"
+	"github.com/maxpert/marmot/logstream"
+	"github.com/maxpert/marmot/snapshot"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/rs/zerolog"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	os.Exit(m.Run())
+}
+
+// dirStorage keeps uploaded snapshots in a local directory.
+type dirStorage struct {
+	dir string
+}
+
+func (s *dirStorage) Upload(name, filePath string) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(s.dir, name), data, 0644)
+}
+
+func (s *dirStorage) Download(filePath, name string) error {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return snapshot.ErrNoSnapshotFound
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filePath, data, 0644)
+}
+
+func (s *dirStorage) LastModified(name string) (time.Time, error) {
+	stat, err := os.Stat(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return time.Time{}, snapshot.ErrNoSnapshotFound
+	}
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return stat.ModTime(), nil
+}
+
+// newTestAdmin serves admin API of a replicator connected to a fresh JetStream server, with
+// snapshots uploaded to returned storage.
+func newTestAdmin(t *testing.T) (*httptest.Server, *dirStorage) {
+	t.Helper()
+
+	saved := *cfg.Config
+	t.Cleanup(func() {
+		*cfg.Config = saved
+	})
+
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		NoSigs:    true,
+		NoLog:     true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns.Start()
+	t.Cleanup(ns.Shutdown)
+	if !ns.ReadyForConnections(10 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+
+	path := filepath.Join(t.TempDir(), "marmot.db")
+	streamDB, err := db.OpenStreamDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Config.NATS.URLs = []string{ns.ClientURL()}
+	cfg.Config.SeqMapPath = filepath.Join(t.TempDir(), "seq-map.cbor")
+	storage := &dirStorage{dir: t.TempDir()}
+	replicator, err := logstream.NewReplicator(snapshot.NewNatsDBSnapshot(streamDB, storage), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := httptest.NewServer(NewServer(replicator, nil, streamDB).mux)
+	t.Cleanup(api.Close)
+	return api, storage
+}
+
+func TestSnapshotEndpointReturnsMetadata(t *testing.T) {
+	api, storage := newTestAdmin(t)
+
+	res, err := http.Get(api.URL + "/snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected GET to be rejected, got status %d", res.StatusCode)
+	}
+
+	res, err = http.Post(api.URL+"/snapshot?timeout=30s", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected snapshot to be saved, got status %d", res.StatusCode)
+	}
+
+	info := snapshot.Info{}
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(storage.dir, info.Name))
+	if err != nil {
+		t.Fatalf("expected snapshot %q uploaded before response: %v", info.Name, err)
+	}
+
+	h := fnv.New64()
+	h.Write(data)
+	if checksum := fmt.Sprintf("%x", h.Sum64()); info.Checksum != checksum || info.Size != int64(len(data)) {
+		t.Fatalf("expected checksum %s and size %d, got %+v", checksum, len(data), info)
+	}
+
+	if info.SavedAt.IsZero() {
+		t.Fatalf("expected snapshot time in metadata, got %+v", info)
+	}
+}
+
+func TestSnapshotEndpointRejectsInvalidTimeout(t *testing.T) {
+	api, _ := newTestAdmin(t)
+
+	res, err := http.Post(api.URL+"/snapshot?timeout=soon", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected invalid timeout to be rejected, got status %d", res.StatusCode)
+	}
+}
+
+func TestAdminListenerStopsOnDone(t *testing.T) {
+	saved := *cfg.Config
+	t.Cleanup(func() {
+		*cfg.Config = saved
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cfg.Config.Admin.Enable = true
+	cfg.Config.Admin.Bind = addr
+	done := make(chan struct{})
+	NewServer(nil, nil, nil).Start(done)
+
+	get := func() error {
+		res, err := http.Get("http://" + addr + "/nope")
+		if err == nil {
+			res.Body.Close()
+		}
+
+		return err
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for get() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("admin listener not started")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(done)
+	for get() == nil {
+		if time.Now().After(deadline.Add(5 * time.Second)) {
+			t.Fatal("admin listener still serving after done was closed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
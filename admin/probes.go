@@ -0,0 +1,156 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/db"
+	"github.com/maxpert/marmot/logstream"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+const probeShutdownTimeout = 5 * time.Second
+
+// ProbeServer serves liveness and readiness probes, separate from admin API so probes can
+// be exposed to orchestrator without exposing admin operations.
+type ProbeServer struct {
+	replicator *logstream.Replicator
+	streamDB   *db.SqliteStreamDB
+	mux        *http.ServeMux
+}
+
+type probeStatus struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func NewProbeServer(replicator *logstream.Replicator, streamDB *db.SqliteStreamDB) *ProbeServer {
+	s := &ProbeServer{
+		replicator: replicator,
+		streamDB:   streamDB,
+		mux:        http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/healthz", s.handleHealthz)
+	s.mux.HandleFunc("/readyz", s.handleReadyz)
+	s.mux.HandleFunc("/status", s.handleStatus)
+	return s
+}
+
+// Start serves probes in background if bind address is configured, server shuts down once
+// done is closed.
+func (s *ProbeServer) Start(done <-chan struct{}) {
+	if cfg.Config.HealthCheck.Bind == "" {
+		return
+	}
+
+	server := &http.Server{
+		Addr:    cfg.Config.HealthCheck.Bind,
+		Handler: s.mux,
+	}
+
+	go func() {
+		log.Info().Str("bind", cfg.Config.HealthCheck.Bind).Msg("Starting health check probes")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Msg("Unable to start health check listener")
+		}
+	}()
+
+	go func() {
+		<-done
+		ctx, cancel := context.WithTimeout(context.Background(), probeShutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			log.Warn().Err(err).Msg("Unable to shutdown health check listener")
+		}
+	}()
+}
+
+func (s *ProbeServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if reason := s.unhealthyReason(); reason != "" {
+		writeJSON(w, http.StatusServiceUnavailable, &probeStatus{Status: "unavailable", Reason: reason})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &probeStatus{Status: "ok"})
+}
+
+func (s *ProbeServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	reason := s.unhealthyReason()
+	if reason == "" {
+		reason = s.unreadyReason()
+	}
+
+	if reason != "" {
+		writeJSON(w, http.StatusServiceUnavailable, &probeStatus{Status: "unavailable", Reason: reason})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &probeStatus{Status: "ok"})
+}
+
+// handleStatus lists replication status of every captured table, for debugging which table
+// of which node is lagging.
+func (s *ProbeServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	tables, err := s.streamDB.Status()
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to fetch replication status")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"node_id": cfg.Config.NodeID, "tables": tables})
+}
+
+func (s *ProbeServer) unhealthyReason() string {
+	if status := s.replicator.ConnectionStatus(); status != nats.CONNECTED {
+		return fmt.Sprintf("NATS connection is %s", status)
+	}
+
+	if !s.streamDB.CDCInstalled() {
+		return "change data capture triggers are not installed yet"
+	}
+
+	return ""
+}
+
+func (s *ProbeServer) unreadyReason() string {
+	consumers, err := s.replicator.Consumers()
+	if err != nil {
+		return fmt.Sprintf("unable to fetch consumer info: %s", err)
+	}
+
+	if len(consumers) != int(cfg.Config.StreamCount()) {
+		return fmt.Sprintf("%d of %d shard consumers listening", len(consumers), cfg.Config.StreamCount())
+	}
+
+	for _, c := range consumers {
+		// Push consumer delivers ahead of applying, delivered changes not yet acked are still behind
+		lag := c.NumPending + uint64(c.NumAckPending)
+		if lag > cfg.Config.HealthCheck.MaxLag {
+			return fmt.Sprintf("shard %d is %d changes behind, max lag is %d", c.Shard, lag, cfg.Config.HealthCheck.MaxLag)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asaskevich/EventBus"
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/db"
+	"github.com/maxpert/marmot/logstream"
+	"github.com/maxpert/marmot/sink"
+	"github.com/maxpert/marmot/utils"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// withReplicationConfig restores configuration changed by replication tests. CDC watcher of
+// databases keeps reading configuration after test finishes, only fields it doesn't read are
+// restored.
+func withReplicationConfig(t *testing.T) {
+	savedDeadLetter, savedTables := cfg.Config.ReplicationLog.DeadLetter, cfg.Config.Replication.Tables
+	savedDedupPolicy, savedDedupWindow := cfg.Config.Replication.DedupPolicy, cfg.Config.Replication.DedupWindow
+	savedURLs, savedSeqMap := cfg.Config.NATS.URLs, cfg.Config.SeqMapPath
+	t.Cleanup(func() {
+		cfg.Config.ReplicationLog.DeadLetter, cfg.Config.Replication.Tables = savedDeadLetter, savedTables
+		cfg.Config.Replication.DedupPolicy, cfg.Config.Replication.DedupWindow = savedDedupPolicy, savedDedupWindow
+		cfg.Config.NATS.URLs, cfg.Config.SeqMapPath = savedURLs, savedSeqMap
+	})
+}
+
+// startTestNATS starts a fresh JetStream server replicators connect to, sequence map of
+// replicators is kept across replicators of same test like across restarts of a node.
+func startTestNATS(t *testing.T) {
+	t.Helper()
+
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		NoSigs:    true,
+		NoLog:     true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Start()
+	t.Cleanup(s.Shutdown)
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+
+	cfg.Config.NATS.URLs = []string{s.ClientURL()}
+	cfg.Config.SeqMapPath = filepath.Join(t.TempDir(), "seq-map.cbor")
+}
+
+func newTestReplicator(t *testing.T, seqStore logstream.SequenceStore) *logstream.Replicator {
+	t.Helper()
+
+	r, err := logstream.NewReplicator(nil, seqStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+// listenChanges runs listener of shard in background until returned stop is called or test
+// finishes, stop drains replicator and waits for listener to return.
+func listenChanges(t *testing.T, r *logstream.Replicator, shard uint64, callback func(data []byte, meta *nats.MsgMetadata) error) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = r.Listen(shard, callback)
+	}()
+
+	once := &sync.Once{}
+	stop := func() {
+		once.Do(func() {
+			_ = r.Drain()
+			<-done
+		})
+	}
+
+	t.Cleanup(stop)
+	return stop
+}
+
+// applyChanges returns listener applying changes to streamDB the way a running node does,
+// applied changes are delivered to sinks.
+func applyChanges(t *testing.T, streamDB *db.SqliteStreamDB, sinks ...sink.Sink) func(data []byte, meta *nats.MsgMetadata) error {
+	dispatcher, err := sink.NewDispatcher(sinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(dispatcher.Stop)
+	return onChangeEvent(streamDB, utils.NewStateContext(), EventBus.New(), dispatcher)
+}
+
+func publishChange(t *testing.T, r *logstream.Replicator, event *db.ChangeLogEvent) {
+	t.Helper()
+
+	ev := &logstream.ReplicationEvent[db.ChangeLogEvent]{FromNodeId: 4242, Payload: *event}
+	data, err := ev.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Publish(1, event.MessageID(4242), data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOversizedRowDeadLettered(t *testing.T) {
+	withReplicationConfig(t)
+	cfg.Config.ReplicationLog.DeadLetter = true
+	cfg.Config.Replication.Tables = map[string]cfg.TableConfiguration{
+		"books": {MaxRowSize: 128},
+	}
+	streamDB, app := openReplicatedDB(t)
+	startTestNATS(t)
+	r := newTestReplicator(t, nil)
+
+	for i, title := range []string{"dune", strings.Repeat("wide", 64), "emma"} {
+		publishChange(t, r, &db.ChangeLogEvent{
+			Id:        int64(i + 1),
+			Type:      "insert",
+			TableName: "books",
+			Row:       map[string]any{"id": int64(i + 1), "title": title},
+		})
+	}
+	listenChanges(t, r, 1, applyChanges(t, streamDB))
+
+	var letters []*logstream.DeadLetter
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var err error
+		letters, err = r.DeadLetters(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		count := 0
+		if err := app.QueryRow("SELECT COUNT(*) FROM books").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(letters) == 1 && count == 2 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 rows applied and 1 dead letter, got %d rows and %d dead letters", count, len(letters))
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if letters[0].StreamSequence != 2 || !strings.Contains(letters[0].Error, db.ErrRowTooLarge.Error()) {
+		t.Fatalf("expected oversized row dead lettered with reason, got %+v", letters[0])
+	}
+
+	title := ""
+	if err := app.QueryRow("SELECT title FROM books WHERE id = 2").Scan(&title); err == nil {
+		t.Fatalf("expected oversized row not applied, found %q", title)
+	}
+}
+
+func TestResumeAfterCrashAppliesEveryChangeOnce(t *testing.T) {
+	withReplicationConfig(t)
+	streamDB, app := openReplicatedDB(t)
+	startTestNATS(t)
+
+	first := newTestReplicator(t, streamDB)
+	for i := 1; i <= 5; i++ {
+		publishChange(t, first, &db.ChangeLogEvent{
+			Id:        int64(i),
+			Type:      "insert",
+			TableName: "books",
+			Row:       map[string]any{"id": int64(i), "title": "book"},
+		})
+	}
+
+	// Node crashes right after third change commits, before sequence map is saved
+	crashed := make(chan struct{})
+	apply := applyChanges(t, streamDB)
+	stop := listenChanges(t, first, 1, func(data []byte, meta *nats.MsgMetadata) error {
+		if err := apply(data, meta); err != nil {
+			return err
+		}
+
+		if meta.Sequence.Stream == 3 {
+			close(crashed)
+			return context.Canceled
+		}
+
+		return nil
+	})
+
+	select {
+	case <-crashed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for changes")
+	}
+	stop()
+
+	if seq, err := streamDB.AppliedSeq(first.Watermarks()[0].Stream); err != nil || seq != 3 {
+		t.Fatalf("expected applied sequence 3 committed with changes, got %d (%v)", seq, err)
+	}
+
+	// Restarted node resumes after last change committed to database
+	second := newTestReplicator(t, streamDB)
+	applied := make(chan uint64, 8)
+	apply = applyChanges(t, streamDB)
+	listenChanges(t, second, 1, func(data []byte, meta *nats.MsgMetadata) error {
+		applied <- meta.Sequence.Stream
+		return apply(data, meta)
+	})
+
+	for _, expected := range []uint64{4, 5} {
+		select {
+		case seq := <-applied:
+			if seq != expected {
+				t.Fatalf("expected change %d applied after restart, got %d", expected, seq)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for change %d", expected)
+		}
+	}
+
+	select {
+	case seq := <-applied:
+		t.Fatalf("change %d applied twice", seq)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	count := 0
+	if err := app.QueryRow("SELECT COUNT(*) FROM books").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 5 {
+		t.Fatalf("expected every change applied, got %d rows", count)
+	}
+}
+
+func TestDuplicatePublishMutatesRowOnce(t *testing.T) {
+	withReplicationConfig(t)
+	cfg.Config.Replication.DedupPolicy = cfg.DedupRing
+	cfg.Config.Replication.DedupWindow = 16
+	streamDB, app := openReplicatedDB(t)
+	for _, stmt := range []string{
+		"CREATE TABLE book_mutations(id INTEGER)",
+		"CREATE TRIGGER books_inserted AFTER INSERT ON books BEGIN INSERT INTO book_mutations VALUES (NEW.id); END",
+		"CREATE TRIGGER books_updated AFTER UPDATE ON books BEGIN INSERT INTO book_mutations VALUES (NEW.id); END",
+	} {
+		if _, err := app.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	startTestNATS(t)
+	r := newTestReplicator(t, nil)
+
+	change := &db.ChangeLogEvent{
+		Id:        1,
+		Type:      "update",
+		TableName: "books",
+		Row:       map[string]any{"id": int64(1), "title": "dune"},
+		CreatedAt: 1700000000000,
+	}
+
+	// Republished within duplicates window, dropped by JetStream
+	publishChange(t, r, change)
+	publishChange(t, r, change)
+
+	// Redelivered with another message ID, skipped when applying
+	data, err := (&logstream.ReplicationEvent[db.ChangeLogEvent]{FromNodeId: 4242, Payload: *change}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Publish(1, "redelivered", data); err != nil {
+		t.Fatal(err)
+	}
+
+	publishChange(t, r, &db.ChangeLogEvent{
+		Id:        2,
+		Type:      "insert",
+		TableName: "books",
+		Row:       map[string]any{"id": int64(2), "title": "emma"},
+		CreatedAt: 1700000001000,
+	})
+
+	applied := make(chan uint64, 8)
+	apply := applyChanges(t, streamDB)
+	listenChanges(t, r, 1, func(data []byte, meta *nats.MsgMetadata) error {
+		if err := apply(data, meta); err != nil {
+			return err
+		}
+
+		applied <- meta.Sequence.Stream
+		return nil
+	})
+
+	for _, expected := range []uint64{1, 2, 3} {
+		select {
+		case seq := <-applied:
+			if seq != expected {
+				t.Fatalf("expected message %d, got %d", expected, seq)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for message %d", expected)
+		}
+	}
+
+	select {
+	case seq := <-applied:
+		t.Fatalf("expected republished change dropped by JetStream, got message %d", seq)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	mutations := 0
+	if err := app.QueryRow("SELECT COUNT(*) FROM book_mutations WHERE id = 1").Scan(&mutations); err != nil {
+		t.Fatal(err)
+	}
+
+	if mutations != 1 {
+		t.Fatalf("expected duplicated change to mutate row once, got %d mutations", mutations)
+	}
+}
+
+func TestBlobLargerThanMaxPayloadRoundTrips(t *testing.T) {
+	withReplicationConfig(t)
+	streamDB, app := openReplicatedDB(t)
+	startTestNATS(t)
+	r := newTestReplicator(t, nil)
+
+	blob := make([]byte, 5*1024*1024)
+	if _, err := rand.Read(blob); err != nil {
+		t.Fatal(err)
+	}
+
+	publishChange(t, r, &db.ChangeLogEvent{
+		Id:        1,
+		Type:      "insert",
+		TableName: "books",
+		Row:       map[string]any{"id": int64(1), "title": blob},
+	})
+
+	applied := make(chan *nats.MsgMetadata, 8)
+	apply := applyChanges(t, streamDB)
+	listenChanges(t, r, 1, func(data []byte, meta *nats.MsgMetadata) error {
+		if err := apply(data, meta); err != nil {
+			return err
+		}
+
+		applied <- meta
+		return nil
+	})
+
+	select {
+	case meta := <-applied:
+		if meta.Sequence.Stream < 6 {
+			t.Fatalf("expected change split into chunks, applied at sequence %d", meta.Sequence.Stream)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("timed out waiting for chunked change")
+	}
+
+	var stored []byte
+	if err := app.QueryRow("SELECT title FROM books WHERE id = 1").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(stored, blob) {
+		t.Fatalf("expected stored blob equal to published %d bytes, got %d different bytes", len(blob), len(stored))
+	}
+}
+
+func TestAppliedChangesDeliveredToHooks(t *testing.T) {
+	withReplicationConfig(t)
+	streamDB, _ := openReplicatedDB(t)
+	startTestNATS(t)
+	r := newTestReplicator(t, nil)
+
+	changes := []*db.ChangeLogEvent{
+		{Id: 1, Type: "insert", TableName: "books", Row: map[string]any{"id": int64(1), "title": "dune"}},
+		{Id: 2, Type: "update", TableName: "books", Row: map[string]any{"id": int64(1), "title": "dune messiah"}},
+		{Id: 3, Type: "delete", TableName: "books", Row: map[string]any{"id": int64(1), "title": "dune messiah"}},
+	}
+	for _, change := range changes {
+		publishChange(t, r, change)
+	}
+
+	// Hooks run once change is committed along with its stream sequence
+	stream := r.Watermarks()[0].Stream
+	type delivery struct {
+		event   *sink.Event
+		applied uint64
+	}
+	delivered := make(chan delivery, len(changes))
+	hook := sink.NewHook("cache", func(event *sink.Event) error {
+		applied, err := streamDB.AppliedSeq(stream)
+		if err != nil {
+			return err
+		}
+
+		delivered <- delivery{event: event, applied: applied}
+		return nil
+	})
+
+	// Single worker keeps deliveries in apply order
+	savedSinks := cfg.Config.Sinks
+	cfg.Config.Sinks.Workers = 1
+	t.Cleanup(func() { cfg.Config.Sinks = savedSinks })
+
+	listenChanges(t, r, 1, applyChanges(t, streamDB, hook))
+
+	for _, change := range changes {
+		var d delivery
+		select {
+		case d = <-delivered:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for %s hook", change.Type)
+		}
+
+		if d.event.Type != change.Type || d.event.TableName != "books" || d.event.FromNodeID != 4242 ||
+			fmt.Sprint(d.event.Key["id"]) != "1" || d.event.Row["title"] != change.Row["title"] {
+			t.Fatalf("unexpected %s hook payload %+v", change.Type, d.event)
+		}
+
+		// Stream sequences of published changes match their IDs
+		if d.applied < uint64(change.Id) {
+			t.Fatalf("%s hook invoked before change was committed, applied sequence %d", change.Type, d.applied)
+		}
+	}
+}
@@ -1,16 +1,23 @@
 package cfg
 
 import (
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"hash/fnv"
+	"net"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	"github.com/denisbrodbeck/machineid"
 	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
@@ -25,12 +32,95 @@ const (
 	SFTP   SnapshotStoreType = "sftp"
 )
 
+const (
+	LogFormatConsole = "console"
+	LogFormatJSON    = "json"
+)
+
+// LogSubsystemNATS is embedded NATS server logging subsystem, the only one with its own level.
+const LogSubsystemNATS = "nats"
+
+const (
+	SinkOnFullBlock = "block"
+	SinkOnFullDrop  = "drop"
+)
+
+const (
+	DedupNone = "none"
+	DedupRing = "ring"
+	DedupTime = "time"
+)
+
+const (
+	OrderingGlobal = "global"
+	OrderingPerKey = "per-key"
+)
+
+const (
+	RolePrimary = "primary"
+	RoleReplica = "replica"
+)
+
+const (
+	ConflictNone      = "none"
+	ConflictLWW       = "lww"
+	ConflictLWWNodeID = "lww-node-id"
+)
+
+const (
+	CodecNone   = "none"
+	CodecSnappy = "snappy"
+	CodecZstd   = "zstd"
+)
+
+const (
+	ClockWall = "wall"
+	ClockHLC  = "hlc"
+)
+
+const (
+	JournalModeWAL      = "WAL"
+	JournalModeDelete   = "DELETE"
+	JournalModeTruncate = "TRUNCATE"
+	JournalModePersist  = "PERSIST"
+	JournalModeMemory   = "MEMORY"
+	JournalModeOff      = "OFF"
+)
+
+const (
+	MissingTableError  = "error"
+	MissingTableSkip   = "skip"
+	MissingTableCreate = "create"
+)
+
 type ReplicationLogConfiguration struct {
 	Shards         uint64 `toml:"shards"`
 	MaxEntries     int64  `toml:"max_entries"`
 	Replicas       int    `toml:"replicas"`
 	Compress       bool   `toml:"compress"`
 	UpdateExisting bool   `toml:"update_existing"`
+	Codec          string `toml:"codec"`
+	ZstdLevel      string `toml:"zstd_level"`
+
+	AtomicTransactions    bool   `toml:"atomic_transactions"`
+	MaxTransactionChanges uint32 `toml:"max_transaction_changes"`
+	EmbedSchema           bool   `toml:"embed_schema"`
+	DeadLetter            bool   `toml:"dead_letter"`
+	PublishBufferSize     int    `toml:"publish_buffer_size"`
+
+	CatchUpRate      uint32 `toml:"catch_up_rate"`
+	CatchUpThreshold uint64 `toml:"catch_up_threshold"`
+	DuplicatesWindow uint32 `toml:"duplicates_window"`
+	ChunkSize        int    `toml:"chunk_size"`
+
+	BatchMaxCount int    `toml:"batch_max_count"`
+	BatchMaxBytes int    `toml:"batch_max_bytes"`
+	BatchLinger   uint32 `toml:"batch_linger"`
+}
+
+// BatchingEnabled returns true if changes are published batched instead of one per message.
+func (c *ReplicationLogConfiguration) BatchingEnabled() bool {
+	return c.AtomicTransactions || c.BatchMaxCount > 0
 }
 
 type WebDAVConfiguration struct {
@@ -59,6 +149,7 @@ type ObjectStoreConfiguration struct {
 type SnapshotConfiguration struct {
 	Enable    bool                     `toml:"enabled"`
 	Interval  uint32                   `toml:"interval"`
+	MaxAge    uint32                   `toml:"max_age"`
 	StoreType SnapshotStoreType        `toml:"store"`
 	Nats      ObjectStoreConfiguration `toml:"nats"`
 	S3        S3Configuration          `toml:"s3"`
@@ -69,22 +160,170 @@ type SnapshotConfiguration struct {
 type NATSConfiguration struct {
 	URLs                 []string `toml:"urls"`
 	SubjectPrefix        string   `toml:"subject_prefix"`
+	ControlPrefix        string   `toml:"control_subject_prefix"`
 	StreamPrefix         string   `toml:"stream_prefix"`
 	ServerConfigFile     string   `toml:"server_config"`
 	SeedFile             string   `toml:"seed_file"`
 	CredsUser            string   `toml:"user_name"`
 	CredsPassword        string   `toml:"user_password"`
+	Token                string   `toml:"token"`
+	CredsFile            string   `toml:"creds_file"`
 	CAFile               string   `toml:"ca_file"`
 	CertFile             string   `toml:"cert_file"`
 	KeyFile              string   `toml:"key_file"`
+	InsecureSkipVerify   bool     `toml:"insecure_skip_verify"`
 	BindAddress          string   `toml:"bind_address"`
 	ConnectRetries       int      `toml:"connect_retries"`
 	ReconnectWaitSeconds int      `toml:"reconnect_wait_seconds"`
+	MaxReconnects        int      `toml:"max_reconnects"`
+	PingIntervalSeconds  int      `toml:"ping_interval_seconds"`
+	NoEcho               bool     `toml:"no_echo"`
+
+	JetStreamReadyTimeoutSeconds int   `toml:"jetstream_ready_timeout_seconds"`
+	MinClusterSize               int   `toml:"min_cluster_size"`
+	ClusterWaitTimeoutSeconds    int   `toml:"cluster_wait_timeout_seconds"`
+	JSMaxMemory                  int64 `toml:"js_max_memory"`
+	JSMaxFile                    int64 `toml:"js_max_file"`
+}
+
+type EncryptionConfiguration struct {
+	Key     string `toml:"key"`
+	KeyFile string `toml:"key_file"`
+	Require bool   `toml:"require"`
+}
+
+// Enabled returns true if change payloads are encrypted before publishing.
+func (c *EncryptionConfiguration) Enabled() bool {
+	return c.Key != "" || c.KeyFile != ""
+}
+
+// LoadKey returns AES key decoded from base64 key or contents of key file, nil if encryption
+// isn't enabled.
+func (c *EncryptionConfiguration) LoadKey() ([]byte, error) {
+	encoded := c.Key
+	if c.KeyFile != "" {
+		data, err := os.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded = strings.TrimSpace(string(data))
+	}
+
+	if encoded == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("invalid encryption key size %d, expected 16, 24 or 32 bytes", len(key))
+	}
+}
+
+type FileSinkConfiguration struct {
+	Enable  bool   `toml:"enable"`
+	Path    string `toml:"path"`
+	MaxSize int64  `toml:"max_size"`
+	MaxAge  int64  `toml:"max_age"`
+	Gzip    bool   `toml:"gzip"`
+}
+
+type WebhookSinkConfiguration struct {
+	Enable       bool              `toml:"enable"`
+	URL          string            `toml:"url"`
+	Tables       []string          `toml:"tables"`
+	Headers      map[string]string `toml:"headers"`
+	Timeout      uint32            `toml:"timeout"`
+	MaxRetries   int               `toml:"max_retries"`
+	RetryBackoff uint32            `toml:"retry_backoff"`
+}
+
+type SinkConfiguration struct {
+	Workers     int                      `toml:"workers"`
+	QueueSize   int                      `toml:"queue_size"`
+	OnFull      string                   `toml:"on_full"`
+	DroppedPath string                   `toml:"dropped_path"`
+	File        FileSinkConfiguration    `toml:"file"`
+	Webhook     WebhookSinkConfiguration `toml:"webhook"`
 }
 
 type LoggingConfiguration struct {
-	Verbose bool   `toml:"verbose"`
-	Format  string `toml:"format"`
+	Verbose    bool              `toml:"verbose"`
+	Format     string            `toml:"format"`
+	Level      string            `toml:"level"`
+	Subsystems map[string]string `toml:"subsystems"`
+}
+
+// GlobalLevel returns configured log level, falling back to debug or info based on verbose.
+func (c *LoggingConfiguration) GlobalLevel() zerolog.Level {
+	if c.Level != "" {
+		level, _ := zerolog.ParseLevel(c.Level)
+		return level
+	}
+
+	if c.Verbose {
+		return zerolog.DebugLevel
+	}
+
+	return zerolog.InfoLevel
+}
+
+// SubsystemLevel returns log level overridden for subsystem, or global level if not overridden.
+func (c *LoggingConfiguration) SubsystemLevel(name string) zerolog.Level {
+	if l, ok := c.Subsystems[name]; ok {
+		level, _ := zerolog.ParseLevel(l)
+		return level
+	}
+
+	return c.GlobalLevel()
+}
+
+type HealthConfiguration struct {
+	Gossip         bool   `toml:"gossip"`
+	ClusterSize    int    `toml:"cluster_size"`
+	GossipInterval uint32 `toml:"gossip_interval"`
+	PeerTimeout    uint32 `toml:"peer_timeout"`
+
+	ClockSkewThreshold uint32 `toml:"clock_skew_threshold"`
+}
+
+type StatsDConfiguration struct {
+	Enable  bool   `toml:"enable"`
+	Address string `toml:"address"`
+	Prefix  string `toml:"prefix"`
+}
+
+type MaintenanceConfiguration struct {
+	Interval                   uint32 `toml:"interval"`
+	IncrementalVacuumFreePages int64  `toml:"incremental_vacuum_free_pages"`
+	WalCheckpointMode          string `toml:"wal_checkpoint_mode"`
+	WalCheckpointBatches       uint32 `toml:"wal_checkpoint_batches"`
+	WalCheckpointInterval      uint32 `toml:"wal_checkpoint_interval"`
+}
+
+type ShutdownConfiguration struct {
+	Timeout          uint32 `toml:"timeout"`
+	SinksTimeout     uint32 `toml:"sinks_timeout"`
+	NATSDrainTimeout uint32 `toml:"nats_drain_timeout"`
+	CleanupTimeout   uint32 `toml:"cleanup_timeout"`
+	DBFlushTimeout   uint32 `toml:"db_flush_timeout"`
+}
+
+type AdminConfiguration struct {
+	Enable bool   `toml:"enable"`
+	Bind   string `toml:"bind"`
+}
+
+type HealthCheckConfiguration struct {
+	Bind   string `toml:"bind"`
+	MaxLag uint64 `toml:"max_lag"`
 }
 
 type PrometheusConfiguration struct {
@@ -94,6 +333,31 @@ type PrometheusConfiguration struct {
 	Subsystem string `toml:"subsystem"`
 }
 
+type TableConfiguration struct {
+	VersionColumn   string            `toml:"version_column"`
+	Shard           uint64            `toml:"shard"`
+	Stream          string            `toml:"stream"`
+	Ordering        string            `toml:"ordering"`
+	MaxRowSize      int               `toml:"max_row_size"`
+	RemapIDs        bool              `toml:"remap_ids"`
+	RemapReferences map[string]string `toml:"remap_references"`
+
+	ExcludeFromSnapshot bool `toml:"exclude_from_snapshot"`
+}
+
+type ReplicationConfiguration struct {
+	MissingTable       string                        `toml:"missing_table"`
+	DedupPolicy        string                        `toml:"dedup_policy"`
+	DedupWindow        int                           `toml:"dedup_window"`
+	Clock              string                        `toml:"clock"`
+	ConflictResolution string                        `toml:"conflict_resolution"`
+	ReplicateDDL       bool                          `toml:"replicate_ddl"`
+	AutoAddTables      bool                          `toml:"auto_add_tables"`
+	IncludeTables      []string                      `toml:"include_tables"`
+	ExcludeTables      []string                      `toml:"exclude_tables"`
+	Tables             map[string]TableConfiguration `toml:"tables"`
+}
+
 type Configuration struct {
 	SeqMapPath      string `toml:"seq_map_path"`
 	DBPath          string `toml:"db_path"`
@@ -104,20 +368,37 @@ type Configuration struct {
 	CleanupInterval uint32 `toml:"cleanup_interval"`
 	SleepTimeout    uint32 `toml:"sleep_timeout"`
 	PollingInterval uint32 `toml:"polling_interval"`
+	Role            string `toml:"role"`
+	JournalMode     string `toml:"journal_mode"`
+
+	CleanupOnExit       bool `toml:"cleanup_on_exit"`
+	CleanupTablesOnExit bool `toml:"cleanup_tables_on_exit"`
 
 	Snapshot       SnapshotConfiguration       `toml:"snapshot"`
 	ReplicationLog ReplicationLogConfiguration `toml:"replication_log"`
+	Replication    ReplicationConfiguration    `toml:"replication"`
 	NATS           NATSConfiguration           `toml:"nats"`
+	Encryption     EncryptionConfiguration     `toml:"encryption"`
+	Sinks          SinkConfiguration           `toml:"sinks"`
 	Logging        LoggingConfiguration        `toml:"logging"`
 	Prometheus     PrometheusConfiguration     `toml:"prometheus"`
+	StatsD         StatsDConfiguration         `toml:"statsd"`
+	Admin          AdminConfiguration          `toml:"admin"`
+	Health         HealthConfiguration         `toml:"health"`
+	HealthCheck    HealthCheckConfiguration    `toml:"health_check"`
+	Maintenance    MaintenanceConfiguration    `toml:"maintenance"`
+	Shutdown       ShutdownConfiguration       `toml:"shutdown"`
 }
 
 var ConfigPathFlag = flag.String("config", "", "Path to configuration file")
 var CleanupFlag = flag.Bool("cleanup", false, "Only cleanup marmot triggers and changelogs")
+var DryRunFlag = flag.Bool("dry-run", false, "Only report what -cleanup would remove without removing anything")
 var SaveSnapshotFlag = flag.Bool("save-snapshot", false, "Only take snapshot and upload")
 var ClusterAddrFlag = flag.String("cluster-addr", "", "Cluster listening address")
 var ClusterPeersFlag = flag.String("cluster-peers", "", "Comma separated list of clusters")
 var LeafServerFlag = flag.String("leaf-servers", "", "Comma separated list of leaf servers")
+var NodeIDFlag = flag.Uint64("node-id", 0, "Node ID overriding node_id of configuration file")
+var BindAddressFlag = flag.String("bind-address", "", "Embedded NATS server bind address overriding nats.bind_address of configuration file")
 
 var DataRootDir = os.TempDir()
 var Config = &Configuration{
@@ -130,10 +411,16 @@ var Config = &Configuration{
 	CleanupInterval: 5000,
 	SleepTimeout:    0,
 	PollingInterval: 0,
+	Role:            RolePrimary,
+	JournalMode:     JournalModeWAL,
+
+	CleanupOnExit:       false,
+	CleanupTablesOnExit: false,
 
 	Snapshot: SnapshotConfiguration{
 		Enable:    true,
 		Interval:  0,
+		MaxAge:    0,
 		StoreType: Nats,
 		Nats: ObjectStoreConfiguration{
 			Replicas: 1,
@@ -149,11 +436,40 @@ var Config = &Configuration{
 		Replicas:       1,
 		Compress:       true,
 		UpdateExisting: false,
+		Codec:          "",
+		ZstdLevel:      "default",
+
+		AtomicTransactions:    false,
+		MaxTransactionChanges: 10000,
+		EmbedSchema:           false,
+		DeadLetter:            false,
+		PublishBufferSize:     1024,
+
+		CatchUpRate:      0,
+		CatchUpThreshold: 10000,
+		DuplicatesWindow: 0,
+		ChunkSize:        0,
+
+		BatchMaxCount: 0,
+		BatchMaxBytes: 0,
+		BatchLinger:   0,
+	},
+
+	Replication: ReplicationConfiguration{
+		MissingTable:       MissingTableError,
+		DedupPolicy:        DedupNone,
+		DedupWindow:        0,
+		Clock:              ClockWall,
+		ConflictResolution: ConflictNone,
+		ReplicateDDL:       false,
+		AutoAddTables:      false,
+		Tables:             map[string]TableConfiguration{},
 	},
 
 	NATS: NATSConfiguration{
 		URLs:                 []string{},
 		SubjectPrefix:        "marmot-change-log",
+		ControlPrefix:        "marmot-control",
 		StreamPrefix:         "marmot-changes",
 		ServerConfigFile:     "",
 		SeedFile:             "",
@@ -162,11 +478,49 @@ var Config = &Configuration{
 		BindAddress:          ":-1",
 		ConnectRetries:       5,
 		ReconnectWaitSeconds: 2,
+		MaxReconnects:        0,
+		PingIntervalSeconds:  0,
+
+		JetStreamReadyTimeoutSeconds: 30,
+		MinClusterSize:               0,
+		ClusterWaitTimeoutSeconds:    60,
+		JSMaxMemory:                  -1,
+		JSMaxFile:                    -1,
+	},
+
+	Encryption: EncryptionConfiguration{
+		Key:     "",
+		KeyFile: "",
+		Require: false,
+	},
+
+	Sinks: SinkConfiguration{
+		Workers:   4,
+		QueueSize: 1024,
+		OnFull:    SinkOnFullBlock,
+		File: FileSinkConfiguration{
+			Enable:  false,
+			Path:    path.Join(DataRootDir, "changes.jsonl"),
+			MaxSize: 64 * 1024 * 1024,
+			MaxAge:  0,
+			Gzip:    false,
+		},
+		Webhook: WebhookSinkConfiguration{
+			Enable:       false,
+			URL:          "",
+			Tables:       []string{},
+			Headers:      map[string]string{},
+			Timeout:      5000,
+			MaxRetries:   5,
+			RetryBackoff: 500,
+		},
 	},
 
 	Logging: LoggingConfiguration{
-		Verbose: false,
-		Format:  "console",
+		Verbose:    false,
+		Format:     LogFormatConsole,
+		Level:      "",
+		Subsystems: map[string]string{},
 	},
 
 	Prometheus: PrometheusConfiguration{
@@ -175,6 +529,47 @@ var Config = &Configuration{
 		Namespace: "marmot",
 		Subsystem: "",
 	},
+
+	StatsD: StatsDConfiguration{
+		Enable:  false,
+		Address: "127.0.0.1:8125",
+		Prefix:  "marmot",
+	},
+
+	Admin: AdminConfiguration{
+		Enable: false,
+		Bind:   "127.0.0.1:3011",
+	},
+
+	Health: HealthConfiguration{
+		Gossip:         false,
+		ClusterSize:    0,
+		GossipInterval: 1000,
+		PeerTimeout:    5000,
+
+		ClockSkewThreshold: 0,
+	},
+
+	HealthCheck: HealthCheckConfiguration{
+		Bind:   "",
+		MaxLag: 1000,
+	},
+
+	Maintenance: MaintenanceConfiguration{
+		Interval:                   60000,
+		IncrementalVacuumFreePages: 0,
+		WalCheckpointMode:          "",
+		WalCheckpointBatches:       0,
+		WalCheckpointInterval:      0,
+	},
+
+	Shutdown: ShutdownConfiguration{
+		Timeout:          30000,
+		SinksTimeout:     10000,
+		NATSDrainTimeout: 10000,
+		CleanupTimeout:   5000,
+		DBFlushTimeout:   5000,
+	},
 }
 
 func init() {
@@ -196,7 +591,8 @@ func init() {
 func Load(filePath string) error {
 	_, err := toml.DecodeFile(filePath, Config)
 	if os.IsNotExist(err) {
-		return nil
+		applyFlagOverrides()
+		return Config.validate()
 	}
 
 	if err != nil {
@@ -212,6 +608,375 @@ func Load(filePath string) error {
 		Config.SeqMapPath = path.Join(DataRootDir, "seq-map.cbor")
 	}
 
+	applyFlagOverrides()
+	return Config.validate()
+}
+
+func applyFlagOverrides() {
+	if *NodeIDFlag != 0 {
+		Config.NodeID = *NodeIDFlag
+	}
+
+	if *BindAddressFlag != "" {
+		Config.NATS.BindAddress = *BindAddressFlag
+	}
+}
+
+func (c *Configuration) validate() error {
+	if c.NodeID == 0 {
+		return fmt.Errorf("node_id must be non-zero")
+	}
+
+	if _, _, err := net.SplitHostPort(c.NATS.BindAddress); err != nil {
+		return fmt.Errorf("invalid nats.bind_address %q: %w", c.NATS.BindAddress, err)
+	}
+
+	if err := validateControlPrefix(c.NATS.ControlPrefix, c.NATS.SubjectPrefix); err != nil {
+		return err
+	}
+
+	if c.Logging.Format != LogFormatConsole && c.Logging.Format != LogFormatJSON {
+		return fmt.Errorf("invalid logging.format %q", c.Logging.Format)
+	}
+
+	if c.Logging.Level != "" {
+		if _, err := zerolog.ParseLevel(c.Logging.Level); err != nil {
+			return fmt.Errorf("invalid logging.level %q", c.Logging.Level)
+		}
+	}
+
+	for name, level := range c.Logging.Subsystems {
+		if name != LogSubsystemNATS {
+			return fmt.Errorf("unknown logging subsystem %q", name)
+		}
+
+		if _, err := zerolog.ParseLevel(level); err != nil || level == "" {
+			return fmt.Errorf("invalid logging.subsystems.%s level %q", name, level)
+		}
+	}
+
+	if c.NATS.JSMaxMemory != -1 && c.NATS.JSMaxMemory < 1 {
+		return fmt.Errorf("nats.js_max_memory must be positive or -1, got %d", c.NATS.JSMaxMemory)
+	}
+
+	if c.NATS.JSMaxFile != -1 && c.NATS.JSMaxFile < 1 {
+		return fmt.Errorf("nats.js_max_file must be positive or -1, got %d", c.NATS.JSMaxFile)
+	}
+
+	if c.NATS.MinClusterSize < 0 {
+		return fmt.Errorf("nats.min_cluster_size must not be negative")
+	}
+
+	authModes := 0
+	for _, set := range []bool{c.NATS.CredsUser != "", c.NATS.Token != "", c.NATS.SeedFile != "", c.NATS.CredsFile != ""} {
+		if set {
+			authModes++
+		}
+	}
+
+	if authModes > 1 {
+		return fmt.Errorf("only one of nats.user_name, nats.token, nats.seed_file or nats.creds_file can be set")
+	}
+
+	if c.NATS.CredsPassword != "" && c.NATS.CredsUser == "" {
+		return fmt.Errorf("nats.user_password requires nats.user_name")
+	}
+
+	if c.NATS.MaxReconnects < -1 {
+		return fmt.Errorf("nats.max_reconnects must be -1 (retry forever), 0 (default) or positive")
+	}
+
+	if c.NATS.PingIntervalSeconds < 0 {
+		return fmt.Errorf("nats.ping_interval_seconds must not be negative")
+	}
+
+	if c.NATS.MinClusterSize > 0 && c.NATS.ClusterWaitTimeoutSeconds < 1 {
+		return fmt.Errorf("nats.cluster_wait_timeout_seconds must be positive when min_cluster_size is set")
+	}
+
+	if c.Role != RolePrimary && c.Role != RoleReplica {
+		return fmt.Errorf("invalid role %q", c.Role)
+	}
+
+	c.JournalMode = strings.ToUpper(c.JournalMode)
+	switch c.JournalMode {
+	case JournalModeWAL, JournalModeDelete, JournalModeTruncate, JournalModePersist, JournalModeMemory, JournalModeOff:
+	default:
+		return fmt.Errorf("invalid journal_mode %q", c.JournalMode)
+	}
+
+	if c.Sinks.OnFull != SinkOnFullBlock && c.Sinks.OnFull != SinkOnFullDrop {
+		return fmt.Errorf("invalid sinks.on_full %q", c.Sinks.OnFull)
+	}
+
+	switch strings.ToLower(c.Maintenance.WalCheckpointMode) {
+	case "":
+	case "passive", "full", "restart", "truncate":
+		if c.Maintenance.WalCheckpointBatches == 0 && c.Maintenance.WalCheckpointInterval == 0 {
+			return fmt.Errorf("maintenance.wal_checkpoint_batches or maintenance.wal_checkpoint_interval must be set")
+		}
+	default:
+		return fmt.Errorf("invalid maintenance.wal_checkpoint_mode %q", c.Maintenance.WalCheckpointMode)
+	}
+
+	s := c.Shutdown
+	if s.Timeout == 0 || s.SinksTimeout == 0 || s.NATSDrainTimeout == 0 || s.CleanupTimeout == 0 || s.DBFlushTimeout == 0 {
+		return fmt.Errorf("shutdown timeouts must be positive")
+	}
+
+	if uint64(s.SinksTimeout)+uint64(s.NATSDrainTimeout)+uint64(s.CleanupTimeout)+uint64(s.DBFlushTimeout) > uint64(s.Timeout) {
+		return fmt.Errorf("shutdown stage timeouts must not add up to more than shutdown.timeout (%d)", s.Timeout)
+	}
+
+	if c.CleanupTablesOnExit && !c.CleanupOnExit {
+		return fmt.Errorf("cleanup_tables_on_exit requires cleanup_on_exit")
+	}
+
+	if c.Sinks.File.Enable && c.Sinks.File.Path == "" {
+		return fmt.Errorf("sinks.file.path is required when file sink is enabled")
+	}
+
+	if c.Sinks.File.MaxSize < 0 || c.Sinks.File.MaxAge < 0 {
+		return fmt.Errorf("sinks.file.max_size and sinks.file.max_age must not be negative")
+	}
+
+	if c.Sinks.Webhook.Enable {
+		u, err := url.Parse(c.Sinks.Webhook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid sinks.webhook.url %q, expected http(s) URL", c.Sinks.Webhook.URL)
+		}
+	}
+
+	if c.Sinks.Webhook.MaxRetries < 0 {
+		return fmt.Errorf("sinks.webhook.max_retries must not be negative")
+	}
+
+	switch c.Replication.MissingTable {
+	case MissingTableError, MissingTableSkip, MissingTableCreate:
+	default:
+		return fmt.Errorf("invalid replication.missing_table %q", c.Replication.MissingTable)
+	}
+
+	switch c.Replication.DedupPolicy {
+	case DedupNone:
+	case DedupRing, DedupTime:
+		if c.Replication.DedupWindow < 1 {
+			return fmt.Errorf("replication.dedup_window must be positive for %q dedup policy", c.Replication.DedupPolicy)
+		}
+	default:
+		return fmt.Errorf("invalid replication.dedup_policy %q", c.Replication.DedupPolicy)
+	}
+
+	for _, patterns := range [][]string{c.Replication.IncludeTables, c.Replication.ExcludeTables} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid replication table pattern %q: %w", pattern, err)
+			}
+		}
+	}
+
+	if c.ReplicationLog.ChunkSize < 0 {
+		return fmt.Errorf("replication_log.chunk_size must not be negative")
+	}
+
+	if c.ReplicationLog.BatchMaxCount < 0 || c.ReplicationLog.BatchMaxBytes < 0 {
+		return fmt.Errorf("replication_log.batch_max_count and batch_max_bytes must not be negative")
+	}
+
+	if c.ReplicationLog.BatchLinger != 0 && !c.ReplicationLog.BatchingEnabled() {
+		return fmt.Errorf("replication_log.batch_linger requires batch_max_count or atomic_transactions")
+	}
+
+	switch c.ReplicationLog.Codec {
+	case "", CodecNone, CodecSnappy, CodecZstd:
+	default:
+		return fmt.Errorf("invalid replication_log.codec %q", c.ReplicationLog.Codec)
+	}
+
+	if c.Encryption.Key != "" && c.Encryption.KeyFile != "" {
+		return fmt.Errorf("only one of encryption.key or encryption.key_file can be set")
+	}
+
+	if c.Encryption.Require && !c.Encryption.Enabled() {
+		return fmt.Errorf("encryption.require needs encryption.key or encryption.key_file")
+	}
+
+	if _, err := c.Encryption.LoadKey(); err != nil {
+		return err
+	}
+
+	if ok, _ := zstd.EncoderLevelFromString(c.ReplicationLog.ZstdLevel); !ok {
+		return fmt.Errorf("invalid replication_log.zstd_level %q", c.ReplicationLog.ZstdLevel)
+	}
+
+	switch c.Replication.ConflictResolution {
+	case ConflictNone, ConflictLWW, ConflictLWWNodeID:
+	default:
+		return fmt.Errorf("invalid replication.conflict_resolution %q", c.Replication.ConflictResolution)
+	}
+
+	if c.Replication.Clock != ClockWall && c.Replication.Clock != ClockHLC {
+		return fmt.Errorf("invalid replication.clock %q", c.Replication.Clock)
+	}
+
+	if c.Prometheus.Enable && c.StatsD.Enable {
+		return fmt.Errorf("only one of prometheus or statsd metrics can be enabled")
+	}
+
+	if c.Health.Gossip && (c.Health.GossipInterval == 0 || c.Health.PeerTimeout < c.Health.GossipInterval) {
+		return fmt.Errorf("invalid health gossip timing, peer_timeout must be at least gossip_interval")
+	}
+
+	if c.ReplicationLog.Shards == 0 {
+		return fmt.Errorf("replication_log.shards must be at least 1")
+	}
+
+	if c.ReplicationLog.AtomicTransactions {
+		if c.ReplicationLog.MaxTransactionChanges == 0 {
+			return fmt.Errorf("replication_log.max_transaction_changes must be at least 1")
+		}
+
+		if err := c.validateAtomicTransactions(); err != nil {
+			return err
+		}
+	}
+
+	for name, table := range c.Replication.Tables {
+		if table.Shard > c.ReplicationLog.Shards {
+			return fmt.Errorf("invalid shard %d for table %s, only %d shards configured", table.Shard, name, c.ReplicationLog.Shards)
+		}
+
+		if table.MaxRowSize < 0 {
+			return fmt.Errorf("invalid max_row_size %d for table %s", table.MaxRowSize, name)
+		}
+
+		if err := validateTableStream(name, table); err != nil {
+			return err
+		}
+
+		switch table.Ordering {
+		case "", OrderingGlobal:
+		case OrderingPerKey:
+			if table.Shard != 0 {
+				return fmt.Errorf("table %s can't use per-key ordering while pinned to shard %d", name, table.Shard)
+			}
+
+			if table.Stream != "" {
+				return fmt.Errorf("table %s can't use per-key ordering on dedicated stream %s", name, table.Stream)
+			}
+		default:
+			return fmt.Errorf("invalid ordering %q for table %s", table.Ordering, name)
+		}
+	}
+
+	return nil
+}
+
+// ControlSubject returns subject of control messages (health, notifications) with given name.
+func (c *Configuration) ControlSubject(name string) string {
+	return c.NATS.ControlPrefix + "." + name
+}
+
+// validateControlPrefix makes sure control subjects are valid NATS subject tokens that can't
+// collide with data subjects `<subject_prefix>-<shard>`.
+func validateControlPrefix(prefix, dataPrefix string) error {
+	if prefix == "" {
+		return fmt.Errorf("nats.control_subject_prefix must not be empty")
+	}
+
+	if strings.ContainsAny(prefix, " \t\r\n*>") || strings.HasPrefix(prefix, ".") ||
+		strings.HasSuffix(prefix, ".") || strings.Contains(prefix, "..") {
+		return fmt.Errorf("invalid nats.control_subject_prefix %q", prefix)
+	}
+
+	if prefix == dataPrefix || strings.HasPrefix(prefix, dataPrefix+"-") {
+		return fmt.Errorf("nats.control_subject_prefix %q overlaps data subjects of %q", prefix, dataPrefix)
+	}
+
+	return nil
+}
+
+// TableStreams returns sorted names of dedicated streams tables are mapped to. Dedicated streams
+// get shard IDs right after regular shards in this order, see StreamCount.
+func (c *Configuration) TableStreams() []string {
+	seen := map[string]bool{}
+	ret := make([]string, 0)
+	for _, table := range c.Replication.Tables {
+		if table.Stream != "" && !seen[table.Stream] {
+			seen[table.Stream] = true
+			ret = append(ret, table.Stream)
+		}
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+// StreamCount returns number of replication log streams, regular shards followed by dedicated
+// table streams.
+func (c *Configuration) StreamCount() uint64 {
+	return c.ReplicationLog.Shards + uint64(len(c.TableStreams()))
+}
+
+// validateAtomicTransactions makes sure every replicated table is published on a single stream,
+// batches are published on stream of their first change so a transaction spanning streams would
+// otherwise be applied out of order with other changes of its tables.
+func (c *Configuration) validateAtomicTransactions() error {
+	// Tables without shard or stream are distributed over shards by primary key hash
+	unpinned := "hash"
+	if c.ReplicationLog.Shards == 1 {
+		unpinned = "shard 1"
+	}
+
+	streams := map[string]bool{}
+	if len(c.Replication.Tables) == 0 {
+		streams[unpinned] = true
+	}
+
+	for _, table := range c.Replication.Tables {
+		switch {
+		case table.Stream != "":
+			streams["stream "+table.Stream] = true
+		case table.Shard != 0:
+			streams[fmt.Sprintf("shard %d", table.Shard)] = true
+		default:
+			streams[unpinned] = true
+		}
+	}
+
+	if len(streams) > 1 || streams["hash"] {
+		return fmt.Errorf("replication_log.atomic_transactions requires shards = 1 or every table pinned to the same shard or stream")
+	}
+
+	return nil
+}
+
+// deadLetterStream is suffix of dead letter stream and subject, dedicated table streams use
+// same `<prefix>-<name>` naming so it can't be used as table stream.
+const deadLetterStream = "dead-letter"
+
+// validateTableStream makes sure dedicated stream name of table can't collide with numbered
+// shard streams or dead letter stream and is valid within NATS stream and subject names.
+func validateTableStream(name string, table TableConfiguration) error {
+	if table.Stream == "" {
+		return nil
+	}
+
+	if table.Shard != 0 {
+		return fmt.Errorf("table %s can't be mapped to stream %s while pinned to shard %d", name, table.Stream, table.Shard)
+	}
+
+	for i, r := range table.Stream {
+		letter := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		if !letter && (i == 0 || !(r >= '0' && r <= '9') && r != '_' && r != '-') {
+			return fmt.Errorf("invalid stream %q for table %s, must start with a letter followed by letters, digits, _ or -", table.Stream, name)
+		}
+	}
+
+	if table.Stream == deadLetterStream {
+		return fmt.Errorf("stream %q of table %s is reserved for dead letters", table.Stream, name)
+	}
+
 	return nil
 }
 
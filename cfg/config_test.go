@@ -0,0 +1,267 @@
+package cfg
+
+import (
+	"encoding/base64"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// withConfig restores configuration and flags once test finishes.
+func withConfig(t *testing.T) {
+	saved := *Config
+	savedRoot := DataRootDir
+	t.Cleanup(func() {
+		*Config = saved
+		DataRootDir = savedRoot
+		_ = flag.Set("node-id", "0")
+		_ = flag.Set("bind-address", "")
+	})
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestFlagsOverrideConfig(t *testing.T) {
+	withConfig(t)
+	path := writeConfig(t, "node_id=5\n[nats]\nbind_address=\"127.0.0.1:4222\"\n")
+
+	if err := flag.Set("node-id", "9"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := flag.Set("bind-address", "0.0.0.0:5222"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if Config.NodeID != 9 || Config.NATS.BindAddress != "0.0.0.0:5222" {
+		t.Fatalf("expected flags to override configuration, got node %d bound to %s", Config.NodeID, Config.NATS.BindAddress)
+	}
+}
+
+func TestConfigUsedWithoutFlags(t *testing.T) {
+	withConfig(t)
+	path := writeConfig(t, "node_id=5\n[nats]\nbind_address=\"127.0.0.1:4222\"\n")
+
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if Config.NodeID != 5 || Config.NATS.BindAddress != "127.0.0.1:4222" {
+		t.Fatalf("expected configuration values, got node %d bound to %s", Config.NodeID, Config.NATS.BindAddress)
+	}
+}
+
+func TestInvalidBindAddressFlagRejected(t *testing.T) {
+	withConfig(t)
+	path := writeConfig(t, "node_id=5\n")
+
+	if err := flag.Set("bind-address", "no-port"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Load(path); err == nil {
+		t.Fatal("expected invalid bind address to be rejected")
+	}
+}
+
+func TestJetStreamLimitsValidated(t *testing.T) {
+	withConfig(t)
+	Config.NodeID = 1
+
+	for _, limits := range [][2]int64{{0, -1}, {-1, 0}, {-2, 1 << 20}} {
+		Config.NATS.JSMaxMemory, Config.NATS.JSMaxFile = limits[0], limits[1]
+		if err := Config.validate(); err == nil {
+			t.Errorf("expected limits %v to be rejected", limits)
+		}
+	}
+
+	Config.NATS.JSMaxMemory, Config.NATS.JSMaxFile = 1<<20, -1
+	if err := Config.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTableOrderingValidated(t *testing.T) {
+	withConfig(t)
+	Config.NodeID = 1
+	Config.ReplicationLog.Shards = 2
+
+	for _, table := range []TableConfiguration{{Ordering: "random"}, {Ordering: OrderingPerKey, Shard: 2}} {
+		Config.Replication.Tables = map[string]TableConfiguration{"books": table}
+		if err := Config.validate(); err == nil {
+			t.Errorf("expected table %+v to be rejected", table)
+		}
+	}
+
+	Config.Replication.Tables = map[string]TableConfiguration{
+		"books":   {Ordering: OrderingGlobal, Shard: 2},
+		"authors": {Ordering: OrderingPerKey},
+	}
+	if err := Config.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestZeroShardsRejected(t *testing.T) {
+	withConfig(t)
+	Config.NodeID = 1
+	Config.ReplicationLog.Shards = 0
+
+	if err := Config.validate(); err == nil {
+		t.Fatal("expected zero shards to be rejected")
+	}
+}
+
+func TestTableStreamsValidated(t *testing.T) {
+	withConfig(t)
+	Config.NodeID = 1
+	Config.ReplicationLog.Shards = 2
+
+	for _, table := range []TableConfiguration{
+		{Stream: "1"},
+		{Stream: "orders.eu"},
+		{Stream: "dead-letter"},
+		{Stream: "orders", Shard: 1},
+		{Stream: "orders", Ordering: OrderingPerKey},
+	} {
+		Config.Replication.Tables = map[string]TableConfiguration{"orders": table}
+		if err := Config.validate(); err == nil {
+			t.Errorf("expected table %+v to be rejected", table)
+		}
+	}
+
+	Config.Replication.Tables = map[string]TableConfiguration{
+		"orders":   {Stream: "orders"},
+		"payments": {Stream: "orders"},
+		"audit":    {Stream: "audit_log"},
+		"books":    {},
+	}
+	if err := Config.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if streams := Config.TableStreams(); !reflect.DeepEqual(streams, []string{"audit_log", "orders"}) || Config.StreamCount() != 4 {
+		t.Fatalf("expected 2 shards and 2 table streams, got %v", streams)
+	}
+}
+
+func TestShutdownTimeoutsValidated(t *testing.T) {
+	withConfig(t)
+	Config.NodeID = 1
+
+	if err := Config.validate(); err != nil {
+		t.Fatalf("expected default shutdown timeouts to be valid: %v", err)
+	}
+
+	Config.Shutdown.CleanupTimeout = 0
+	if err := Config.validate(); err == nil {
+		t.Error("expected zero cleanup timeout to be rejected")
+	}
+
+	Config.Shutdown.CleanupTimeout = Config.Shutdown.Timeout
+	if err := Config.validate(); err == nil {
+		t.Error("expected stage timeouts adding up past total timeout to be rejected")
+	}
+}
+
+func TestControlPrefixValidated(t *testing.T) {
+	withConfig(t)
+	Config.NodeID = 1
+	Config.NATS.SubjectPrefix = "marmot-change-log"
+
+	for _, prefix := range []string{"", "ops.*", "ops..health", ".ops", "marmot-change-log", "marmot-change-log-ops"} {
+		Config.NATS.ControlPrefix = prefix
+		if err := Config.validate(); err == nil {
+			t.Errorf("expected control prefix %q to be rejected", prefix)
+		}
+	}
+
+	Config.NATS.ControlPrefix = "ops.marmot"
+	if err := Config.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if subject := Config.ControlSubject("health"); subject != "ops.marmot.health" {
+		t.Fatalf("expected control subject under configured prefix, got %s", subject)
+	}
+}
+
+func TestEncryptionKeyLoaded(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	path := filepath.Join(t.TempDir(), "marmot.key")
+	if err := os.WriteFile(path, []byte(encoded+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []EncryptionConfiguration{{Key: encoded}, {KeyFile: path}} {
+		loaded, err := c.LoadKey()
+		if err != nil || !reflect.DeepEqual(loaded, key) {
+			t.Fatalf("expected key loaded from %+v, got %v (%v)", c, loaded, err)
+		}
+	}
+
+	for _, c := range []EncryptionConfiguration{
+		{Key: "not base64"},
+		{Key: base64.StdEncoding.EncodeToString(key[:10])},
+		{KeyFile: filepath.Join(t.TempDir(), "missing.key")},
+	} {
+		if _, err := c.LoadKey(); err == nil {
+			t.Errorf("expected key of %+v to be rejected", c)
+		}
+	}
+
+	if loaded, err := (&EncryptionConfiguration{}).LoadKey(); loaded != nil || err != nil {
+		t.Fatalf("expected no key without encryption, got %v (%v)", loaded, err)
+	}
+}
+
+func TestAtomicTransactionsRequireSingleStream(t *testing.T) {
+	withConfig(t)
+	Config.NodeID = 1
+	Config.ReplicationLog.AtomicTransactions = true
+
+	if err := Config.validate(); err != nil {
+		t.Fatalf("expected atomic transactions on single shard to be valid: %v", err)
+	}
+
+	Config.ReplicationLog.Shards = 2
+	for _, tables := range []map[string]TableConfiguration{
+		nil,
+		{"orders": {}, "payments": {}},
+		{"orders": {Shard: 1}, "payments": {Shard: 2}},
+		{"orders": {Stream: "orders"}, "payments": {Shard: 1}},
+		{"orders": {Stream: "orders"}, "payments": {Stream: "payments"}},
+	} {
+		Config.Replication.Tables = tables
+		if err := Config.validate(); err == nil {
+			t.Errorf("expected atomic transactions over tables %v to be rejected", tables)
+		}
+	}
+
+	for _, tables := range []map[string]TableConfiguration{
+		{"orders": {Shard: 2}, "payments": {Shard: 2}},
+		{"orders": {Stream: "ledger"}, "payments": {Stream: "ledger"}},
+	} {
+		Config.Replication.Tables = tables
+		if err := Config.validate(); err != nil {
+			t.Errorf("expected atomic transactions over tables %v to be valid: %v", tables, err)
+		}
+	}
+}
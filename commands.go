@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/maxpert/marmot/db"
+)
+
+var ErrUnknownCommand = errors.New("unknown command")
+
+// runCommand runs maintenance command given as arguments, writing its output to out.
+func runCommand(streamDB *db.SqliteStreamDB, args []string, out io.Writer) error {
+	switch args[0] {
+	case "changelog":
+		return changeLogCommand(streamDB, args[1:], out)
+	case "repair":
+		return repairCommand(streamDB, args[1:], out)
+	}
+
+	return fmt.Errorf("%w: %s", ErrUnknownCommand, strings.Join(args, " "))
+}
+
+func changeLogCommand(streamDB *db.SqliteStreamDB, args []string, out io.Writer) error {
+	if len(args) < 1 || args[0] != "list" {
+		return fmt.Errorf("%w: changelog %s", ErrUnknownCommand, strings.Join(args, " "))
+	}
+
+	flags := flag.NewFlagSet("changelog list", flag.ContinueOnError)
+	table := flags.String("table", "", "Only list change logs of given table")
+	limit := flags.Uint("limit", 100, "Maximum number of change log rows to list per table")
+	payload := flags.Bool("payload", false, "Print row payload of every change log entry")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	tables := []string{*table}
+	if *table == "" {
+		var err error
+		tables, err = streamDB.ChangeLogTables()
+		if err != nil {
+			return err
+		}
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	header := "TABLE\tSEQ\tOP\tSTATE\tKEY\tTIMESTAMP"
+	if *payload {
+		header += "\tPAYLOAD"
+	}
+	fmt.Fprintln(w, header)
+
+	for _, name := range tables {
+		rows, err := streamDB.ListChangeLogs(name, *limit)
+		if err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			line := fmt.Sprintf(
+				"%s\t%d\t%s\t%s\t%s\t%s",
+				row.TableName,
+				row.Id,
+				row.Type,
+				changeLogStateName(row.State),
+				formatKey(row.Key),
+				row.CreatedAt.Format(time.RFC3339Nano),
+			)
+
+			if *payload {
+				data, err := json.Marshal(row.Row)
+				if err != nil {
+					return err
+				}
+
+				line += "\t" + string(data)
+			}
+
+			fmt.Fprintln(w, line)
+		}
+	}
+
+	return w.Flush()
+}
+
+func repairCommand(streamDB *db.SqliteStreamDB, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("repair", flag.ContinueOnError)
+	check := flags.Bool("check", false, "Only report inconsistencies without repairing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	reports, err := streamDB.RepairChangeLogs(!*check)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tORPHANED_GLOBAL\tUNLINKED_PENDING")
+	total := 0
+	for _, r := range reports {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", r.Table, r.OrphanedGlobal, r.UnlinkedPending)
+		total += r.OrphanedGlobal + r.UnlinkedPending
+	}
+
+	switch {
+	case total == 0:
+		fmt.Fprintln(w, "\nChange logs are consistent")
+	case *check:
+		fmt.Fprintf(w, "\n%d inconsistencies found, run without -check to repair\n", total)
+	default:
+		fmt.Fprintf(w, "\n%d inconsistencies repaired\n", total)
+	}
+
+	return w.Flush()
+}
+
+func printCleanupPlan(streamDB *db.SqliteStreamDB, out io.Writer) error {
+	triggers, tables, err := streamDB.CleanupPlan(true)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tNAME")
+	for _, name := range triggers {
+		fmt.Fprintf(w, "trigger\t%s\n", name)
+	}
+
+	for _, name := range tables {
+		fmt.Fprintf(w, "table\t%s\n", name)
+	}
+
+	fmt.Fprintf(w, "\nDry run, %d triggers and %d tables would be dropped\n", len(triggers), len(tables))
+	return w.Flush()
+}
+
+func changeLogStateName(state db.ChangeLogState) string {
+	switch state {
+	case db.Pending:
+		return "pending"
+	case db.Published:
+		return "published"
+	case db.Failed:
+		return "failed"
+	}
+
+	return fmt.Sprintf("unknown(%d)", state)
+}
+
+func formatKey(key map[string]any) string {
+	names := make([]string, 0, len(key))
+	for k := range key {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, k := range names {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, key[k]))
+	}
+
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/maxpert/marmot/db"
+)
+
+func openCommandDB(t *testing.T, stmts ...string) *db.SqliteStreamDB {
+	t.Helper()
+
+	return openCommandDBAt(t, filepath.Join(t.TempDir(), "marmot.db"), stmts...)
+}
+
+func openCommandDBAt(t *testing.T, path string, stmts ...string) *db.SqliteStreamDB {
+	t.Helper()
+
+	app, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	for _, stmt := range stmts {
+		if _, err := app.Exec(stmt); err != nil {
+			t.Fatalf("unable to execute %q: %v", stmt, err)
+		}
+	}
+
+	streamDB, err := db.OpenStreamDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return streamDB
+}
+
+func TestChangeLogListCommand(t *testing.T) {
+	streamDB := openCommandDB(
+		t,
+		"CREATE TABLE books(id INTEGER PRIMARY KEY, title TEXT)",
+		"CREATE TABLE __marmot__books_change_log("+
+			"id INTEGER PRIMARY KEY, val_id INTEGER, val_title TEXT, type TEXT, created_at INTEGER, state INTEGER)",
+		"INSERT INTO __marmot__books_change_log VALUES (1, 7, 'dune', 'insert', 1700000000000, 1)",
+		"INSERT INTO __marmot__books_change_log VALUES (2, 7, 'dune messiah', 'update', 1700000001000, 0)",
+	)
+
+	out := &bytes.Buffer{}
+	if err := runCommand(streamDB, []string{"changelog", "list", "-payload"}, out); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected header and 2 rows, got:\n%s", out.String())
+	}
+
+	expected := [][]string{
+		{"books", "1", "insert", "published", "id=7", `"title":"dune"`},
+		{"books", "2", "update", "pending", "id=7", `"title":"dune messiah"`},
+	}
+	for i, parts := range expected {
+		for _, part := range parts {
+			if !strings.Contains(lines[i+1], part) {
+				t.Errorf("row %d %q is missing %q", i+1, lines[i+1], part)
+			}
+		}
+	}
+}
+
+func TestChangeLogListCommandLimit(t *testing.T) {
+	streamDB := openCommandDB(
+		t,
+		"CREATE TABLE books(id INTEGER PRIMARY KEY, title TEXT)",
+		"CREATE TABLE __marmot__books_change_log("+
+			"id INTEGER PRIMARY KEY, val_id INTEGER, val_title TEXT, type TEXT, created_at INTEGER, state INTEGER)",
+		"INSERT INTO __marmot__books_change_log VALUES (1, 7, 'dune', 'insert', 1700000000000, 1)",
+		"INSERT INTO __marmot__books_change_log VALUES (2, 8, 'emma', 'insert', 1700000001000, 0)",
+	)
+
+	out := &bytes.Buffer{}
+	err := runCommand(streamDB, []string{"changelog", "list", "-table", "books", "-limit", "1"}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(out.String(), "id=8") || !strings.Contains(out.String(), "id=7") {
+		t.Fatalf("expected only oldest row, got:\n%s", out.String())
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	streamDB := openCommandDB(t)
+	if err := runCommand(streamDB, []string{"nope"}, &bytes.Buffer{}); err == nil {
+		t.Fatal("expected unknown command error")
+	}
+}
+
+func TestCleanupDryRunChangesNothing(t *testing.T) {
+	streamDB, app := openReplicatedDB(t)
+	schema := func() []string {
+		rows, err := app.Query("SELECT type || ' ' || name FROM sqlite_master ORDER BY 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+
+		ret := make([]string, 0)
+		for rows.Next() {
+			name := ""
+			if err := rows.Scan(&name); err != nil {
+				t.Fatal(err)
+			}
+
+			ret = append(ret, name)
+		}
+
+		return ret
+	}
+
+	before := schema()
+	out := &bytes.Buffer{}
+	if err := printCleanupPlan(streamDB, out); err != nil {
+		t.Fatal(err)
+	}
+
+	if after := schema(); !reflect.DeepEqual(before, after) {
+		t.Fatalf("dry run changed schema from %v to %v", before, after)
+	}
+
+	reported := map[string]bool{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		reported[strings.Join(strings.Fields(line), " ")] = true
+	}
+
+	planned := 0
+	for _, object := range before {
+		parts := strings.SplitN(object, " ", 2)
+		if !strings.HasPrefix(parts[1], db.MarmotPrefix) || (parts[0] != "trigger" && parts[0] != "table") {
+			continue
+		}
+
+		planned++
+		if !reported[object] {
+			t.Errorf("expected %s %s in plan:\n%s", parts[0], parts[1], out.String())
+		}
+	}
+
+	if planned == 0 || !strings.Contains(out.String(), "Dry run") {
+		t.Fatalf("expected dry run to report marmot triggers and tables, got:\n%s", out.String())
+	}
+
+	if err := streamDB.RemoveCDC(true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, object := range schema() {
+		if strings.Contains(object, db.MarmotPrefix) {
+			t.Fatalf("expected planned objects removed by cleanup, %s left", object)
+		}
+	}
+}
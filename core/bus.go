@@ -0,0 +1,97 @@
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const DefaultSubscriberBuffer = 64
+
+type LifecycleEventType string
+
+const (
+	SnapshotStarted   LifecycleEventType = "snapshot_started"
+	SnapshotSaved     LifecycleEventType = "snapshot_saved"
+	SnapshotFailed    LifecycleEventType = "snapshot_failed"
+	HealthDegraded    LifecycleEventType = "health_degraded"
+	HealthRestored    LifecycleEventType = "health_restored"
+	RolePromoted      LifecycleEventType = "role_promoted"
+	ShutdownStarted   LifecycleEventType = "shutdown_started"
+	ConsumerRecreated LifecycleEventType = "consumer_recreated"
+)
+
+// LifecycleEvent notifies subscribers about a state change of a node component.
+type LifecycleEvent struct {
+	Type       LifecycleEventType `json:"type"`
+	Time       time.Time          `json:"time"`
+	Attributes map[string]any     `json:"attributes,omitempty"`
+}
+
+// Lifecycle is node wide bus components publish lifecycle events on.
+var Lifecycle = NewBus[LifecycleEvent]()
+
+// Bus is a typed publish/subscribe bus. Every subscriber owns a bounded buffer, publishing
+// never blocks and events are dropped for subscribers whose buffer is full.
+type Bus[T any] struct {
+	lock *sync.RWMutex
+	subs map[uint64]chan T
+	next uint64
+}
+
+func NewBus[T any]() *Bus[T] {
+	return &Bus[T]{
+		lock: &sync.RWMutex{},
+		subs: map[uint64]chan T{},
+	}
+}
+
+// Subscribe returns channel receiving published events and function removing subscription.
+func (b *Bus[T]) Subscribe(buffer int) (<-chan T, func()) {
+	if buffer < 1 {
+		buffer = DefaultSubscriberBuffer
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	id := b.next
+	b.next++
+	ch := make(chan T, buffer)
+	b.subs[id] = ch
+
+	once := &sync.Once{}
+	return ch, func() {
+		once.Do(func() {
+			b.lock.Lock()
+			defer b.lock.Unlock()
+
+			delete(b.subs, id)
+			close(ch)
+		})
+	}
+}
+
+// Publish delivers event to every subscriber with room in its buffer.
+func (b *Bus[T]) Publish(event T) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for id, ch := range b.subs {
+		select {
+		case ch <- event:
+		default:
+			log.Debug().Uint64("subscriber", id).Msg("Subscriber buffer full, dropping event")
+		}
+	}
+}
+
+// PublishLifecycle publishes lifecycle event of given type on Lifecycle bus.
+func PublishLifecycle(eventType LifecycleEventType, attributes map[string]any) {
+	Lifecycle.Publish(LifecycleEvent{
+		Type:       eventType,
+		Time:       time.Now(),
+		Attributes: attributes,
+	})
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBusDoesNotBlockOnSlowSubscriber(t *testing.T) {
+	bus := NewBus[int]()
+	slow, unsubscribeSlow := bus.Subscribe(1)
+	defer unsubscribeSlow()
+	fast, unsubscribeFast := bus.Subscribe(16)
+	defer unsubscribeFast()
+
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; i < 10; i++ {
+			bus.Publish(i)
+		}
+	}()
+
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publishing blocked on slow subscriber")
+	}
+
+	for i := 0; i < 10; i++ {
+		if event := <-fast; event != i {
+			t.Fatalf("expected event %d, got %d", i, event)
+		}
+	}
+
+	if event := <-slow; event != 0 {
+		t.Fatalf("expected slow subscriber to keep first event, got %d", event)
+	}
+
+	select {
+	case event := <-slow:
+		t.Fatalf("expected events past full buffer dropped, got %d", event)
+	default:
+	}
+}
+
+func TestBusUnsubscribe(t *testing.T) {
+	bus := NewBus[string]()
+	events, unsubscribe := bus.Subscribe(0)
+	if cap(events) != DefaultSubscriberBuffer {
+		t.Fatalf("expected default buffer of %d, got %d", DefaultSubscriberBuffer, cap(events))
+	}
+
+	unsubscribe()
+	unsubscribe()
+	bus.Publish("ignored")
+	if _, ok := <-events; ok {
+		t.Fatal("expected channel closed once unsubscribed")
+	}
+}
+
+func TestPublishLifecycle(t *testing.T) {
+	events, unsubscribe := Lifecycle.Subscribe(4)
+	defer unsubscribe()
+
+	PublishLifecycle(SnapshotSaved, map[string]any{"name": "snapshot.db"})
+	select {
+	case event := <-events:
+		if event.Type != SnapshotSaved || event.Attributes["name"] != "snapshot.db" || event.Time.IsZero() {
+			t.Fatalf("unexpected lifecycle event %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lifecycle event not delivered")
+	}
+}
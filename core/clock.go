@@ -0,0 +1,74 @@
+package core
+
+import (
+	"sync"
+)
+
+const logicalBits = 16
+
+// Clock stamps changes with timestamps comparable across nodes. Timestamps carry wall clock
+// milliseconds in upper 48 bits and a logical counter in lower 16 bits, so wall clock and
+// hybrid logical clock stamps share the same ordering.
+type Clock interface {
+	// Stamp returns timestamp for a change captured at given wall clock milliseconds
+	Stamp(wallMillis int64) uint64
+	// Observe advances clock past timestamp received from another node
+	Observe(ts uint64)
+}
+
+// ChangeClock is node wide clock used for stamping captured changes.
+var ChangeClock Clock = WallClock{}
+
+// WallClock stamps changes with raw wall clock time, skewed clocks on nodes skew stamps too.
+type WallClock struct{}
+
+func (WallClock) Stamp(wallMillis int64) uint64 {
+	return TimestampFromMillis(wallMillis)
+}
+
+func (WallClock) Observe(uint64) {}
+
+// HybridClock is a hybrid logical clock, stamps never go backwards and always order after
+// every timestamp observed from peers, regardless of how far wall clocks drift apart.
+type HybridClock struct {
+	lock *sync.Mutex
+	last uint64
+}
+
+func NewHybridClock() *HybridClock {
+	return &HybridClock{lock: &sync.Mutex{}}
+}
+
+func (c *HybridClock) Stamp(wallMillis int64) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ts := TimestampFromMillis(wallMillis)
+	if ts <= c.last {
+		ts = c.last + 1
+	}
+
+	c.last = ts
+	return ts
+}
+
+func (c *HybridClock) Observe(ts uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if ts > c.last {
+		c.last = ts
+	}
+}
+
+func TimestampFromMillis(millis int64) uint64 {
+	if millis < 0 {
+		return 0
+	}
+
+	return uint64(millis) << logicalBits
+}
+
+func TimestampMillis(ts uint64) int64 {
+	return int64(ts >> logicalBits)
+}
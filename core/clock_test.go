@@ -0,0 +1,48 @@
+package core
+
+import "testing"
+
+func TestHybridClockOrdersAcrossSkewedClocks(t *testing.T) {
+	const skew = int64(10000)
+	now := int64(1700000000000)
+
+	// Node a runs 10s ahead of node b, b overwrites row written by a right after receiving it
+	for _, tc := range []struct {
+		name     string
+		a, b     Clock
+		bOrdered bool
+	}{
+		{name: "wall", a: WallClock{}, b: WallClock{}, bOrdered: false},
+		{name: "hybrid", a: NewHybridClock(), b: NewHybridClock(), bOrdered: true},
+	} {
+		first := tc.a.Stamp(now + skew)
+		tc.b.Observe(first)
+		second := tc.b.Stamp(now + 1)
+
+		if (second > first) != tc.bOrdered {
+			t.Errorf("%s clock: expected later write winning %v, stamps %d and %d", tc.name, tc.bOrdered, first, second)
+		}
+	}
+}
+
+func TestHybridClockNeverGoesBackwards(t *testing.T) {
+	c := NewHybridClock()
+	last := uint64(0)
+	for _, wall := range []int64{1000, 1000, 999, 500, 1001, 1001} {
+		ts := c.Stamp(wall)
+		if ts <= last {
+			t.Fatalf("stamp %d for wall clock %d isn't after previous stamp %d", ts, wall, last)
+		}
+
+		last = ts
+	}
+
+	if millis := TimestampMillis(last); millis != 1001 {
+		t.Fatalf("expected stamp to keep wall clock millis 1001, got %d", millis)
+	}
+
+	c.Observe(TimestampFromMillis(5000))
+	if ts := c.Stamp(1002); TimestampMillis(ts) != 5000 || ts <= TimestampFromMillis(5000) {
+		t.Fatalf("expected stamp after observed timestamp, got %d", ts)
+	}
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/maxpert/marmot/pool"
+	"github.com/rs/zerolog/log"
+)
+
+const appliedSeqName = "_applied_seq"
+const appliedSeqScript = `CREATE TABLE IF NOT EXISTS %s (
+    stream TEXT NOT NULL PRIMARY KEY,
+    seq INTEGER NOT NULL
+)`
+const appliedSeqUpsertQuery = `INSERT OR REPLACE INTO %s(stream, seq) VALUES (?, ?)`
+
+// StreamPosition is stream and sequence a replicated change was delivered from, zero value
+// means position isn't tracked.
+type StreamPosition struct {
+	Stream string `json:"stream"`
+	Seq    uint64 `json:"seq"`
+}
+
+func (conn *SqliteStreamDB) appliedSeqTable() string {
+	return conn.prefix + appliedSeqName
+}
+
+func (conn *SqliteStreamDB) initAppliedSeq() error {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	log.Info().Msg("Creating applied sequence table")
+	_, err = sqlConn.DB().Exec(fmt.Sprintf(appliedSeqScript, conn.appliedSeqTable()))
+	return err
+}
+
+// AppliedSeq returns last sequence of stream applied to database, 0 if nothing was applied.
+func (conn *SqliteStreamDB) AppliedSeq(stream string) (uint64, error) {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return 0, err
+	}
+	defer sqlConn.Return()
+
+	seq := uint64(0)
+	_, err = sqlConn.DB().
+		From(conn.appliedSeqTable()).
+		Select("seq").
+		Where(goqu.C("stream").Eq(stream)).
+		Prepared(true).
+		ScanVal(&seq)
+	return seq, err
+}
+
+// SetAppliedSeq overwrites last applied sequence of stream, including moving it backwards.
+func (conn *SqliteStreamDB) SetAppliedSeq(stream string, seq uint64) error {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	_, err = sqlConn.DB().Exec(fmt.Sprintf(appliedSeqUpsertQuery, conn.appliedSeqTable()), stream, seq)
+	return err
+}
+
+// recordAppliedSeq saves position within transaction applying changes delivered from it, so
+// changes and sequence commit together and a crash can't apply them twice after restart.
+func (conn *SqliteStreamDB) recordAppliedSeq(tnx *goqu.TxDatabase, pos StreamPosition) error {
+	if pos.Stream == "" {
+		return nil
+	}
+
+	_, err := tnx.Exec(fmt.Sprintf(appliedSeqUpsertQuery, conn.appliedSeqTable()), pos.Stream, pos.Seq)
+	return err
+}
+
+// SnapshotSeqs returns stream sequences backup at bkFilePath is consistent with, empty if
+// backup was saved without them.
+func SnapshotSeqs(bkFilePath string) (map[string]uint64, error) {
+	sqlDB, rawDB, err := pool.OpenRaw(fmt.Sprintf("%s?mode=ro", bkFilePath))
+	if err != nil {
+		return nil, err
+	}
+	defer sqlDB.Close()
+	defer rawDB.Close()
+
+	return mergeAppliedSeqs(goqu.New("sqlite", sqlDB), MarmotPrefix+appliedSeqName, map[string]uint64{})
+}
+
+// mergeAppliedSeqs returns highest of seqs and sequences saved in applied sequence table.
+func mergeAppliedSeqs(gSQL *goqu.Database, table string, seqs map[string]uint64) (map[string]uint64, error) {
+	ret := make(map[string]uint64, len(seqs))
+	for stream, seq := range seqs {
+		ret[stream] = seq
+	}
+
+	exists, err := gSQL.From("sqlite_master").
+		Where(goqu.C("type").Eq("table"), goqu.C("name").Eq(table)).
+		Prepared(true).
+		Count()
+	if err != nil || exists == 0 {
+		return ret, err
+	}
+
+	var rows []struct {
+		Stream string `db:"stream"`
+		Seq    uint64 `db:"seq"`
+	}
+
+	err = gSQL.From(table).Select("stream", "seq").ScanStructs(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		if row.Seq > ret[row.Stream] {
+			ret[row.Stream] = row.Seq
+		}
+	}
+
+	return ret, nil
+}
+
+func writeAppliedSeqs(gSQL *goqu.Database, table string, seqs map[string]uint64) error {
+	_, err := gSQL.Exec(fmt.Sprintf(appliedSeqScript, table))
+	if err != nil {
+		return err
+	}
+
+	for stream, seq := range seqs {
+		_, err = gSQL.Exec(fmt.Sprintf(appliedSeqUpsertQuery, table), stream, seq)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/maxpert/marmot/cfg"
+)
+
+// ErrChangeRejected is returned when a before apply hook rejects a replicated change.
+var ErrChangeRejected = errors.New("rejected by before apply hook")
+
+// ErrRowTooLarge is returned when a replicated row exceeds max row size of its table.
+var ErrRowTooLarge = errors.New("row exceeds max row size")
+
+// BeforeApplyHook can modify replicated change before it's applied, returning nil change
+// skips it while returning an error rejects whole batch change belongs to.
+type BeforeApplyHook func(event *ChangeLogEvent) (*ChangeLogEvent, error)
+
+// OnBeforeApply registers hook invoked for every replicated change outside of apply
+// transaction, hooks run in order of registration. Hooks must be registered before
+// replication starts.
+func (conn *SqliteStreamDB) OnBeforeApply(hook BeforeApplyHook) {
+	conn.beforeApply = append(conn.beforeApply, hook)
+}
+
+// checkRowSizes rejects events whose serialized row is larger than configured limit of
+// their table.
+func checkRowSizes(events []*ChangeLogEvent) error {
+	for _, event := range events {
+		limit := cfg.Config.Replication.Tables[event.TableName].MaxRowSize
+		if limit == 0 {
+			continue
+		}
+
+		data, err := cbor.Marshal(event.Row)
+		if err != nil {
+			return err
+		}
+
+		if len(data) > limit {
+			return fmt.Errorf(
+				"%w: %s row %d is %d bytes, limit is %d",
+				ErrRowTooLarge,
+				event.TableName,
+				event.Id,
+				len(data),
+				limit,
+			)
+		}
+	}
+
+	return nil
+}
+
+func (conn *SqliteStreamDB) runBeforeApplyHooks(events []*ChangeLogEvent) ([]*ChangeLogEvent, error) {
+	if len(conn.beforeApply) == 0 {
+		return events, nil
+	}
+
+	ret := make([]*ChangeLogEvent, 0, len(events))
+	for _, event := range events {
+		var err error
+		for _, hook := range conn.beforeApply {
+			event, err = hook(event)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrChangeRejected, err)
+			}
+
+			if event == nil {
+				break
+			}
+		}
+
+		if event != nil {
+			ret = append(ret, event)
+		}
+	}
+
+	return ret, nil
+}
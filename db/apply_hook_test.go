@@ -0,0 +1,59 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestBeforeApplyHookModifiesChange(t *testing.T) {
+	source := newTestDB(t, booksSchema)
+	replica := newTestDB(t, booksSchema)
+	replica.OnBeforeApply(func(event *ChangeLogEvent) (*ChangeLogEvent, error) {
+		if event.Row["title"] == "skipped" {
+			return nil, nil
+		}
+
+		event.Row["title"] = strings.ToUpper(event.Row["title"].(string))
+		return event, nil
+	})
+
+	source.exec(
+		"INSERT INTO books VALUES (1, 'dune', 1)",
+		"INSERT INTO books VALUES (2, 'skipped', 1)",
+	)
+	if err := replica.ReplicateBatch(remoteNodeID, source.publish(), StreamPosition{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := replica.query("SELECT id, title FROM books")
+	if len(rows) != 1 || fmt.Sprint(rows[0][0]) != "1" || rows[0][1] != "DUNE" {
+		t.Fatalf("expected only modified change applied, got %v", rows)
+	}
+}
+
+func TestBeforeApplyHookRejectsBatch(t *testing.T) {
+	source := newTestDB(t, booksSchema)
+	replica := newTestDB(t, booksSchema)
+	replica.OnBeforeApply(func(event *ChangeLogEvent) (*ChangeLogEvent, error) {
+		if event.Row["title"] == "banned" {
+			return nil, errors.New("banned title")
+		}
+
+		return event, nil
+	})
+
+	source.exec(
+		"INSERT INTO books VALUES (1, 'dune', 1)",
+		"INSERT INTO books VALUES (2, 'banned', 1)",
+	)
+	err := replica.ReplicateBatch(remoteNodeID, source.publish(), StreamPosition{})
+	if !errors.Is(err, ErrChangeRejected) {
+		t.Fatalf("expected %v, got %v", ErrChangeRejected, err)
+	}
+
+	if cnt := replica.count("books"); cnt != 0 {
+		t.Fatalf("expected rejected batch not applied, got %d rows", cnt)
+	}
+}
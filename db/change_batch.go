@@ -0,0 +1,62 @@
+package db
+
+import (
+	"github.com/fxamacker/cbor/v2"
+	"github.com/maxpert/marmot/cfg"
+)
+
+// pendingChange is a scanned change log row, or all rows of a source transaction when
+// publishing atomic transactions, with events it publishes. Events of a pending change are
+// never split across batches.
+type pendingChange struct {
+	changes []globalChangeLogEntry
+	events  []*ChangeLogEvent
+	size    int
+}
+
+// splitBatches groups changes into batches up to max count and max bytes of config, full is
+// true if any batch reached a limit and has to be published without lingering.
+func splitBatches(changes []*pendingChange, c cfg.ReplicationLogConfiguration) ([][]*pendingChange, bool) {
+	batches := make([][]*pendingChange, 0, 1)
+	current := make([]*pendingChange, 0, len(changes))
+	count, size := 0, 0
+	full := false
+	for _, p := range changes {
+		overCount := c.BatchMaxCount > 0 && count+len(p.events) > c.BatchMaxCount
+		overSize := c.BatchMaxBytes > 0 && size+p.size > c.BatchMaxBytes
+		if len(current) != 0 && (overCount || overSize) {
+			batches = append(batches, current)
+			current = make([]*pendingChange, 0, len(changes))
+			count, size = 0, 0
+			full = true
+		}
+
+		current = append(current, p)
+		count += len(p.events)
+		size += p.size
+	}
+
+	if len(current) != 0 {
+		batches = append(batches, current)
+	}
+
+	if (c.BatchMaxCount > 0 && count >= c.BatchMaxCount) || (c.BatchMaxBytes > 0 && size >= c.BatchMaxBytes) {
+		full = true
+	}
+
+	return batches, full
+}
+
+func eventsSize(events []*ChangeLogEvent) (int, error) {
+	size := 0
+	for _, event := range events {
+		data, err := cbor.Marshal(event)
+		if err != nil {
+			return 0, err
+		}
+
+		size += len(data)
+	}
+
+	return size, nil
+}
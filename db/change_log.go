@@ -8,10 +8,12 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
 	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/core"
 	"github.com/maxpert/marmot/utils"
 
 	_ "embed"
@@ -25,6 +27,7 @@ import (
 var ErrNoTableMapping = errors.New("no table mapping found")
 var ErrLogNotReadyToPublish = errors.New("not ready to publish changes")
 var ErrEndOfWatch = errors.New("watching event finished")
+var ErrStatementsClosed = errors.New("prepared statements closed after schema change")
 
 //go:embed table_change_log_script.tmpl
 var tableChangeLogScriptTemplate string
@@ -45,28 +48,33 @@ const (
 )
 const changeLogName = "change_log"
 const upsertQuery = `INSERT OR REPLACE INTO %s(%s) VALUES (%s)`
+const deleteByKeyQuery = `DELETE FROM %s WHERE %s = ?`
+const versionedUpsertQuery = `INSERT INTO %s(%s) VALUES (%s) ON CONFLICT(%s) DO UPDATE SET %s WHERE %s.%s IS NULL OR %s.%s < excluded.%s`
 
 type globalChangeLogTemplateData struct {
 	Prefix string
 }
 
 type triggerTemplateData struct {
-	Prefix    string
-	TableName string
-	Columns   []*ColumnInfo
-	Triggers  map[string]string
+	Prefix      string
+	TableName   string
+	Columns     []*ColumnInfo
+	PrimaryKeys []*ColumnInfo
+	Triggers    map[string]string
 }
 
 type globalChangeLogEntry struct {
 	Id            int64  `db:"id"`
 	ChangeTableId int64  `db:"change_table_id"`
 	TableName     string `db:"table_name"`
+	TxnId         int64  `db:"txn_id"`
 }
 
 type changeLogEntry struct {
-	Id    int64  `db:"id"`
-	Type  string `db:"type"`
-	State string `db:"state"`
+	Id        int64  `db:"id"`
+	Type      string `db:"type"`
+	State     string `db:"state"`
+	CreatedAt int64  `db:"created_at"`
 }
 
 func init() {
@@ -79,8 +87,18 @@ func init() {
 	)
 }
 
-func (conn *SqliteStreamDB) Replicate(event *ChangeLogEvent) error {
-	if err := conn.consumeReplicationEvent(event); err != nil {
+func (conn *SqliteStreamDB) Replicate(fromNodeID uint64, event *ChangeLogEvent) error {
+	if err := conn.consumeReplicationEvent(fromNodeID, event); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReplicateBatch applies all events within a single transaction, either all
+// of the events are applied or none of them. Stream position events were delivered from
+// is saved in the same transaction.
+func (conn *SqliteStreamDB) ReplicateBatch(fromNodeID uint64, events []*ChangeLogEvent, pos StreamPosition) error {
+	if err := conn.consumeReplicationEventAt(fromNodeID, pos, events...); err != nil {
 		return err
 	}
 	return nil
@@ -94,7 +112,7 @@ func (conn *SqliteStreamDB) CleanupChangeLogs(beforeTime time.Time) (int64, erro
 	defer sqlConn.Return()
 
 	total := int64(0)
-	for name := range conn.watchTablesSchema {
+	for _, name := range conn.ReplicatedTables() {
 		metaTableName := conn.metaTable(name, changeLogName)
 		rs, err := sqlConn.DB().Delete(metaTableName).
 			Where(
@@ -128,6 +146,10 @@ func (conn *SqliteStreamDB) globalMetaTable() string {
 	return conn.prefix + "_change_log_global"
 }
 
+func (conn *SqliteStreamDB) txnEpochTable() string {
+	return conn.prefix + "_txn_epoch"
+}
+
 func (conn *SqliteStreamDB) globalCDCScript() (string, error) {
 	buf := new(bytes.Buffer)
 	err := globalChangeLogTpl.Execute(buf, &globalChangeLogTemplateData{
@@ -142,17 +164,25 @@ func (conn *SqliteStreamDB) globalCDCScript() (string, error) {
 }
 
 func (conn *SqliteStreamDB) tableCDCScriptFor(tableName string) (string, error) {
-	columns, ok := conn.watchTablesSchema[tableName]
+	columns, ok := conn.tableColumns(tableName)
 	if !ok {
 		return "", errors.New("table info not found")
 	}
 
+	primaryKeys := make([]*ColumnInfo, 0)
+	for _, col := range columns {
+		if col.IsPrimaryKey {
+			primaryKeys = append(primaryKeys, col)
+		}
+	}
+
 	buf := new(bytes.Buffer)
 	err := tableChangeLogTpl.Execute(buf, &triggerTemplateData{
-		Prefix:    conn.prefix,
-		Triggers:  map[string]string{"insert": "NEW", "update": "NEW", "delete": "OLD"},
-		Columns:   columns,
-		TableName: tableName,
+		Prefix:      conn.prefix,
+		Triggers:    map[string]string{"insert": "NEW", "update": "NEW", "delete": "OLD"},
+		Columns:     columns,
+		PrimaryKeys: primaryKeys,
+		TableName:   tableName,
 	})
 
 	if err != nil {
@@ -162,36 +192,208 @@ func (conn *SqliteStreamDB) tableCDCScriptFor(tableName string) (string, error)
 	return spaceStripper.ReplaceAllString(buf.String(), "\n    "), nil
 }
 
-func (conn *SqliteStreamDB) consumeReplicationEvent(event *ChangeLogEvent) error {
+func (conn *SqliteStreamDB) consumeReplicationEvent(fromNodeID uint64, events ...*ChangeLogEvent) error {
+	return conn.consumeReplicationEventAt(fromNodeID, StreamPosition{}, events...)
+}
+
+func (conn *SqliteStreamDB) consumeReplicationEventAt(fromNodeID uint64, pos StreamPosition, events ...*ChangeLogEvent) error {
 	sqlConn, err := conn.pool.Borrow()
 	if err != nil {
 		return err
 	}
 	defer sqlConn.Return()
 
-	return sqlConn.DB().WithTx(func(tnx *goqu.TxDatabase) error {
-		primaryKeyMap := conn.getPrimaryKeyMap(event)
-		if primaryKeyMap == nil {
+	if conn.applied != nil {
+		events = lo.Filter(events, func(event *ChangeLogEvent, _ int) bool {
+			return !conn.applied.contains(fromNodeID, event)
+		})
+
+		// Stream position still moves past redelivered changes, so they aren't fetched again
+		// when consumer resumes from applied sequence
+		if len(events) == 0 {
+			return sqlConn.DB().WithTx(func(tnx *goqu.TxDatabase) error {
+				return conn.recordAppliedSeq(tnx, pos)
+			})
+		}
+	}
+
+	// Own changes echoed back are already stored locally regardless of their size
+	if fromNodeID != cfg.Config.NodeID {
+		for _, event := range events {
+			core.ChangeClock.Observe(event.Timestamp)
+		}
+
+		err = checkRowSizes(events)
+		if err != nil {
+			return err
+		}
+	}
+
+	applyEvents, err := conn.runBeforeApplyHooks(events)
+	if err != nil {
+		return err
+	}
+
+	err = withApplyTx(sqlConn.SQL(), func(tnx *goqu.TxDatabase, tx *sql.Tx) error {
+		for _, event := range applyEvents {
+			start := time.Now()
+			err := conn.applyReplicationEvent(tnx, tx, sqlConn.SQL(), fromNodeID, event)
+			if err != nil {
+				return err
+			}
+
+			conn.stats.applyLatency.With(event.TableName).Observe(float64(time.Since(start).Microseconds()))
+		}
+
+		return conn.recordAppliedSeq(tnx, pos)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if conn.applied != nil {
+		conn.applied.add(fromNodeID, events)
+	}
+
+	conn.status.recordApplied(fromNodeID, pos, applyEvents)
+
+	// Triggers can only be reinstalled once added columns are committed
+	for _, event := range applyEvents {
+		if event.Type != SchemaChangeType {
+			continue
+		}
+
+		if _, err := conn.refreshTableSchema(event.TableName); err != nil {
+			return err
+		}
+	}
+
+	conn.captureCreatedTables(applyEvents)
+
+	if fromNodeID != cfg.Config.NodeID {
+		for _, event := range applyEvents {
+			conn.stats.tableApplied.With(event.TableName).Inc()
+		}
+	}
+
+	conn.onBatchApplied()
+	return nil
+}
+
+// withApplyTx runs fn within a transaction on db, fn gets underlying SQL transaction as well
+// so statements prepared on db can be executed within it.
+func withApplyTx(db *sql.DB, fn func(tnx *goqu.TxDatabase, tx *sql.Tx) error) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err = fn(goqu.NewTx("sqlite", tx), tx); err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			log.Warn().Err(rErr).Msg("Unable to rollback apply transaction")
+		}
+
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// applyReplicationEvent applies event within tnx, tx is the same transaction used to execute
+// statements prepared on db.
+func (conn *SqliteStreamDB) applyReplicationEvent(tnx *goqu.TxDatabase, tx *sql.Tx, db *sql.DB, fromNodeID uint64, event *ChangeLogEvent) error {
+	if event.Type == SchemaChangeType {
+		return conn.applySchemaChange(tnx, event)
+	}
+
+	primaryKeyMap := conn.GetPrimaryKeyMap(event)
+	if primaryKeyMap == nil {
+		switch cfg.Config.Replication.MissingTable {
+		case cfg.MissingTableSkip:
+			conn.stats.missingTableSkipped.Inc()
+			log.Warn().
+				Int64("event_id", event.Id).
+				Str("table", event.TableName).
+				Msg("Table not found locally, skipping change")
+			return nil
+		case cfg.MissingTableCreate:
+			if err := createMissingTable(tnx, event); err != nil {
+				return err
+			}
+
+			primaryKeyMap = schemaPrimaryKeyMap(event)
+		default:
 			return ErrNoTableMapping
 		}
+	}
+
+	// Own changes echoed back already carry local IDs
+	if remapper, ok := conn.idRemappers[event.TableName]; ok && fromNodeID != cfg.Config.NodeID {
+		applied, err := remapper.remap(tnx, conn.idMapTable(), fromNodeID, event)
+		if err != nil || applied {
+			return err
+		}
+
+		primaryKeyMap = conn.GetPrimaryKeyMap(event)
+	}
 
-		logEv := log.Debug().
+	logEv := log.Debug().
+		Int64("event_id", event.Id).
+		Str("type", event.Type)
+
+	for k, v := range primaryKeyMap {
+		logEv = logEv.Str(event.TableName+"."+k, fmt.Sprintf("%v", v))
+	}
+
+	logEv.Send()
+
+	won, err := conn.resolveConflict(tnx, fromNodeID, event)
+	if err != nil {
+		return err
+	}
+
+	if !won {
+		conn.stats.conflictDropped.Inc()
+		log.Debug().
 			Int64("event_id", event.Id).
-			Str("type", event.Type)
+			Str("table", event.TableName).
+			Uint64("timestamp", event.Timestamp).
+			Msg("Dropping change older than local row version")
+		return nil
+	}
 
-		for k, v := range primaryKeyMap {
-			logEv = logEv.Str(event.TableName+"."+k, fmt.Sprintf("%v", v))
+	if versionColumn := guardedVersionColumn(event); versionColumn != "" {
+		applied, err := replicateVersionedRow(tnx, event, primaryKeyMap, versionColumn)
+		if err != nil || applied {
+			return err
 		}
 
-		logEv.Send()
+		conn.stats.staleSkipped.Inc()
+		log.Debug().
+			Int64("event_id", event.Id).
+			Str("table", event.TableName).
+			Msg("Skipping stale change")
+		return nil
+	}
 
-		return replicateRow(tnx, event, primaryKeyMap)
-	})
+	if st := conn.intKeyStatement(event.TableName); st != nil && st.matches(event.Row) {
+		return st.replicate(db, tx, event)
+	}
+
+	return replicateRow(tnx, event, primaryKeyMap)
 }
 
-func (conn *SqliteStreamDB) getPrimaryKeyMap(event *ChangeLogEvent) map[string]any {
+func (conn *SqliteStreamDB) GetPrimaryKeyMap(event *ChangeLogEvent) map[string]any {
 	ret := make(map[string]any)
-	tableColsSchema, ok := conn.watchTablesSchema[event.TableName]
+	tableColsSchema, ok := conn.tableColumns(event.TableName)
 	if !ok {
 		return nil
 	}
@@ -223,10 +425,34 @@ func (conn *SqliteStreamDB) initGlobalChangeLog() error {
 		return err
 	}
 
-	return nil
+	return conn.syncGlobalChangeLogColumns(sqlConn.DB())
+}
+
+// syncGlobalChangeLogColumns adds transaction ID column to global change logs created by older
+// versions, changes captured before upgrade have no transaction ID.
+func (conn *SqliteStreamDB) syncGlobalChangeLogColumns(db *goqu.Database) error {
+	existing := make([]string, 0)
+	err := db.From(goqu.L("pragma_table_info(?)", conn.globalMetaTable())).
+		Select("name").
+		Where(goqu.C("name").Eq("txn_id")).
+		Prepared(true).
+		ScanVals(&existing)
+	if err != nil || len(existing) != 0 {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf(addColumnQuery, conn.globalMetaTable(), "txn_id", "INTEGER NOT NULL DEFAULT 0"))
+	return err
 }
 
 func (conn *SqliteStreamDB) initTriggers(tableName string) error {
+	return conn.installTriggers(tableName, nil)
+}
+
+// installTriggers (re)creates triggers of table, pending changes captured by previous triggers
+// get given columns re-read from table within same transaction, so changes committed between
+// a schema change and trigger reinstall aren't published without added columns.
+func (conn *SqliteStreamDB) installTriggers(tableName string, reread []*ColumnInfo) error {
 	sqlConn, err := conn.pool.Borrow()
 	if err != nil {
 		return err
@@ -244,13 +470,47 @@ func (conn *SqliteStreamDB) initTriggers(tableName string) error {
 		return err
 	}
 
-	log.Info().Msg(fmt.Sprintf("Creating trigger for %v", name))
-	_, err = sqlConn.DB().Exec(script)
+	columns, _ := conn.tableColumns(name)
+	err = conn.syncChangeLogColumns(sqlConn.DB(), name, columns)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	log.Info().Msg(fmt.Sprintf("Creating trigger for %v", name))
+	return sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		_, err := tx.Exec(script)
+		if err != nil || len(reread) == 0 {
+			return err
+		}
+
+		return conn.rereadPendingColumns(tx, name, columns, reread)
+	})
+}
+
+// rereadPendingColumns fills given columns of pending inserts and updates of table from its
+// current rows. Deleted rows are gone, so their changes keep only columns they were captured with.
+func (conn *SqliteStreamDB) rereadPendingColumns(tx *goqu.TxDatabase, tableName string, columns []*ColumnInfo, reread []*ColumnInfo) error {
+	changeLog := conn.metaTable(tableName, changeLogName)
+	keys := make([]string, 0)
+	for _, col := range columns {
+		if col.IsPrimaryKey {
+			keys = append(keys, fmt.Sprintf("%s.%s = %s.val_%s", tableName, col.Name, changeLog, col.Name))
+		}
+	}
+
+	sets := make([]string, 0, len(reread))
+	for _, col := range reread {
+		sets = append(sets, fmt.Sprintf(
+			"val_%s = (SELECT %s FROM %s WHERE %s)",
+			col.Name, col.Name, tableName, strings.Join(keys, " AND "),
+		))
+	}
+
+	_, err := tx.Exec(
+		fmt.Sprintf("UPDATE %s SET %s WHERE state = ? AND type != 'delete'", changeLog, strings.Join(sets, ", ")),
+		Pending,
+	)
+	return err
 }
 
 func (conn *SqliteStreamDB) watchChanges(watcher *fsnotify.Watcher, path string) {
@@ -331,6 +591,94 @@ func (conn *SqliteStreamDB) getGlobalChanges(limit uint32) ([]globalChangeLogEnt
 	return entries, nil
 }
 
+// getTransactionChanges advances transaction epoch and scans changes of earlier epochs only, all
+// source transactions that captured an earlier epoch have committed by the time epoch advances
+// since SQLite serializes writers. A source transaction cut by limit is left for next scan unless
+// it's the only one scanned, in which case up to max_transaction_changes of its changes are
+// returned regardless of limit and rest of it is published by following scans.
+func (conn *SqliteStreamDB) getTransactionChanges(limit uint32) ([]globalChangeLogEntry, error) {
+	sw := utils.NewStopWatch("scan_changes")
+	defer sw.Log(log.Debug(), conn.stats.scanChanges)
+
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return nil, err
+	}
+	defer sqlConn.Return()
+
+	epoch := int64(0)
+	err = sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		_, err := tx.Update(conn.txnEpochTable()).
+			Set(goqu.Record{"id": goqu.L("id + 1")}).
+			Executor().
+			Exec()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.From(conn.txnEpochTable()).Select("id").ScanVal(&epoch)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []globalChangeLogEntry
+	err = sqlConn.DB().
+		From(conn.globalMetaTable()).
+		Where(goqu.C("txn_id").Lt(epoch)).
+		Order(goqu.I("id").Asc()).
+		Limit(uint(limit)).
+		ScanStructs(&entries)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) < int(limit) || len(entries) == 0 {
+		return entries, nil
+	}
+
+	last := entries[len(entries)-1].TxnId
+	if last == 0 {
+		return entries, nil
+	}
+
+	if entries[0].TxnId != last {
+		end := len(entries)
+		for end > 0 && entries[end-1].TxnId == last {
+			end--
+		}
+
+		return entries[:end], nil
+	}
+
+	maxChanges := cfg.Config.ReplicationLog.MaxTransactionChanges
+	entries = nil
+	err = sqlConn.DB().
+		From(conn.globalMetaTable()).
+		Where(goqu.C("txn_id").Eq(last)).
+		Order(goqu.I("id").Asc()).
+		Limit(uint(maxChanges)).
+		ScanStructs(&entries)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) >= int(maxChanges) {
+		log.Warn().
+			Int64("txn_id", last).
+			Uint32("max_transaction_changes", maxChanges).
+			Msg("Transaction exceeds max_transaction_changes, publishing it in parts")
+	}
+
+	return entries, nil
+}
+
+// publishesTransactions returns true if changes of a source transaction are published together.
+func (conn *SqliteStreamDB) publishesTransactions() bool {
+	return conn.OnChangeBatch != nil && cfg.Config.ReplicationLog.AtomicTransactions
+}
+
 func (conn *SqliteStreamDB) countChanges() (int64, error) {
 	sw := utils.NewStopWatch("count_changes")
 	defer sw.Log(log.Debug(), conn.stats.countChanges)
@@ -347,12 +695,25 @@ func (conn *SqliteStreamDB) countChanges() (int64, error) {
 }
 
 func (conn *SqliteStreamDB) publishChangeLog() {
+	if conn.IsReplica() {
+		return
+	}
+
 	if !conn.publishLock.TryLock() {
 		log.Warn().Msg("Publish in progress skipping...")
 		return
 	}
 	defer conn.publishLock.Unlock()
 
+	err := conn.detectSchemaChanges()
+	if err != nil {
+		if !errors.Is(err, ErrLogNotReadyToPublish) && !errors.Is(err, context.Canceled) {
+			log.Error().Err(err).Msg("Unable to publish schema change")
+		}
+
+		return
+	}
+
 	cnt, err := conn.countChanges()
 	if err != nil {
 		log.Error().Err(err).Msg("Unable to count global changes")
@@ -365,7 +726,12 @@ func (conn *SqliteStreamDB) publishChangeLog() {
 		return
 	}
 
-	changes, err := conn.getGlobalChanges(cfg.Config.ScanMaxChanges)
+	var changes []globalChangeLogEntry
+	if conn.publishesTransactions() {
+		changes, err = conn.getTransactionChanges(cfg.Config.ScanMaxChanges)
+	} else {
+		changes, err = conn.getGlobalChanges(cfg.Config.ScanMaxChanges)
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("Unable to scan global changes")
 		return
@@ -375,6 +741,11 @@ func (conn *SqliteStreamDB) publishChangeLog() {
 		return
 	}
 
+	if conn.OnChangeBatch != nil {
+		conn.publishChangeLogBatch(changes)
+		return
+	}
+
 	for _, change := range changes {
 		logEntry := changeLogEntry{}
 		found := false
@@ -408,7 +779,117 @@ func (conn *SqliteStreamDB) publishChangeLog() {
 		}
 
 		conn.stats.published.Inc()
+		conn.stats.tablePublished.With(change.TableName).Inc()
+	}
+}
+
+// publishChangeLogBatch publishes scanned changes batched up to configured limits. With atomic
+// transactions changes are grouped by source transaction ID and a transaction is never split
+// across batches, even if it's larger than batch limits. A partial batch is held back until its
+// oldest change is older than linger duration.
+func (conn *SqliteStreamDB) publishChangeLogBatch(changes []globalChangeLogEntry) {
+	pending := make([]*pendingChange, 0, len(changes))
+	oldest := int64(0)
+	for _, change := range changes {
+		logEntry := changeLogEntry{}
+		found, err := conn.getChangeEntry(&logEntry, change)
+		if err != nil {
+			log.Error().Err(err).Msg("Error scanning last row ID")
+			return
+		}
+
+		if !found {
+			log.Panic().
+				Str("table", change.TableName).
+				Int64("id", change.ChangeTableId).
+				Msg("Global change log row not found in corresponding table")
+			return
+		}
+
+		changeEvents, err := conn.fetchChangeEvents(change.TableName, []*changeLogEntry{&logEntry})
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to fetch changes")
+			return
+		}
+
+		size, err := eventsSize(changeEvents)
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to encode changes")
+			return
+		}
+
+		if oldest == 0 || logEntry.CreatedAt < oldest {
+			oldest = logEntry.CreatedAt
+		}
+
+		// Changes captured before upgrade have no transaction ID and are published one by one
+		if last := len(pending) - 1; conn.publishesTransactions() && last >= 0 &&
+			change.TxnId != 0 && pending[last].changes[0].TxnId == change.TxnId {
+			pending[last].changes = append(pending[last].changes, change)
+			pending[last].events = append(pending[last].events, changeEvents...)
+			pending[last].size += size
+			continue
+		}
+
+		pending = append(pending, &pendingChange{
+			changes: []globalChangeLogEntry{change},
+			events:  changeEvents,
+			size:    size,
+		})
+	}
+
+	batches, full := splitBatches(pending, cfg.Config.ReplicationLog)
+	full = full || len(changes) >= int(cfg.Config.ScanMaxChanges)
+	linger := time.Duration(cfg.Config.ReplicationLog.BatchLinger) * time.Millisecond
+	if age := time.Since(time.UnixMilli(oldest)); !full && age < linger {
+		conn.scheduleLingerFlush(linger - age)
+		return
+	}
+
+	for _, batch := range batches {
+		events := make([]*ChangeLogEvent, 0, len(batch))
+		for _, p := range batch {
+			events = append(events, p.events...)
+		}
+
+		err := conn.OnChangeBatch(events)
+		if err != nil {
+			if !errors.Is(err, ErrLogNotReadyToPublish) && !errors.Is(err, context.Canceled) {
+				log.Error().Err(err).Int("size", len(events)).Msg("Unable to publish change batch")
+			}
+
+			return
+		}
+
+		conn.stats.batchSize.Observe(float64(len(events)))
+		for _, p := range batch {
+			for _, change := range p.changes {
+				err = conn.markChangePublished(change)
+				if err != nil {
+					log.Error().Err(err).Msg("Unable to cleanup change log")
+				}
+
+				conn.stats.published.Inc()
+				conn.stats.tablePublished.With(change.TableName).Inc()
+			}
+		}
+	}
+}
+
+// scheduleLingerFlush publishes changes again once partial batch lingered long enough, so
+// latency stays bounded when writes stop. Must be called holding publish lock.
+func (conn *SqliteStreamDB) scheduleLingerFlush(after time.Duration) {
+	if conn.lingerTimer != nil {
+		return
 	}
+
+	conn.lingerTimer = time.AfterFunc(after, func() {
+		conn.publishLock.Lock()
+		conn.lingerTimer = nil
+		conn.publishLock.Unlock()
+
+		conn.publishChangeLog()
+	})
 }
 
 func (conn *SqliteStreamDB) markChangePublished(change globalChangeLogEntry) error {
@@ -451,7 +932,7 @@ func (conn *SqliteStreamDB) getChangeEntry(entry *changeLogEntry, change globalC
 	}
 	defer sqlConn.Return()
 
-	return sqlConn.DB().Select("id", "type", "state").
+	return sqlConn.DB().Select("id", "type", "state", "created_at").
 		From(conn.metaTable(change.TableName, changeLogName)).
 		Where(
 			goqu.C("state").Eq(Pending),
@@ -462,6 +943,36 @@ func (conn *SqliteStreamDB) getChangeEntry(entry *changeLogEntry, change globalC
 }
 
 func (conn *SqliteStreamDB) consumeChangeLogs(tableName string, changes []*changeLogEntry) error {
+	events, err := conn.fetchChangeEvents(tableName, changes)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		logger := log.With().
+			Int64("rowid", event.Id).
+			Str("table", tableName).
+			Str("type", event.Type).
+			Logger()
+
+		if conn.OnChange != nil {
+			err = conn.OnChange(event)
+
+			if err != nil {
+				if err == ErrLogNotReadyToPublish || err == context.Canceled {
+					return err
+				}
+
+				logger.Error().Err(err).Msg("Failed to publish for table " + tableName)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (conn *SqliteStreamDB) fetchChangeEvents(tableName string, changes []*changeLogEntry) ([]*ChangeLogEvent, error) {
 	rowIds := lo.Map(changes, func(e *changeLogEntry, i int) int64 {
 		return e.Id
 	})
@@ -476,49 +987,45 @@ func (conn *SqliteStreamDB) consumeChangeLogs(tableName string, changes []*chang
 	idColumnName := conn.prefix + "change_log_id"
 	rawRows, err := conn.fetchChangeRows(tableName, idColumnName, rowIds)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	rows := &EnhancedRows{rawRows}
 	defer rows.Finalize()
 
+	tableInfo, _ := conn.tableColumns(tableName)
+	events := make([]*ChangeLogEvent, 0, len(changes))
 	for rows.Next() {
 		row, err := rows.fetchRow()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		changeRowID := row[idColumnName].(int64)
 		changeRow := changeMap[changeRowID]
 		delete(row, idColumnName)
 
-		logger := log.With().
-			Int64("rowid", changeRowID).
-			Str("table", tableName).
-			Str("type", changeRow.Type).
-			Logger()
-
-		if conn.OnChange != nil {
-			err = conn.OnChange(&ChangeLogEvent{
-				Id:        changeRowID,
-				Type:      changeRow.Type,
-				TableName: tableName,
-				Row:       row,
-				tableInfo: conn.watchTablesSchema[tableName],
-			})
-
-			if err != nil {
-				if err == ErrLogNotReadyToPublish || err == context.Canceled {
-					return err
-				}
+		events = append(events, &ChangeLogEvent{
+			Id:        changeRowID,
+			Type:      changeRow.Type,
+			TableName: tableName,
+			Row:       row,
+			Timestamp: core.ChangeClock.Stamp(changeRow.CreatedAt),
+			CreatedAt: changeRow.CreatedAt,
+			tableInfo: tableInfo,
+		})
 
-				logger.Error().Err(err).Msg("Failed to publish for table " + tableName)
-				return err
-			}
+		if cfg.Config.ReplicationLog.EmbedSchema {
+			events[len(events)-1].Schema = tableInfo
 		}
 	}
 
-	return nil
+	err = conn.recordLocalVersions(events)
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
 }
 
 func (conn *SqliteStreamDB) fetchChangeRows(
@@ -533,7 +1040,7 @@ func (conn *SqliteStreamDB) fetchChangeRows(
 	defer sqlConn.Return()
 
 	columnNames := make([]any, 0)
-	tableCols := conn.watchTablesSchema[tableName]
+	tableCols, _ := conn.tableColumns(tableName)
 	columnNames = append(columnNames, goqu.C("id").As(idColumnName))
 	for _, col := range tableCols {
 		columnNames = append(columnNames, goqu.C("val_"+col.Name).As(col.Name))
@@ -556,6 +1063,199 @@ func (conn *SqliteStreamDB) fetchChangeRows(
 	return rawRows, nil
 }
 
+// guardedVersionColumn returns version column guarding applies of event's table, empty if
+// table has none or change carries no version.
+func guardedVersionColumn(event *ChangeLogEvent) string {
+	versionColumn := cfg.Config.Replication.Tables[event.TableName].VersionColumn
+	if versionColumn == "" || event.Row[versionColumn] == nil {
+		return ""
+	}
+
+	return versionColumn
+}
+
+// replicateVersionedRow applies change only if local row doesn't carry a newer version, the
+// version comparison is part of the write so it can't race with local writes. Upserts only
+// apply when strictly newer, deletes apply as long as local row has not moved past deleted
+// version. Returns false if no row was written, a delete of a row that is already gone
+// counts as skipped too.
+func replicateVersionedRow(tx *goqu.TxDatabase, event *ChangeLogEvent, pkMap map[string]any, versionColumn string) (bool, error) {
+	var res sql.Result
+	var err error
+	switch event.Type {
+	case "insert", "update":
+		columnNames := make([]string, 0, len(event.Row))
+		updates := make([]string, 0, len(event.Row))
+		columnValues := make([]any, 0, len(event.Row))
+		for k, v := range event.Row {
+			columnNames = append(columnNames, k)
+			updates = append(updates, fmt.Sprintf("%s = excluded.%s", k, k))
+			columnValues = append(columnValues, v)
+		}
+
+		query := fmt.Sprintf(
+			versionedUpsertQuery,
+			event.TableName,
+			strings.Join(columnNames, ", "),
+			strings.Join(strings.Split(strings.Repeat("?", len(columnNames)), ""), ", "),
+			strings.Join(lo.Keys(pkMap), ", "),
+			strings.Join(updates, ", "),
+			event.TableName, versionColumn,
+			event.TableName, versionColumn, versionColumn,
+		)
+		res, err = tx.Exec(query, columnValues...)
+	case "delete":
+		res, err = tx.Delete(event.TableName).
+			Where(
+				goqu.Ex(pkMap),
+				goqu.Or(goqu.C(versionColumn).IsNull(), goqu.C(versionColumn).Lte(event.Row[versionColumn])),
+			).
+			Prepared(true).
+			Executor().
+			Exec()
+	default:
+		return false, fmt.Errorf("invalid operation type %s", event.Type)
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// intKeyStatements holds apply statements prebuilt for tables keyed by a single integer
+// column, statements are prepared once per connection and reused by every transaction applying
+// changes on that connection. Statements are closed once table schema changes.
+type intKeyStatements struct {
+	columns []string
+	pk      string
+	upsert  string
+	delete  string
+
+	lock     *sync.Mutex
+	prepared map[*sql.DB]*preparedIntKeyStatements
+	closed   bool
+}
+
+type preparedIntKeyStatements struct {
+	upsert *sql.Stmt
+	delete *sql.Stmt
+}
+
+func newIntKeyStatements(tableName string, columns []*ColumnInfo) *intKeyStatements {
+	pkColumns := lo.Filter(columns, func(c *ColumnInfo, _ int) bool {
+		return c.IsPrimaryKey
+	})
+
+	if len(pkColumns) != 1 || !strings.Contains(strings.ToUpper(pkColumns[0].Type), "INT") {
+		return nil
+	}
+
+	columnNames := lo.Map(columns, func(c *ColumnInfo, _ int) string {
+		return c.Name
+	})
+
+	return &intKeyStatements{
+		columns: columnNames,
+		pk:      pkColumns[0].Name,
+		upsert: fmt.Sprintf(
+			upsertQuery,
+			tableName,
+			strings.Join(columnNames, ", "),
+			strings.Join(strings.Split(strings.Repeat("?", len(columnNames)), ""), ", "),
+		),
+		delete:   fmt.Sprintf(deleteByKeyQuery, tableName, pkColumns[0].Name),
+		lock:     &sync.Mutex{},
+		prepared: map[*sql.DB]*preparedIntKeyStatements{},
+	}
+}
+
+// prepare returns statements prepared on db, preparing them on first use.
+func (s *intKeyStatements) prepare(db *sql.DB) (*preparedIntKeyStatements, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil, ErrStatementsClosed
+	}
+
+	if p, ok := s.prepared[db]; ok {
+		return p, nil
+	}
+
+	upsert, err := db.Prepare(s.upsert)
+	if err != nil {
+		return nil, err
+	}
+
+	del, err := db.Prepare(s.delete)
+	if err != nil {
+		upsert.Close()
+		return nil, err
+	}
+
+	p := &preparedIntKeyStatements{upsert: upsert, delete: del}
+	s.prepared[db] = p
+	return p, nil
+}
+
+// close closes statements prepared on every connection, statements can't be used afterwards.
+func (s *intKeyStatements) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	for db, p := range s.prepared {
+		p.upsert.Close()
+		p.delete.Close()
+		delete(s.prepared, db)
+	}
+}
+
+// matches reports whether row has exactly the columns statements were built with,
+// rows captured against a different schema have to go through generic path.
+func (s *intKeyStatements) matches(row map[string]any) bool {
+	if len(row) != len(s.columns) {
+		return false
+	}
+
+	for _, c := range s.columns {
+		if _, ok := row[c]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// replicate applies event within tx using statements prepared on db, tx must be a transaction
+// of db.
+func (s *intKeyStatements) replicate(db *sql.DB, tx *sql.Tx, event *ChangeLogEvent) error {
+	p, err := s.prepare(db)
+	if err != nil {
+		return err
+	}
+
+	if event.Type == "insert" || event.Type == "update" {
+		values := make([]any, 0, len(s.columns))
+		for _, c := range s.columns {
+			values = append(values, event.Row[c])
+		}
+
+		_, err := tx.Stmt(p.upsert).Exec(values...)
+		return err
+	}
+
+	if event.Type == "delete" {
+		_, err := tx.Stmt(p.delete).Exec(event.Row[s.pk])
+		return err
+	}
+
+	return fmt.Errorf("invalid operation type %s", event.Type)
+}
+
 func replicateRow(tx *goqu.TxDatabase, event *ChangeLogEvent, pkMap map[string]any) error {
 	if event.Type == "insert" || event.Type == "update" {
 		return replicateUpsert(tx, event, pkMap)
@@ -1,6 +1,8 @@
 package db
 
 import (
+	"bytes"
+	"fmt"
 	"hash/fnv"
 	"reflect"
 	"sort"
@@ -24,6 +26,9 @@ type ChangeLogEvent struct {
 	Type      string
 	TableName string
 	Row       map[string]any
+	Timestamp uint64        `cbor:",omitempty"`
+	Schema    []*ColumnInfo `cbor:",omitempty"`
+	CreatedAt int64         `cbor:",omitempty"`
 	tableInfo []*ColumnInfo `cbor:"-"`
 }
 
@@ -55,6 +60,9 @@ func (e ChangeLogEvent) Unwrap() (ChangeLogEvent, error) {
 		TableName: e.TableName,
 		Type:      e.Type,
 		Row:       map[string]any{},
+		Timestamp: e.Timestamp,
+		Schema:    e.Schema,
+		CreatedAt: e.CreatedAt,
 		tableInfo: e.tableInfo,
 	}
 
@@ -71,32 +79,67 @@ func (e ChangeLogEvent) Unwrap() (ChangeLogEvent, error) {
 }
 
 func (e ChangeLogEvent) Hash() (uint64, error) {
+	key, err := e.PartitionKey()
+	if err != nil {
+		return 0, err
+	}
+
 	hasher := fnv.New64()
-	enc := cbor.NewEncoder(hasher)
-	err := enc.StartIndefiniteArray()
+	_, err = hasher.Write(key)
 	if err != nil {
 		return 0, err
 	}
 
+	return hasher.Sum64(), nil
+}
+
+// MessageID identifies change published by node for JetStream deduplication, it stays same
+// when change log row is published again. Creation time of change log row tells apart rows
+// reusing IDs after change logs are recreated.
+func (e *ChangeLogEvent) MessageID(nodeID uint64) string {
+	return fmt.Sprintf("%d-%s-%d-%d", nodeID, e.TableName, e.Id, e.CreatedAt)
+}
+
+// BatchMessageID identifies batch of changes published by node for JetStream deduplication.
+func BatchMessageID(nodeID uint64, events []ChangeLogEvent) string {
+	hasher := fnv.New64a()
+	for i := range events {
+		_, _ = hasher.Write([]byte(events[i].MessageID(nodeID)))
+		_, _ = hasher.Write([]byte{0})
+	}
+
+	return fmt.Sprintf("%d-batch-%016x", nodeID, hasher.Sum64())
+}
+
+// PartitionKey returns stable encoding of table name and primary key values of row,
+// identifying row across nodes.
+func (e ChangeLogEvent) PartitionKey() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := cbor.NewEncoder(buf)
+	err := enc.StartIndefiniteArray()
+	if err != nil {
+		return nil, err
+	}
+
 	err = enc.Encode(e.TableName)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	pkColumns := e.getSortedPKColumns()
 	for _, pk := range pkColumns {
 		err = enc.Encode([]any{pk, e.Row[pk]})
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 	}
 
 	err = enc.EndIndefinite()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return hasher.Sum64(), nil
+	return buf.Bytes(), nil
 }
 
 func (e ChangeLogEvent) getSortedPKColumns() []string {
@@ -144,6 +187,9 @@ func (e ChangeLogEvent) prepare() ChangeLogEvent {
 		Type:      e.Type,
 		TableName: e.TableName,
 		Row:       preparedRow,
+		Timestamp: e.Timestamp,
+		Schema:    e.Schema,
+		CreatedAt: e.CreatedAt,
 		tableInfo: e.tableInfo,
 	}
 }
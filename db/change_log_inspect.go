@@ -0,0 +1,130 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+const changeLogColumnPrefix = "val_"
+
+type ChangeLogRow struct {
+	Id        int64
+	TableName string
+	Type      string
+	State     ChangeLogState
+	CreatedAt time.Time
+	Key       map[string]any
+	Row       map[string]any
+}
+
+// ChangeLogTables lists the user tables that currently have a change log table installed.
+func (conn *SqliteStreamDB) ChangeLogTables() ([]string, error) {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return nil, err
+	}
+	defer sqlConn.Return()
+
+	suffix := "_" + changeLogName
+	names := make([]string, 0)
+	err = sqlConn.DB().
+		Select("name").
+		From("sqlite_master").
+		Where(
+			goqu.C("type").Eq("table"),
+			hasMarmotPrefix(conn.prefix),
+			goqu.C("name").Like("%"+suffix),
+			goqu.C("name").Neq(conn.globalMetaTable()),
+		).
+		Order(goqu.C("name").Asc()).
+		Prepared(true).
+		ScanVals(&names)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make([]string, 0, len(names))
+	for _, name := range names {
+		tables = append(tables, strings.TrimSuffix(strings.TrimPrefix(name, conn.prefix), suffix))
+	}
+
+	return tables, nil
+}
+
+// ListChangeLogs reads up to limit change log rows (oldest first) of given table.
+func (conn *SqliteStreamDB) ListChangeLogs(tableName string, limit uint) ([]*ChangeLogRow, error) {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return nil, err
+	}
+	defer sqlConn.Return()
+
+	var colInfo []*ColumnInfo
+	err = sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		colInfo, err = getTableInfo(tx, tableName)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	query, params, err := sqlConn.DB().
+		From(conn.metaTable(tableName, changeLogName)).
+		Order(goqu.I("id").Asc()).
+		Limit(limit).
+		Prepared(true).
+		ToSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	rawRows, err := sqlConn.DB().Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := &EnhancedRows{rawRows}
+	defer rows.Finalize()
+
+	ret := make([]*ChangeLogRow, 0)
+	for rows.Next() {
+		row, err := rows.fetchRow()
+		if err != nil {
+			return nil, err
+		}
+
+		entry := &ChangeLogRow{
+			TableName: tableName,
+			Key:       map[string]any{},
+			Row:       map[string]any{},
+		}
+
+		entry.Id, _ = row["id"].(int64)
+		entry.Type, _ = row["type"].(string)
+		if state, ok := row["state"].(int64); ok {
+			entry.State = ChangeLogState(state)
+		}
+
+		if createdAt, ok := row["created_at"].(int64); ok {
+			entry.CreatedAt = time.UnixMilli(createdAt)
+		}
+
+		for k, v := range row {
+			if strings.HasPrefix(k, changeLogColumnPrefix) {
+				entry.Row[strings.TrimPrefix(k, changeLogColumnPrefix)] = v
+			}
+		}
+
+		for _, col := range colInfo {
+			if col.IsPrimaryKey {
+				entry.Key[col.Name] = entry.Row[col.Name]
+			}
+		}
+
+		ret = append(ret, entry)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,407 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/maxpert/marmot/cfg"
+)
+
+const booksSchema = "CREATE TABLE books(id INTEGER PRIMARY KEY, title TEXT, version INT)"
+
+const remoteNodeID = uint64(4242)
+
+func TestStaleVersionChangeSkipped(t *testing.T) {
+	c := withConfig(t)
+	c.Replication.Tables = map[string]cfg.TableConfiguration{
+		"books": {VersionColumn: "version"},
+	}
+
+	source := newTestDB(t, booksSchema)
+	replica := newTestDB(t, booksSchema)
+	replica.exec("INSERT INTO books VALUES (1, 'newer', 3)")
+	replica.publish()
+
+	source.exec("INSERT INTO books VALUES (1, 'stale', 2)")
+	source.exec("UPDATE books SET title = 'newest', version = 4 WHERE id = 1")
+	events := source.publish()
+	if len(events) != 2 {
+		t.Fatalf("expected 2 changes, got %d", len(events))
+	}
+
+	if err := replica.Replicate(remoteNodeID, events[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := replica.query("SELECT title, version FROM books WHERE id = 1")
+	if rows[0][0] != "newer" || rows[0][1] != int64(3) {
+		t.Fatalf("stale change was applied, row is %v", rows[0])
+	}
+
+	if err := replica.Replicate(remoteNodeID, events[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	rows = replica.query("SELECT title, version FROM books WHERE id = 1")
+	if rows[0][0] != "newest" || rows[0][1] != int64(4) {
+		t.Fatalf("newer change was not applied, row is %v", rows[0])
+	}
+}
+
+func TestStaleVersionDeleteSkipped(t *testing.T) {
+	c := withConfig(t)
+	c.Replication.Tables = map[string]cfg.TableConfiguration{
+		"books": {VersionColumn: "version"},
+	}
+
+	replica := newTestDB(t, booksSchema)
+	replica.exec("INSERT INTO books VALUES (1, 'newer', 3)", "INSERT INTO books VALUES (2, 'same', 2)")
+	replica.publish()
+
+	for _, event := range []*ChangeLogEvent{
+		{Id: 1, Type: "delete", TableName: "books", Row: map[string]any{"id": int64(1), "title": "older", "version": int64(2)}},
+		{Id: 2, Type: "delete", TableName: "books", Row: map[string]any{"id": int64(2), "title": "same", "version": int64(2)}},
+	} {
+		if err := replica.Replicate(remoteNodeID, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows := replica.query("SELECT id, version FROM books")
+	if len(rows) != 1 || rows[0][0] != int64(1) || rows[0][1] != int64(3) {
+		t.Fatalf("expected only delete of unchanged row applied, rows are %v", rows)
+	}
+}
+
+func TestAtomicTransactionAppliesAllOrNothing(t *testing.T) {
+	c := withConfig(t)
+	c.ReplicationLog.AtomicTransactions = true
+
+	source := newTestDB(t, "CREATE TABLE accounts(id INTEGER PRIMARY KEY, balance INT)")
+	replica := newTestDB(t, "CREATE TABLE accounts(id INTEGER PRIMARY KEY, balance INT CHECK(balance >= 0))")
+
+	source.exec(
+		"INSERT INTO accounts VALUES (1, 10)",
+		"INSERT INTO accounts VALUES (2, -5)",
+		"INSERT INTO accounts VALUES (3, 20)",
+	)
+	batches := source.publishBatches()
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Fatalf("expected one batch of 3 changes, got %v", batches)
+	}
+
+	if err := replica.ReplicateBatch(remoteNodeID, batches[0], StreamPosition{}); err == nil {
+		t.Fatal("expected batch violating check constraint to fail")
+	}
+
+	if cnt := replica.count("accounts"); cnt != 0 {
+		t.Fatalf("expected no rows of failed transaction, got %d", cnt)
+	}
+
+	source.exec(
+		"UPDATE accounts SET balance = 0 WHERE id = 2",
+		"UPDATE accounts SET balance = 5 WHERE id = 1",
+	)
+	batches = source.publishBatches()
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("expected one batch of 2 changes, got %v", batches)
+	}
+
+	if err := replica.ReplicateBatch(remoteNodeID, batches[0], StreamPosition{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := replica.query("SELECT id, balance FROM accounts ORDER BY id")
+	if len(rows) != 2 || rows[0][1] != int64(5) || rows[1][1] != int64(0) {
+		t.Fatalf("unexpected rows after applying transaction %v", rows)
+	}
+}
+
+func TestAtomicTransactionNotSplitByScanLimit(t *testing.T) {
+	c := withConfig(t)
+	c.ReplicationLog.AtomicTransactions = true
+	c.ScanMaxChanges = 2
+
+	source := newTestDB(t, booksSchema)
+	source.exec(
+		"INSERT INTO books VALUES (1, 'a', 1)",
+		"INSERT INTO books VALUES (2, 'b', 1)",
+		"INSERT INTO books VALUES (3, 'c', 1)",
+	)
+	batches := source.publishBatches()
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Fatalf("expected transaction larger than scan limit in one batch, got %v", batches)
+	}
+
+	source.exec("INSERT INTO books VALUES (4, 'd', 1)")
+	if batches = source.publishBatches(); len(batches) != 1 || len(batches[0]) != 1 {
+		t.Fatalf("expected transaction scanned on its own in its own batch, got %v", batches)
+	}
+}
+
+func TestOversizedTransactionPublishedInParts(t *testing.T) {
+	c := withConfig(t)
+	c.ReplicationLog.AtomicTransactions = true
+	c.ReplicationLog.MaxTransactionChanges = 3
+	c.ScanMaxChanges = 2
+
+	source := newTestDB(t, booksSchema)
+	source.exec(
+		"INSERT INTO books VALUES (1, 'a', 1)",
+		"INSERT INTO books VALUES (2, 'b', 1)",
+		"INSERT INTO books VALUES (3, 'c', 1)",
+		"INSERT INTO books VALUES (4, 'd', 1)",
+		"INSERT INTO books VALUES (5, 'e', 1)",
+	)
+
+	sizes := make([]int, 0)
+	for _, batch := range append(source.publishBatches(), source.publishBatches()...) {
+		sizes = append(sizes, len(batch))
+	}
+
+	if !reflect.DeepEqual(sizes, []int{3, 2}) {
+		t.Fatalf("expected transaction capped at 3 changes per batch, got batches of %v", sizes)
+	}
+}
+
+func TestGlobalChangeLogMigratedWithTransactionID(t *testing.T) {
+	c := withConfig(t)
+	c.ReplicationLog.AtomicTransactions = true
+
+	source := newTestDB(
+		t,
+		booksSchema,
+		"CREATE TABLE __marmot___change_log_global(id INTEGER PRIMARY KEY AUTOINCREMENT, change_table_id INTEGER, table_name TEXT)",
+	)
+
+	source.exec("INSERT INTO books VALUES (1, 'a', 1)", "INSERT INTO books VALUES (2, 'b', 1)")
+	batches := source.publishBatches()
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("expected one batch of 2 changes, got %v", batches)
+	}
+}
+
+const itemsSchema = "CREATE TABLE items(id INTEGER PRIMARY KEY, name TEXT, price REAL, data BLOB, qty INT)"
+
+// disableIntKeyPath makes table apply changes through generic path.
+func (d *testDB) disableIntKeyPath(table string) {
+	d.schemaLock.Lock()
+	defer d.schemaLock.Unlock()
+
+	delete(d.intKeyStatements, table)
+}
+
+func TestIntKeyPathMatchesGenericPath(t *testing.T) {
+	source := newTestDB(t, itemsSchema)
+	fast := newTestDB(t, itemsSchema)
+	generic := newTestDB(t, itemsSchema)
+	generic.disableIntKeyPath("items")
+
+	if fast.intKeyStatement("items") == nil {
+		t.Fatal("expected integer key statements for items")
+	}
+
+	source.exec(
+		"INSERT INTO items VALUES (1, 'pen', 1.5, x'0102', 10)",
+		"INSERT INTO items VALUES (2, 'ink', NULL, NULL, 3)",
+		"INSERT INTO items VALUES (3, 'pad', 4.25, x'ff', 7)",
+	)
+	source.exec(
+		"UPDATE items SET qty = qty - 1, name = 'red pen' WHERE id = 1",
+		"DELETE FROM items WHERE id = 2",
+		"UPDATE items SET id = 30 WHERE id = 3",
+	)
+
+	events := source.publish()
+	for _, event := range events {
+		if err := fast.Replicate(remoteNodeID, event); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := generic.Replicate(remoteNodeID, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := "SELECT id, name, price, data, qty FROM items ORDER BY id"
+	expected := source.query(query)
+	for name, replica := range map[string]*testDB{"fast": fast, "generic": generic} {
+		rows := replica.query(query)
+		if !reflect.DeepEqual(rows, expected) {
+			t.Fatalf("%s path rows %v don't match source rows %v", name, rows, expected)
+		}
+	}
+}
+
+func TestIntKeyStatementsInvalidatedOnSchemaChange(t *testing.T) {
+	replica := newTestDB(t, itemsSchema)
+	old := replica.intKeyStatement("items")
+
+	replica.exec("ALTER TABLE items ADD COLUMN color TEXT")
+	if _, err := replica.refreshTableSchema("items"); err != nil {
+		t.Fatal(err)
+	}
+
+	current := replica.intKeyStatement("items")
+	if current == nil || current == old || len(current.columns) != 6 {
+		t.Fatalf("expected statements rebuilt with added column, got %v", current)
+	}
+
+	sqlConn, err := replica.pool.Borrow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlConn.Return()
+
+	if _, err := old.prepare(sqlConn.SQL()); !errors.Is(err, ErrStatementsClosed) {
+		t.Fatalf("expected old statements to be closed, got %v", err)
+	}
+}
+
+func BenchmarkApplyIntKey(b *testing.B) {
+	for _, name := range []string{"prepared", "generic"} {
+		b.Run(name, func(b *testing.B) {
+			replica := newTestDB(b, itemsSchema)
+			if name == "generic" {
+				replica.disableIntKeyPath("items")
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				events := make([]*ChangeLogEvent, 0, 100)
+				for j := 0; j < 100; j++ {
+					id := int64(i*100 + j)
+					events = append(events, &ChangeLogEvent{
+						Id:        id,
+						Type:      "insert",
+						TableName: "items",
+						Row: map[string]any{
+							"id":    id % 1000,
+							"name":  "item",
+							"price": 1.5,
+							"data":  []byte{1, 2, 3},
+							"qty":   id,
+						},
+					})
+				}
+
+				if err := replica.ReplicateBatch(remoteNodeID, events, StreamPosition{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMissingTablePolicies(t *testing.T) {
+	for _, policy := range []string{cfg.MissingTableError, cfg.MissingTableSkip, cfg.MissingTableCreate} {
+		t.Run(policy, func(t *testing.T) {
+			c := withConfig(t)
+			c.Replication.MissingTable = policy
+			c.ReplicationLog.EmbedSchema = true
+
+			source := newTestDB(t, booksSchema)
+			replica := newTestDB(t)
+
+			source.exec("INSERT INTO books VALUES (1, 'dune', 1)")
+			events := source.publish()
+			err := replica.Replicate(remoteNodeID, events[0])
+
+			switch policy {
+			case cfg.MissingTableError:
+				if !errors.Is(err, ErrNoTableMapping) {
+					t.Fatalf("expected %v, got %v", ErrNoTableMapping, err)
+				}
+
+				if exists := replica.query("SELECT name FROM sqlite_master WHERE name = 'books'"); len(exists) != 0 {
+					t.Fatal("table must not be created")
+				}
+			case cfg.MissingTableSkip:
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if exists := replica.query("SELECT name FROM sqlite_master WHERE name = 'books'"); len(exists) != 0 {
+					t.Fatal("table must not be created")
+				}
+			case cfg.MissingTableCreate:
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				rows := replica.query("SELECT id, title, version FROM books")
+				if len(rows) != 1 || rows[0][1] != "dune" {
+					t.Fatalf("expected created table with replicated row, got %v", rows)
+				}
+
+				if _, ok := replica.tableColumns("books"); !ok {
+					t.Fatal("expected created table to be captured")
+				}
+
+				pk := replica.query("SELECT name FROM pragma_table_info('books') WHERE pk = 1")
+				if len(pk) != 1 || pk[0][0] != "id" {
+					t.Fatalf("expected id as primary key of created table, got %v", pk)
+				}
+			}
+		})
+	}
+}
+
+func TestMissingTableCreateWithoutSchema(t *testing.T) {
+	c := withConfig(t)
+	c.Replication.MissingTable = cfg.MissingTableCreate
+
+	source := newTestDB(t, booksSchema)
+	replica := newTestDB(t)
+
+	source.exec("INSERT INTO books VALUES (1, 'dune', 1)")
+	events := source.publish()
+	if err := replica.Replicate(remoteNodeID, events[0]); !errors.Is(err, ErrNoTableMapping) {
+		t.Fatalf("expected %v for change without schema, got %v", ErrNoTableMapping, err)
+	}
+}
+
+func TestPrimaryKeyUpdateLeavesOneRow(t *testing.T) {
+	source := newTestDB(t, booksSchema)
+	replica := newTestDB(t, booksSchema)
+
+	source.exec("INSERT INTO books VALUES (1, 'dune', 1)")
+	source.exec("UPDATE books SET id = 2, title = 'dune messiah' WHERE id = 1")
+	for _, event := range source.publish() {
+		if err := replica.Replicate(remoteNodeID, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows := replica.query("SELECT id, title FROM books")
+	if len(rows) != 1 || rows[0][0] != int64(2) || rows[0][1] != "dune messiah" {
+		t.Fatalf("expected single row keyed by new id, got %v", rows)
+	}
+}
+
+func TestReplicatedChangeNotCapturedAgain(t *testing.T) {
+	source := newTestDB(t, booksSchema)
+	replica := newTestDB(t, booksSchema)
+
+	source.exec("INSERT INTO books VALUES (1, 'dune', 1)")
+	events := source.publish()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- replica.Replicate(remoteNodeID, events[0])
+	}()
+	replica.exec("INSERT INTO books VALUES (2, 'emma', 1)")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	published := replica.publish()
+	if len(published) != 1 || published[0].Row["title"] != "emma" {
+		t.Fatalf("expected only local change published, got %d changes", len(published))
+	}
+
+	if cnt := replica.count("books"); cnt != 2 {
+		t.Fatalf("expected replicated and local rows, got %d rows", cnt)
+	}
+}
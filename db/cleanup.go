@@ -4,20 +4,36 @@ import (
 	"fmt"
 
 	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
 	"github.com/rs/zerolog/log"
 )
 
 const deleteTriggerQuery = `DROP TRIGGER IF EXISTS %s`
 const deleteMarmotTables = `DROP TABLE IF EXISTS %s;`
 
-func removeMarmotTriggers(conn *goqu.Database, prefix string) error {
-	triggers := make([]string, 0)
+// hasMarmotPrefix matches object names starting with prefix, LIKE can't be used since
+// underscores of prefix are wildcards and would match user objects too
+func hasMarmotPrefix(prefix string) exp.BooleanExpression {
+	return goqu.Func("substr", goqu.C("name"), 1, len(prefix)).Eq(prefix)
+}
+
+func listMarmotObjects(conn *goqu.Database, objType string, prefix string) ([]string, error) {
+	names := make([]string, 0)
 	err := conn.
 		Select("name").
 		From("sqlite_master").
-		Where(goqu.C("type").Eq("trigger"), goqu.C("name").Like(prefix+"%")).
+		Where(goqu.C("type").Eq(objType), hasMarmotPrefix(prefix)).
 		Prepared(true).
-		ScanVals(&triggers)
+		ScanVals(&names)
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+func removeMarmotTriggers(conn *goqu.Database, prefix string) error {
+	triggers, err := listMarmotObjects(conn, "trigger", prefix)
 	if err != nil {
 		return err
 	}
@@ -35,13 +51,7 @@ func removeMarmotTriggers(conn *goqu.Database, prefix string) error {
 }
 
 func removeMarmotTables(conn *goqu.Database, prefix string) error {
-	tables := make([]string, 0)
-	err := conn.
-		Select("name").
-		From("sqlite_master").
-		Where(goqu.C("type").Eq("table"), goqu.C("name").Like(prefix+"%")).
-		Prepared(true).
-		ScanVals(&tables)
+	tables, err := listMarmotObjects(conn, "table", prefix)
 	if err != nil {
 		return err
 	}
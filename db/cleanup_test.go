@@ -0,0 +1,37 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRemoveCDCCleansStaleTriggers(t *testing.T) {
+	d := newTestDB(
+		t,
+		booksSchema,
+		"CREATE TABLE notes(id INTEGER PRIMARY KEY, body TEXT)",
+		"CREATE TABLE __marmot_notes(id INTEGER PRIMARY KEY, body TEXT)",
+		"CREATE TRIGGER notes_audit AFTER INSERT ON notes BEGIN INSERT INTO __marmot_notes VALUES (NEW.id, NEW.body); END",
+	)
+	d.exec("INSERT INTO books VALUES (1, 'dune', 1)")
+
+	// Trigger left behind by a previous run that was killed, for a table since renamed
+	d.exec("CREATE TRIGGER " + MarmotPrefix + "archived_change_log_on_insert AFTER INSERT ON notes BEGIN SELECT 1; END")
+
+	for i := 0; i < 2; i++ {
+		if err := d.RemoveCDC(true); err != nil {
+			t.Fatalf("cleanup run %d failed: %v", i+1, err)
+		}
+	}
+
+	for _, row := range d.query("SELECT type, name FROM sqlite_master WHERE type IN ('table', 'trigger')") {
+		if strings.HasPrefix(row[1].(string), MarmotPrefix) {
+			t.Fatalf("expected %s %s removed", row[0], row[1])
+		}
+	}
+
+	d.exec("INSERT INTO notes VALUES (1, 'kept')")
+	if d.count("books") != 1 || d.count("__marmot_notes") != 1 {
+		t.Fatal("expected user tables and triggers kept by cleanup")
+	}
+}
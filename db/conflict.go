@@ -0,0 +1,176 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/core"
+	"github.com/rs/zerolog/log"
+)
+
+const rowVersionName = "_row_versions"
+const rowVersionScript = `CREATE TABLE IF NOT EXISTS %s (
+    table_name TEXT NOT NULL,
+    row_key BLOB NOT NULL,
+    timestamp INTEGER NOT NULL,
+    node_id INTEGER NOT NULL,
+    PRIMARY KEY (table_name, row_key)
+)`
+const rowVersionUpsertQuery = `INSERT OR REPLACE INTO %s(table_name, row_key, timestamp, node_id) VALUES (?, ?, ?, ?)`
+const rowVersionLocalUpsertQuery = `INSERT INTO %[1]s(table_name, row_key, timestamp, node_id) VALUES (?, ?, ?, ?)
+ON CONFLICT(table_name, row_key) DO UPDATE SET timestamp = excluded.timestamp, node_id = excluded.node_id
+WHERE excluded.timestamp > %[1]s.timestamp OR (excluded.timestamp = %[1]s.timestamp AND (? OR excluded.node_id >= %[1]s.node_id))`
+
+// rowVersion is timestamp and origin node of last change applied to a row, kept after row
+// is deleted so late changes can't resurrect it.
+type rowVersion struct {
+	Timestamp uint64 `db:"timestamp"`
+	NodeID    uint64 `db:"node_id"`
+}
+
+// wins reports if change with given timestamp from given node supersedes current version.
+// Same change seen again (e.g. own change echoed back) always wins, re-applying it is a no-op.
+func (v *rowVersion) wins(timestamp uint64, nodeID uint64) bool {
+	if timestamp != v.Timestamp {
+		return timestamp > v.Timestamp
+	}
+
+	if nodeID == v.NodeID || cfg.Config.Replication.ConflictResolution != cfg.ConflictLWWNodeID {
+		return true
+	}
+
+	return nodeID > v.NodeID
+}
+
+func (conn *SqliteStreamDB) rowVersionTable() string {
+	return conn.prefix + rowVersionName
+}
+
+func (conn *SqliteStreamDB) initRowVersions() error {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	log.Info().Msg("Creating row version table")
+	_, err = sqlConn.DB().Exec(fmt.Sprintf(rowVersionScript, conn.rowVersionTable()))
+	return err
+}
+
+func (conn *SqliteStreamDB) rowKey(event *ChangeLogEvent) ([]byte, error) {
+	keyed := *event
+	keyed.tableInfo, _ = conn.tableColumns(event.TableName)
+	return keyed.PartitionKey()
+}
+
+// resolveConflict reports whether incoming change beats last change applied to same row
+// according to configured conflict resolution, recording its version when it does.
+// Changes without timestamp (published by older nodes) are applied as they arrive.
+func (conn *SqliteStreamDB) resolveConflict(tx *goqu.TxDatabase, fromNodeID uint64, event *ChangeLogEvent) (bool, error) {
+	if cfg.Config.Replication.ConflictResolution == cfg.ConflictNone || event.Timestamp == 0 {
+		return true, nil
+	}
+
+	key, err := conn.rowKey(event)
+	if err != nil {
+		return false, err
+	}
+
+	current := &rowVersion{}
+	found, err := tx.From(conn.rowVersionTable()).
+		Select("timestamp", "node_id").
+		Where(goqu.Ex{"table_name": event.TableName, "row_key": key}).
+		Prepared(true).
+		ScanStruct(current)
+	if err != nil {
+		return false, err
+	}
+
+	if found && !current.wins(event.Timestamp, fromNodeID) {
+		return false, nil
+	}
+
+	pending, err := conn.pendingLocalVersion(tx, event)
+	if err != nil {
+		return false, err
+	}
+
+	if pending != nil && !pending.wins(event.Timestamp, fromNodeID) {
+		return false, nil
+	}
+
+	_, err = tx.Exec(fmt.Sprintf(rowVersionUpsertQuery, conn.rowVersionTable()), event.TableName, key, event.Timestamp, fromNodeID)
+	return err == nil, err
+}
+
+// pendingLocalVersion returns version a local change of same row captured but not published
+// yet will be published with, versions of local changes are only recorded once published so
+// changes replicated in between have to be compared against change log.
+func (conn *SqliteStreamDB) pendingLocalVersion(tx *goqu.TxDatabase, event *ChangeLogEvent) (*rowVersion, error) {
+	columns, ok := conn.tableColumns(event.TableName)
+	if !ok {
+		return nil, nil
+	}
+
+	where := goqu.Ex{"state": Pending}
+	for _, col := range columns {
+		if col.IsPrimaryKey {
+			where["val_"+col.Name] = event.Row[col.Name]
+		}
+	}
+
+	var createdAt sql.NullInt64
+	_, err := tx.From(conn.metaTable(event.TableName, changeLogName)).
+		Select(goqu.MAX("created_at")).
+		Where(where).
+		Prepared(true).
+		ScanVal(&createdAt)
+	if err != nil || !createdAt.Valid {
+		return nil, err
+	}
+
+	timestamp := core.TimestampFromMillis(createdAt.Int64)
+
+	// Hybrid clock has observed incoming change already, so local change is stamped after it
+	if cfg.Config.Replication.Clock == cfg.ClockHLC && timestamp <= event.Timestamp {
+		timestamp = event.Timestamp + 1
+	}
+
+	return &rowVersion{Timestamp: timestamp, NodeID: cfg.Config.NodeID}, nil
+}
+
+// recordLocalVersions stores versions of changes captured locally, so changes replicated
+// later are compared against local writes too. Versions of remote changes applied while
+// local change was pending and that beat it are kept.
+func (conn *SqliteStreamDB) recordLocalVersions(events []*ChangeLogEvent) error {
+	if cfg.Config.Replication.ConflictResolution == cfg.ConflictNone || len(events) == 0 {
+		return nil
+	}
+
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	return sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		query := fmt.Sprintf(rowVersionLocalUpsertQuery, conn.rowVersionTable())
+		anyNodeWinsTie := cfg.Config.Replication.ConflictResolution != cfg.ConflictLWWNodeID
+		for _, event := range events {
+			key, err := conn.rowKey(event)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(query, event.TableName, key, event.Timestamp, cfg.Config.NodeID, anyNodeWinsTie)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/core"
+)
+
+type sourcedChange struct {
+	nodeID uint64
+	event  *ChangeLogEvent
+}
+
+func bookChange(nodeID uint64, timestamp uint64, changeType string, title string) sourcedChange {
+	return sourcedChange{
+		nodeID: nodeID,
+		event: &ChangeLogEvent{
+			Id:        int64(timestamp),
+			Type:      changeType,
+			TableName: "books",
+			Row:       map[string]any{"id": int64(1), "title": title, "version": int64(1)},
+			Timestamp: timestamp,
+		},
+	}
+}
+
+// convergedBooks applies changes in given order to a fresh replica and returns its books.
+func convergedBooks(t *testing.T, changes ...sourcedChange) [][]any {
+	replica := newTestDB(t, booksSchema)
+	for _, change := range changes {
+		if err := replica.Replicate(change.nodeID, change.event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return replica.query("SELECT id, title FROM books ORDER BY id")
+}
+
+func TestConflictResolutionConverges(t *testing.T) {
+	cases := []struct {
+		name     string
+		strategy string
+		a, b     sourcedChange
+		title    string
+	}{
+		{
+			name:     "newer timestamp wins",
+			strategy: cfg.ConflictLWW,
+			a:        bookChange(2, 100, "update", "older"),
+			b:        bookChange(1, 200, "update", "newer"),
+			title:    "newer",
+		},
+		{
+			name:     "higher node wins tie",
+			strategy: cfg.ConflictLWWNodeID,
+			a:        bookChange(1, 100, "update", "lower node"),
+			b:        bookChange(2, 100, "update", "higher node"),
+			title:    "higher node",
+		},
+		{
+			name:     "late update doesn't resurrect deleted row",
+			strategy: cfg.ConflictLWW,
+			a:        bookChange(1, 100, "update", "stale"),
+			b:        bookChange(2, 200, "delete", "deleted"),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := withConfig(t)
+			c.Replication.ConflictResolution = tc.strategy
+
+			forward := convergedBooks(t, tc.a, tc.b)
+			backward := convergedBooks(t, tc.b, tc.a)
+			if !reflect.DeepEqual(forward, backward) {
+				t.Fatalf("replicas diverged, got %v and %v", forward, backward)
+			}
+
+			if tc.title == "" && len(forward) != 0 {
+				t.Fatalf("expected row deleted, got %v", forward)
+			}
+
+			if tc.title != "" && (len(forward) != 1 || forward[0][1] != tc.title) {
+				t.Fatalf("expected %q to win, got %v", tc.title, forward)
+			}
+		})
+	}
+}
+
+func TestConflictResolutionDisabledAppliesInArrivalOrder(t *testing.T) {
+	withConfig(t).Replication.ConflictResolution = cfg.ConflictNone
+
+	older, newer := bookChange(2, 100, "update", "older"), bookChange(1, 200, "update", "newer")
+	if rows := convergedBooks(t, newer, older); len(rows) != 1 || rows[0][1] != "older" {
+		t.Fatalf("expected last arriving change applied, got %v", rows)
+	}
+}
+
+func TestRemoteChangeComparedAgainstUnpublishedLocalWrite(t *testing.T) {
+	withConfig(t).Replication.ConflictResolution = cfg.ConflictLWW
+
+	replica := newTestDB(t, booksSchema)
+	replica.exec("INSERT INTO books VALUES (1, 'local', 1)")
+
+	// Remote changes arrive after local write was captured but before it's published
+	now := uint64(time.Now().UnixMilli())
+	older := bookChange(2, core.TimestampFromMillis(int64(now)-10000), "update", "older")
+	if err := replica.Replicate(older.nodeID, older.event); err != nil {
+		t.Fatal(err)
+	}
+
+	if rows := replica.query("SELECT title FROM books WHERE id = 1"); rows[0][0] != "local" {
+		t.Fatalf("expected older remote change to lose against pending local write, got %v", rows)
+	}
+
+	newer := bookChange(2, core.TimestampFromMillis(int64(now)+10000), "update", "newer")
+	if err := replica.Replicate(newer.nodeID, newer.event); err != nil {
+		t.Fatal(err)
+	}
+
+	// Publishing local write must not record its version over newer remote change
+	replica.publish()
+	late := bookChange(2, core.TimestampFromMillis(int64(now)+5000), "update", "late")
+	if err := replica.Replicate(late.nodeID, late.event); err != nil {
+		t.Fatal(err)
+	}
+
+	if rows := replica.query("SELECT title FROM books WHERE id = 1"); rows[0][0] != "newer" {
+		t.Fatalf("expected newest remote change to win, got %v", rows)
+	}
+}
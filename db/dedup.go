@@ -0,0 +1,124 @@
+package db
+
+import (
+	"sync"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+)
+
+// appliedID identifies a change by origin node and change log row, creation time tells
+// apart rows reusing IDs once change logs are recreated.
+type appliedID struct {
+	nodeID    uint64
+	table     string
+	id        int64
+	createdAt int64
+}
+
+func newAppliedID(nodeID uint64, event *ChangeLogEvent) appliedID {
+	return appliedID{nodeID: nodeID, table: event.TableName, id: event.Id, createdAt: event.CreatedAt}
+}
+
+type appliedEntry struct {
+	key appliedID
+	at  time.Time
+}
+
+// appliedSet remembers recently applied changes so redelivered changes are skipped, it's
+// bounded either by number of IDs (ring policy) or by age of IDs (time policy). Any ID
+// within configured window is guaranteed to be remembered. Ring policy overwrites oldest
+// slot of a fixed size circular buffer, time policy evicts from head of entries and only
+// compacts them once evicted entries make up half of slice.
+type appliedSet struct {
+	lock    *sync.Mutex
+	ids     map[appliedID]struct{}
+	entries []appliedEntry
+	head    int
+	count   int
+	size    int
+	window  time.Duration
+}
+
+func newAppliedSet(c cfg.ReplicationConfiguration) *appliedSet {
+	s := &appliedSet{
+		lock: &sync.Mutex{},
+		ids:  map[appliedID]struct{}{},
+	}
+
+	switch c.DedupPolicy {
+	case cfg.DedupRing:
+		s.size = c.DedupWindow
+		s.entries = make([]appliedEntry, s.size)
+	case cfg.DedupTime:
+		s.window = time.Duration(c.DedupWindow) * time.Millisecond
+		s.entries = make([]appliedEntry, 0)
+	default:
+		return nil
+	}
+
+	return s
+}
+
+func (s *appliedSet) contains(nodeID uint64, event *ChangeLogEvent) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.expire(time.Now())
+	_, ok := s.ids[newAppliedID(nodeID, event)]
+	return ok
+}
+
+func (s *appliedSet) add(nodeID uint64, events []*ChangeLogEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	for _, event := range events {
+		key := newAppliedID(nodeID, event)
+		if _, ok := s.ids[key]; ok {
+			continue
+		}
+
+		s.ids[key] = struct{}{}
+		s.push(appliedEntry{key: key, at: now})
+	}
+
+	s.expire(now)
+}
+
+// push records entry, evicting oldest ID once ring is full.
+func (s *appliedSet) push(entry appliedEntry) {
+	if s.size == 0 {
+		s.entries = append(s.entries, entry)
+		return
+	}
+
+	if s.count < s.size {
+		s.entries[(s.head+s.count)%s.size] = entry
+		s.count++
+		return
+	}
+
+	delete(s.ids, s.entries[s.head].key)
+	s.entries[s.head] = entry
+	s.head = (s.head + 1) % s.size
+}
+
+// expire evicts IDs older than time window, entries are kept in insertion order.
+func (s *appliedSet) expire(now time.Time) {
+	if s.window == 0 {
+		return
+	}
+
+	for s.head < len(s.entries) && now.Sub(s.entries[s.head].at) > s.window {
+		delete(s.ids, s.entries[s.head].key)
+		s.entries[s.head] = appliedEntry{}
+		s.head++
+	}
+
+	if s.head > 0 && s.head >= len(s.entries)/2 {
+		s.entries = append(s.entries[:0], s.entries[s.head:]...)
+		s.head = 0
+	}
+}
@@ -0,0 +1,162 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+)
+
+// redelivered applies event of book id again after row was changed locally, returns true if
+// it was deduplicated and local change survived.
+func (d *testDB) redelivered(event *ChangeLogEvent, id int) bool {
+	d.t.Helper()
+
+	if _, err := d.app.Exec("UPDATE books SET title = 'local' WHERE id = ?", id); err != nil {
+		d.t.Fatal(err)
+	}
+
+	if err := d.Replicate(remoteNodeID, event); err != nil {
+		d.t.Fatal(err)
+	}
+
+	return d.query("SELECT title FROM books WHERE id = ?", id)[0][0] == "local"
+}
+
+func TestRingDedupWindow(t *testing.T) {
+	c := withConfig(t)
+	c.Replication.DedupPolicy = cfg.DedupRing
+	c.Replication.DedupWindow = 2
+
+	source := newTestDB(t, booksSchema)
+	replica := newTestDB(t, booksSchema)
+	source.exec(
+		"INSERT INTO books VALUES (1, 'a', 1)",
+		"INSERT INTO books VALUES (2, 'b', 1)",
+		"INSERT INTO books VALUES (3, 'c', 1)",
+	)
+	events := source.publish()
+	for _, event := range events {
+		if err := replica.Replicate(remoteNodeID, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !replica.redelivered(events[2], 3) {
+		t.Fatal("expected change within window to be deduplicated")
+	}
+
+	if replica.redelivered(events[0], 1) {
+		t.Fatal("expected change outside window to be applied again")
+	}
+}
+
+func TestTimeDedupWindow(t *testing.T) {
+	c := withConfig(t)
+	c.Replication.DedupPolicy = cfg.DedupTime
+	c.Replication.DedupWindow = 200
+
+	source := newTestDB(t, booksSchema)
+	replica := newTestDB(t, booksSchema)
+	source.exec("INSERT INTO books VALUES (1, 'a', 1)")
+	events := source.publish()
+	if err := replica.Replicate(remoteNodeID, events[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if !replica.redelivered(events[0], 1) {
+		t.Fatal("expected change within window to be deduplicated")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if replica.redelivered(events[0], 1) {
+		t.Fatal("expected change outside window to be applied again")
+	}
+}
+
+func TestDedupTellsApartRecreatedChangeLogRows(t *testing.T) {
+	c := withConfig(t)
+	c.Replication.DedupPolicy = cfg.DedupRing
+	c.Replication.DedupWindow = 16
+
+	source := newTestDB(t, booksSchema)
+	replica := newTestDB(t, booksSchema)
+	source.exec("INSERT INTO books VALUES (1, 'a', 1)")
+	events := source.publish()
+	if err := replica.Replicate(remoteNodeID, events[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if events[0].CreatedAt == 0 {
+		t.Fatal("expected creation time of change log row to be replicated")
+	}
+
+	// Change log row ID reused once change logs are recreated
+	reused := *events[0]
+	reused.CreatedAt++
+	if replica.redelivered(&reused, 1) {
+		t.Fatal("expected change with reused ID but different creation time to be applied")
+	}
+}
+
+func TestDedupedBatchRecordsStreamPosition(t *testing.T) {
+	c := withConfig(t)
+	c.Replication.DedupPolicy = cfg.DedupRing
+	c.Replication.DedupWindow = 16
+
+	source := newTestDB(t, booksSchema)
+	replica := newTestDB(t, booksSchema)
+	source.exec("INSERT INTO books VALUES (1, 'a', 1)")
+	events := source.publish()
+
+	if err := replica.ReplicateBatch(remoteNodeID, events, StreamPosition{Stream: "books", Seq: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same change redelivered under a later sequence, e.g. published again after a crash
+	if err := replica.ReplicateBatch(remoteNodeID, events, StreamPosition{Stream: "books", Seq: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	seq, err := replica.AppliedSeq("books")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seq != 5 {
+		t.Fatalf("expected applied sequence to move past deduplicated batch, got %d", seq)
+	}
+}
+
+func TestAppliedSetEvictsOldest(t *testing.T) {
+	ring := newAppliedSet(cfg.ReplicationConfiguration{DedupPolicy: cfg.DedupRing, DedupWindow: 3})
+	events := make([]*ChangeLogEvent, 0)
+	for i := int64(1); i <= 7; i++ {
+		event := &ChangeLogEvent{Id: i, TableName: "books"}
+		events = append(events, event)
+		ring.add(remoteNodeID, []*ChangeLogEvent{event})
+	}
+
+	for i, event := range events {
+		if ring.contains(remoteNodeID, event) != (i >= 4) {
+			t.Errorf("expected only last 3 changes in ring, change %d contained: %v", event.Id, !(i >= 4))
+		}
+	}
+
+	if len(ring.ids) != 3 || len(ring.entries) != 3 {
+		t.Fatalf("expected ring to stay at 3 entries, got %d IDs in %d entries", len(ring.ids), len(ring.entries))
+	}
+
+	window := newAppliedSet(cfg.ReplicationConfiguration{DedupPolicy: cfg.DedupTime, DedupWindow: 50})
+	window.add(remoteNodeID, events[:4])
+	time.Sleep(100 * time.Millisecond)
+	window.add(remoteNodeID, events[4:])
+
+	if window.contains(remoteNodeID, events[0]) || !window.contains(remoteNodeID, events[6]) {
+		t.Fatal("expected only changes within time window to be contained")
+	}
+
+	if len(window.entries)-window.head != 3 {
+		t.Fatalf("expected 3 live entries, got %d", len(window.entries)-window.head)
+	}
+}
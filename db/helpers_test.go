@@ -0,0 +1,225 @@
+package db
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/core"
+	"github.com/rs/zerolog"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	os.Exit(m.Run())
+}
+
+// testDB is a stream database on a fresh file, writes through app connection are captured
+// like writes of any application sharing the database.
+type testDB struct {
+	*SqliteStreamDB
+	t   testing.TB
+	app *sql.DB
+
+	lock    *sync.Mutex
+	changes []*ChangeLogEvent
+	batches [][]*ChangeLogEvent
+}
+
+func newTestDB(t testing.TB, schema ...string) *testDB {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "marmot.db")
+	app, err := sql.Open("sqlite3", journalDSN(path)+"&_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.Close() })
+
+	for _, stmt := range schema {
+		if _, err := app.Exec(stmt); err != nil {
+			t.Fatalf("unable to create schema %q: %v", stmt, err)
+		}
+	}
+
+	streamDB, err := OpenStreamDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret := &testDB{SqliteStreamDB: streamDB, t: t, app: app, lock: &sync.Mutex{}}
+	streamDB.OnChange = func(event *ChangeLogEvent) error {
+		ret.lock.Lock()
+		defer ret.lock.Unlock()
+
+		ret.changes = append(ret.changes, event)
+		return nil
+	}
+
+	tables, err := GetAllDBTables(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := streamDB.installCDC(tables); err != nil {
+		t.Fatal(err)
+	}
+
+	return ret
+}
+
+// exec runs statements as application, all in one transaction.
+func (d *testDB) exec(stmts ...string) {
+	d.t.Helper()
+
+	tx, err := d.app.Begin()
+	if err != nil {
+		d.t.Fatal(err)
+	}
+
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			d.t.Fatalf("unable to execute %q: %v", stmt, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		d.t.Fatal(err)
+	}
+}
+
+// publish scans change log and returns captured events as replicas receive them.
+func (d *testDB) publish() []*ChangeLogEvent {
+	d.t.Helper()
+
+	d.publishChangeLog()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	ret := make([]*ChangeLogEvent, 0, len(d.changes))
+	for _, event := range d.changes {
+		ret = append(ret, roundTrip(d.t, event))
+	}
+
+	d.changes = nil
+	return ret
+}
+
+// publishBatches enables batch publishing and returns published batches as replicas receive them.
+func (d *testDB) publishBatches() [][]*ChangeLogEvent {
+	d.t.Helper()
+
+	d.OnChangeBatch = func(events []*ChangeLogEvent) error {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+
+		d.batches = append(d.batches, events)
+		return nil
+	}
+	d.publishChangeLog()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	ret := make([][]*ChangeLogEvent, 0, len(d.batches))
+	for _, batch := range d.batches {
+		events := make([]*ChangeLogEvent, 0, len(batch))
+		for _, event := range batch {
+			events = append(events, roundTrip(d.t, event))
+		}
+
+		ret = append(ret, events)
+	}
+
+	d.batches = nil
+	return ret
+}
+
+func (d *testDB) query(query string, args ...any) [][]any {
+	d.t.Helper()
+
+	rows, err := d.app.Query(query, args...)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		d.t.Fatal(err)
+	}
+
+	ret := make([][]any, 0)
+	for rows.Next() {
+		values := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+
+		if err := rows.Scan(ptrs...); err != nil {
+			d.t.Fatal(err)
+		}
+
+		ret = append(ret, values)
+	}
+
+	return ret
+}
+
+func (d *testDB) count(table string) int64 {
+	d.t.Helper()
+
+	cnt := int64(0)
+	if err := d.app.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&cnt); err != nil {
+		d.t.Fatal(err)
+	}
+
+	return cnt
+}
+
+// roundTrip encodes and decodes event the way it travels over NATS.
+func roundTrip(t testing.TB, event *ChangeLogEvent) *ChangeLogEvent {
+	t.Helper()
+
+	em, err := cbor.EncOptions{}.EncModeWithTags(core.CBORTags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dm, err := cbor.DecOptions{}.DecModeWithTags(core.CBORTags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, _ := event.Wrap()
+	data, err := em.Marshal(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := ChangeLogEvent{}
+	if err := dm.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	ret, _ := decoded.Unwrap()
+	return &ret
+}
+
+// withConfig restores configuration once test finishes, tests must replace maps and slices
+// of configuration instead of modifying them in place.
+func withConfig(t testing.TB) *cfg.Configuration {
+	saved := *cfg.Config
+	t.Cleanup(func() {
+		*cfg.Config = saved
+	})
+
+	return cfg.Config
+}
@@ -0,0 +1,166 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/maxpert/marmot/cfg"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+)
+
+const idMapName = "_id_map"
+const idMapScript = `CREATE TABLE IF NOT EXISTS %s (
+    table_name TEXT NOT NULL,
+    node_id INTEGER NOT NULL,
+    remote_id INTEGER NOT NULL,
+    local_id INTEGER NOT NULL,
+    PRIMARY KEY (table_name, node_id, remote_id)
+)`
+
+var ErrRemapNotSupported = errors.New("id remapping requires a single integer primary key")
+
+// idRemapper translates primary key of incoming rows into locally assigned IDs so
+// they don't collide with rows inserted locally, mappings are persisted per origin
+// node. Columns referencing remapped tables are translated using same mappings.
+type idRemapper struct {
+	table      string
+	pk         string
+	references map[string]string
+}
+
+func newIDRemapper(tableName string, columns []*ColumnInfo, tableCfg cfg.TableConfiguration) (*idRemapper, error) {
+	pkColumns := lo.Filter(columns, func(c *ColumnInfo, _ int) bool {
+		return c.IsPrimaryKey
+	})
+
+	if len(pkColumns) != 1 || !strings.Contains(strings.ToUpper(pkColumns[0].Type), "INT") {
+		return nil, fmt.Errorf("%w: %s", ErrRemapNotSupported, tableName)
+	}
+
+	references := tableCfg.RemapReferences
+	if references == nil {
+		references = map[string]string{}
+	}
+
+	return &idRemapper{
+		table:      tableName,
+		pk:         pkColumns[0].Name,
+		references: references,
+	}, nil
+}
+
+func (conn *SqliteStreamDB) idMapTable() string {
+	return conn.prefix + idMapName
+}
+
+func (conn *SqliteStreamDB) initIDMap() error {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	log.Info().Msg("Creating ID map table")
+	_, err = sqlConn.DB().Exec(fmt.Sprintf(idMapScript, conn.idMapTable()))
+	return err
+}
+
+// remap rewrites event row in place using local IDs, returns true if event was
+// fully applied by remapper and must not be applied again.
+func (r *idRemapper) remap(tx *goqu.TxDatabase, mapTable string, nodeID uint64, event *ChangeLogEvent) (bool, error) {
+	for col, refTable := range r.references {
+		val, ok := event.Row[col]
+		if !ok || val == nil {
+			continue
+		}
+
+		localID, found, err := lookupLocalID(tx, mapTable, refTable, nodeID, val)
+		if err != nil {
+			return false, err
+		}
+
+		if found {
+			event.Row[col] = localID
+		}
+	}
+
+	remoteID := event.Row[r.pk]
+	localID, found, err := lookupLocalID(tx, mapTable, r.table, nodeID, remoteID)
+	if err != nil {
+		return false, err
+	}
+
+	if found {
+		event.Row[r.pk] = localID
+		if event.Type != "delete" {
+			return false, nil
+		}
+
+		_, err = tx.Delete(mapTable).
+			Where(goqu.Ex{"table_name": r.table, "node_id": nodeID, "remote_id": remoteID}).
+			Prepared(true).
+			Executor().
+			Exec()
+		return false, err
+	}
+
+	// Row was never replicated here, so there is nothing to delete
+	if event.Type == "delete" {
+		return true, nil
+	}
+
+	record := goqu.Record{}
+	for k, v := range event.Row {
+		if k != r.pk {
+			record[k] = v
+		}
+	}
+
+	rs, err := tx.Insert(r.table).Rows(record).Prepared(true).Executor().Exec()
+	if err != nil {
+		return false, err
+	}
+
+	newID, err := rs.LastInsertId()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Insert(mapTable).
+		Rows(goqu.Record{
+			"table_name": r.table,
+			"node_id":    nodeID,
+			"remote_id":  remoteID,
+			"local_id":   newID,
+		}).
+		Prepared(true).
+		Executor().
+		Exec()
+	if err != nil {
+		return false, err
+	}
+
+	log.Debug().
+		Str("table", r.table).
+		Uint64("node_id", nodeID).
+		Any("remote_id", remoteID).
+		Int64("local_id", newID).
+		Msg("Remapped replicated row ID")
+
+	event.Row[r.pk] = newID
+	return true, nil
+}
+
+func lookupLocalID(tx *goqu.TxDatabase, mapTable, table string, nodeID uint64, remoteID any) (int64, bool, error) {
+	localID := int64(0)
+	found, err := tx.From(mapTable).
+		Select("local_id").
+		Where(goqu.Ex{"table_name": table, "node_id": nodeID, "remote_id": remoteID}).
+		Prepared(true).
+		ScanVal(&localID)
+
+	return localID, found, err
+}
@@ -0,0 +1,62 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/maxpert/marmot/cfg"
+)
+
+func TestRemappedIDsKeepReferences(t *testing.T) {
+	c := withConfig(t)
+	c.Replication.Tables = map[string]cfg.TableConfiguration{
+		"authors": {RemapIDs: true},
+		"books":   {RemapIDs: true, RemapReferences: map[string]string{"author_id": "authors"}},
+	}
+
+	schema := []string{
+		"CREATE TABLE authors(id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT)",
+		"CREATE TABLE books(id INTEGER PRIMARY KEY AUTOINCREMENT, author_id INTEGER REFERENCES authors(id), title TEXT)",
+	}
+	source := newTestDB(t, schema...)
+	replica := newTestDB(t, schema...)
+
+	// Local rows take same IDs as rows inserted on source
+	replica.exec(
+		"INSERT INTO authors VALUES (1, 'austen')",
+		"INSERT INTO books VALUES (1, 1, 'emma')",
+	)
+	replica.publish()
+
+	source.exec(
+		"INSERT INTO authors VALUES (1, 'herbert')",
+		"INSERT INTO books VALUES (1, 1, 'dune')",
+	)
+	source.exec("UPDATE books SET title = 'dune messiah' WHERE id = 1")
+	for _, event := range source.publish() {
+		if err := replica.Replicate(remoteNodeID, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows := replica.query("SELECT a.id, a.name, b.id, b.title FROM books b JOIN authors a ON a.id = b.author_id ORDER BY b.id")
+	expected := [][]any{
+		{int64(1), "austen", int64(1), "emma"},
+		{int64(2), "herbert", int64(2), "dune messiah"},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("expected remapped rows next to local rows with consistent references, got %v", rows)
+	}
+
+	source.exec("DELETE FROM books WHERE id = 1")
+	for _, event := range source.publish() {
+		if err := replica.Replicate(remoteNodeID, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows = replica.query("SELECT id, title FROM books")
+	if len(rows) != 1 || rows[0][1] != "emma" {
+		t.Fatalf("expected only remapped row to be deleted, got %v", rows)
+	}
+}
@@ -0,0 +1,45 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/maxpert/marmot/cfg"
+)
+
+func TestJournalModeConfigured(t *testing.T) {
+	c := withConfig(t)
+	c.JournalMode = cfg.JournalModeTruncate
+	source := newTestDB(t, booksSchema)
+	replica := newTestDB(t, booksSchema)
+
+	for _, d := range []*testDB{source, replica} {
+		err := d.WithReadTx(func(tx *sql.Tx) error {
+			mode := ""
+			if err := tx.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+				return err
+			}
+
+			if !strings.EqualFold(mode, cfg.JournalModeTruncate) {
+				t.Errorf("expected journal mode %s, got %s", cfg.JournalModeTruncate, mode)
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	source.exec("INSERT INTO books VALUES (1, 'dune', 1)")
+	source.exec("UPDATE books SET title = 'dune messiah' WHERE id = 1")
+	if err := replica.ReplicateBatch(remoteNodeID, source.publish(), StreamPosition{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := replica.query("SELECT title FROM books WHERE id = 1")
+	if len(rows) != 1 || rows[0][0] != "dune messiah" {
+		t.Fatalf("expected changes replicated with truncate journal, got %v", rows)
+	}
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+const autoVacuumIncremental = 2
+
+// IncrementalVacuum releases free pages back to file system once number of free pages
+// exceeds threshold. Database must be using incremental auto vacuum, otherwise it's a
+// no-op. Returns number of pages released, concurrent calls are skipped.
+func (conn *SqliteStreamDB) IncrementalVacuum(threshold int64) (int64, error) {
+	if !conn.maintenanceLock.TryLock() {
+		return 0, nil
+	}
+	defer conn.maintenanceLock.Unlock()
+
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return 0, err
+	}
+	defer sqlConn.Return()
+
+	autoVacuum := int64(0)
+	err = sqlConn.DB().QueryRow("PRAGMA auto_vacuum;").Scan(&autoVacuum)
+	if err != nil {
+		return 0, err
+	}
+
+	if autoVacuum != autoVacuumIncremental {
+		log.Warn().
+			Int64("auto_vacuum", autoVacuum).
+			Msg("Incremental vacuum requires PRAGMA auto_vacuum=INCREMENTAL followed by a VACUUM, skipping")
+		return 0, nil
+	}
+
+	freePages := int64(0)
+	err = sqlConn.DB().QueryRow("PRAGMA freelist_count;").Scan(&freePages)
+	if err != nil {
+		return 0, err
+	}
+
+	conn.stats.freePages.Set(float64(freePages))
+	if freePages <= threshold {
+		return 0, nil
+	}
+
+	log.Info().
+		Int64("free_pages", freePages).
+		Int64("threshold", threshold).
+		Msg("Free pages exceed threshold, running incremental vacuum")
+
+	// Every freed page is a step of the statement, so rows have to be drained
+	rows, err := sqlConn.DB().Query("PRAGMA incremental_vacuum;")
+	if err != nil {
+		return 0, err
+	}
+
+	for rows.Next() {
+	}
+
+	if err = rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	remaining := int64(0)
+	err = sqlConn.DB().QueryRow("PRAGMA freelist_count;").Scan(&remaining)
+	if err != nil {
+		return 0, err
+	}
+
+	conn.stats.freePages.Set(float64(remaining))
+	return freePages - remaining, nil
+}
+
+// Checkpoint forces WAL checkpoint flushing all committed changes into main database file.
+func (conn *SqliteStreamDB) Checkpoint() error {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	return performCheckpoint(sqlConn.DB())
+}
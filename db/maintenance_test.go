@@ -0,0 +1,61 @@
+package db
+
+import "testing"
+
+func TestIncrementalVacuumThreshold(t *testing.T) {
+	d := newTestDB(
+		t,
+		"PRAGMA auto_vacuum = INCREMENTAL",
+		"VACUUM",
+		"CREATE TABLE blobs(id INTEGER PRIMARY KEY, data BLOB)",
+	)
+
+	for i := 0; i < 50; i++ {
+		d.exec("INSERT INTO blobs(data) VALUES (randomblob(16384))")
+	}
+	d.exec("DELETE FROM blobs")
+
+	free := d.query("PRAGMA freelist_count")[0][0].(int64)
+	if free == 0 {
+		t.Fatal("expected free pages after delete")
+	}
+
+	released, err := d.IncrementalVacuum(free)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if released != 0 {
+		t.Fatalf("expected no vacuum while free pages don't exceed threshold, released %d", released)
+	}
+
+	released, err = d.IncrementalVacuum(free - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if released != free {
+		t.Fatalf("expected all %d free pages released, released %d", free, released)
+	}
+
+	if remaining := d.query("PRAGMA freelist_count")[0][0].(int64); remaining != 0 {
+		t.Fatalf("expected no free pages left, got %d", remaining)
+	}
+}
+
+func TestIncrementalVacuumSkippedWithoutAutoVacuum(t *testing.T) {
+	d := newTestDB(t, "CREATE TABLE blobs(id INTEGER PRIMARY KEY, data BLOB)")
+	for i := 0; i < 10; i++ {
+		d.exec("INSERT INTO blobs(data) VALUES (randomblob(16384))")
+	}
+	d.exec("DELETE FROM blobs")
+
+	released, err := d.IncrementalVacuum(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if released != 0 {
+		t.Fatalf("expected vacuum to be skipped, released %d", released)
+	}
+}
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/rs/zerolog/log"
+)
+
+const orphanGlobalChangesQuery = `SELECT g.id FROM %[1]s g
+LEFT JOIN %[2]s t ON t.id = g.change_table_id
+WHERE g.table_name = ? AND t.id IS NULL`
+
+const unlinkedPendingChangesQuery = `SELECT t.id FROM %[2]s t
+WHERE t.state = ? AND NOT EXISTS (
+    SELECT 1 FROM %[1]s g WHERE g.table_name = ? AND g.change_table_id = t.id
+)
+ORDER BY t.id ASC`
+
+// RepairReport lists change log inconsistencies found for a table. Orphaned global changes
+// point at change log rows that no longer exist and would crash publishing, they can't be
+// recovered and are removed. Unlinked pending changes are missing from global change log
+// and would never be published, they're linked back preserving their order.
+type RepairReport struct {
+	Table           string
+	OrphanedGlobal  int
+	UnlinkedPending int
+}
+
+// RepairChangeLogs checks consistency between global change log and per table change logs,
+// only reporting findings unless fix is set. It's safe to run on a stopped node.
+func (conn *SqliteStreamDB) RepairChangeLogs(fix bool) ([]*RepairReport, error) {
+	tables, err := conn.ChangeLogTables()
+	if err != nil {
+		return nil, err
+	}
+
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return nil, err
+	}
+	defer sqlConn.Return()
+
+	// Nothing to check if CDC was never installed
+	installed, err := sqlConn.DB().From("sqlite_master").
+		Select("name").
+		Where(goqu.C("type").Eq("table"), goqu.C("name").Eq(conn.globalMetaTable())).
+		Prepared(true).
+		ScanVal(new(string))
+	if err != nil || !installed {
+		return []*RepairReport{}, err
+	}
+
+	reports := make([]*RepairReport, 0, len(tables)+1)
+	err = sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		orphanTables, err := conn.repairUnknownTables(tx, tables, fix)
+		if err != nil {
+			return err
+		}
+
+		reports = append(reports, orphanTables...)
+		for _, table := range tables {
+			report, err := conn.repairTable(tx, table, fix)
+			if err != nil {
+				return err
+			}
+
+			reports = append(reports, report)
+		}
+
+		return nil
+	})
+
+	return reports, err
+}
+
+func (conn *SqliteStreamDB) repairTable(tx *goqu.TxDatabase, table string, fix bool) (*RepairReport, error) {
+	globalTable := conn.globalMetaTable()
+	logTable := conn.metaTable(table, changeLogName)
+
+	orphans := make([]int64, 0)
+	err := tx.ScanVals(&orphans, fmt.Sprintf(orphanGlobalChangesQuery, globalTable, logTable), table)
+	if err != nil {
+		return nil, err
+	}
+
+	unlinked := make([]int64, 0)
+	err = tx.ScanVals(&unlinked, fmt.Sprintf(unlinkedPendingChangesQuery, globalTable, logTable), Pending, table)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RepairReport{Table: table, OrphanedGlobal: len(orphans), UnlinkedPending: len(unlinked)}
+	if !fix {
+		return report, nil
+	}
+
+	if len(orphans) != 0 {
+		_, err = tx.Delete(globalTable).Where(goqu.C("id").In(orphans)).Prepared(true).Executor().Exec()
+		if err != nil {
+			return nil, err
+		}
+
+		log.Warn().Str("table", table).Int("count", len(orphans)).Msg("Removed orphaned global changes")
+	}
+
+	for _, id := range unlinked {
+		_, err = tx.Insert(globalTable).
+			Rows(goqu.Record{"change_table_id": id, "table_name": table}).
+			Prepared(true).
+			Executor().
+			Exec()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(unlinked) != 0 {
+		log.Info().Str("table", table).Int("count", len(unlinked)).Msg("Linked pending changes to global change log")
+	}
+
+	return report, nil
+}
+
+// repairUnknownTables handles global changes of tables whose change log table is gone.
+func (conn *SqliteStreamDB) repairUnknownTables(tx *goqu.TxDatabase, tables []string, fix bool) ([]*RepairReport, error) {
+	where := goqu.C("table_name").NotIn(tables)
+	if len(tables) == 0 {
+		where = goqu.C("table_name").IsNotNull()
+	}
+
+	type unknownTable struct {
+		Name  string `db:"table_name"`
+		Count int    `db:"cnt"`
+	}
+
+	unknown := make([]unknownTable, 0)
+	err := tx.From(conn.globalMetaTable()).
+		Select(goqu.C("table_name"), goqu.COUNT("*").As("cnt")).
+		Where(where).
+		GroupBy(goqu.C("table_name")).
+		Prepared(true).
+		ScanStructs(&unknown)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]*RepairReport, 0, len(unknown))
+	for _, u := range unknown {
+		reports = append(reports, &RepairReport{Table: u.Name, OrphanedGlobal: u.Count})
+	}
+
+	if !fix || len(unknown) == 0 {
+		return reports, nil
+	}
+
+	_, err = tx.Delete(conn.globalMetaTable()).Where(where).Prepared(true).Executor().Exec()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Warn().Int("tables", len(unknown)).Msg("Removed global changes of tables without change log")
+	return reports, nil
+}
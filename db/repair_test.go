@@ -0,0 +1,48 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRepairFixesChangeLogInconsistency(t *testing.T) {
+	source := newTestDB(t, booksSchema)
+	source.exec(
+		"INSERT INTO books VALUES (1, 'dune', 1)",
+		"INSERT INTO books VALUES (2, 'emma', 1)",
+		"INSERT INTO books VALUES (3, 'ulysses', 1)",
+	)
+
+	// Simulate crash leaving second change out of global change log and global change of
+	// third one pointing at a missing row
+	logTable := source.metaTable("books", changeLogName)
+	source.exec(
+		fmt.Sprintf("DELETE FROM %s WHERE change_table_id = (SELECT id FROM %s WHERE val_id = 2)", source.globalMetaTable(), logTable),
+		fmt.Sprintf("DELETE FROM %s WHERE val_id = 3", logTable),
+	)
+
+	for _, fix := range []bool{false, true} {
+		reports, err := source.RepairChangeLogs(fix)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(reports) != 1 || reports[0].OrphanedGlobal != 1 || reports[0].UnlinkedPending != 1 {
+			t.Fatalf("expected one orphaned and one unlinked change reported (fix=%v), got %+v", fix, reports)
+		}
+	}
+
+	reports, err := source.RepairChangeLogs(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reports[0].OrphanedGlobal != 0 || reports[0].UnlinkedPending != 0 {
+		t.Fatalf("expected consistent change log after repair, got %+v", reports[0])
+	}
+
+	events := source.publish()
+	if len(events) != 2 || events[0].Row["title"] != "dune" || events[1].Row["title"] != "emma" {
+		t.Fatalf("expected both remaining changes published in order, got %d changes", len(events))
+	}
+}
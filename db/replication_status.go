@@ -0,0 +1,113 @@
+package db
+
+import (
+	"sync"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/maxpert/marmot/cfg"
+)
+
+// TableStatus is where replication of a table stands on this node. Published is last
+// position a local change of table was published at, Applied is last position a change of
+// table from each peer was applied from, and Pending is number of local changes not yet
+// published.
+type TableStatus struct {
+	Table     string                    `json:"table"`
+	Published *StreamPosition           `json:"published,omitempty"`
+	Applied   map[uint64]StreamPosition `json:"applied"`
+	Pending   int64                     `json:"pending"`
+}
+
+type replicationStatus struct {
+	lock      *sync.Mutex
+	published map[string]StreamPosition
+	applied   map[string]map[uint64]StreamPosition
+}
+
+func newReplicationStatus() *replicationStatus {
+	return &replicationStatus{
+		lock:      &sync.Mutex{},
+		published: map[string]StreamPosition{},
+		applied:   map[string]map[uint64]StreamPosition{},
+	}
+}
+
+func (s *replicationStatus) recordApplied(fromNodeID uint64, pos StreamPosition, events []*ChangeLogEvent) {
+	if pos.Stream == "" || fromNodeID == cfg.Config.NodeID {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, event := range events {
+		peers, ok := s.applied[event.TableName]
+		if !ok {
+			peers = map[uint64]StreamPosition{}
+			s.applied[event.TableName] = peers
+		}
+
+		peers[fromNodeID] = pos
+	}
+}
+
+// RecordPublished saves position local change of table was published at.
+func (conn *SqliteStreamDB) RecordPublished(table string, pos StreamPosition) {
+	conn.status.lock.Lock()
+	defer conn.status.lock.Unlock()
+
+	if pos.Seq > conn.status.published[table].Seq {
+		conn.status.published[table] = pos
+	}
+}
+
+// Status returns replication status of every captured table as one snapshot. Positions are
+// copied and pending changes counted within a single read transaction while holding status
+// lock, so no publish or apply is recorded in between and counts of all tables are taken at
+// same point of change logs. A published change stays pending until its change log row is
+// marked published right after its position is recorded, so it may briefly be counted as
+// pending while already covered by Published, but is never missing from both.
+func (conn *SqliteStreamDB) Status() ([]*TableStatus, error) {
+	tables := conn.ReplicatedTables()
+	ret := make([]*TableStatus, 0, len(tables))
+
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return nil, err
+	}
+	defer sqlConn.Return()
+
+	conn.status.lock.Lock()
+	defer conn.status.lock.Unlock()
+
+	err = sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		for _, table := range tables {
+			status := &TableStatus{Table: table, Applied: map[uint64]StreamPosition{}}
+			if pos, ok := conn.status.published[table]; ok {
+				status.Published = &pos
+			}
+
+			for nodeID, pos := range conn.status.applied[table] {
+				status.Applied[nodeID] = pos
+			}
+
+			pending, err := tx.From(conn.metaTable(table, changeLogName)).
+				Where(goqu.C("state").Eq(Pending)).
+				Prepared(true).
+				Count()
+			if err != nil {
+				return err
+			}
+
+			status.Pending = pending
+			ret = append(ret, status)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,45 @@
+package db
+
+import "testing"
+
+func TestStatusCountsChangePendingUntilMarkedPublished(t *testing.T) {
+	source := newTestDB(t, booksSchema)
+	source.exec("INSERT INTO books VALUES (1, 'a', 1)", "INSERT INTO books VALUES (2, 'b', 1)")
+
+	status, err := source.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(status) != 1 || status[0].Pending != 2 || status[0].Published != nil {
+		t.Fatalf("expected 2 pending unpublished changes, got %+v", status[0])
+	}
+
+	seq := uint64(0)
+	source.OnChange = func(event *ChangeLogEvent) error {
+		seq++
+		source.RecordPublished(event.TableName, StreamPosition{Stream: "marmot-changes-1", Seq: seq})
+
+		status, err := source.Status()
+		if err != nil {
+			return err
+		}
+
+		// Change is recorded published before its change log row is marked published
+		if status[0].Published.Seq != seq || status[0].Pending != int64(3-seq) {
+			t.Errorf("expected change %d published and still pending, got %+v", seq, status[0])
+		}
+
+		return nil
+	}
+	source.publishChangeLog()
+
+	status, err = source.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status[0].Pending != 0 || status[0].Published.Seq != 2 {
+		t.Fatalf("expected no pending changes once published, got %+v", status[0])
+	}
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/maxpert/marmot/core"
+	"github.com/rs/zerolog/log"
+)
+
+const writeGuardName = "write_guard"
+const writeGuardTriggerScript = `CREATE TRIGGER IF NOT EXISTS %s
+BEFORE %s ON %s
+WHEN (SELECT COUNT(*) FROM pragma_function_list WHERE name='marmot_version') < 1
+BEGIN
+    SELECT RAISE(ABORT, 'marmot replica is read-only');
+END;`
+
+var ErrNotReplica = errors.New("node is not a replica")
+
+var writeGuardOperations = []string{"insert", "update", "delete"}
+
+// IsReplica reports whether node is running as read-only replica, replicas reject local
+// writes and never publish changes.
+func (conn *SqliteStreamDB) IsReplica() bool {
+	return atomic.LoadInt32(&conn.replica) != 0
+}
+
+// DemoteToReplica installs write guard rejecting all local writes on watched tables,
+// replicated changes are still applied.
+func (conn *SqliteStreamDB) DemoteToReplica() error {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	for _, tableName := range conn.ReplicatedTables() {
+		if err = conn.execWriteGuard(sqlConn.DB(), tableName); err != nil {
+			return err
+		}
+	}
+
+	atomic.StoreInt32(&conn.replica, 1)
+	log.Info().Msg("Running as replica, local writes will be rejected")
+	return nil
+}
+
+func (conn *SqliteStreamDB) installWriteGuard(tableName string) error {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	return conn.execWriteGuard(sqlConn.DB(), tableName)
+}
+
+func (conn *SqliteStreamDB) execWriteGuard(gSQL *goqu.Database, tableName string) error {
+	for _, op := range writeGuardOperations {
+		script := fmt.Sprintf(writeGuardTriggerScript, conn.writeGuardTrigger(tableName, op), op, tableName)
+		if _, err := gSQL.Exec(script); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Promote removes write guard so that node accepts and publishes local writes again.
+func (conn *SqliteStreamDB) Promote() error {
+	if !conn.IsReplica() {
+		return ErrNotReplica
+	}
+
+	err := conn.removeWriteGuard()
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&conn.replica, 0)
+	core.PublishLifecycle(core.RolePromoted, nil)
+	log.Info().Msg("Promoted to primary, accepting local writes")
+	return nil
+}
+
+func (conn *SqliteStreamDB) removeWriteGuard() error {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	for _, tableName := range conn.ReplicatedTables() {
+		for _, op := range writeGuardOperations {
+			query := fmt.Sprintf(deleteTriggerQuery, conn.writeGuardTrigger(tableName, op))
+			if _, err = sqlConn.DB().Exec(query); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (conn *SqliteStreamDB) writeGuardTrigger(tableName, op string) string {
+	return conn.prefix + tableName + "_" + writeGuardName + "_on_" + op
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/maxpert/marmot/cfg"
+)
+
+func TestReplicaRejectsLocalWritesUntilPromoted(t *testing.T) {
+	c := withConfig(t)
+	source := newTestDB(t, booksSchema)
+	c.Role = cfg.RoleReplica
+	replica := newTestDB(t, booksSchema)
+
+	if !replica.IsReplica() {
+		t.Fatal("expected node configured as replica to start as replica")
+	}
+
+	if _, err := replica.app.Exec("INSERT INTO books VALUES (1, 'local', 1)"); err == nil {
+		t.Fatal("expected local write on replica to be rejected")
+	}
+
+	source.exec("INSERT INTO books VALUES (2, 'replicated', 1)")
+	for _, event := range source.publish() {
+		if err := replica.Replicate(remoteNodeID, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if cnt := replica.count("books"); cnt != 1 {
+		t.Fatalf("expected replicated change applied on replica, got %d rows", cnt)
+	}
+
+	if err := replica.Promote(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := replica.Promote(); !errors.Is(err, ErrNotReplica) {
+		t.Fatalf("expected %v promoting primary, got %v", ErrNotReplica, err)
+	}
+
+	replica.exec("INSERT INTO books VALUES (3, 'local', 1)")
+	events := replica.publish()
+	if len(events) != 1 || events[0].Row["title"] != "local" {
+		t.Fatalf("expected promoted node to publish local write, got %d changes", len(events))
+	}
+}
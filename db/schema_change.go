@@ -0,0 +1,364 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/maxpert/marmot/cfg"
+	"github.com/rs/zerolog/log"
+)
+
+// SchemaChangeType is type of change carrying new columns of a table instead of a row,
+// published to every shard ahead of row changes captured against new schema.
+const SchemaChangeType = "schema"
+
+const addColumnQuery = `ALTER TABLE "%s" ADD COLUMN "%s" %s`
+const createTableQuery = `CREATE TABLE IF NOT EXISTS "%s" (%s)`
+
+func (conn *SqliteStreamDB) tableColumns(tableName string) ([]*ColumnInfo, bool) {
+	conn.schemaLock.RLock()
+	defer conn.schemaLock.RUnlock()
+
+	columns, ok := conn.watchTablesSchema[tableName]
+	return columns, ok
+}
+
+func (conn *SqliteStreamDB) intKeyStatement(tableName string) *intKeyStatements {
+	conn.schemaLock.RLock()
+	defer conn.schemaLock.RUnlock()
+
+	return conn.intKeyStatements[tableName]
+}
+
+func (conn *SqliteStreamDB) setTableColumns(tableName string, columns []*ColumnInfo) {
+	conn.schemaLock.Lock()
+	defer conn.schemaLock.Unlock()
+
+	conn.watchTablesSchema[tableName] = columns
+	if old, ok := conn.intKeyStatements[tableName]; ok {
+		old.close()
+	}
+
+	if st := newIntKeyStatements(tableName, columns); st != nil {
+		conn.intKeyStatements[tableName] = st
+	} else {
+		delete(conn.intKeyStatements, tableName)
+	}
+
+	tablePKColumnsLock.Lock()
+	delete(tablePKColumnsCache, tableName)
+	tablePKColumnsLock.Unlock()
+}
+
+func (conn *SqliteStreamDB) schemaVersion() (int64, error) {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return 0, err
+	}
+	defer sqlConn.Return()
+
+	version := int64(0)
+	_, err = sqlConn.DB().ScanVal(&version, "PRAGMA schema_version")
+	return version, err
+}
+
+// detectSchemaChanges reinstalls triggers of tables altered since last check, and publishes
+// their new schema if DDL replication is enabled. Changes of a table can only be published
+// once its schema change is published, otherwise replicas would receive unknown columns.
+func (conn *SqliteStreamDB) detectSchemaChanges() error {
+	version, err := conn.schemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if version != conn.lastSchemaVersion {
+		if cfg.Config.Replication.AutoAddTables {
+			conn.addNewTables()
+		}
+
+		for _, tableName := range conn.ReplicatedTables() {
+			changed, err := conn.refreshTableSchema(tableName)
+			if err != nil {
+				log.Warn().Err(err).Str("table", tableName).Msg("Unable to refresh schema of table")
+				continue
+			}
+
+			if changed && cfg.Config.Replication.ReplicateDDL && conn.OnSchemaChange != nil {
+				conn.pendingSchema = append(conn.pendingSchema, conn.schemaChangeEvent(tableName, version))
+			}
+		}
+
+		conn.lastSchemaVersion = version
+	}
+
+	for len(conn.pendingSchema) != 0 {
+		if err := conn.OnSchemaChange(conn.pendingSchema[0]); err != nil {
+			return err
+		}
+
+		conn.pendingSchema = conn.pendingSchema[1:]
+	}
+
+	return nil
+}
+
+// refreshTableSchema reloads columns of table and reinstalls its triggers if they changed.
+func (conn *SqliteStreamDB) refreshTableSchema(tableName string) (bool, error) {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return false, err
+	}
+
+	var columns []*ColumnInfo
+	err = sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		exists, err := tableExists(tx, tableName)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return fmt.Errorf("%w: %s no longer exists", ErrTableNotFound, tableName)
+		}
+
+		columns, err = getTableInfo(tx, tableName)
+		return err
+	})
+	sqlConn.Return()
+	if err != nil {
+		return false, err
+	}
+
+	current, _ := conn.tableColumns(tableName)
+	if sameColumns(current, columns) {
+		return false, nil
+	}
+
+	if _, ok := conn.idRemappers[tableName]; ok {
+		log.Warn().Str("table", tableName).Msg("Schema of table with remapped IDs changed, restart to rebuild ID remapping")
+	}
+
+	conn.setTableColumns(tableName, columns)
+	if err := conn.installTriggers(tableName, addedColumns(current, columns)); err != nil {
+		return false, err
+	}
+
+	log.Info().
+		Str("table", tableName).
+		Strs("columns", columnNames(columns)).
+		Msg("Schema of table changed, reinstalled change data capture triggers")
+	return true, nil
+}
+
+// syncChangeLogColumns adds value columns of table missing from its existing change log,
+// change log is created with columns table had when it was first captured.
+func (conn *SqliteStreamDB) syncChangeLogColumns(db *goqu.Database, tableName string, columns []*ColumnInfo) error {
+	existing := make([]string, 0)
+	err := db.From(goqu.L("pragma_table_info(?)", conn.metaTable(tableName, changeLogName))).
+		Select("name").
+		Prepared(true).
+		ScanVals(&existing)
+	if err != nil || len(existing) == 0 {
+		return err
+	}
+
+	known := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		known[name] = true
+	}
+
+	for _, col := range columns {
+		if known["val_"+col.Name] {
+			continue
+		}
+
+		_, err = db.Exec(fmt.Sprintf(addColumnQuery, conn.metaTable(tableName, changeLogName), "val_"+col.Name, col.Type))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// schemaChangeEvent describes current columns of table, ID is negative schema version so it
+// never collides with IDs of row changes in deduplication.
+func (conn *SqliteStreamDB) schemaChangeEvent(tableName string, version int64) *ChangeLogEvent {
+	columns, _ := conn.tableColumns(tableName)
+	return &ChangeLogEvent{
+		Id:        -version,
+		Type:      SchemaChangeType,
+		TableName: tableName,
+		Row:       map[string]any{},
+		Schema:    columns,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+}
+
+// applySchemaChange adds columns of replicated schema missing from local table. Only added
+// columns are replicated, other schema changes have to be applied on every node.
+func (conn *SqliteStreamDB) applySchemaChange(tnx *goqu.TxDatabase, event *ChangeLogEvent) error {
+	current, ok := conn.tableColumns(event.TableName)
+	if !ok && cfg.Config.Replication.MissingTable == cfg.MissingTableCreate {
+		return createMissingTable(tnx, event)
+	}
+
+	if !ok {
+		log.Warn().Str("table", event.TableName).Msg("Table not captured locally, skipping schema change")
+		return nil
+	}
+
+	known := make(map[string]bool, len(current))
+	for _, col := range current {
+		known[col.Name] = true
+	}
+
+	for _, col := range event.Schema {
+		if known[col.Name] {
+			continue
+		}
+
+		if col.IsPrimaryKey {
+			return fmt.Errorf("%w: can't add primary key column %s to %s", ErrChangeRejected, col.Name, event.TableName)
+		}
+
+		log.Info().Str("table", event.TableName).Str("column", col.Name).Msg("Adding replicated column")
+		_, err := tnx.Exec(fmt.Sprintf(addColumnQuery, event.TableName, col.Name, columnDefinition(col)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createMissingTable creates table of event from its embedded schema if it doesn't exist yet.
+func createMissingTable(tnx *goqu.TxDatabase, event *ChangeLogEvent) error {
+	if len(event.Schema) == 0 {
+		return fmt.Errorf("%w: %s has no embedded schema to create it from", ErrNoTableMapping, event.TableName)
+	}
+
+	primaryKeys := make([]*ColumnInfo, 0)
+	defs := make([]string, 0, len(event.Schema)+1)
+	for _, col := range event.Schema {
+		defs = append(defs, fmt.Sprintf(`"%s" %s`, col.Name, columnDefinition(col)))
+		if col.IsPrimaryKey {
+			primaryKeys = append(primaryKeys, col)
+		}
+	}
+
+	sort.Slice(primaryKeys, func(i, j int) bool {
+		return primaryKeys[i].PrimaryKeyIndex < primaryKeys[j].PrimaryKeyIndex
+	})
+
+	if len(primaryKeys) != 0 {
+		names := make([]string, 0, len(primaryKeys))
+		for _, col := range primaryKeys {
+			names = append(names, fmt.Sprintf(`"%s"`, col.Name))
+		}
+
+		defs = append(defs, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(names, ", ")))
+	}
+
+	log.Info().Str("table", event.TableName).Msg("Creating missing table from replicated schema")
+	_, err := tnx.Exec(fmt.Sprintf(createTableQuery, event.TableName, strings.Join(defs, ", ")))
+	return err
+}
+
+// schemaPrimaryKeyMap returns primary key values of event row using its embedded schema.
+func schemaPrimaryKeyMap(event *ChangeLogEvent) map[string]any {
+	ret := make(map[string]any)
+	for _, col := range event.Schema {
+		if col.IsPrimaryKey {
+			ret[col.Name] = event.Row[col.Name]
+		}
+	}
+
+	return ret
+}
+
+// captureCreatedTables starts capturing tables created from replicated schema once they're
+// committed, so following changes of those tables take regular apply path.
+func (conn *SqliteStreamDB) captureCreatedTables(events []*ChangeLogEvent) {
+	if cfg.Config.Replication.MissingTable != cfg.MissingTableCreate {
+		return
+	}
+
+	for _, event := range events {
+		if len(event.Schema) == 0 || !IsTableReplicated(event.TableName) {
+			continue
+		}
+
+		if _, ok := conn.tableColumns(event.TableName); ok {
+			continue
+		}
+
+		if err := conn.AddTable(event.TableName); err != nil {
+			log.Warn().Err(err).Str("table", event.TableName).Msg("Unable to capture created table")
+		}
+	}
+}
+
+func columnDefinition(col *ColumnInfo) string {
+	def := col.Type
+	if col.NotNull {
+		def += " NOT NULL"
+	}
+
+	if col.DefaultValue != nil {
+		value := col.DefaultValue
+		if b, ok := value.([]byte); ok {
+			value = string(b)
+		}
+
+		def += fmt.Sprintf(" DEFAULT %v", value)
+	}
+
+	return def
+}
+
+func sameColumns(a []*ColumnInfo, b []*ColumnInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Name != b[i].Name ||
+			!strings.EqualFold(a[i].Type, b[i].Type) ||
+			a[i].NotNull != b[i].NotNull ||
+			a[i].IsPrimaryKey != b[i].IsPrimaryKey ||
+			fmt.Sprint(a[i].DefaultValue) != fmt.Sprint(b[i].DefaultValue) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// addedColumns returns columns of updated schema missing from current one.
+func addedColumns(current []*ColumnInfo, updated []*ColumnInfo) []*ColumnInfo {
+	known := make(map[string]bool, len(current))
+	for _, col := range current {
+		known[col.Name] = true
+	}
+
+	added := make([]*ColumnInfo, 0)
+	for _, col := range updated {
+		if !known[col.Name] {
+			added = append(added, col)
+		}
+	}
+
+	return added
+}
+
+func columnNames(columns []*ColumnInfo) []string {
+	names := make([]string, 0, len(columns))
+	for _, col := range columns {
+		names = append(names, col.Name)
+	}
+
+	return names
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxpert/marmot/cfg"
+)
+
+func TestExcludedTableEmptyAfterRestore(t *testing.T) {
+	c := withConfig(t)
+	c.Replication.Tables = map[string]cfg.TableConfiguration{
+		"sessions": {ExcludeFromSnapshot: true},
+	}
+
+	schema := []string{booksSchema, "CREATE TABLE sessions(id INTEGER PRIMARY KEY, token TEXT)"}
+	source := newTestDB(t, schema...)
+	source.exec(
+		"INSERT INTO books VALUES (1, 'dune', 1)",
+		"INSERT INTO sessions VALUES (1, 'secret')",
+	)
+
+	backup := filepath.Join(t.TempDir(), "snapshot.db")
+	if _, err := source.BackupTo(backup, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if cnt := source.count("sessions"); cnt != 1 {
+		t.Fatalf("expected snapshot to leave source intact, got %d sessions", cnt)
+	}
+
+	replica := newTestDB(t, schema...)
+	if err := replica.RestoreFrom(backup); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := sql.Open("sqlite3", replica.GetPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	books, sessions := 0, -1
+	if err := restored.QueryRow("SELECT COUNT(*) FROM books").Scan(&books); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restored.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&sessions); err != nil {
+		t.Fatalf("expected excluded table to be restored empty: %v", err)
+	}
+
+	if books != 1 || sessions != 0 {
+		t.Fatalf("expected 1 book and no sessions after restore, got %d and %d", books, sessions)
+	}
+}
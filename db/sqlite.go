@@ -4,42 +4,80 @@ import (
 	"context"
 	"database/sql"
 	"database/sql/driver"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/doug-martin/goqu/v9"
 	"github.com/fsnotify/fsnotify"
 	"github.com/mattn/go-sqlite3"
+	"github.com/maxpert/marmot/cfg"
 	"github.com/maxpert/marmot/pool"
 	"github.com/maxpert/marmot/telemetry"
 	"github.com/rs/zerolog/log"
 )
 
 const snapshotTransactionMode = "exclusive"
+const restoreTempSuffix = "-restore"
+
+var ErrCorruptBackup = errors.New("backup failed integrity check")
 
 var PoolSize = 4
 var MarmotPrefix = "__marmot__"
 
 type statsSqliteStreamDB struct {
-	published      telemetry.Counter
-	pendingPublish telemetry.Gauge
-	countChanges   telemetry.Histogram
-	scanChanges    telemetry.Histogram
+	published       telemetry.Counter
+	pendingPublish  telemetry.Gauge
+	countChanges    telemetry.Histogram
+	scanChanges     telemetry.Histogram
+	staleSkipped    telemetry.Counter
+	conflictDropped telemetry.Counter
+	batchSize       telemetry.Histogram
+	tablePublished  telemetry.Vec[telemetry.Counter]
+	tableApplied    telemetry.Vec[telemetry.Counter]
+	applyLatency    telemetry.Vec[telemetry.Histogram]
+
+	missingTableSkipped telemetry.Counter
+	freePages           telemetry.Gauge
+	walCheckpoint       telemetry.Histogram
 }
 
 type SqliteStreamDB struct {
 	OnChange      func(event *ChangeLogEvent) error
+	OnChangeBatch func(events []*ChangeLogEvent) error
+	// OnSchemaChange publishes schema change of a table to every shard
+	OnSchemaChange func(event *ChangeLogEvent) error
+	// ValidateTable rejects tables added at runtime that can't be replicated
+	ValidateTable func(name string) error
 	pool          *pool.SQLitePool
 	rawConnection *sqlite3.SQLiteConn
 	publishLock   *sync.Mutex
 
+	maintenanceLock *sync.Mutex
+	replica         int32
+	cdcInstalled    int32
+	applied         *appliedSet
+	beforeApply     []BeforeApplyHook
+	walCheckpointer *walCheckpointer
+
 	dbPath            string
 	prefix            string
+	schemaLock        *sync.RWMutex
 	watchTablesSchema map[string][]*ColumnInfo
+	intKeyStatements  map[string]*intKeyStatements
+	idRemappers       map[string]*idRemapper
 	stats             *statsSqliteStreamDB
+
+	lastSchemaVersion int64
+	pendingSchema     []*ChangeLogEvent
+	lingerTimer       *time.Timer
+	removedTables     map[string]bool
+	status            *replicationStatus
 }
 
 type ColumnInfo struct {
@@ -51,16 +89,18 @@ type ColumnInfo struct {
 	IsPrimaryKey    bool
 }
 
+// RestoreFrom replaces database at destPath with backup. Backup is copied next to database
+// and renamed over it, so a crash midway never leaves a partially written database behind.
 func RestoreFrom(destPath, bkFilePath string) error {
-	dnsTpl := "%s?_journal_mode=WAL&_foreign_keys=false&_busy_timeout=30000&_sync=FULL&_txlock=%s"
-	dns := fmt.Sprintf(dnsTpl, destPath, snapshotTransactionMode)
+	dnsTpl := "%s?_journal_mode=%s&_foreign_keys=false&_busy_timeout=30000&_sync=FULL&_txlock=%s"
+	dns := fmt.Sprintf(dnsTpl, destPath, cfg.Config.JournalMode, snapshotTransactionMode)
 	destDB, dest, err := pool.OpenRaw(dns)
 	if err != nil {
 		return err
 	}
 	defer dest.Close()
 
-	dns = fmt.Sprintf(dnsTpl, bkFilePath, snapshotTransactionMode)
+	dns = fmt.Sprintf(dnsTpl, bkFilePath, cfg.Config.JournalMode, snapshotTransactionMode)
 	srcDB, src, err := pool.OpenRaw(dns)
 	if err != nil {
 		return err
@@ -70,44 +110,55 @@ func RestoreFrom(destPath, bkFilePath string) error {
 	dgSQL := goqu.New("sqlite", destDB)
 	sgSQL := goqu.New("sqlite", srcDB)
 
+	check := ""
+	_, err = sgSQL.ScanVal(&check, "PRAGMA quick_check;")
+	if err != nil {
+		return err
+	}
+
+	if check != "ok" {
+		return fmt.Errorf("%w: %s", ErrCorruptBackup, check)
+	}
+
+	// WAL of current database would be replayed over restored one, so it must be empty
+	err = performCheckpoint(dgSQL)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := destPath + restoreTempSuffix
+	defer os.Remove(tmpPath)
+
 	// Source locking is required so that any lock related metadata is mirrored in destination
 	// Transacting on both src and dest in immediate mode makes sure nobody
 	// else is modifying or interacting with DB
-	err = sgSQL.WithTx(func(dtx *goqu.TxDatabase) error {
+	return sgSQL.WithTx(func(dtx *goqu.TxDatabase) error {
 		return dgSQL.WithTx(func(_ *goqu.TxDatabase) error {
-			err = copyFile(destPath, bkFilePath)
+			err = copyFile(tmpPath, bkFilePath)
 			if err != nil {
 				return err
 			}
 
-			err = copyFile(destPath+"-shm", bkFilePath+"-shm")
+			err = os.Rename(tmpPath, destPath)
 			if err != nil {
 				return err
 			}
 
-			err = copyFile(destPath+"-wal", bkFilePath+"-wal")
-			if err != nil {
-				return err
+			// Only WAL mode keeps log next to database, drop anything written after checkpoint
+			if cfg.Config.JournalMode == cfg.JournalModeWAL {
+				err = os.Truncate(destPath+"-wal", 0)
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
 			}
 
-			return nil
+			return syncDir(path.Dir(destPath))
 		})
 	})
-
-	if err != nil {
-		return err
-	}
-
-	err = performCheckpoint(dgSQL)
-	if err != nil {
-		return err
-	}
-
-	return nil
 }
 
 func GetAllDBTables(path string) ([]string, error) {
-	connectionStr := fmt.Sprintf("%s?_journal_mode=WAL", path)
+	connectionStr := journalDSN(path)
 	conn, rawConn, err := pool.OpenRaw(connectionStr)
 	if err != nil {
 		return nil, err
@@ -129,11 +180,19 @@ func GetAllDBTables(path string) ([]string, error) {
 }
 
 func OpenStreamDB(path string) (*SqliteStreamDB, error) {
-	dbPool, err := pool.NewSQLitePool(fmt.Sprintf("%s?_journal_mode=WAL", path), PoolSize, true)
+	// Applying changes reads row state before writing, deferred transactions would fail with
+	// busy snapshot if another writer commits in between instead of waiting for write lock
+	dbPool, err := pool.NewSQLitePool(journalDSN(path)+"&_txlock=immediate", PoolSize, true)
 	if err != nil {
 		return nil, err
 	}
 
+	if cfg.Config.JournalMode != cfg.JournalModeWAL {
+		log.Warn().
+			Str("journal_mode", cfg.Config.JournalMode).
+			Msg("Non-WAL journal mode blocks readers while applying changes, expect reduced replication concurrency")
+	}
+
 	conn, err := dbPool.Borrow()
 	if err != nil {
 		return nil, err
@@ -150,12 +209,30 @@ func OpenStreamDB(path string) (*SqliteStreamDB, error) {
 		dbPath:            path,
 		prefix:            MarmotPrefix,
 		publishLock:       &sync.Mutex{},
+		maintenanceLock:   &sync.Mutex{},
+		schemaLock:        &sync.RWMutex{},
 		watchTablesSchema: map[string][]*ColumnInfo{},
+		intKeyStatements:  map[string]*intKeyStatements{},
+		idRemappers:       map[string]*idRemapper{},
+		removedTables:     map[string]bool{},
+		status:            newReplicationStatus(),
+		applied:           newAppliedSet(cfg.Config.Replication),
+		walCheckpointer:   newWalCheckpointer(cfg.Config.Maintenance),
 		stats: &statsSqliteStreamDB{
-			published:      telemetry.NewCounter("published", "number of rows published"),
-			pendingPublish: telemetry.NewGauge("pending_publish", "rows pending publishing"),
-			countChanges:   telemetry.NewHistogram("count_changes", "latency counting changes in microseconds"),
-			scanChanges:    telemetry.NewHistogram("scan_changes", "latency scanning change rows in DB"),
+			published:       telemetry.NewCounter("published", "number of rows published"),
+			pendingPublish:  telemetry.NewGauge("pending_publish", "rows pending publishing"),
+			countChanges:    telemetry.NewHistogram("count_changes", "latency counting changes in microseconds"),
+			scanChanges:     telemetry.NewHistogram("scan_changes", "latency scanning change rows in DB"),
+			staleSkipped:    telemetry.NewCounter("stale_skipped", "number of stale changes skipped by version guard"),
+			conflictDropped: telemetry.NewCounter("conflict_dropped", "number of changes dropped by conflict resolution"),
+			batchSize:       telemetry.NewHistogram("batch_size", "number of changes per published batch"),
+			tablePublished:  telemetry.NewCounterVec("table_published", "number of rows published per table", "table"),
+			tableApplied:    telemetry.NewCounterVec("table_applied", "number of replicated rows applied per table", "table"),
+			applyLatency:    telemetry.NewHistogramVec("apply_latency", "latency applying replicated rows per table in microseconds", "table"),
+
+			missingTableSkipped: telemetry.NewCounter("missing_table_skipped", "number of changes skipped for missing tables"),
+			freePages:           telemetry.NewGauge("free_pages", "number of free pages in database file"),
+			walCheckpoint:       telemetry.NewHistogram("wal_checkpoint", "latency of WAL checkpoints in microseconds"),
 		},
 	}
 
@@ -163,6 +240,25 @@ func OpenStreamDB(path string) (*SqliteStreamDB, error) {
 }
 
 func (conn *SqliteStreamDB) InstallCDC(tables []string) error {
+	err := conn.installCDC(tables)
+	if err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	go conn.watchChanges(watcher, conn.dbPath)
+	atomic.StoreInt32(&conn.cdcInstalled, 1)
+	return nil
+}
+
+// installCDC sets up change logs, triggers and bookkeeping tables of tables without
+// watching database for changes.
+func (conn *SqliteStreamDB) installCDC(tables []string) error {
+	tables = FilterReplicatedTables(tables)
 	sqlConn, err := conn.pool.Borrow()
 	if err != nil {
 		return err
@@ -176,7 +272,16 @@ func (conn *SqliteStreamDB) InstallCDC(tables []string) error {
 				return err
 			}
 
-			conn.watchTablesSchema[n] = colInfo
+			conn.setTableColumns(n, colInfo)
+
+			if tableCfg := cfg.Config.Replication.Tables[n]; tableCfg.RemapIDs {
+				remapper, err := newIDRemapper(n, colInfo, tableCfg)
+				if err != nil {
+					return err
+				}
+
+				conn.idRemappers[n] = remapper
+			}
 		}
 
 		return nil
@@ -190,13 +295,47 @@ func (conn *SqliteStreamDB) InstallCDC(tables []string) error {
 		return err
 	}
 
-	watcher, err := fsnotify.NewWatcher()
+	err = conn.removeUncapturedCDC()
 	if err != nil {
 		return err
 	}
 
-	go conn.watchChanges(watcher, conn.dbPath)
-	return nil
+	err = conn.initAppliedSeq()
+	if err != nil {
+		return err
+	}
+
+	if len(conn.idRemappers) != 0 {
+		err = conn.initIDMap()
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.Config.Replication.ConflictResolution != cfg.ConflictNone {
+		err = conn.initRowVersions()
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.Config.Role == cfg.RoleReplica {
+		err = conn.DemoteToReplica()
+	} else {
+		err = conn.removeWriteGuard()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	conn.lastSchemaVersion, err = conn.schemaVersion()
+	return err
+}
+
+// CDCInstalled reports whether change data capture triggers are installed and changes are watched.
+func (conn *SqliteStreamDB) CDCInstalled() bool {
+	return atomic.LoadInt32(&conn.cdcInstalled) != 0
 }
 
 func (conn *SqliteStreamDB) RemoveCDC(tables bool) error {
@@ -219,12 +358,36 @@ func (conn *SqliteStreamDB) RemoveCDC(tables bool) error {
 	return nil
 }
 
+// CleanupPlan lists triggers and tables RemoveCDC would drop without touching them.
+func (conn *SqliteStreamDB) CleanupPlan(tables bool) ([]string, []string, error) {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer sqlConn.Return()
+
+	triggerNames, err := listMarmotObjects(sqlConn.DB(), "trigger", conn.prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tableNames := make([]string, 0)
+	if tables {
+		tableNames, err = listMarmotObjects(sqlConn.DB(), "table", conn.prefix)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return triggerNames, tableNames, nil
+}
+
 func (conn *SqliteStreamDB) installChangeLogTriggers() error {
 	if err := conn.initGlobalChangeLog(); err != nil {
 		return err
 	}
 
-	for tableName := range conn.watchTablesSchema {
+	for _, tableName := range conn.ReplicatedTables() {
 		err := conn.initTriggers(tableName)
 		if err != nil {
 			return err
@@ -280,52 +443,112 @@ func getTableInfo(tx *goqu.TxDatabase, table string) ([]*ColumnInfo, error) {
 	return tableInfo, nil
 }
 
-func (conn *SqliteStreamDB) BackupTo(bkFilePath string) error {
-	sqlDB, rawDB, err := pool.OpenRaw(fmt.Sprintf("%s?mode=ro&_foreign_keys=false&_journal_mode=WAL", conn.dbPath))
+// BackupTo saves copy of database without marmot tables to bkFilePath. Backup keeps stream
+// sequences it's consistent with, seqs are sequences known to be applied before backup started
+// and are merged with ones saved in database. Merged sequences are returned.
+func (conn *SqliteStreamDB) BackupTo(bkFilePath string, seqs map[string]uint64) (map[string]uint64, error) {
+	sqlDB, rawDB, err := pool.OpenRaw(fmt.Sprintf("%s?mode=ro&_foreign_keys=false&_journal_mode=%s", conn.dbPath, cfg.Config.JournalMode))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer sqlDB.Close()
 	defer rawDB.Close()
 
 	_, err = rawDB.Exec("VACUUM main INTO ?;", []driver.Value{bkFilePath})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = rawDB.Close()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = sqlDB.Close()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Now since we have separate copy of DB we don't need to deal with WAL journals or foreign keys
 	// We need to remove all the marmot specific tables, triggers, and vacuum out the junk.
 	sqlDB, rawDB, err = pool.OpenRaw(fmt.Sprintf("%s?_foreign_keys=false&_journal_mode=TRUNCATE", bkFilePath))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	gSQL := goqu.New("sqlite", sqlDB)
+	seqs, err = mergeAppliedSeqs(gSQL, conn.appliedSeqTable(), seqs)
+	if err != nil {
+		return nil, err
+	}
+
 	err = removeMarmotTriggers(gSQL, conn.prefix)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = removeMarmotTables(gSQL, conn.prefix)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	err = truncateExcludedTables(gSQL)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeAppliedSeqs(gSQL, conn.appliedSeqTable(), seqs)
+	if err != nil {
+		return nil, err
 	}
 
 	_, err = gSQL.Exec("VACUUM;")
+	if err != nil {
+		return nil, err
+	}
+
+	return seqs, nil
+}
+
+// RestoreFrom replaces database with backup and reopens connections of pool on restored file.
+func (conn *SqliteStreamDB) RestoreFrom(bkFilePath string) error {
+	err := RestoreFrom(conn.dbPath, bkFilePath)
 	if err != nil {
 		return err
 	}
 
+	conn.pool.Reset()
+	return nil
+}
+
+// truncateExcludedTables empties tables excluded from snapshots, keeping their schema.
+func truncateExcludedTables(gSQL *goqu.Database) error {
+	for name, tableCfg := range cfg.Config.Replication.Tables {
+		if !tableCfg.ExcludeFromSnapshot {
+			continue
+		}
+
+		found, err := gSQL.From("sqlite_master").
+			Select("name").
+			Where(goqu.C("type").Eq("table"), goqu.C("name").Eq(name)).
+			Prepared(true).
+			ScanVal(new(string))
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			continue
+		}
+
+		_, err = gSQL.Delete(name).Executor().Exec()
+		if err != nil {
+			return err
+		}
+
+		log.Debug().Str("table", name).Msg("Excluded table data from snapshot")
+	}
+
 	return nil
 }
 
@@ -339,7 +562,7 @@ func (conn *SqliteStreamDB) GetPath() string {
 
 func (conn *SqliteStreamDB) WithReadTx(cb func(tx *sql.Tx) error) error {
 	var tx *sql.Tx = nil
-	db, _, err := pool.OpenRaw(fmt.Sprintf("%s?_journal_mode=WAL", conn.dbPath))
+	db, _, err := pool.OpenRaw(journalDSN(conn.dbPath))
 	if err != nil {
 		return err
 	}
@@ -365,6 +588,10 @@ func (conn *SqliteStreamDB) WithReadTx(cb func(tx *sql.Tx) error) error {
 	return cb(tx)
 }
 
+func journalDSN(path string) string {
+	return fmt.Sprintf("%s?_journal_mode=%s", path, cfg.Config.JournalMode)
+}
+
 func copyFile(toPath, fromPath string) error {
 	fi, err := os.OpenFile(fromPath, os.O_RDWR, 0)
 	if err != nil {
@@ -387,11 +614,21 @@ func copyFile(toPath, fromPath string) error {
 	return err
 }
 
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
 func listDBTables(names *[]string, gSQL *goqu.TxDatabase) error {
 	err := gSQL.Select("name").From("sqlite_schema").Where(
 		goqu.C("type").Eq("table"),
 		goqu.C("name").NotLike("sqlite_%"),
-		goqu.C("name").NotLike(MarmotPrefix+"%"),
+		goqu.Func("substr", goqu.C("name"), 1, len(MarmotPrefix)).Neq(MarmotPrefix),
 	).ScanVals(names)
 
 	if err != nil {
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/maxpert/marmot/cfg"
+	"github.com/rs/zerolog/log"
+)
+
+// IsTableReplicated reports whether changes of table are captured according to include and
+// exclude patterns of replication config. Exclude wins when table matches both.
+func IsTableReplicated(name string) bool {
+	if matchesAny(cfg.Config.Replication.ExcludeTables, name) {
+		return false
+	}
+
+	include := cfg.Config.Replication.IncludeTables
+	return len(include) == 0 || matchesAny(include, name)
+}
+
+// FilterReplicatedTables returns tables, in same order, whose changes are captured.
+func FilterReplicatedTables(tables []string) []string {
+	ret := make([]string, 0, len(tables))
+	for _, name := range tables {
+		if IsTableReplicated(name) {
+			ret = append(ret, name)
+			continue
+		}
+
+		log.Info().Str("table", name).Msg("Table excluded from change data capture")
+	}
+
+	return ret
+}
+
+// ReplicatedTables returns sorted names of tables changes are being captured for.
+func (conn *SqliteStreamDB) ReplicatedTables() []string {
+	conn.schemaLock.RLock()
+	defer conn.schemaLock.RUnlock()
+
+	ret := make([]string, 0, len(conn.watchTablesSchema))
+	for name := range conn.watchTablesSchema {
+		ret = append(ret, name)
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+// removeUncapturedCDC drops triggers and change logs left over for tables that are no longer
+// captured (e.g. excluded since last start). Pending changes of those tables are discarded.
+func (conn *SqliteStreamDB) removeUncapturedCDC() error {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	gSQL := sqlConn.DB()
+	triggers := make([]struct {
+		Name      string `db:"name"`
+		TableName string `db:"tbl_name"`
+	}, 0)
+
+	err = gSQL.Select("name", "tbl_name").
+		From("sqlite_master").
+		Where(goqu.C("type").Eq("trigger"), hasMarmotPrefix(conn.prefix)).
+		Prepared(true).
+		ScanStructs(&triggers)
+	if err != nil {
+		return err
+	}
+
+	for _, trigger := range triggers {
+		if _, ok := conn.tableColumns(trigger.TableName); ok {
+			continue
+		}
+
+		log.Info().Str("table", trigger.TableName).Str("name", trigger.Name).Msg("Dropping trigger of uncaptured table")
+		if _, err = gSQL.Exec(fmt.Sprintf(deleteTriggerQuery, trigger.Name)); err != nil {
+			return err
+		}
+	}
+
+	tables, err := listMarmotObjects(gSQL, "table", conn.prefix)
+	if err != nil {
+		return err
+	}
+
+	suffix := "_" + changeLogName
+	for _, name := range tables {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+
+		tableName := strings.TrimSuffix(strings.TrimPrefix(name, conn.prefix), suffix)
+		if _, ok := conn.tableColumns(tableName); ok {
+			continue
+		}
+
+		log.Info().Str("table", tableName).Msg("Dropping change log of uncaptured table")
+		if _, err = gSQL.Exec(fmt.Sprintf(deleteMarmotTables, name)); err != nil {
+			return err
+		}
+
+		_, err = gSQL.Delete(conn.globalMetaTable()).
+			Where(goqu.C("table_name").Eq(tableName)).
+			Prepared(true).
+			Executor().
+			Exec()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/maxpert/marmot/cfg"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrTableNotFound = errors.New("table not found")
+var ErrTableExcluded = errors.New("table excluded from change data capture")
+var ErrTableRequiresRestart = errors.New("table can only be captured on restart")
+
+// AddTable starts capturing changes of table without restart, installing its change log and
+// triggers. Adding an already captured table is a no-op.
+func (conn *SqliteStreamDB) AddTable(name string) error {
+	conn.publishLock.Lock()
+	defer conn.publishLock.Unlock()
+
+	delete(conn.removedTables, name)
+	return conn.addTable(name)
+}
+
+// RemoveTable stops capturing changes of table, dropping its triggers and change log. Pending
+// changes of table that weren't published yet are discarded. Removed table isn't captured again
+// automatically until restart or AddTable.
+func (conn *SqliteStreamDB) RemoveTable(name string) error {
+	conn.publishLock.Lock()
+	defer conn.publishLock.Unlock()
+
+	if _, ok := conn.tableColumns(name); !ok {
+		return nil
+	}
+
+	conn.removedTables[name] = true
+	conn.removeTableColumns(name)
+	err := conn.removeUncapturedCDC()
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("table", name).Msg("Stopped capturing changes of table")
+	return nil
+}
+
+// addTable must be called holding publish lock, so no changes are scanned while table is set up.
+func (conn *SqliteStreamDB) addTable(name string) error {
+	if _, ok := conn.tableColumns(name); ok {
+		return nil
+	}
+
+	if !IsTableReplicated(name) {
+		return fmt.Errorf("%w: %s", ErrTableExcluded, name)
+	}
+
+	if cfg.Config.Replication.Tables[name].RemapIDs {
+		return fmt.Errorf("%w: %s remaps IDs", ErrTableRequiresRestart, name)
+	}
+
+	if conn.ValidateTable != nil {
+		if err := conn.ValidateTable(name); err != nil {
+			return err
+		}
+	}
+
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+
+	var columns []*ColumnInfo
+	err = sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		exists, err := tableExists(tx, name)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return fmt.Errorf("%w: %s", ErrTableNotFound, name)
+		}
+
+		columns, err = getTableInfo(tx, name)
+		return err
+	})
+	sqlConn.Return()
+	if err != nil {
+		return err
+	}
+
+	conn.setTableColumns(name, columns)
+	err = conn.initTriggers(name)
+	if err == nil && conn.IsReplica() {
+		err = conn.installWriteGuard(name)
+	}
+
+	if err != nil {
+		conn.removeTableColumns(name)
+		return err
+	}
+
+	log.Info().Str("table", name).Msg("Started capturing changes of table")
+	return nil
+}
+
+// addNewTables captures tables created since startup that match include patterns.
+func (conn *SqliteStreamDB) addNewTables() {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to list new tables")
+		return
+	}
+
+	names := make([]string, 0)
+	err = sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		return listDBTables(&names, tx)
+	})
+	sqlConn.Return()
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to list new tables")
+		return
+	}
+
+	for _, name := range names {
+		if _, ok := conn.tableColumns(name); ok || conn.removedTables[name] || !IsTableReplicated(name) {
+			continue
+		}
+
+		if err := conn.addTable(name); err != nil {
+			log.Warn().Err(err).Str("table", name).Msg("Unable to capture new table")
+		}
+	}
+}
+
+func (conn *SqliteStreamDB) removeTableColumns(tableName string) {
+	conn.schemaLock.Lock()
+	defer conn.schemaLock.Unlock()
+
+	delete(conn.watchTablesSchema, tableName)
+	if st, ok := conn.intKeyStatements[tableName]; ok {
+		st.close()
+		delete(conn.intKeyStatements, tableName)
+	}
+
+	tablePKColumnsLock.Lock()
+	delete(tablePKColumnsCache, tableName)
+	tablePKColumnsLock.Unlock()
+}
+
+func tableExists(tx *goqu.TxDatabase, tableName string) (bool, error) {
+	cnt, err := tx.From("sqlite_master").
+		Where(goqu.C("type").Eq("table"), goqu.C("name").Eq(tableName)).
+		Prepared(true).
+		Count()
+	return cnt != 0, err
+}
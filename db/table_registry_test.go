@@ -0,0 +1,84 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+const authorsSchema = "CREATE TABLE authors(id INTEGER PRIMARY KEY, name TEXT)"
+
+func (d *testDB) triggerCount(table string) int64 {
+	d.t.Helper()
+
+	cnt := int64(0)
+	err := d.app.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND tbl_name = ?", table).Scan(&cnt)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+
+	return cnt
+}
+
+func TestTableAddedAfterStartReplicates(t *testing.T) {
+	source := newTestDB(t, booksSchema)
+	replica := newTestDB(t, booksSchema)
+
+	for _, d := range []*testDB{source, replica} {
+		d.exec(authorsSchema)
+		if err := d.AddTable("authors"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	triggers := source.triggerCount("authors")
+	if err := source.AddTable("authors"); err != nil {
+		t.Fatal(err)
+	}
+
+	if triggers == 0 || source.triggerCount("authors") != triggers {
+		t.Fatalf("expected adding tracked table again to keep %d triggers, got %d", triggers, source.triggerCount("authors"))
+	}
+
+	source.exec(
+		"INSERT INTO authors VALUES (1, 'frank herbert')",
+		"INSERT INTO authors VALUES (2, 'jane austen')",
+		"UPDATE authors SET name = 'Frank Herbert' WHERE id = 1",
+	)
+	changes := source.publish()
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes of added table, got %d", len(changes))
+	}
+
+	if err := replica.ReplicateBatch(remoteNodeID, changes, StreamPosition{}); err != nil {
+		t.Fatal(err)
+	}
+
+	query := "SELECT id, name FROM authors ORDER BY id"
+	if rows, expected := replica.query(query), source.query(query); !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("replica rows %v don't match source rows %v", rows, expected)
+	}
+}
+
+func TestNewTablesAddedAutomatically(t *testing.T) {
+	c := withConfig(t)
+	c.Replication.AutoAddTables = true
+
+	source := newTestDB(t, booksSchema)
+	source.exec(authorsSchema)
+	source.publish()
+
+	source.exec("INSERT INTO authors VALUES (1, 'frank herbert')")
+	changes := source.publish()
+	if len(changes) != 1 || changes[0].TableName != "authors" {
+		t.Fatalf("expected change of new table published, got %v", changes)
+	}
+
+	if err := source.RemoveTable("authors"); err != nil {
+		t.Fatal(err)
+	}
+
+	source.exec("INSERT INTO authors VALUES (2, 'jane austen')")
+	if changes := source.publish(); len(changes) != 0 || source.triggerCount("authors") != 0 {
+		t.Fatalf("expected removed table to stay uncaptured, got %v", changes)
+	}
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/rs/zerolog/log"
+)
+
+// walCheckpointer runs WAL checkpoints every configured number of applied batches or
+// interval, whichever comes first. Checkpoints run off the apply path in background and
+// overlapping checkpoints are skipped.
+type walCheckpointer struct {
+	lock      *sync.Mutex
+	running   *sync.Mutex
+	mode      string
+	batches   uint32
+	interval  time.Duration
+	applied   uint32
+	lastCheck time.Time
+}
+
+func newWalCheckpointer(c cfg.MaintenanceConfiguration) *walCheckpointer {
+	if c.WalCheckpointMode == "" {
+		return nil
+	}
+
+	return &walCheckpointer{
+		lock:      &sync.Mutex{},
+		running:   &sync.Mutex{},
+		mode:      strings.ToUpper(c.WalCheckpointMode),
+		batches:   c.WalCheckpointBatches,
+		interval:  time.Duration(c.WalCheckpointInterval) * time.Millisecond,
+		lastCheck: time.Now(),
+	}
+}
+
+// due records an applied batch and returns true if checkpoint should run now.
+func (w *walCheckpointer) due() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.applied++
+	if (w.batches > 0 && w.applied >= w.batches) || (w.interval > 0 && time.Since(w.lastCheck) >= w.interval) {
+		w.applied = 0
+		w.lastCheck = time.Now()
+		return true
+	}
+
+	return false
+}
+
+func (conn *SqliteStreamDB) onBatchApplied() {
+	w := conn.walCheckpointer
+	if w == nil || !w.due() {
+		return
+	}
+
+	go func() {
+		if !w.running.TryLock() {
+			return
+		}
+		defer w.running.Unlock()
+
+		if err := conn.walCheckpoint(w.mode); err != nil {
+			log.Warn().Err(err).Str("mode", w.mode).Msg("Unable to checkpoint WAL")
+		}
+	}()
+}
+
+func (conn *SqliteStreamDB) walCheckpoint(mode string) error {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return err
+	}
+	defer sqlConn.Return()
+
+	start := time.Now()
+	busy, walFrames, checkpointed := int64(0), int64(0), int64(0)
+	err = sqlConn.DB().
+		QueryRow(fmt.Sprintf("PRAGMA wal_checkpoint(%s);", mode)).
+		Scan(&busy, &walFrames, &checkpointed)
+	if err != nil {
+		return err
+	}
+
+	conn.stats.walCheckpoint.Observe(float64(time.Since(start).Microseconds()))
+	log.Debug().
+		Str("mode", mode).
+		Int64("busy", busy).
+		Int64("log", walFrames).
+		Int64("checkpointed", checkpointed).
+		Msg("WAL checkpoint complete")
+	return nil
+}
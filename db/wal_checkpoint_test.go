@@ -0,0 +1,80 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+)
+
+const blobsSchema = "CREATE TABLE blobs(id INTEGER PRIMARY KEY, data BLOB)"
+
+func TestWalCheckpointCadence(t *testing.T) {
+	w := newWalCheckpointer(cfg.MaintenanceConfiguration{WalCheckpointMode: "passive", WalCheckpointBatches: 3})
+	if w.mode != "PASSIVE" {
+		t.Fatalf("expected mode normalized to PASSIVE, got %s", w.mode)
+	}
+
+	for i := 1; i <= 9; i++ {
+		if due := w.due(); due != (i%3 == 0) {
+			t.Fatalf("batch %d: expected checkpoint due %v, got %v", i, i%3 == 0, due)
+		}
+	}
+
+	w = newWalCheckpointer(cfg.MaintenanceConfiguration{WalCheckpointMode: "passive", WalCheckpointInterval: 50})
+	if w.due() {
+		t.Fatal("expected no checkpoint before interval elapsed")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !w.due() || w.due() {
+		t.Fatal("expected exactly one checkpoint once interval elapsed")
+	}
+
+	if newWalCheckpointer(cfg.MaintenanceConfiguration{}) != nil {
+		t.Fatal("expected no checkpointer without checkpoint mode")
+	}
+}
+
+func TestWalCheckpointKeepsWalBounded(t *testing.T) {
+	const batches = 20
+	walSize := func(mode string) int64 {
+		c := withConfig(t)
+		c.Maintenance.WalCheckpointMode = mode
+		c.Maintenance.WalCheckpointBatches = 5
+
+		source := newTestDB(t, blobsSchema)
+		replica := newTestDB(t, blobsSchema)
+		for i := 0; i < batches; i++ {
+			source.exec("INSERT INTO blobs(data) VALUES (randomblob(32768))")
+			if err := replica.ReplicateBatch(remoteNodeID, source.publish(), StreamPosition{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Checkpoint after last batch runs in background
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			stat, err := os.Stat(replica.dbPath + "-wal")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if stat.Size() == 0 || mode == "" || time.Now().After(deadline) {
+				return stat.Size()
+			}
+
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	unbounded := walSize("")
+	if unbounded < batches*32768 {
+		t.Fatalf("expected WAL to hold all batches without checkpoints, it's %d bytes", unbounded)
+	}
+
+	if bounded := walSize("truncate"); bounded != 0 {
+		t.Fatalf("expected truncate checkpoints to empty WAL, it's %d bytes", bounded)
+	}
+}
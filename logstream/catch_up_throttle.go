@@ -0,0 +1,78 @@
+package logstream
+
+import (
+	"sync"
+	"time"
+
+	"github.com/maxpert/marmot/telemetry"
+	"github.com/rs/zerolog/log"
+)
+
+// catchUpThrottle caps rate at which changes are applied while node is far behind stream.
+// Rate is shared by all shards, so total apply rate during catch-up stays within limit.
+type catchUpThrottle struct {
+	lock      *sync.Mutex
+	interval  time.Duration
+	threshold uint64
+	next      time.Time
+	throttled telemetry.Counter
+}
+
+func newCatchUpThrottle(rate uint32, threshold uint64) *catchUpThrottle {
+	if rate == 0 {
+		return nil
+	}
+
+	return &catchUpThrottle{
+		lock:      &sync.Mutex{},
+		interval:  time.Second / time.Duration(rate),
+		threshold: threshold,
+		throttled: telemetry.NewCounter("catch_up_throttled", "number of changes delayed by catch-up throttle"),
+	}
+}
+
+// behind reports if given number of pending messages is above catch-up threshold.
+func (t *catchUpThrottle) behind(pending uint64) bool {
+	return t != nil && pending > t.threshold
+}
+
+// wait blocks until next change can be applied, it is a no-op once node has caught up.
+func (t *catchUpThrottle) wait(pending uint64) {
+	if !t.behind(pending) {
+		return
+	}
+
+	t.lock.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+
+	delay := t.next.Sub(now)
+	t.next = t.next.Add(t.interval)
+	t.lock.Unlock()
+
+	if delay > 0 {
+		t.throttled.Inc()
+		time.Sleep(delay)
+	}
+}
+
+func logCatchUpTransition(shardID uint64, pending uint64, wasBehind, isBehind bool) {
+	if wasBehind == isBehind {
+		return
+	}
+
+	if isBehind {
+		log.Info().
+			Uint64("shard", shardID).
+			Uint64("pending", pending).
+			Msg("Shard far behind, throttling catch-up replay")
+		return
+	}
+
+	log.Info().
+		Uint64("shard", shardID).
+		Uint64("pending", pending).
+		Msg("Shard caught up, lifting catch-up throttle")
+}
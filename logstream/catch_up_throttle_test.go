@@ -0,0 +1,63 @@
+package logstream
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestCatchUpThrottledWhileBehind(t *testing.T) {
+	c := withConfig(t)
+	c.ReplicationLog.CatchUpRate = 50
+	c.ReplicationLog.CatchUpThreshold = 10
+	r := newTestReplicator(t)
+
+	const total = 40
+	for i := 0; i < total; i++ {
+		if _, err := r.Publish(1, strconv.Itoa(i), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type apply struct {
+		at      time.Time
+		pending uint64
+	}
+
+	applied := make(chan apply, total)
+	listen(r, 1, func(_ []byte, meta *nats.MsgMetadata) error {
+		applied <- apply{at: time.Now(), pending: meta.NumPending}
+		return nil
+	})
+
+	applies := make([]apply, 0, total)
+	for len(applies) < total {
+		select {
+		case a := <-applied:
+			applies = append(applies, a)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out after %d changes", len(applies))
+		}
+	}
+
+	// Changes applied while more than threshold was pending are spaced by rate
+	throttled := 0
+	for throttled < total && applies[throttled].pending > 10 {
+		throttled++
+	}
+
+	if throttled < 20 {
+		t.Fatalf("expected most of backlog applied while behind, only %d were", throttled)
+	}
+
+	interval := time.Second / 50
+	if elapsed := applies[throttled-1].at.Sub(applies[0].at); elapsed < time.Duration(throttled-2)*interval {
+		t.Fatalf("%d changes applied in %s while behind, faster than 50 changes/s", throttled, elapsed)
+	}
+
+	if elapsed := applies[total-1].at.Sub(applies[throttled].at); elapsed > time.Duration(total-throttled-1)*interval/2 {
+		t.Fatalf("expected throttle lifted once caught up, last %d changes took %s", total-throttled, elapsed)
+	}
+}
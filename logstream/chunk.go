@@ -0,0 +1,151 @@
+package logstream
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/nats-io/nats.go"
+)
+
+// chunkHeader carries "<index>/<total>" of a chunk of change too large for a single message,
+// chunkPrevHeader carries stream sequence of previous chunk. Last chunk links back to all
+// others, so receivers only act on it and fetch rest by sequence, regardless of order or
+// timing in which chunks are delivered.
+const chunkHeader = "Marmot-Chunk"
+const chunkPrevHeader = "Marmot-Chunk-Prev"
+
+// chunkHeadroom is reserved for headers when chunk size is derived from server max payload
+const chunkHeadroom = 4096
+
+// payloadHeaders travel with change payload when it's dead lettered and replayed, chunked
+// payloads are reassembled before being dead lettered and split again if needed
+var payloadHeaders = []string{codecHeader, nonceHeader}
+
+func (r *Replicator) chunkSize() int {
+	if cfg.Config.ReplicationLog.ChunkSize > 0 {
+		return cfg.Config.ReplicationLog.ChunkSize
+	}
+
+	return int(r.client.MaxPayload()) - chunkHeadroom
+}
+
+// publishChunks publishes payload split into chunks in order, ack of last chunk is returned.
+// Chunks get message IDs derived from msgID, so a retried publish reuses chunks already
+// published and sequences they are linked by stay valid. Encrypted payload is split after
+// sealing, every chunk carries nonce of whole payload. newMsg builds message of every chunk.
+func publishChunks(
+	js nats.JetStreamContext,
+	msgID string,
+	payload []byte,
+	size int,
+	newMsg func(msgID string, data []byte) *nats.Msg,
+) (*nats.PubAck, error) {
+	total := (len(payload) + size - 1) / size
+	var ack *nats.PubAck
+	for i := 0; i < total; i++ {
+		end := (i + 1) * size
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		chunkID := ""
+		if msgID != "" {
+			chunkID = fmt.Sprintf("%s/%d", msgID, i+1)
+		}
+
+		msg := newMsg(chunkID, payload[i*size:end])
+		msg.Header.Set(chunkHeader, fmt.Sprintf("%d/%d", i+1, total))
+		if ack != nil {
+			msg.Header.Set(chunkPrevHeader, strconv.FormatUint(ack.Sequence, 10))
+		}
+
+		var err error
+		ack, err = js.PublishMsg(msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ack, nil
+}
+
+// assembleChunks returns payload of msg, reassembled from all chunks if msg is last chunk
+// of a change. Returns false for other chunks, they carry no change on their own.
+func (r *Replicator) assembleChunks(js nats.JetStreamContext, msg *nats.Msg, meta *nats.MsgMetadata) ([]byte, bool, error) {
+	if isPartialChunk(msg.Header) {
+		return nil, false, nil
+	}
+
+	data, _, err := fetchChunks(js, meta.Stream, msg.Header, msg.Data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return data, true, nil
+}
+
+// isPartialChunk returns true for a chunk other than last one of a change
+func isPartialChunk(header nats.Header) bool {
+	index, total, err := parseChunkHeader(header.Get(chunkHeader))
+	return err == nil && index < total
+}
+
+// fetchChunks returns payload reassembled from a message with header and data and sequences
+// of chunks before it, fetched from stream. Data is returned as is for unchunked messages.
+func fetchChunks(js nats.JetStreamContext, stream string, header nats.Header, data []byte) ([]byte, []uint64, error) {
+	if header.Get(chunkHeader) == "" {
+		return data, nil, nil
+	}
+
+	index, total, err := parseChunkHeader(header.Get(chunkHeader))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if index < total {
+		return nil, nil, fmt.Errorf("chunk %d/%d is not last chunk", index, total)
+	}
+
+	parts := make([][]byte, total)
+	seqs := make([]uint64, 0, total-1)
+	parts[total-1] = data
+	prev := header.Get(chunkPrevHeader)
+	for i := total - 1; i > 0; i-- {
+		seq, err := strconv.ParseUint(prev, 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid previous chunk sequence %q", prev)
+		}
+
+		chunk, err := js.GetMsg(stream, seq, nats.DirectGet())
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to fetch chunk %d/%d at sequence %d: %w", i, total, seq, err)
+		}
+
+		chunkIndex, chunkTotal, err := parseChunkHeader(chunk.Header.Get(chunkHeader))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if chunkIndex != i || chunkTotal != total {
+			return nil, nil, fmt.Errorf("expected chunk %d/%d at sequence %d, found %d/%d", i, total, seq, chunkIndex, chunkTotal)
+		}
+
+		parts[i-1] = chunk.Data
+		seqs = append(seqs, seq)
+		prev = chunk.Header.Get(chunkPrevHeader)
+	}
+
+	return bytes.Join(parts, nil), seqs, nil
+}
+
+func parseChunkHeader(header string) (int, int, error) {
+	index, total := 0, 0
+	_, err := fmt.Sscanf(header, "%d/%d", &index, &total)
+	if err != nil || index < 1 || index > total {
+		return 0, 0, fmt.Errorf("invalid chunk header %q", header)
+	}
+
+	return index, total, nil
+}
@@ -0,0 +1,82 @@
+package logstream
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/maxpert/marmot/cfg"
+)
+
+// codecHeader names codec payload of a change message is encoded with. Messages without it
+// were published by nodes predating per-message codecs and are zstd compressed only on
+// compressed streams.
+const codecHeader = "Marmot-Codec"
+
+// payloadCodec encodes change payloads before publishing and decodes them on receive based on
+// codec header of each message, so nodes publishing with different codecs interoperate.
+type payloadCodec struct {
+	name    string
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func newPayloadCodec(c cfg.ReplicationLogConfiguration) (*payloadCodec, error) {
+	name := c.Codec
+	if name == "" {
+		name = cfg.CodecNone
+		if c.Compress {
+			name = cfg.CodecZstd
+		}
+	}
+
+	_, level := zstd.EncoderLevelFromString(c.ZstdLevel)
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return nil, err
+	}
+
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &payloadCodec{
+		name:    name,
+		encoder: encoder,
+		decoder: decoder,
+	}, nil
+}
+
+func (c *payloadCodec) encode(payload []byte) []byte {
+	switch c.name {
+	case cfg.CodecZstd:
+		return c.encoder.EncodeAll(payload, nil)
+	case cfg.CodecSnappy:
+		return s2.EncodeSnappy(nil, payload)
+	default:
+		return payload
+	}
+}
+
+// decode decodes payload encoded with codec named in header, legacy messages without codec
+// header are zstd compressed if stream is compressed.
+func (c *payloadCodec) decode(codec string, payload []byte, compressedStream bool) ([]byte, error) {
+	if codec == "" {
+		codec = cfg.CodecNone
+		if compressedStream {
+			codec = cfg.CodecZstd
+		}
+	}
+
+	switch codec {
+	case cfg.CodecNone:
+		return payload, nil
+	case cfg.CodecZstd:
+		return c.decoder.DecodeAll(payload, nil)
+	case cfg.CodecSnappy:
+		return s2.Decode(nil, payload)
+	default:
+		return nil, fmt.Errorf("unknown payload codec %q", codec)
+	}
+}
@@ -0,0 +1,98 @@
+package logstream
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/db"
+)
+
+var codecs = []string{cfg.CodecNone, cfg.CodecSnappy, cfg.CodecZstd}
+
+// samplePayload encodes a batch of rows shaped like a typical application table.
+func samplePayload(tb testing.TB, rows int) []byte {
+	tb.Helper()
+
+	ev := &ReplicationEvent[db.ChangeLogEvent]{FromNodeId: 1}
+	for i := 0; i < rows; i++ {
+		ev.Batch = append(ev.Batch, db.ChangeLogEvent{
+			Id:        int64(i + 1),
+			Type:      "insert",
+			TableName: "orders",
+			Row: map[string]any{
+				"id":         int64(i + 1),
+				"customer":   fmt.Sprintf("customer-%d@example.com", i%50),
+				"status":     []string{"pending", "paid", "shipped"}[i%3],
+				"total":      float64(i%500) + 0.99,
+				"notes":      "Leave the parcel at the front door if nobody answers",
+				"created_at": int64(1700000000000 + i*1000),
+			},
+		})
+	}
+
+	ev.Payload = ev.Batch[0]
+	data, err := ev.Marshal()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return data
+}
+
+func newTestCodec(tb testing.TB, name string) *payloadCodec {
+	tb.Helper()
+
+	c, err := newPayloadCodec(cfg.ReplicationLogConfiguration{Codec: name})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return c
+}
+
+func TestCodecsInteroperate(t *testing.T) {
+	payload := samplePayload(t, 10)
+	for _, publisher := range codecs {
+		encoded := newTestCodec(t, publisher).encode(payload)
+		for _, subscriber := range codecs {
+			decoded, err := newTestCodec(t, subscriber).decode(publisher, encoded, false)
+			if err != nil {
+				t.Fatalf("%s subscriber can't decode %s payload: %v", subscriber, publisher, err)
+			}
+
+			if !bytes.Equal(decoded, payload) {
+				t.Fatalf("%s subscriber decoded %s payload incorrectly", subscriber, publisher)
+			}
+		}
+	}
+
+	// Legacy messages without codec header are zstd compressed on compressed streams
+	legacy := newTestCodec(t, cfg.CodecZstd).encode(payload)
+	if decoded, err := newTestCodec(t, cfg.CodecNone).decode("", legacy, true); err != nil || !bytes.Equal(decoded, payload) {
+		t.Fatalf("expected legacy compressed payload decoded, got %v", err)
+	}
+
+	if _, err := newTestCodec(t, cfg.CodecNone).decode("lz4", payload, false); err == nil {
+		t.Fatal("expected unknown codec to be rejected")
+	}
+}
+
+// BenchmarkCodecPayloadSize reports encoded size of a batch of 100 rows for every codec.
+func BenchmarkCodecPayloadSize(b *testing.B) {
+	payload := samplePayload(b, 100)
+	for _, name := range codecs {
+		b.Run(name, func(b *testing.B) {
+			c := newTestCodec(b, name)
+			size := 0
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				size = len(c.encode(payload))
+			}
+
+			b.ReportMetric(float64(size), "bytes/payload")
+			b.ReportMetric(float64(size)/float64(len(payload)), "ratio")
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package logstream
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	deadLetterSubjectHeader  = "Marmot-Original-Subject"
+	deadLetterStreamHeader   = "Marmot-Original-Stream"
+	deadLetterSequenceHeader = "Marmot-Original-Sequence"
+	deadLetterErrorHeader    = "Marmot-Error"
+	deadLetterAttemptsHeader = "Marmot-Attempts"
+	deadLetterNodeHeader     = "Marmot-Node-Id"
+)
+
+var ErrDeadLetterDisabled = errors.New("dead letter stream disabled")
+
+// DeadLetter is a change that failed to apply after all retries, Data is raw payload
+// exactly as it was published on original subject, reassembled if change was chunked.
+type DeadLetter struct {
+	Sequence       uint64    `json:"seq"`
+	Time           time.Time `json:"time"`
+	NodeID         uint64    `json:"node_id"`
+	Subject        string    `json:"subject"`
+	Stream         string    `json:"stream"`
+	StreamSequence uint64    `json:"stream_seq"`
+	Error          string    `json:"error"`
+	Attempts       int       `json:"attempts"`
+	Codec          string    `json:"codec,omitempty"`
+	Encrypted      bool      `json:"encrypted,omitempty"`
+	Data           []byte    `json:"-"`
+	PayloadSize    int       `json:"payload_size"`
+
+	// chunks are sequences of dead letter chunks before Sequence, for payloads too large
+	// for a single message
+	chunks []uint64
+}
+
+// DeadLetters lists up to limit dead lettered changes oldest first.
+func (r *Replicator) DeadLetters(limit int) ([]*DeadLetter, error) {
+	js, err := r.deadLetterStream()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := js.StreamInfo(deadLetterStreamName())
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*DeadLetter, 0)
+	// Sequences of an empty stream are zero, there is no message to fetch
+	for seq := info.State.FirstSeq; seq > 0 && seq <= info.State.LastSeq && len(ret) < limit; seq++ {
+		msg, err := js.GetMsg(deadLetterStreamName(), seq)
+		if err == nats.ErrMsgNotFound {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		// Dead letters split into chunks are listed once by their last chunk
+		if isPartialChunk(msg.Header) {
+			continue
+		}
+
+		letter, err := parseDeadLetter(js, msg)
+		if err != nil {
+			log.Warn().Err(err).Uint64("seq", seq).Msg("Unable to read dead lettered change")
+			continue
+		}
+
+		ret = append(ret, letter)
+	}
+
+	return ret, nil
+}
+
+// ReplayDeadLetter publishes dead lettered change back on its original subject and
+// removes it from dead letter stream. Every node will receive replayed change again.
+func (r *Replicator) ReplayDeadLetter(seq uint64) (SequenceToken, error) {
+	js, err := r.deadLetterStream()
+	if err != nil {
+		return SequenceToken{}, err
+	}
+
+	msg, err := js.GetMsg(deadLetterStreamName(), seq)
+	if err != nil {
+		return SequenceToken{}, err
+	}
+
+	letter, err := parseDeadLetter(js, msg)
+	if err != nil {
+		return SequenceToken{}, err
+	}
+
+	replayID := fmt.Sprintf("replay-%d-%d-%d", r.nodeID, seq, time.Now().UnixNano())
+	newMsg := func(msgID string, data []byte) *nats.Msg {
+		replay := nats.NewMsg(letter.Subject)
+		replay.Data = data
+		for _, name := range payloadHeaders {
+			if v := msg.Header.Get(name); v != "" {
+				replay.Header.Set(name, v)
+			}
+		}
+		replay.Header.Set(nats.MsgIdHdr, msgID)
+		return replay
+	}
+
+	var ack *nats.PubAck
+	if size := r.chunkSize(); len(letter.Data) > size {
+		ack, err = publishChunks(js, replayID, letter.Data, size, newMsg)
+	} else {
+		ack, err = js.PublishMsg(newMsg(replayID, letter.Data))
+	}
+
+	if err != nil {
+		return SequenceToken{}, err
+	}
+
+	for _, chunkSeq := range append(letter.chunks, seq) {
+		err = js.DeleteMsg(deadLetterStreamName(), chunkSeq)
+		if err != nil {
+			return SequenceToken{}, err
+		}
+	}
+
+	log.Info().
+		Uint64("seq", seq).
+		Str("subject", letter.Subject).
+		Uint64("replay_seq", ack.Sequence).
+		Msg("Replayed dead lettered change")
+	return SequenceToken{Stream: ack.Stream, Sequence: ack.Sequence}, nil
+}
+
+// deadLetter publishes change of msg on dead letter stream. Last chunk of a chunked change
+// is dead lettered with payload of all chunks, so replay doesn't depend on chunks still
+// being retained in original stream.
+func (r *Replicator) deadLetter(msg *nats.Msg, meta *nats.MsgMetadata, cause error, attempts int) error {
+	js, err := r.deadLetterStream()
+	if err != nil {
+		return err
+	}
+
+	data := msg.Data
+	if msg.Header.Get(chunkHeader) != "" {
+		payload, _, err := fetchChunks(js, meta.Stream, msg.Header, msg.Data)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("stream", meta.Stream).
+				Uint64("stream_seq", meta.Sequence.Stream).
+				Msg("Unable to reassemble chunked change, dead lettering last chunk only")
+		} else {
+			data = payload
+		}
+	}
+
+	newMsg := func(_ string, data []byte) *nats.Msg {
+		letter := nats.NewMsg(deadLetterSubject())
+		letter.Data = data
+		for _, name := range payloadHeaders {
+			if v := msg.Header.Get(name); v != "" {
+				letter.Header.Set(name, v)
+			}
+		}
+		letter.Header.Set(deadLetterSubjectHeader, msg.Subject)
+		letter.Header.Set(deadLetterStreamHeader, meta.Stream)
+		letter.Header.Set(deadLetterSequenceHeader, strconv.FormatUint(meta.Sequence.Stream, 10))
+		letter.Header.Set(deadLetterErrorHeader, cause.Error())
+		letter.Header.Set(deadLetterAttemptsHeader, strconv.Itoa(attempts))
+		letter.Header.Set(deadLetterNodeHeader, strconv.FormatUint(r.nodeID, 10))
+		return letter
+	}
+
+	var ack *nats.PubAck
+	if size := r.chunkSize(); len(data) > size {
+		ack, err = publishChunks(js, "", data, size, newMsg)
+	} else {
+		ack, err = js.PublishMsg(newMsg("", data))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.Warn().
+		Err(cause).
+		Str("stream", meta.Stream).
+		Uint64("stream_seq", meta.Sequence.Stream).
+		Uint64("seq", ack.Sequence).
+		Msg("Change moved to dead letter stream")
+	return nil
+}
+
+func (r *Replicator) deadLetterStream() (nats.JetStreamContext, error) {
+	if !cfg.Config.ReplicationLog.DeadLetter {
+		return nil, ErrDeadLetterDisabled
+	}
+
+	return r.streamMap[SnapshotShardID], nil
+}
+
+func ensureDeadLetterStream(js nats.JetStreamContext) error {
+	_, err := js.StreamInfo(deadLetterStreamName(), nats.MaxWait(10*time.Second))
+	if err == nats.ErrStreamNotFound {
+		log.Debug().Str("name", deadLetterStreamName()).Msg("Creating dead letter stream")
+		_, err = js.AddStream(makeDeadLetterStreamConfig())
+	}
+
+	return err
+}
+
+func makeDeadLetterStreamConfig() *nats.StreamConfig {
+	replicas := cfg.Config.ReplicationLog.Replicas
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	if replicas > 5 {
+		replicas = 5
+	}
+
+	return &nats.StreamConfig{
+		Name:              deadLetterStreamName(),
+		Subjects:          []string{deadLetterSubject()},
+		Discard:           nats.DiscardOld,
+		MaxMsgs:           cfg.Config.ReplicationLog.MaxEntries,
+		Storage:           nats.FileStorage,
+		Retention:         nats.LimitsPolicy,
+		AllowDirect:       true,
+		MaxConsumers:      -1,
+		MaxMsgsPerSubject: -1,
+		Replicas:          replicas,
+	}
+}
+
+func parseDeadLetter(js nats.JetStreamContext, msg *nats.RawStreamMsg) (*DeadLetter, error) {
+	streamSeq, _ := strconv.ParseUint(msg.Header.Get(deadLetterSequenceHeader), 10, 64)
+	attempts, _ := strconv.Atoi(msg.Header.Get(deadLetterAttemptsHeader))
+	nodeID, _ := strconv.ParseUint(msg.Header.Get(deadLetterNodeHeader), 10, 64)
+
+	data, chunks, err := fetchChunks(js, deadLetterStreamName(), msg.Header, msg.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeadLetter{
+		Sequence:       msg.Sequence,
+		Time:           msg.Time,
+		NodeID:         nodeID,
+		Subject:        msg.Header.Get(deadLetterSubjectHeader),
+		Stream:         msg.Header.Get(deadLetterStreamHeader),
+		StreamSequence: streamSeq,
+		Error:          msg.Header.Get(deadLetterErrorHeader),
+		Attempts:       attempts,
+		Codec:          msg.Header.Get(codecHeader),
+		Encrypted:      msg.Header.Get(nonceHeader) != "",
+		Data:           data,
+		PayloadSize:    len(data),
+		chunks:         chunks,
+	}, nil
+}
+
+func deadLetterStreamName() string {
+	return cfg.Config.NATS.StreamPrefix + "-dead-letter"
+}
+
+func deadLetterSubject() string {
+	return cfg.Config.NATS.SubjectPrefix + "-dead-letter"
+}
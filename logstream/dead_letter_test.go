@@ -0,0 +1,159 @@
+package logstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestReplayChunkedDeadLetter(t *testing.T) {
+	c := withConfig(t)
+	c.ReplicationLog.DeadLetter = true
+	c.ReplicationLog.ChunkSize = 64
+	r := newTestReplicator(t)
+
+	payload := make([]byte, 1000)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	applied := make(chan []byte, 1)
+	streams := make(chan string, 2)
+	rejected := false
+	listen(r, 1, func(data []byte, meta *nats.MsgMetadata) error {
+		streams <- meta.Stream
+		if !rejected {
+			rejected = true
+			return fmt.Errorf("%w: constraint failed", ErrChangeRejected)
+		}
+
+		applied <- data
+		return nil
+	})
+
+	if _, err := r.Publish(1, "big", payload); err != nil {
+		t.Fatal(err)
+	}
+
+	letters := waitDeadLetters(t, r, 1)
+	if !bytes.Equal(decodeDeadLetter(t, r, letters[0]), payload) {
+		t.Fatalf("expected dead letter with whole payload, got %d bytes", letters[0].PayloadSize)
+	}
+
+	// Replay must not depend on chunks retained in original stream
+	js := r.streamMap[1]
+	if err := js.PurgeStream(<-streams); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.ReplayDeadLetter(letters[0].Sequence); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-applied:
+		if !bytes.Equal(data, payload) {
+			t.Fatalf("replayed change doesn't match payload, got %d bytes", len(data))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("replayed change was not applied")
+	}
+
+	if letters, err := r.DeadLetters(10); err != nil || len(letters) != 0 {
+		t.Fatalf("expected replayed dead letter to be removed, got %v %v", letters, err)
+	}
+}
+
+func waitDeadLetters(t *testing.T, r *Replicator, n int) []*DeadLetter {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		letters, err := r.DeadLetters(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(letters) >= n {
+			return letters
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("expected %d dead letters", n)
+	return nil
+}
+
+func decodeDeadLetter(t *testing.T, r *Replicator, letter *DeadLetter) []byte {
+	t.Helper()
+
+	data, err := r.codec.decode(letter.Codec, letter.Data, r.compressionEnabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestUndecodableChangeDeadLettered(t *testing.T) {
+	c := withConfig(t)
+	c.ReplicationLog.DeadLetter = true
+	r := newTestReplicator(t)
+
+	garbage := nats.NewMsg(subjectName(1))
+	garbage.Data = []byte("garbage")
+	garbage.Header.Set(codecHeader, "bogus")
+	if _, err := r.streamMap[1].PublishMsg(garbage); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Publish(1, "valid", []byte("valid")); err != nil {
+		t.Fatal(err)
+	}
+
+	applied := make(chan string, 2)
+	listen(r, 1, func(data []byte, _ *nats.MsgMetadata) error {
+		applied <- string(data)
+		return nil
+	})
+
+	select {
+	case data := <-applied:
+		if data != "valid" {
+			t.Fatalf("expected only valid change applied, got %q", data)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("consumption stopped at undecodable change")
+	}
+
+	letters := waitDeadLetters(t, r, 1)
+	if string(letters[0].Data) != "garbage" || letters[0].Attempts != 1 || letters[0].StreamSequence != 1 {
+		t.Fatalf("expected undecodable change dead lettered once, got %+v", letters[0])
+	}
+}
+
+func TestUndecodableChangeStopsWithoutDeadLetter(t *testing.T) {
+	withConfig(t)
+	r := newTestReplicator(t)
+
+	garbage := nats.NewMsg(subjectName(1))
+	garbage.Data = []byte("garbage")
+	garbage.Header.Set(codecHeader, "bogus")
+	if _, err := r.streamMap[1].PublishMsg(garbage); err != nil {
+		t.Fatal(err)
+	}
+
+	err := r.Listen(1, func([]byte, *nats.MsgMetadata) error {
+		t.Error("undecodable change must not reach listener")
+		return nil
+	})
+	if !errors.Is(err, ErrDecodeFailed) {
+		t.Fatalf("expected %v, got %v", ErrDecodeFailed, err)
+	}
+}
@@ -0,0 +1,97 @@
+package logstream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/maxpert/marmot/cfg"
+)
+
+// nonceHeader carries base64 AES-GCM nonce of an encrypted change payload, messages without
+// it carry plaintext payload.
+const nonceHeader = "Marmot-Nonce"
+
+var ErrPlaintextRejected = errors.New("plaintext change rejected, encryption is required")
+var ErrNoEncryptionKey = errors.New("encrypted change received without encryption key configured")
+
+// payloadCipher encrypts encoded change payloads with AES-GCM before publishing and
+// authenticates and decrypts them on receive.
+type payloadCipher struct {
+	aead    cipher.AEAD
+	require bool
+}
+
+func newPayloadCipher(c cfg.EncryptionConfiguration) (*payloadCipher, error) {
+	key, err := c.LoadKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if key == nil {
+		return &payloadCipher{}, nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &payloadCipher{aead: aead, require: c.Require}, nil
+}
+
+func (c *payloadCipher) enabled() bool {
+	return c.aead != nil
+}
+
+// seal returns payload encrypted with a random nonce and the nonce encoded for nonce header,
+// payload is returned as is with an empty nonce if encryption isn't enabled.
+func (c *payloadCipher) seal(payload []byte) ([]byte, string, error) {
+	if !c.enabled() {
+		return payload, "", nil
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+
+	return c.aead.Seal(nil, nonce, payload, nil), base64.StdEncoding.EncodeToString(nonce), nil
+}
+
+// open authenticates and decrypts payload sealed with nonce from header. Plaintext payloads
+// without nonce are accepted unless encryption is required, so encryption can be rolled out
+// node by node.
+func (c *payloadCipher) open(header string, payload []byte) ([]byte, error) {
+	if header == "" {
+		if c.require {
+			return nil, ErrPlaintextRejected
+		}
+
+		return payload, nil
+	}
+
+	if !c.enabled() {
+		return nil, ErrNoEncryptionKey
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(header)
+	if err != nil || len(nonce) != c.aead.NonceSize() {
+		return nil, fmt.Errorf("invalid payload nonce %q", header)
+	}
+
+	plain, err := c.aead.Open(nil, nonce, payload, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to authenticate encrypted change: %w", err)
+	}
+
+	return plain, nil
+}
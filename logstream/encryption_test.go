@@ -0,0 +1,144 @@
+package logstream
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/nats-io/nats.go"
+)
+
+func testKey(fill byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, 32))
+}
+
+func newTestCipher(t *testing.T, c cfg.EncryptionConfiguration) *payloadCipher {
+	t.Helper()
+
+	ret, err := newPayloadCipher(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ret
+}
+
+func TestEncryptedChangeRoundTrips(t *testing.T) {
+	c := withConfig(t)
+	c.Encryption = cfg.EncryptionConfiguration{Key: testKey(1), Require: true}
+	r := newTestReplicator(t)
+
+	if _, err := r.Publish(1, "secret", []byte("secret row")); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := r.streamMap[1].GetMsg(streamName(1, r.compressionEnabled), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.Header.Get(nonceHeader) == "" || bytes.Contains(stored.Data, []byte("secret row")) {
+		t.Fatalf("expected change stored encrypted with nonce, got %q", stored.Data)
+	}
+
+	applied := make(chan string, 1)
+	listen(r, 1, func(data []byte, _ *nats.MsgMetadata) error {
+		applied <- string(data)
+		return nil
+	})
+
+	select {
+	case data := <-applied:
+		if data != "secret row" {
+			t.Fatalf("expected decrypted change, got %q", data)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for encrypted change")
+	}
+}
+
+func TestPayloadCipherRejectsUnauthenticated(t *testing.T) {
+	sender := newTestCipher(t, cfg.EncryptionConfiguration{Key: testKey(1)})
+	sealed, nonce, err := sender.seal([]byte("row"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plain, err := sender.open(nonce, sealed); err != nil || string(plain) != "row" {
+		t.Fatalf("expected sealed payload to open with same key, got %q (%v)", plain, err)
+	}
+
+	wrongKey := newTestCipher(t, cfg.EncryptionConfiguration{Key: testKey(2)})
+	if plain, err := wrongKey.open(nonce, sealed); err == nil {
+		t.Fatalf("expected payload sealed with another key rejected, got %q", plain)
+	}
+
+	tampered := append([]byte{}, sealed...)
+	tampered[0] ^= 0xff
+	if plain, err := sender.open(nonce, tampered); err == nil {
+		t.Fatalf("expected tampered payload rejected, got %q", plain)
+	}
+
+	if _, err := sender.open("bogus", sealed); err == nil {
+		t.Fatal("expected invalid nonce rejected")
+	}
+
+	if _, err := newTestCipher(t, cfg.EncryptionConfiguration{}).open(nonce, sealed); !errors.Is(err, ErrNoEncryptionKey) {
+		t.Fatalf("expected %v without key, got %v", ErrNoEncryptionKey, err)
+	}
+
+	if plain, err := sender.open("", []byte("row")); err != nil || string(plain) != "row" {
+		t.Fatalf("expected plaintext accepted while not required, got %q (%v)", plain, err)
+	}
+
+	strict := newTestCipher(t, cfg.EncryptionConfiguration{Key: testKey(1), Require: true})
+	if _, err := strict.open("", []byte("row")); !errors.Is(err, ErrPlaintextRejected) {
+		t.Fatalf("expected %v, got %v", ErrPlaintextRejected, err)
+	}
+}
+
+func TestChangeSealedWithWrongKeyDeadLettered(t *testing.T) {
+	c := withConfig(t)
+	c.ReplicationLog.DeadLetter = true
+	c.Encryption = cfg.EncryptionConfiguration{Key: testKey(1)}
+	r := newTestReplicator(t)
+
+	sealed, nonce, err := newTestCipher(t, cfg.EncryptionConfiguration{Key: testKey(2)}).seal(r.codec.encode([]byte("foreign")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := nats.NewMsg(subjectName(1))
+	msg.Data = sealed
+	msg.Header.Set(nonceHeader, nonce)
+	if _, err := r.streamMap[1].PublishMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Publish(1, "valid", []byte("valid")); err != nil {
+		t.Fatal(err)
+	}
+
+	applied := make(chan string, 2)
+	listen(r, 1, func(data []byte, _ *nats.MsgMetadata) error {
+		applied <- string(data)
+		return nil
+	})
+
+	select {
+	case data := <-applied:
+		if data != "valid" {
+			t.Fatalf("expected only authenticated change applied, got %q", data)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("consumption stopped at unauthenticated change")
+	}
+
+	letters := waitDeadLetters(t, r, 1)
+	if letters[0].StreamSequence != 1 || !letters[0].Encrypted {
+		t.Fatalf("expected change sealed with wrong key dead lettered, got %+v", letters[0])
+	}
+}
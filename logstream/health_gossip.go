@@ -0,0 +1,281 @@
+package logstream
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/core"
+	"github.com/maxpert/marmot/telemetry"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+type healthBeacon struct {
+	NodeID    uint64
+	Timestamp int64
+}
+
+// HealthStatus is point in time view of peers this node can reach through NATS.
+type HealthStatus struct {
+	NodeID         uint64   `json:"node_id"`
+	Degraded       bool     `json:"degraded"`
+	ClusterSize    int      `json:"cluster_size"`
+	Quorum         int      `json:"quorum"`
+	ReachablePeers []uint64 `json:"reachable_peers"`
+
+	ClockSkewMillis map[uint64]int64 `json:"clock_skew_millis,omitempty"`
+}
+
+// HealthGossip periodically broadcasts a beacon and tracks beacons of peers. A node that
+// can't reach quorum of configured cluster size (itself included) marks itself degraded,
+// which usually means it's on minority side of a network partition.
+type HealthGossip struct {
+	// OnHealthChange is invoked with new state every time node becomes degraded or healthy
+	OnHealthChange func(degraded bool)
+
+	nc          *nats.Conn
+	sub         *nats.Subscription
+	stop        chan struct{}
+	stopped     chan struct{}
+	lock        *sync.RWMutex
+	lastSeen    map[uint64]time.Time
+	skew        map[uint64]int64
+	degraded    bool
+	clusterSize int
+	interval    time.Duration
+	timeout     time.Duration
+	skewLimit   int64
+	stats       telemetry.Gauge
+	skewStats   telemetry.Gauge
+}
+
+func NewHealthGossip(r *Replicator) *HealthGossip {
+	c := cfg.Config.Health
+	return &HealthGossip{
+		nc:          r.client,
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+		lock:        &sync.RWMutex{},
+		lastSeen:    map[uint64]time.Time{},
+		skew:        map[uint64]int64{},
+		clusterSize: c.ClusterSize,
+		interval:    time.Duration(c.GossipInterval) * time.Millisecond,
+		timeout:     time.Duration(c.PeerTimeout) * time.Millisecond,
+		skewLimit:   int64(c.ClockSkewThreshold),
+		stats:       telemetry.NewGauge("health_degraded", "1 if node can't reach quorum of peers"),
+		skewStats:   telemetry.NewGauge("clock_skew", "largest absolute clock skew to a peer in milliseconds"),
+	}
+}
+
+// Start subscribes to peer beacons and starts broadcasting own beacon if enabled.
+func (h *HealthGossip) Start() error {
+	if !cfg.Config.Health.Gossip {
+		return nil
+	}
+
+	sub, err := h.nc.Subscribe(healthSubject(), func(msg *nats.Msg) {
+		beacon := &healthBeacon{}
+		if err := cbor.Unmarshal(msg.Data, beacon); err != nil {
+			log.Warn().Err(err).Msg("Unable to decode health beacon")
+			return
+		}
+
+		now := time.Now()
+		h.lock.Lock()
+		h.lastSeen[beacon.NodeID] = now
+		if beacon.NodeID != cfg.Config.NodeID {
+			h.trackSkew(beacon.NodeID, beacon.Timestamp-now.UnixMilli())
+		}
+		h.lock.Unlock()
+
+		core.ChangeClock.Observe(core.TimestampFromMillis(beacon.Timestamp))
+	})
+	if err != nil {
+		return err
+	}
+
+	h.sub = sub
+	go h.broadcast()
+	return nil
+}
+
+// Stop stops broadcasting and tracking beacons, health isn't re-evaluated after it returns.
+func (h *HealthGossip) Stop() {
+	if h.sub == nil {
+		return
+	}
+
+	close(h.stop)
+	<-h.stopped
+	_ = h.sub.Unsubscribe()
+	h.sub = nil
+}
+
+// Status returns current health, node is never degraded when gossip is disabled or
+// cluster size isn't configured.
+func (h *HealthGossip) Status() *HealthStatus {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	skew := make(map[uint64]int64, len(h.skew))
+	for nodeID, millis := range h.skew {
+		skew[nodeID] = millis
+	}
+
+	return &HealthStatus{
+		NodeID:         cfg.Config.NodeID,
+		Degraded:       h.degraded,
+		ClusterSize:    h.clusterSize,
+		Quorum:         h.quorum(),
+		ReachablePeers: h.reachablePeers(),
+
+		ClockSkewMillis: skew,
+	}
+}
+
+// trackSkew records clock skew to peer as seen on beacon arrival, which includes delivery
+// latency. Warns once when skew crosses configured threshold and once it's back within.
+func (h *HealthGossip) trackSkew(nodeID uint64, skew int64) {
+	previous, seen := h.skew[nodeID]
+	h.skew[nodeID] = skew
+
+	largest := int64(0)
+	for _, millis := range h.skew {
+		if abs(millis) > largest {
+			largest = abs(millis)
+		}
+	}
+	h.skewStats.Set(float64(largest))
+
+	if h.skewLimit < 1 {
+		return
+	}
+
+	exceeded := abs(skew) > h.skewLimit
+	if seen && exceeded == (abs(previous) > h.skewLimit) {
+		return
+	}
+
+	if exceeded {
+		log.Warn().
+			Uint64("peer", nodeID).
+			Int64("skew_ms", skew).
+			Int64("threshold_ms", h.skewLimit).
+			Msg("Clock skew to peer exceeds threshold, timestamp based conflict resolution is unreliable")
+	} else if seen {
+		log.Info().
+			Uint64("peer", nodeID).
+			Int64("skew_ms", skew).
+			Msg("Clock skew to peer back within threshold")
+	}
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+
+	return v
+}
+
+func (h *HealthGossip) IsDegraded() bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	return h.degraded
+}
+
+func (h *HealthGossip) broadcast() {
+	defer close(h.stopped)
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+
+		beacon := &healthBeacon{NodeID: cfg.Config.NodeID, Timestamp: time.Now().UnixMilli()}
+		payload, err := cbor.Marshal(beacon)
+		if err == nil {
+			err = h.nc.Publish(healthSubject(), payload)
+		}
+
+		if err != nil {
+			log.Warn().Err(err).Msg("Unable to publish health beacon")
+		}
+
+		h.evaluate()
+	}
+}
+
+func (h *HealthGossip) evaluate() {
+	changed, degraded := h.updateDegraded()
+	if changed && h.OnHealthChange != nil {
+		h.OnHealthChange(degraded)
+	}
+}
+
+// updateDegraded re-evaluates reachable peers, returns true with new state if it changed.
+func (h *HealthGossip) updateDegraded() (bool, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.clusterSize < 1 {
+		return false, false
+	}
+
+	reachable := len(h.reachablePeers()) + 1
+	degraded := reachable < h.quorum()
+	changed := degraded != h.degraded
+	if changed {
+		log.Warn().
+			Bool("degraded", degraded).
+			Int("reachable", reachable).
+			Int("quorum", h.quorum()).
+			Msg("Node health changed")
+
+		eventType := core.HealthRestored
+		if degraded {
+			eventType = core.HealthDegraded
+		}
+
+		core.PublishLifecycle(eventType, map[string]any{"reachable": reachable, "quorum": h.quorum()})
+	}
+
+	h.degraded = degraded
+	if degraded {
+		h.stats.Set(1)
+	} else {
+		h.stats.Set(0)
+	}
+
+	return changed, degraded
+}
+
+func (h *HealthGossip) quorum() int {
+	return h.clusterSize/2 + 1
+}
+
+func (h *HealthGossip) reachablePeers() []uint64 {
+	peers := make([]uint64, 0, len(h.lastSeen))
+	for nodeID, seen := range h.lastSeen {
+		if nodeID != cfg.Config.NodeID && time.Since(seen) <= h.timeout {
+			peers = append(peers, nodeID)
+		}
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i] < peers[j]
+	})
+	return peers
+}
+
+func healthSubject() string {
+	return cfg.Config.ControlSubject("health")
+}
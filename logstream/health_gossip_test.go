@@ -0,0 +1,157 @@
+package logstream
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/nats-io/nats.go"
+)
+
+// beaconPeers publishes beacons on behalf of peers until returned stop is called, like nodes
+// on other side of a partition would.
+func beaconPeers(t *testing.T, r *Replicator, peers ...uint64) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			for _, nodeID := range peers {
+				payload, err := cbor.Marshal(&healthBeacon{NodeID: nodeID, Timestamp: time.Now().UnixMilli()})
+				if err == nil {
+					err = r.client.Publish(healthSubject(), payload)
+				}
+
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	once := &sync.Once{}
+	stopBeacons := func() {
+		once.Do(func() {
+			close(stop)
+			<-stopped
+		})
+	}
+
+	t.Cleanup(stopBeacons)
+	return stopBeacons
+}
+
+func TestHealthGossipDegradedOnPartition(t *testing.T) {
+	c := withConfig(t)
+	c.NodeID = 1
+	c.Health.Gossip = true
+	c.Health.ClusterSize = 3
+	c.Health.GossipInterval = 20
+	c.Health.PeerTimeout = 200
+	r := newTestReplicator(t)
+
+	changes := make(chan bool, 8)
+	health := NewHealthGossip(r)
+	health.OnHealthChange = func(degraded bool) {
+		changes <- degraded
+	}
+
+	expect := func(degraded bool) {
+		t.Helper()
+
+		select {
+		case state := <-changes:
+			if state != degraded || health.IsDegraded() != degraded {
+				t.Fatalf("expected degraded %v, got %v", degraded, state)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected degraded %v, state didn't change", degraded)
+		}
+	}
+
+	// Start without any peer reachable, node is on minority side right away
+	if err := health.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(health.Stop)
+	expect(true)
+
+	stopMajority := beaconPeers(t, r, 2, 3)
+	expect(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for status := health.Status(); len(status.ReachablePeers) != 2 || status.Quorum != 2; status = health.Status() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected both peers reachable with quorum of 2, got %+v", status)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Partition cuts node off both peers
+	stopMajority()
+	expect(true)
+
+	// One peer is enough for quorum
+	stopPeer := beaconPeers(t, r, 2)
+	expect(false)
+	stopPeer()
+}
+
+func TestControlAndDataSubjectPrefixes(t *testing.T) {
+	c := withConfig(t)
+	c.NodeID = 1
+	c.NATS.SubjectPrefix = "data"
+	c.NATS.ControlPrefix = "ops"
+	c.Health.Gossip = true
+	c.Health.ClusterSize = 1
+	c.Health.GossipInterval = 20
+	r := newTestReplicator(t)
+
+	received := make(chan *nats.Msg, 64)
+	sub, err := r.client.ChanSubscribe(">", received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sub.Unsubscribe() })
+
+	health := NewHealthGossip(r)
+	if err := health.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(health.Stop)
+
+	if _, err := r.Publish(1, "change", []byte("change")); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]bool{}
+	timeout := time.After(5 * time.Second)
+	for !seen["ops.health"] || !seen["data-1"] {
+		select {
+		case msg := <-received:
+			if strings.HasPrefix(msg.Subject, "$JS.") || strings.HasPrefix(msg.Subject, "_INBOX.") {
+				continue
+			}
+
+			if !strings.HasPrefix(msg.Subject, "ops.") && !strings.HasPrefix(msg.Subject, "data-") {
+				t.Fatalf("message published on %s outside of control and data prefixes", msg.Subject)
+			}
+
+			seen[msg.Subject] = true
+		case <-timeout:
+			t.Fatalf("expected health beacon on ops.health and change on data-1, got %v", seen)
+		}
+	}
+}
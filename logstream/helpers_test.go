@@ -0,0 +1,120 @@
+package logstream
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/snapshot"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	os.Exit(m.Run())
+}
+
+// withConfig restores configuration once test finishes, tests must replace maps and slices
+// of configuration instead of modifying them in place.
+func withConfig(t testing.TB) *cfg.Configuration {
+	saved := *cfg.Config
+	t.Cleanup(func() {
+		*cfg.Config = saved
+	})
+
+	return cfg.Config
+}
+
+// newTestServer starts a standalone JetStream server on a random port.
+func newTestServer(t testing.TB) *server.Server {
+	t.Helper()
+
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		NoSigs:    true,
+		NoLog:     true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Start()
+	t.Cleanup(s.Shutdown)
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+
+	return s
+}
+
+// newTestReplicator connects a replicator to a fresh JetStream server, configuration has to be
+// adjusted through withConfig before calling it.
+func newTestReplicator(t testing.TB) *Replicator {
+	t.Helper()
+
+	s := newTestServer(t)
+	cfg.Config.NATS.URLs = []string{s.ClientURL()}
+	cfg.Config.SeqMapPath = filepath.Join(t.TempDir(), "seq-map.cbor")
+
+	r, err := NewReplicator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(r.client.Close)
+	return r
+}
+
+// listen runs listener of shard in background until replicator is closed.
+func listen(r *Replicator, shardID uint64, callback func(payload []byte, meta *nats.MsgMetadata) error) {
+	go func() {
+		_ = r.Listen(shardID, callback)
+	}()
+}
+
+// fakeSnapshot records saved snapshots instead of uploading them.
+type fakeSnapshot struct {
+	lock  *sync.Mutex
+	last  time.Time
+	err   error
+	saved []map[string]uint64
+}
+
+func newFakeSnapshot(last time.Time, err error) *fakeSnapshot {
+	return &fakeSnapshot{lock: &sync.Mutex{}, last: last, err: err}
+}
+
+func (f *fakeSnapshot) SaveSnapshot(seqs map[string]uint64) (*snapshot.Info, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.saved = append(f.saved, seqs)
+	f.last, f.err = time.Now(), nil
+	return &snapshot.Info{Name: "snapshot.db", Checksum: "checksum", SavedAt: f.last, Sequences: seqs}, nil
+}
+
+func (f *fakeSnapshot) RestoreSnapshot() (map[string]uint64, error) {
+	return nil, snapshot.ErrNoSnapshotFound
+}
+
+func (f *fakeSnapshot) LastSnapshotTime() (time.Time, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.last, f.err
+}
+
+func (f *fakeSnapshot) savedCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.saved)
+}
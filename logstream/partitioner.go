@@ -0,0 +1,43 @@
+package logstream
+
+import (
+	"hash/fnv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Partitioner picks shard index (0 to shards-1) for a change of table identified by key.
+// Same key must always map to same index so that changes of a row stay in order.
+type Partitioner interface {
+	Partition(table string, key []byte, shards int) int
+}
+
+// HashPartitioner is default partitioner distributing keys by their FNV-1 hash.
+type HashPartitioner struct{}
+
+func (HashPartitioner) Partition(_ string, key []byte, shards int) int {
+	hasher := fnv.New64()
+	_, _ = hasher.Write(key)
+	return int(hasher.Sum64() % uint64(shards))
+}
+
+// SetPartitioner replaces partitioner used for tables without explicit shard assignment,
+// it must be set before any change is published.
+func (r *Replicator) SetPartitioner(p Partitioner) {
+	r.partitioner = p
+}
+
+func (r *Replicator) partition(table string, key []byte) uint64 {
+	shards := int(r.shards)
+	index := r.partitioner.Partition(table, key, shards)
+	if index < 0 || index >= shards {
+		log.Error().
+			Str("table", table).
+			Int("index", index).
+			Int("shards", shards).
+			Msg("Partitioner returned out of range shard, wrapping around")
+		index = ((index % shards) + shards) % shards
+	}
+
+	return uint64(index) + 1
+}
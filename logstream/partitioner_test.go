@@ -0,0 +1,66 @@
+package logstream
+
+import (
+	"strconv"
+	"testing"
+)
+
+// modPartitioner routes decimal keys round robin, which spreads sequential IDs evenly.
+type modPartitioner struct {
+	offset int
+}
+
+func (p modPartitioner) Partition(_ string, key []byte, shards int) int {
+	id, _ := strconv.Atoi(string(key))
+	return id%shards + p.offset
+}
+
+func TestCustomPartitionerOverridesRouting(t *testing.T) {
+	r := &Replicator{shards: 4, partitioner: HashPartitioner{}}
+	r.SetPartitioner(modPartitioner{})
+
+	for id := 0; id < 8; id++ {
+		key := []byte(strconv.Itoa(id))
+		expected := uint64(id%4) + 1
+		if shardID := r.ShardOf("books", key); shardID != expected {
+			t.Fatalf("expected key %d on shard %d, got %d", id, expected, shardID)
+		}
+
+		if shardID := r.ShardOf("books", key); shardID != expected {
+			t.Fatalf("expected key %d to stay on shard %d, got %d", id, expected, shardID)
+		}
+	}
+}
+
+func TestPartitionerOutOfRangeWrapsAround(t *testing.T) {
+	r := &Replicator{shards: 4, partitioner: modPartitioner{offset: -6}}
+
+	for id := 0; id < 8; id++ {
+		shardID := r.ShardOf("books", []byte(strconv.Itoa(id)))
+		if shardID < 1 || shardID > 4 {
+			t.Fatalf("expected shard within 1-4 for key %d, got %d", id, shardID)
+		}
+	}
+}
+
+func TestHashPartitionerStable(t *testing.T) {
+	p := HashPartitioner{}
+	for _, key := range []string{"1", "2", "books-42"} {
+		first := p.Partition("books", []byte(key), 8)
+		if first < 0 || first >= 8 || p.Partition("books", []byte(key), 8) != first {
+			t.Fatalf("expected stable in range partition for %q, got %d", key, first)
+		}
+	}
+}
+
+func TestShardOfStableAcrossInvocations(t *testing.T) {
+	for _, key := range []string{"1", "42", "books-42"} {
+		expected := (&Replicator{shards: 8, partitioner: HashPartitioner{}}).ShardOf("books", []byte(key))
+		for i := 0; i < 1000; i++ {
+			r := &Replicator{shards: 8, partitioner: HashPartitioner{}}
+			if shardID := r.ShardOf("books", []byte(key)); shardID != expected {
+				t.Fatalf("expected key %q routed to shard %d, got %d on invocation %d", key, expected, shardID, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package logstream
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/maxpert/marmot/telemetry"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+const publishRetryInterval = time.Second
+
+// ErrPublishBuffered is returned when payload couldn't be published right away because
+// stream has no leader, payload is retried in order once stream becomes available.
+var ErrPublishBuffered = errors.New("publish buffered until stream leader is available")
+
+type bufferedPublish struct {
+	shardID uint64
+	msgID   string
+	nonce   string
+	payload []byte
+}
+
+type statsPublishBuffer struct {
+	buffered telemetry.Counter
+	dropped  telemetry.Counter
+	pending  telemetry.Gauge
+}
+
+// publishBuffer holds payloads that failed publishing due to stream leader loss. Once
+// anything is buffered all subsequent payloads are queued behind it to keep order.
+type publishBuffer struct {
+	lock    *sync.Mutex
+	entries []*bufferedPublish
+	size    int
+	wake    chan struct{}
+	stats   *statsPublishBuffer
+}
+
+func newPublishBuffer(size int) *publishBuffer {
+	return &publishBuffer{
+		lock:    &sync.Mutex{},
+		entries: make([]*bufferedPublish, 0),
+		size:    size,
+		wake:    make(chan struct{}, 1),
+		stats: &statsPublishBuffer{
+			buffered: telemetry.NewCounter("publish_buffered", "number of publishes buffered due to stream leader loss"),
+			dropped:  telemetry.NewCounter("publish_buffer_dropped", "number of buffered publishes dropped due to full buffer"),
+			pending:  telemetry.NewGauge("publish_buffer_pending", "publishes waiting in buffer for stream leader"),
+		},
+	}
+}
+
+func (b *publishBuffer) enabled() bool {
+	return b.size > 0
+}
+
+func (b *publishBuffer) isEmpty() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return len(b.entries) == 0
+}
+
+// push enqueues payload, dropping oldest entry if buffer is full.
+func (b *publishBuffer) push(shardID uint64, msgID string, nonce string, payload []byte) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.entries) >= b.size {
+		b.entries = b.entries[1:]
+		b.stats.dropped.Inc()
+		log.Error().
+			Int("size", b.size).
+			Msg("Publish buffer full, dropping oldest change")
+	}
+
+	b.entries = append(b.entries, &bufferedPublish{shardID: shardID, msgID: msgID, nonce: nonce, payload: payload})
+	b.stats.buffered.Inc()
+	b.stats.pending.Set(float64(len(b.entries)))
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (b *publishBuffer) peek() *bufferedPublish {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.entries) == 0 {
+		return nil
+	}
+
+	return b.entries[0]
+}
+
+func (b *publishBuffer) pop(entry *bufferedPublish) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// Entry might have been dropped by push while it was being published
+	if len(b.entries) != 0 && b.entries[0] == entry {
+		b.entries = b.entries[1:]
+	}
+
+	b.stats.pending.Set(float64(len(b.entries)))
+}
+
+// drain publishes buffered payloads in order, waiting between attempts while stream
+// leader is unavailable.
+func (b *publishBuffer) drain(publish func(shardID uint64, msgID string, nonce string, payload []byte) error) {
+	for range b.wake {
+		for entry := b.peek(); entry != nil; entry = b.peek() {
+			err := publish(entry.shardID, entry.msgID, entry.nonce, entry.payload)
+			if err != nil {
+				log.Warn().
+					Err(err).
+					Uint64("shard", entry.shardID).
+					Msg("Unable to publish buffered change, retrying...")
+				time.Sleep(publishRetryInterval)
+				continue
+			}
+
+			b.pop(entry)
+		}
+
+		log.Info().Msg("Publish buffer drained")
+	}
+}
+
+func isLeaderLossError(err error) bool {
+	if errors.Is(err, nats.ErrNoStreamResponse) ||
+		errors.Is(err, nats.ErrNoResponders) ||
+		errors.Is(err, nats.ErrTimeout) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var apiErr *nats.APIError
+	return errors.As(err, &apiErr) && apiErr.Code == 503
+}
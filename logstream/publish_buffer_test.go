@@ -0,0 +1,64 @@
+package logstream
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/nats-io/nats.go"
+)
+
+func TestLeaderLossBuffersPublishes(t *testing.T) {
+	c := withConfig(t)
+	c.ReplicationLog.PublishBufferSize = 16
+	r := newTestReplicator(t)
+
+	name := streamName(1, r.compressionEnabled)
+	js := r.streamMap[1]
+	if err := js.DeleteStream(name); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without stream nothing responds to publish, same as while stream has no leader
+	for _, payload := range []string{"first", "second"} {
+		if _, err := r.Publish(1, payload, []byte(payload)); !errors.Is(err, ErrPublishBuffered) {
+			t.Fatalf("expected publish of %s to be buffered, got %v", payload, err)
+		}
+	}
+
+	if r.publishBuffer.isEmpty() {
+		t.Fatal("expected buffered publishes")
+	}
+
+	_, err := js.AddStream(makeShardStreamConfig(1, cfg.Config.ReplicationLog.Shards, r.compressionEnabled))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 2)
+	listen(r, 1, func(payload []byte, _ *nats.MsgMetadata) error {
+		received <- string(payload)
+		return nil
+	})
+
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case payload := <-received:
+			if payload != expected {
+				t.Fatalf("expected %s applied in order, got %s", expected, payload)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("buffered change %s was not applied", expected)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !r.publishBuffer.isEmpty() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected publish buffer to be drained")
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -8,6 +8,7 @@ import (
 type ReplicationEvent[T core.ReplicableEvent[T]] struct {
 	FromNodeId uint64
 	Payload    T
+	Batch      []T `cbor:",omitempty"`
 }
 
 func (e *ReplicationEvent[T]) Marshal() ([]byte, error) {
@@ -16,9 +17,20 @@ func (e *ReplicationEvent[T]) Marshal() ([]byte, error) {
 		return nil, err
 	}
 
+	wrappedBatch := make([]T, 0, len(e.Batch))
+	for _, p := range e.Batch {
+		w, err := p.Wrap()
+		if err != nil {
+			return nil, err
+		}
+
+		wrappedBatch = append(wrappedBatch, w)
+	}
+
 	ev := ReplicationEvent[T]{
 		FromNodeId: e.FromNodeId,
 		Payload:    wrappedPayload,
+		Batch:      wrappedBatch,
 	}
 
 	em, err := cbor.EncOptions{}.EncModeWithTags(core.CBORTags)
@@ -45,5 +57,12 @@ func (e *ReplicationEvent[T]) Unmarshal(data []byte) error {
 		return err
 	}
 
+	for i, p := range e.Batch {
+		e.Batch[i], err = p.Unwrap()
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
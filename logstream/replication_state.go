@@ -1,6 +1,7 @@
 package logstream
 
 import (
+	"context"
 	"errors"
 	"io"
 	"os"
@@ -12,10 +13,19 @@ import (
 
 var ErrNotInitialized = errors.New("not initialized")
 
+// SequenceStore keeps last applied sequence of streams in database, saved in same transaction
+// as applied changes. Sequence map file is only saved after changes are committed, so after a
+// crash in between store is ahead of file.
+type SequenceStore interface {
+	AppliedSeq(stream string) (uint64, error)
+	SetAppliedSeq(stream string, seq uint64) error
+}
+
 type replicationState struct {
-	seq  map[string]uint64
-	lock *sync.RWMutex
-	fl   *os.File
+	seq     map[string]uint64
+	lock    *sync.RWMutex
+	fl      *os.File
+	changed chan struct{}
 }
 
 func (r *replicationState) init() error {
@@ -27,6 +37,7 @@ func (r *replicationState) init() error {
 	r.seq = make(map[string]uint64)
 	r.lock = &sync.RWMutex{}
 	r.fl = fl
+	r.changed = make(chan struct{})
 
 	idx, err := fl.Seek(0, io.SeekEnd)
 	if err != nil {
@@ -68,9 +79,74 @@ func (r *replicationState) save(streamName string, seq uint64) (uint64, error) {
 		return 0, err
 	}
 
+	close(r.changed)
+	r.changed = make(chan struct{})
+	return seq, nil
+}
+
+// set overwrites saved sequence of stream, unlike save it also moves sequence backwards.
+func (r *replicationState) set(streamName string, seq uint64) (uint64, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.fl == nil {
+		return 0, ErrNotInitialized
+	}
+
+	r.seq[streamName] = seq
+	err := r.fl.Truncate(0)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = r.fl.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	defer r.fl.Sync()
+
+	err = cbor.NewEncoder(r.fl).Encode(r.seq)
+	if err != nil {
+		return 0, err
+	}
+
+	close(r.changed)
+	r.changed = make(chan struct{})
 	return seq, nil
 }
 
+// wait blocks until saved sequence of stream reaches seq or ctx is done.
+func (r *replicationState) wait(ctx context.Context, streamName string, seq uint64) error {
+	for {
+		r.lock.RLock()
+		current := r.seq[streamName]
+		changed := r.changed
+		r.lock.RUnlock()
+
+		if current >= seq {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// all returns copy of saved sequences of every stream.
+func (r *replicationState) all() map[string]uint64 {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	ret := make(map[string]uint64, len(r.seq))
+	for streamName, seq := range r.seq {
+		ret[streamName] = seq
+	}
+
+	return ret
+}
+
 func (r *replicationState) get(streamName string) uint64 {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
@@ -4,13 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/maxpert/marmot/stream"
 
-	"github.com/klauspost/compress/zstd"
 	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/core"
 	"github.com/maxpert/marmot/snapshot"
+	"github.com/maxpert/marmot/telemetry"
 	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
 )
@@ -18,26 +21,93 @@ import (
 const maxReplicateRetries = 7
 const SnapshotShardID = uint64(1)
 
+// GlobalOrderShardID is shard globally ordered tables without explicit shard are published on.
+const GlobalOrderShardID = uint64(1)
+
 var SnapshotLeaseTTL = 10 * time.Second
+var ErrTableShardMissing = errors.New("table has no shard assigned")
+
+var ErrUnknownShard = errors.New("unknown shard")
+var ErrShardNotListening = errors.New("shard is not being consumed")
+var ErrSnapshotsDisabled = errors.New("snapshots are disabled")
+var ErrSnapshotLocked = errors.New("snapshot is being saved by another node")
+
+// ErrDecodeFailed marks changes that can't be decoded, retrying them never succeeds.
+var ErrDecodeFailed = errors.New("unable to decode change")
+
+// ErrChangeRejected marks changes rejected by application, they're dead lettered right away.
+var ErrChangeRejected = errors.New("change rejected")
+
+// SequenceToken identifies position of a published change within its JetStream, it
+// can be handed to WaitForSequence on any node for read-your-writes consistency.
+type SequenceToken struct {
+	Table    string `json:"table,omitempty"`
+	Stream   string `json:"stream"`
+	Sequence uint64 `json:"seq"`
+}
+
+// ConsumerStatus summarizes state of a JetStream consumer managed by replicator.
+type ConsumerStatus struct {
+	Shard          uint64    `json:"shard"`
+	Stream         string    `json:"stream"`
+	Name           string    `json:"name"`
+	Durable        string    `json:"durable"`
+	Created        time.Time `json:"created"`
+	Delivered      uint64    `json:"delivered_seq"`
+	AckFloor       uint64    `json:"ack_floor_seq"`
+	NumAckPending  int       `json:"num_ack_pending"`
+	NumRedelivered int       `json:"num_redelivered"`
+	NumWaiting     int       `json:"num_waiting"`
+	NumPending     uint64    `json:"num_pending"`
+}
 
 type Replicator struct {
 	nodeID             uint64
 	shards             uint64
+	streams            uint64
 	compressionEnabled bool
 	lastSnapshot       time.Time
 
 	client    *nats.Conn
 	repState  *replicationState
+	seqStore  SequenceStore
 	metaStore *replicatorMetaStore
 	snapshot  snapshot.NatsSnapshot
 	streamMap map[uint64]nats.JetStreamContext
+
+	tableShards   map[string]uint64
+	tableStreams  map[string]uint64
+	globalTables  map[string]bool
+	partitioner   Partitioner
+	publishBuffer *publishBuffer
+	catchUp       *catchUpThrottle
+	codec         *payloadCodec
+	cipher        *payloadCipher
+	consumerLag   telemetry.Vec[telemetry.Gauge]
+
+	publishedLock *sync.RWMutex
+	lastPublished map[string]SequenceToken
+
+	subsLock      *sync.RWMutex
+	subscriptions map[uint64]*nats.Subscription
+	recreateReqs  map[uint64]chan *consumerRequest
+}
+
+// consumerRequest asks listener of a shard to recreate its consumer, optionally moving
+// applied watermark of shard to seq first.
+type consumerRequest struct {
+	setSeq bool
+	seq    uint64
+	reply  chan error
 }
 
 func NewReplicator(
 	snapshot snapshot.NatsSnapshot,
+	seqStore SequenceStore,
 ) (*Replicator, error) {
 	nodeID := cfg.Config.NodeID
 	shards := cfg.Config.ReplicationLog.Shards
+	streams := cfg.Config.StreamCount()
 	compress := cfg.Config.ReplicationLog.Compress
 	updateExisting := cfg.Config.ReplicationLog.UpdateExisting
 
@@ -47,7 +117,7 @@ func NewReplicator(
 	}
 
 	streamMap := map[uint64]nats.JetStreamContext{}
-	for i := uint64(0); i < shards; i++ {
+	for i := uint64(0); i < streams; i++ {
 		shard := i + 1
 		js, err := nc.JetStream()
 		if err != nil {
@@ -100,6 +170,13 @@ func NewReplicator(
 		streamMap[shard] = js
 	}
 
+	if cfg.Config.ReplicationLog.DeadLetter {
+		err = ensureDeadLetterStream(streamMap[SnapshotShardID])
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	repState := &replicationState{}
 	err = repState.init()
 	if err != nil {
@@ -111,22 +188,122 @@ func NewReplicator(
 		return nil, err
 	}
 
-	return &Replicator{
+	codec, err := newPayloadCodec(cfg.Config.ReplicationLog)
+	if err != nil {
+		return nil, err
+	}
+
+	payloadCipher, err := newPayloadCipher(cfg.Config.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	recreateReqs := map[uint64]chan *consumerRequest{}
+	for shard := uint64(1); shard <= streams; shard++ {
+		recreateReqs[shard] = make(chan *consumerRequest)
+	}
+
+	streamShards := map[string]uint64{}
+	for i, name := range cfg.Config.TableStreams() {
+		streamShards[name] = shards + uint64(i) + 1
+	}
+
+	tableShards := map[string]uint64{}
+	tableStreams := map[string]uint64{}
+	globalTables := map[string]bool{}
+	for name, table := range cfg.Config.Replication.Tables {
+		if table.Shard != 0 {
+			tableShards[name] = table.Shard
+		} else if table.Stream != "" {
+			tableStreams[name] = streamShards[table.Stream]
+		} else if table.Ordering == cfg.OrderingGlobal {
+			globalTables[name] = true
+		}
+	}
+
+	r := &Replicator{
 		client:             nc,
 		nodeID:             nodeID,
 		compressionEnabled: compress,
 		lastSnapshot:       time.Time{},
 
-		shards:    shards,
-		streamMap: streamMap,
-		snapshot:  snapshot,
-		repState:  repState,
-		metaStore: metaStore,
-	}, nil
+		shards:       shards,
+		streams:      streams,
+		streamMap:    streamMap,
+		tableShards:  tableShards,
+		tableStreams: tableStreams,
+		globalTables: globalTables,
+		partitioner:  HashPartitioner{},
+		snapshot:     snapshot,
+		repState:     repState,
+		metaStore:    metaStore,
+
+		publishedLock: &sync.RWMutex{},
+		lastPublished: map[string]SequenceToken{},
+
+		subsLock:      &sync.RWMutex{},
+		subscriptions: map[uint64]*nats.Subscription{},
+		recreateReqs:  recreateReqs,
+
+		publishBuffer: newPublishBuffer(cfg.Config.ReplicationLog.PublishBufferSize),
+		seqStore:      seqStore,
+		codec:         codec,
+		cipher:        payloadCipher,
+		consumerLag:   telemetry.NewGaugeVec("consumer_lag", "changes published to shard stream but not yet applied", "shard"),
+		catchUp: newCatchUpThrottle(
+			cfg.Config.ReplicationLog.CatchUpRate,
+			cfg.Config.ReplicationLog.CatchUpThreshold,
+		),
+	}
+
+	if r.publishBuffer.enabled() {
+		go r.publishBuffer.drain(func(shardID uint64, msgID string, nonce string, payload []byte) error {
+			_, err := r.publishNow(r.streamMap[shardID], shardID, msgID, nonce, payload)
+			return err
+		})
+	}
+
+	return r, nil
 }
 
-func (r *Replicator) Publish(hash uint64, payload []byte) error {
-	shardID := (hash % r.shards) + 1
+// ShardOf returns shard ID a change of table with given partition key is published on.
+// Tables with a shard or dedicated stream assigned in configuration always go to that shard,
+// globally ordered tables go to GlobalOrderShardID, rest are distributed by partitioner.
+func (r *Replicator) ShardOf(table string, key []byte) uint64 {
+	if shardID, ok := r.tableShards[table]; ok {
+		return shardID
+	}
+
+	if shardID, ok := r.tableStreams[table]; ok {
+		return shardID
+	}
+
+	if r.globalTables[table] {
+		return GlobalOrderShardID
+	}
+
+	return r.partition(table, key)
+}
+
+// ValidateTableShards makes sure every table maps to exactly one shard once explicit
+// shard assignment is used, so that no table silently falls back to hash routing.
+func (r *Replicator) ValidateTableShards(tables []string) error {
+	if len(r.tableShards) == 0 {
+		return nil
+	}
+
+	for _, table := range tables {
+		if _, ok := r.tableShards[table]; !ok && r.tableStreams[table] == 0 && !r.globalTables[table] {
+			return fmt.Errorf("%w: %s", ErrTableShardMissing, table)
+		}
+	}
+
+	return nil
+}
+
+// Publish publishes payload on shard stream, non-empty msgID is set as Nats-Msg-Id so
+// JetStream drops republished copies of same change within its duplicates window.
+func (r *Replicator) Publish(shardID uint64, msgID string, payload []byte) (SequenceToken, error) {
 	js, ok := r.streamMap[shardID]
 	if !ok {
 		log.Panic().
@@ -134,50 +311,136 @@ func (r *Replicator) Publish(hash uint64, payload []byte) error {
 			Msg("Invalid shard")
 	}
 
-	if r.compressionEnabled {
-		compPayload, err := payloadCompress(payload)
-		if err != nil {
-			return err
-		}
+	// Payload is sealed once, so retried and chunked publishes share the same nonce
+	payload, nonce, err := r.cipher.seal(r.codec.encode(payload))
+	if err != nil {
+		return SequenceToken{}, err
+	}
 
-		payload = compPayload
+	if r.publishBuffer.enabled() && !r.publishBuffer.isEmpty() {
+		r.publishBuffer.push(shardID, msgID, nonce, payload)
+		return SequenceToken{}, ErrPublishBuffered
+	}
+
+	token, err := r.publishNow(js, shardID, msgID, nonce, payload)
+	if err != nil && r.publishBuffer.enabled() && isLeaderLossError(err) {
+		log.Warn().
+			Err(err).
+			Uint64("shard", shardID).
+			Msg("Stream leader unavailable, buffering change")
+		r.publishBuffer.push(shardID, msgID, nonce, payload)
+		return SequenceToken{}, ErrPublishBuffered
+	}
+
+	return token, err
+}
+
+func (r *Replicator) publishNow(js nats.JetStreamContext, shardID uint64, msgID string, nonce string, payload []byte) (SequenceToken, error) {
+	var ack *nats.PubAck
+	var err error
+	if size := r.chunkSize(); len(payload) > size {
+		ack, err = publishChunks(js, msgID, payload, size, func(id string, data []byte) *nats.Msg {
+			return r.changeMsg(shardID, id, nonce, data)
+		})
+	} else {
+		ack, err = js.PublishMsg(r.changeMsg(shardID, msgID, nonce, payload))
 	}
 
-	ack, err := js.Publish(subjectName(shardID), payload)
 	if err != nil {
-		return err
+		return SequenceToken{}, err
 	}
 
-	if cfg.Config.Snapshot.Enable {
-		seq, err := r.repState.save(ack.Stream, ack.Sequence)
-		if err != nil {
-			return err
-		}
+	if ack.Duplicate {
+		log.Debug().
+			Str("msg_id", msgID).
+			Str("stream", ack.Stream).
+			Uint64("seq", ack.Sequence).
+			Msg("Change already published, dropped as duplicate")
+	}
 
+	// Applied sequences are only saved once listener applies the change, saving published
+	// sequence here would let waits and snapshots pass changes not applied locally yet
+	token := SequenceToken{Stream: ack.Stream, Sequence: ack.Sequence}
+	if cfg.Config.Snapshot.Enable && !ack.Duplicate {
 		snapshotEntries := uint64(cfg.Config.ReplicationLog.MaxEntries) / r.shards
-		if snapshotEntries != 0 && seq%snapshotEntries == 0 && shardID == SnapshotShardID {
+		if snapshotEntries != 0 && ack.Sequence%snapshotEntries == 0 && shardID == SnapshotShardID {
 			log.Debug().
-				Uint64("seq", seq).
+				Uint64("seq", ack.Sequence).
 				Str("stream", ack.Stream).
 				Msg("Initiating save snapshot")
 			go r.SaveSnapshot()
 		}
 	}
 
-	return nil
+	return token, nil
 }
 
-func (r *Replicator) Listen(shardID uint64, callback func(payload []byte) error) error {
+// RecordPublished remembers token as latest change published for table.
+func (r *Replicator) RecordPublished(table string, token SequenceToken) {
+	r.publishedLock.Lock()
+	defer r.publishedLock.Unlock()
+
+	token.Table = table
+	r.lastPublished[table] = token
+}
+
+// LastPublished returns token of latest change this node published for table, clients
+// can pass it to WaitForSequence on a replica to read their own writes.
+func (r *Replicator) LastPublished(table string) (SequenceToken, bool) {
+	r.publishedLock.RLock()
+	defer r.publishedLock.RUnlock()
+
+	token, ok := r.lastPublished[table]
+	return token, ok
+}
+
+// WaitForSequence blocks until change identified by token has been applied locally
+// or ctx is done. Changes within a stream are applied in order, so reaching token's
+// sequence guarantees the change and everything before it in stream is applied.
+func (r *Replicator) WaitForSequence(ctx context.Context, token SequenceToken) error {
+	return r.repState.wait(ctx, token.Stream, token.Sequence)
+}
+
+func (r *Replicator) Listen(shardID uint64, callback func(payload []byte, meta *nats.MsgMetadata) error) error {
 	js := r.streamMap[shardID]
 
 	sub, err := js.SubscribeSync(subjectName(shardID))
 	if err != nil {
 		return err
 	}
-	defer sub.Unsubscribe()
+	defer func() {
+		sub.Unsubscribe()
+	}()
+
+	r.trackSubscription(shardID, sub)
+	defer r.untrackSubscription(shardID)
 
-	savedSeq := r.repState.get(streamName(shardID, r.compressionEnabled))
+	savedSeq, err := r.resumeSeq(streamName(shardID, r.compressionEnabled))
+	if err != nil {
+		return err
+	}
+
+	catchingUp := false
+	lag := r.consumerLag.With(strconv.FormatUint(shardID, 10))
 	for sub.IsValid() {
+		select {
+		case req := <-r.recreateReqs[shardID]:
+			if req.setSeq {
+				savedSeq, err = r.setAppliedSeq(streamName(shardID, r.compressionEnabled), req.seq)
+				if err != nil {
+					req.reply <- err
+					return err
+				}
+			}
+
+			sub, err = r.recreateSubscription(js, shardID, sub, savedSeq)
+			req.reply <- err
+			if err != nil {
+				return err
+			}
+		default:
+		}
+
 		msg, err := sub.NextMsg(5 * time.Second)
 		if errors.Is(err, nats.ErrTimeout) {
 			continue
@@ -196,7 +459,20 @@ func (r *Replicator) Listen(shardID uint64, callback func(payload []byte) error)
 			continue
 		}
 
-		err = r.invokeListener(callback, msg)
+		behind := r.catchUp.behind(meta.NumPending)
+		logCatchUpTransition(shardID, meta.NumPending, catchingUp, behind)
+		catchingUp = behind
+		r.catchUp.wait(meta.NumPending)
+
+		err = r.invokeListener(js, callback, msg, meta)
+		if errors.Is(err, ErrDecodeFailed) {
+			err = r.handleUndecodable(msg, meta, err)
+		} else if errors.Is(err, ErrChangeRejected) && cfg.Config.ReplicationLog.DeadLetter {
+			err = r.deadLetter(msg, meta, err, 1)
+		} else if err != nil && !errors.Is(err, context.Canceled) && cfg.Config.ReplicationLog.DeadLetter {
+			err = r.deadLetter(msg, meta, err, maxReplicateRetries)
+		}
+
 		if err != nil {
 			msg.Nak()
 			if errors.Is(err, context.Canceled) {
@@ -216,11 +492,168 @@ func (r *Replicator) Listen(shardID uint64, callback func(payload []byte) error)
 		if err != nil {
 			return err
 		}
+
+		lag.Set(float64(meta.NumPending))
 	}
 
 	return nil
 }
 
+func (r *Replicator) changeMsg(shardID uint64, msgID string, nonce string, payload []byte) *nats.Msg {
+	msg := nats.NewMsg(subjectName(shardID))
+	msg.Data = payload
+	msg.Header.Set(codecHeader, r.codec.name)
+	if nonce != "" {
+		msg.Header.Set(nonceHeader, nonce)
+	}
+	if msgID != "" {
+		msg.Header.Set(nats.MsgIdHdr, msgID)
+	}
+
+	return msg
+}
+
+// resumeSeq returns sequence of stream to resume after, database may be ahead of sequence map
+// file if process crashed after committing changes, sequence map catches up in that case.
+func (r *Replicator) resumeSeq(streamName string) (uint64, error) {
+	savedSeq := r.repState.get(streamName)
+	if r.seqStore == nil {
+		return savedSeq, nil
+	}
+
+	storedSeq, err := r.seqStore.AppliedSeq(streamName)
+	if err != nil {
+		return 0, err
+	}
+
+	if storedSeq <= savedSeq {
+		return savedSeq, nil
+	}
+
+	log.Info().
+		Str("stream", streamName).
+		Uint64("seq_map", savedSeq).
+		Uint64("db", storedSeq).
+		Msg("Resuming from applied sequence saved in database")
+	return r.repState.save(streamName, storedSeq)
+}
+
+// setAppliedSeq overwrites applied sequence in both sequence map and database.
+func (r *Replicator) setAppliedSeq(streamName string, seq uint64) (uint64, error) {
+	if r.seqStore != nil {
+		if err := r.seqStore.SetAppliedSeq(streamName, seq); err != nil {
+			return 0, err
+		}
+	}
+
+	return r.repState.set(streamName, seq)
+}
+
+// RecreateConsumer replaces consumer of shard with a fresh one starting right after last
+// applied sequence, dropping its redelivery state. Consumer is swapped between messages,
+// so no unapplied message is skipped.
+func (r *Replicator) RecreateConsumer(ctx context.Context, shardID uint64) error {
+	return r.requestConsumer(ctx, shardID, &consumerRequest{})
+}
+
+func (r *Replicator) requestConsumer(ctx context.Context, shardID uint64, req *consumerRequest) error {
+	reqs, ok := r.recreateReqs[shardID]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownShard, shardID)
+	}
+
+	r.subsLock.RLock()
+	_, listening := r.subscriptions[shardID]
+	r.subsLock.RUnlock()
+	if !listening {
+		return fmt.Errorf("%w: %d", ErrShardNotListening, shardID)
+	}
+
+	req.reply = make(chan error, 1)
+	select {
+	case reqs <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-req.reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Replicator) recreateSubscription(
+	js nats.JetStreamContext,
+	shardID uint64,
+	sub *nats.Subscription,
+	savedSeq uint64,
+) (*nats.Subscription, error) {
+	opts := []nats.SubOpt{nats.DeliverAll()}
+	if savedSeq > 0 {
+		opts = []nats.SubOpt{nats.StartSequence(savedSeq + 1)}
+	}
+
+	err := sub.Unsubscribe()
+	if err != nil {
+		return sub, err
+	}
+
+	newSub, err := js.SubscribeSync(subjectName(shardID), opts...)
+	if err != nil {
+		return sub, err
+	}
+
+	r.trackSubscription(shardID, newSub)
+	core.PublishLifecycle(core.ConsumerRecreated, map[string]any{"shard": shardID, "start_seq": savedSeq + 1})
+	log.Info().
+		Uint64("shard", shardID).
+		Uint64("start_seq", savedSeq+1).
+		Msg("Recreated consumer")
+	return newSub, nil
+}
+
+// ConnectionStatus returns status of NATS connection used for replication.
+func (r *Replicator) ConnectionStatus() nats.Status {
+	return r.client.Status()
+}
+
+// Consumers returns status of every consumer currently listening on streams, ordered by shard.
+func (r *Replicator) Consumers() ([]*ConsumerStatus, error) {
+	r.subsLock.RLock()
+	defer r.subsLock.RUnlock()
+
+	ret := make([]*ConsumerStatus, 0, len(r.subscriptions))
+	for shardID := uint64(1); shardID <= r.streams; shardID++ {
+		sub, ok := r.subscriptions[shardID]
+		if !ok {
+			continue
+		}
+
+		info, err := sub.ConsumerInfo()
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &ConsumerStatus{
+			Shard:          shardID,
+			Stream:         info.Stream,
+			Name:           info.Name,
+			Durable:        info.Config.Durable,
+			Created:        info.Created,
+			Delivered:      info.Delivered.Stream,
+			AckFloor:       info.AckFloor.Stream,
+			NumAckPending:  info.NumAckPending,
+			NumRedelivered: info.NumRedelivered,
+			NumWaiting:     info.NumWaiting,
+			NumPending:     info.NumPending,
+		})
+	}
+
+	return ret, nil
+}
+
 func (r *Replicator) RestoreSnapshot() error {
 	if r.snapshot == nil {
 		return nil
@@ -235,7 +668,40 @@ func (r *Replicator) RestoreSnapshot() error {
 
 		savedSeq := r.repState.get(strName)
 		if savedSeq < info.State.FirstSeq {
-			return r.snapshot.RestoreSnapshot()
+			return r.restoreSnapshot()
+		}
+	}
+
+	return nil
+}
+
+// restoreSnapshot restores snapshot and moves sequences back to ones snapshot includes, so
+// only changes published after snapshot are replayed.
+func (r *Replicator) restoreSnapshot() error {
+	seqs, err := r.snapshot.RestoreSnapshot()
+	if err != nil || seqs == nil {
+		return err
+	}
+
+	for shardID, js := range r.streamMap {
+		strName := streamName(shardID, r.compressionEnabled)
+		info, err := js.StreamInfo(strName)
+		if err != nil {
+			return err
+		}
+
+		seq := seqs[strName]
+		if seq+1 < info.State.FirstSeq {
+			log.Warn().
+				Str("stream", strName).
+				Uint64("snapshot_seq", seq).
+				Uint64("first_seq", info.State.FirstSeq).
+				Msg("Snapshot is older than replication log, changes in between are lost")
+		}
+
+		_, err = r.repState.set(strName, seq)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -264,20 +730,124 @@ func (r *Replicator) SaveSnapshot() {
 	r.ForceSaveSnapshot()
 }
 
+// SaveSnapshotIfStale forces a snapshot when newest stored snapshot is older than maxAge,
+// only node holding snapshot lease performs the check so it acts as the leader.
+func (r *Replicator) SaveSnapshotIfStale(maxAge time.Duration) {
+	if r.snapshot == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	locked, err := r.metaStore.ContextRefreshingLease("snapshot", SnapshotLeaseTTL, ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Error acquiring snapshot lock")
+		return
+	}
+
+	if !locked {
+		return
+	}
+
+	lastSnapshot, err := r.snapshot.LastSnapshotTime()
+	if err != nil && err != snapshot.ErrNoSnapshotFound {
+		log.Warn().Err(err).Msg("Unable to get last snapshot time")
+		return
+	}
+
+	age := time.Since(lastSnapshot)
+	if err == nil && age < maxAge {
+		return
+	}
+
+	log.Info().
+		Time("last_snapshot", lastSnapshot).
+		Dur("max_age", maxAge).
+		Msg("Newest snapshot exceeds max age, forcing snapshot save")
+	r.ForceSaveSnapshot()
+}
+
 func (r *Replicator) ForceSaveSnapshot() {
 	if r.snapshot == nil {
 		return
 	}
 
-	err := r.snapshot.SaveSnapshot()
+	_, err := r.saveSnapshot()
 	if err != nil {
 		log.Error().
 			Err(err).
 			Msg("Unable snapshot database")
 		return
 	}
+}
+
+func (r *Replicator) saveSnapshot() (*snapshot.Info, error) {
+	core.PublishLifecycle(core.SnapshotStarted, nil)
+	info, err := r.snapshot.SaveSnapshot(r.repState.all())
+	if err != nil {
+		core.PublishLifecycle(core.SnapshotFailed, map[string]any{"error": err.Error()})
+		return nil, err
+	}
 
 	r.lastSnapshot = time.Now()
+	core.PublishLifecycle(core.SnapshotSaved, map[string]any{"name": info.Name, "checksum": info.Checksum})
+	return info, nil
+}
+
+// SaveSnapshotSync takes snapshot lease, saves and uploads snapshot and returns its info
+// once upload completes. If ctx is done first snapshot keeps running in background, but
+// ctx error is returned.
+func (r *Replicator) SaveSnapshotSync(ctx context.Context) (*snapshot.Info, error) {
+	if r.snapshot == nil {
+		return nil, ErrSnapshotsDisabled
+	}
+
+	leaseCtx, cancel := context.WithCancel(context.Background())
+	locked, err := r.metaStore.ContextRefreshingLease("snapshot", SnapshotLeaseTTL, leaseCtx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if !locked {
+		cancel()
+		return nil, ErrSnapshotLocked
+	}
+
+	type result struct {
+		info *snapshot.Info
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		defer cancel()
+		info, err := r.saveSnapshot()
+		done <- result{info: info, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.info, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Drain drains NATS connection, flushing pending publishes and letting in-flight messages
+// finish, and blocks until connection is closed.
+func (r *Replicator) Drain() error {
+	err := r.client.Drain()
+	if err != nil {
+		return err
+	}
+
+	for !r.client.IsClosed() {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	return nil
 }
 
 func (r *Replicator) ReloadCertificates() error {
@@ -298,15 +868,44 @@ func (r *Replicator) ReloadCertificates() error {
 	return nil
 }
 
-func (r *Replicator) invokeListener(callback func(payload []byte) error, msg *nats.Msg) error {
-	var err error
-	payload := msg.Data
+func (r *Replicator) trackSubscription(shardID uint64, sub *nats.Subscription) {
+	r.subsLock.Lock()
+	defer r.subsLock.Unlock()
 
-	if r.compressionEnabled {
-		payload, err = payloadDecompress(msg.Data)
-		if err != nil {
-			return err
-		}
+	r.subscriptions[shardID] = sub
+}
+
+func (r *Replicator) untrackSubscription(shardID uint64) {
+	r.subsLock.Lock()
+	defer r.subsLock.Unlock()
+
+	delete(r.subscriptions, shardID)
+}
+
+func (r *Replicator) invokeListener(
+	js nats.JetStreamContext,
+	callback func(payload []byte, meta *nats.MsgMetadata) error,
+	msg *nats.Msg,
+	meta *nats.MsgMetadata,
+) error {
+	data, complete, err := r.assembleChunks(js, msg, meta)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrDecodeFailed, err)
+	}
+
+	// Chunks before last one are assembled once last chunk arrives
+	if !complete {
+		return nil
+	}
+
+	data, err = r.cipher.open(msg.Header.Get(nonceHeader), data)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrDecodeFailed, err)
+	}
+
+	payload, err := r.codec.decode(msg.Header.Get(codecHeader), data, r.compressionEnabled)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrDecodeFailed, err)
 	}
 
 	for repRetry := 0; repRetry < maxReplicateRetries; repRetry++ {
@@ -318,8 +917,8 @@ func (r *Replicator) invokeListener(callback func(payload []byte) error, msg *na
 			}
 		}
 
-		err = callback(payload)
-		if err == context.Canceled {
+		err = callback(payload, meta)
+		if err == context.Canceled || errors.Is(err, ErrDecodeFailed) || errors.Is(err, ErrChangeRejected) {
 			return err
 		}
 
@@ -336,6 +935,25 @@ func (r *Replicator) invokeListener(callback func(payload []byte) error, msg *na
 	return err
 }
 
+// handleUndecodable dead letters change that can't be decoded so stream keeps advancing,
+// without dead letter stream replication stops instead of silently dropping the change.
+func (r *Replicator) handleUndecodable(msg *nats.Msg, meta *nats.MsgMetadata, cause error) error {
+	log.Error().
+		Err(cause).
+		Str("subject", msg.Subject).
+		Str("stream", meta.Stream).
+		Uint64("stream_seq", meta.Sequence.Stream).
+		Uint64("delivered", meta.NumDelivered).
+		Int("size", len(msg.Data)).
+		Msg("Received undecodable change")
+
+	if !cfg.Config.ReplicationLog.DeadLetter {
+		return cause
+	}
+
+	return r.deadLetter(msg, meta, cause, 1)
+}
+
 func makeShardStreamConfig(shardID uint64, totalShards uint64, compressed bool) *nats.StreamConfig {
 	streamName := streamName(shardID, compressed)
 	replicas := cfg.Config.ReplicationLog.Replicas
@@ -357,7 +975,7 @@ func makeShardStreamConfig(shardID uint64, totalShards uint64, compressed bool)
 		AllowDirect:       true,
 		MaxConsumers:      -1,
 		MaxMsgsPerSubject: -1,
-		Duplicates:        0,
+		Duplicates:        time.Duration(cfg.Config.ReplicationLog.DuplicatesWindow) * time.Millisecond,
 		DenyDelete:        true,
 		Replicas:          replicas,
 	}
@@ -386,27 +1004,23 @@ func streamName(shardID uint64, compressed bool) string {
 		compPostfix = "-c"
 	}
 
-	return fmt.Sprintf("%s%s-%d", cfg.Config.NATS.StreamPrefix, compPostfix, shardID)
+	return fmt.Sprintf("%s%s-%s", cfg.Config.NATS.StreamPrefix, compPostfix, shardSuffix(shardID))
 }
 
 func subjectName(shardID uint64) string {
-	return fmt.Sprintf("%s-%d", cfg.Config.NATS.SubjectPrefix, shardID)
-}
-
-func payloadCompress(payload []byte) ([]byte, error) {
-	enc, err := zstd.NewWriter(nil)
-	if err != nil {
-		return nil, err
-	}
-
-	return enc.EncodeAll(payload, nil), nil
+	return fmt.Sprintf("%s-%s", cfg.Config.NATS.SubjectPrefix, shardSuffix(shardID))
 }
 
-func payloadDecompress(payload []byte) ([]byte, error) {
-	dec, err := zstd.NewReader(nil)
-	if err != nil {
-		return nil, err
+// shardSuffix names stream and subject of shard, dedicated table streams are named after their
+// configured stream instead of shard ID so names are same on every node.
+func shardSuffix(shardID uint64) string {
+	shards := cfg.Config.ReplicationLog.Shards
+	if shardID > shards {
+		streams := cfg.Config.TableStreams()
+		if shardID-shards <= uint64(len(streams)) {
+			return streams[shardID-shards-1]
+		}
 	}
 
-	return dec.DecodeAll(payload, nil)
+	return strconv.FormatUint(shardID, 10)
 }
@@ -12,6 +12,7 @@ import (
 
 type replicatorMetaStore struct {
 	nats.KeyValue
+	nodeID uint64
 }
 
 type replicatorLockInfo struct {
@@ -38,13 +39,13 @@ func newReplicatorMetaStore(name string, nc *nats.Conn) (*replicatorMetaStore, e
 		return nil, err
 	}
 
-	return &replicatorMetaStore{KeyValue: kv}, nil
+	return &replicatorMetaStore{KeyValue: kv, nodeID: cfg.Config.NodeID}, nil
 }
 
 func (m *replicatorMetaStore) AcquireLease(name string, duration time.Duration) (bool, error) {
 	now := time.Now().UnixMilli()
 	info := &replicatorLockInfo{
-		NodeID:    cfg.Config.NodeID,
+		NodeID:    m.nodeID,
 		Timestamp: now,
 	}
 	payload, err := info.Serialize()
@@ -70,7 +71,7 @@ func (m *replicatorMetaStore) AcquireLease(name string, duration time.Duration)
 		return false, err
 	}
 
-	if info.NodeID != cfg.Config.NodeID && info.Timestamp+duration.Milliseconds() > now {
+	if info.NodeID != m.nodeID && info.Timestamp+duration.Milliseconds() > now {
 		return false, err
 	}
 
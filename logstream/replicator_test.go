@@ -0,0 +1,418 @@
+package logstream
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/snapshot"
+	"github.com/nats-io/nats.go"
+)
+
+func TestWaitForSequenceReturnsOnceApplied(t *testing.T) {
+	c := withConfig(t)
+	c.Snapshot.Enable = true
+	r := newTestReplicator(t)
+
+	first, err := r.Publish(1, "first", []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := r.Publish(1, "second", []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Published but not applied yet
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := r.WaitForSequence(ctx, first); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected wait to time out before change is applied, got %v", err)
+	}
+
+	release := map[string]chan struct{}{
+		"first":  make(chan struct{}),
+		"second": make(chan struct{}),
+	}
+	applied := int32(0)
+	listen(r, 1, func(payload []byte, _ *nats.MsgMetadata) error {
+		<-release[string(payload)]
+		atomic.AddInt32(&applied, 1)
+		return nil
+	})
+
+	waited := make(chan int32, 2)
+	for _, token := range []SequenceToken{first, second} {
+		token := token
+		go func() {
+			if err := r.WaitForSequence(context.Background(), token); err != nil {
+				t.Error(err)
+			}
+
+			waited <- atomic.LoadInt32(&applied)
+		}()
+	}
+
+	select {
+	case <-waited:
+		t.Fatal("wait returned before any change was applied")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release["first"])
+	if n := <-waited; n != 1 {
+		t.Fatalf("expected wait for first change to return after it's applied, %d applied", n)
+	}
+
+	select {
+	case <-waited:
+		t.Fatal("wait for second change returned before it was applied")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release["second"])
+	if n := <-waited; n != 2 {
+		t.Fatalf("expected wait for second change to return after it's applied, %d applied", n)
+	}
+}
+
+func TestConsumersReportState(t *testing.T) {
+	withConfig(t)
+	r := newTestReplicator(t)
+
+	for _, id := range []string{"a", "b", "c"} {
+		if _, err := r.Publish(1, id, []byte(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	listen(r, 1, func(payload []byte, _ *nats.MsgMetadata) error {
+		if string(payload) != "a" {
+			<-release
+		}
+
+		return nil
+	})
+
+	var consumers []*ConsumerStatus
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var err error
+		consumers, err = r.Consumers()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(consumers) == 1 && consumers[0].AckFloor == 1 && consumers[0].Delivered >= 2 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("consumer didn't reach expected state, got %+v", consumers)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	status := consumers[0]
+	if status.Shard != 1 || status.Stream != streamName(1, r.compressionEnabled) {
+		t.Fatalf("unexpected consumer shard or stream %+v", status)
+	}
+
+	if status.NumAckPending < 1 || status.NumPending+status.Delivered != 3 {
+		t.Fatalf("expected 1 applied and 2 pending changes, got %+v", status)
+	}
+}
+
+func TestTableRoutesToConfiguredShard(t *testing.T) {
+	c := withConfig(t)
+	c.ReplicationLog.Shards = 3
+	c.Replication.Tables = map[string]cfg.TableConfiguration{
+		"books":   {Shard: 3},
+		"authors": {Shard: 2},
+	}
+	r := newTestReplicator(t)
+
+	for i := 0; i < 50; i++ {
+		key := []byte(strconv.Itoa(i))
+		if shard := r.ShardOf("books", key); shard != 3 {
+			t.Fatalf("books key %d routed to shard %d instead of 3", i, shard)
+		}
+
+		if shard := r.ShardOf("authors", key); shard != 2 {
+			t.Fatalf("authors key %d routed to shard %d instead of 2", i, shard)
+		}
+	}
+
+	token, err := r.Publish(r.ShardOf("books", []byte("1")), "books-1", []byte("books"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token.Stream != streamName(3, r.compressionEnabled) {
+		t.Fatalf("books change published on %s", token.Stream)
+	}
+
+	if err := r.ValidateTableShards([]string{"books", "authors"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.ValidateTableShards([]string{"books", "reviews"}); !errors.Is(err, ErrTableShardMissing) {
+		t.Fatalf("expected %v for unmapped table, got %v", ErrTableShardMissing, err)
+	}
+}
+
+func TestTablesLandOnDedicatedStreams(t *testing.T) {
+	c := withConfig(t)
+	c.Replication.Tables = map[string]cfg.TableConfiguration{
+		"orders": {Stream: "orders"},
+		"audit":  {Stream: "audit"},
+	}
+	r := newTestReplicator(t)
+
+	// Provisioning streams again on restart finds existing ones
+	restarted, err := NewReplicator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.client.Close()
+
+	tokens := map[string]SequenceToken{}
+	for _, table := range []string{"orders", "audit", "notes"} {
+		token, err := r.Publish(r.ShardOf(table, []byte("1")), table+"-1", []byte(table))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tokens[table] = token
+	}
+
+	if !strings.HasSuffix(tokens["orders"].Stream, "-orders") || !strings.HasSuffix(tokens["audit"].Stream, "-audit") {
+		t.Fatalf("expected tables published on their own streams, got %v", tokens)
+	}
+
+	if tokens["notes"].Stream != streamName(1, r.compressionEnabled) {
+		t.Fatalf("expected unmapped table published on regular shard, got %s", tokens["notes"].Stream)
+	}
+
+	if err := r.ValidateTableShards([]string{"orders", "audit", "notes"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stalled consumer of one stream doesn't hold back others
+	received := make(chan string, 4)
+	stalled := make(chan struct{})
+	t.Cleanup(func() { close(stalled) })
+	for _, table := range []string{"orders", "audit"} {
+		listen(r, r.ShardOf(table, nil), func(payload []byte, _ *nats.MsgMetadata) error {
+			if string(payload) == "orders" {
+				<-stalled
+			}
+
+			received <- string(payload)
+			return nil
+		})
+	}
+
+	select {
+	case table := <-received:
+		if table != "audit" {
+			t.Fatalf("expected audit change applied, got %s", table)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for audit change")
+	}
+
+	watermarks := r.Watermarks()
+	if len(watermarks) != 3 || watermarks[2].Stream != tokens["orders"].Stream || len(watermarks[2].Tables) != 1 {
+		t.Fatalf("expected watermark of every stream, got %+v", watermarks)
+	}
+}
+
+func TestSaveSnapshotIfStale(t *testing.T) {
+	cases := map[string]struct {
+		last     time.Time
+		err      error
+		expected int
+	}{
+		"old":     {last: time.Now().Add(-2 * time.Hour), expected: 1},
+		"recent":  {last: time.Now().Add(-10 * time.Minute), expected: 0},
+		"missing": {err: snapshot.ErrNoSnapshotFound, expected: 1},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			withConfig(t)
+			r := newTestReplicator(t)
+			fake := newFakeSnapshot(tc.last, tc.err)
+			r.snapshot = fake
+
+			r.SaveSnapshotIfStale(time.Hour)
+			if n := fake.savedCount(); n != tc.expected {
+				t.Fatalf("expected %d snapshots saved, got %d", tc.expected, n)
+			}
+		})
+	}
+}
+
+func TestGlobalOrderedTableAppliesInSequence(t *testing.T) {
+	c := withConfig(t)
+	c.ReplicationLog.Shards = 4
+	c.Replication.Tables = map[string]cfg.TableConfiguration{
+		"ledger": {Ordering: cfg.OrderingGlobal},
+		"events": {Ordering: cfg.OrderingPerKey},
+	}
+	r := newTestReplicator(t)
+
+	spread := map[uint64]bool{}
+	for i := 0; i < 50; i++ {
+		spread[r.ShardOf("events", []byte(strconv.Itoa(i)))] = true
+	}
+
+	if len(spread) < 2 {
+		t.Fatalf("expected per-key table to spread over shards, used %v", spread)
+	}
+
+	const total = 30
+	for i := 0; i < total; i++ {
+		key := []byte(strconv.Itoa(i))
+		shard := r.ShardOf("ledger", key)
+		if shard != GlobalOrderShardID {
+			t.Fatalf("ledger key %d routed to shard %d instead of %d", i, shard, GlobalOrderShardID)
+		}
+
+		if _, err := r.Publish(shard, "ledger-"+strconv.Itoa(i), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	applied := make(chan string, total)
+	listen(r, GlobalOrderShardID, func(payload []byte, _ *nats.MsgMetadata) error {
+		applied <- string(payload)
+		return nil
+	})
+
+	for i := 0; i < total; i++ {
+		select {
+		case payload := <-applied:
+			if payload != strconv.Itoa(i) {
+				t.Fatalf("expected change %d applied next, got %s", i, payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for change %d", i)
+		}
+	}
+}
+
+func TestRecreatedConsumerResumesWithoutRedeliveries(t *testing.T) {
+	withConfig(t)
+	r := newTestReplicator(t)
+
+	for _, id := range []string{"a", "b", "c"} {
+		if _, err := r.Publish(1, id, []byte(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	applied := make(chan *nats.MsgMetadata, 8)
+	listen(r, 1, func(payload []byte, meta *nats.MsgMetadata) error {
+		if string(payload) == "b" {
+			close(blocked)
+			<-release
+		}
+
+		applied <- meta
+		return nil
+	})
+
+	select {
+	case <-blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for second change")
+	}
+
+	// Build up redelivery state by rejecting third change behind listener's back
+	r.subsLock.RLock()
+	sub := r.subscriptions[1]
+	r.subsLock.RUnlock()
+	msg, err := sub.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := msg.Nak(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		consumers, err := r.Consumers()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if consumers[0].NumRedelivered > 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected third change redelivered, got %+v", consumers[0])
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	recreated := make(chan error, 1)
+	go func() {
+		recreated <- r.RecreateConsumer(context.Background(), 1)
+	}()
+
+	// Consumer is swapped once second change is applied
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	if err := <-recreated; err != nil {
+		t.Fatal(err)
+	}
+
+	seqs := make([]uint64, 0, 3)
+	for len(seqs) < 3 {
+		select {
+		case meta := <-applied:
+			seqs = append(seqs, meta.Sequence.Stream)
+			if meta.Sequence.Stream == 3 && meta.NumDelivered != 1 {
+				t.Fatalf("expected third change delivered once by recreated consumer, delivered %d times", meta.NumDelivered)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for changes, applied %v", seqs)
+		}
+	}
+
+	if seqs[0] != 1 || seqs[1] != 2 || seqs[2] != 3 {
+		t.Fatalf("expected every change applied once in order, got %v", seqs)
+	}
+
+	select {
+	case meta := <-applied:
+		t.Fatalf("change %d applied again", meta.Sequence.Stream)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	consumers, err := r.Consumers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := consumers[0]; status.NumRedelivered != 0 || status.AckFloor != 3 {
+		t.Fatalf("expected fresh consumer without redeliveries past applied changes, got %+v", status)
+	}
+}
@@ -0,0 +1,103 @@
+package logstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrWatermarkTokenMismatch = errors.New("confirmation token does not match current watermark")
+var ErrTableNotPinned = errors.New("table is hash partitioned across shards and has no single watermark")
+
+// Watermark is last applied stream sequence of a shard. Token must be echoed back when
+// setting watermark, proving caller saw current value before overwriting it.
+type Watermark struct {
+	Shard   uint64   `json:"shard"`
+	Stream  string   `json:"stream"`
+	Applied uint64   `json:"applied"`
+	Tables  []string `json:"tables,omitempty"`
+	Token   string   `json:"token"`
+}
+
+// Watermarks returns applied watermark of every shard, ordered by shard.
+func (r *Replicator) Watermarks() []*Watermark {
+	tables := map[uint64][]string{}
+	for name, shardID := range r.tableShards {
+		tables[shardID] = append(tables[shardID], name)
+	}
+
+	for name, shardID := range r.tableStreams {
+		tables[shardID] = append(tables[shardID], name)
+	}
+
+	for name := range r.globalTables {
+		tables[GlobalOrderShardID] = append(tables[GlobalOrderShardID], name)
+	}
+
+	ret := make([]*Watermark, 0, r.streams)
+	for shardID := uint64(1); shardID <= r.streams; shardID++ {
+		sort.Strings(tables[shardID])
+		ret = append(ret, r.watermark(shardID, tables[shardID]))
+	}
+
+	return ret
+}
+
+// WatermarkShard resolves shard holding watermark of table, only tables pinned to a shard or
+// dedicated stream and globally ordered tables are consumed from a single shard.
+func (r *Replicator) WatermarkShard(table string) (uint64, error) {
+	if shardID, ok := r.tableShards[table]; ok {
+		return shardID, nil
+	}
+
+	if shardID, ok := r.tableStreams[table]; ok {
+		return shardID, nil
+	}
+
+	if r.globalTables[table] {
+		return GlobalOrderShardID, nil
+	}
+
+	return 0, fmt.Errorf("%w: %s", ErrTableNotPinned, table)
+}
+
+// SetWatermark forcibly moves applied watermark of shard to seq and resumes consuming right
+// after it. Rewinding replays changes that were already applied, fast-forwarding skips changes
+// that were never applied, either way nodes can diverge. Token has to match current watermark.
+func (r *Replicator) SetWatermark(ctx context.Context, shardID uint64, seq uint64, token string) error {
+	if shardID < 1 || shardID > r.streams {
+		return fmt.Errorf("%w: %d", ErrUnknownShard, shardID)
+	}
+
+	current := r.watermark(shardID, nil)
+	if token != current.Token {
+		return ErrWatermarkTokenMismatch
+	}
+
+	log.Warn().
+		Uint64("shard", shardID).
+		Uint64("from", current.Applied).
+		Uint64("to", seq).
+		Msg("Manually setting applied watermark, replicas may diverge")
+
+	return r.requestConsumer(ctx, shardID, &consumerRequest{setSeq: true, seq: seq})
+}
+
+func (r *Replicator) watermark(shardID uint64, tables []string) *Watermark {
+	name := streamName(shardID, r.compressionEnabled)
+	applied := r.repState.get(name)
+
+	h := fnv.New64a()
+	_, _ = fmt.Fprintf(h, "%d/%s/%d", r.nodeID, name, applied)
+	return &Watermark{
+		Shard:   shardID,
+		Stream:  name,
+		Applied: applied,
+		Tables:  tables,
+		Token:   fmt.Sprintf("%016x", h.Sum64()),
+	}
+}
@@ -0,0 +1,115 @@
+package logstream
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/nats-io/nats.go"
+)
+
+func TestSetWatermarkChangesResumePoint(t *testing.T) {
+	withConfig(t)
+	r := newTestReplicator(t)
+
+	publish := func(from, to int) {
+		t.Helper()
+
+		for i := from; i <= to; i++ {
+			if _, err := r.Publish(1, strconv.Itoa(i), []byte(strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	applied := make(chan uint64, 16)
+	expect := func(seqs ...uint64) {
+		t.Helper()
+
+		got := make([]uint64, 0, len(seqs))
+		for len(got) < len(seqs) {
+			select {
+			case seq := <-applied:
+				got = append(got, seq)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected changes %v applied, got %v", seqs, got)
+			}
+		}
+
+		if !reflect.DeepEqual(got, seqs) {
+			t.Fatalf("expected changes %v applied, got %v", seqs, got)
+		}
+
+		// Watermark is saved once listener returns
+		deadline := time.Now().Add(5 * time.Second)
+		for r.Watermarks()[0].Applied != seqs[len(seqs)-1] {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected watermark at %d, got %+v", seqs[len(seqs)-1], r.Watermarks()[0])
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	publish(1, 5)
+	listen(r, 1, func(_ []byte, meta *nats.MsgMetadata) error {
+		applied <- meta.Sequence.Stream
+		return nil
+	})
+	expect(1, 2, 3, 4, 5)
+
+	current := r.Watermarks()[0]
+	if err := r.SetWatermark(context.Background(), 1, 2, "stale"); !errors.Is(err, ErrWatermarkTokenMismatch) {
+		t.Fatalf("expected %v without current token, got %v", ErrWatermarkTokenMismatch, err)
+	}
+
+	// Rewinding replays changes after new watermark
+	if err := r.SetWatermark(context.Background(), 1, 2, current.Token); err != nil {
+		t.Fatal(err)
+	}
+	expect(3, 4, 5)
+
+	// Fast-forwarding skips changes up to new watermark
+	if err := r.SetWatermark(context.Background(), 1, 8, r.Watermarks()[0].Token); err != nil {
+		t.Fatal(err)
+	}
+	publish(6, 9)
+	expect(9)
+}
+
+func TestWatermarkShardOfTable(t *testing.T) {
+	c := withConfig(t)
+	c.ReplicationLog.Shards = 3
+	c.Replication.Tables = map[string]cfg.TableConfiguration{
+		"books":  {Shard: 3},
+		"ledger": {Ordering: cfg.OrderingGlobal},
+		"events": {Ordering: cfg.OrderingPerKey},
+	}
+	r := newTestReplicator(t)
+
+	if shard, err := r.WatermarkShard("books"); err != nil || shard != 3 {
+		t.Fatalf("expected pinned table on shard 3, got %d (%v)", shard, err)
+	}
+
+	if shard, err := r.WatermarkShard("ledger"); err != nil || shard != GlobalOrderShardID {
+		t.Fatalf("expected global table on shard %d, got %d (%v)", GlobalOrderShardID, shard, err)
+	}
+
+	if _, err := r.WatermarkShard("events"); !errors.Is(err, ErrTableNotPinned) {
+		t.Fatalf("expected %v for per-key table, got %v", ErrTableNotPinned, err)
+	}
+
+	watermarks := r.Watermarks()
+	if len(watermarks) != 3 || !reflect.DeepEqual(watermarks[0].Tables, []string{"ledger"}) ||
+		!reflect.DeepEqual(watermarks[2].Tables, []string{"books"}) {
+		t.Fatalf("unexpected watermarks %+v", watermarks)
+	}
+
+	if err := r.SetWatermark(context.Background(), 4, 1, ""); !errors.Is(err, ErrUnknownShard) {
+		t.Fatalf("expected %v, got %v", ErrUnknownShard, err)
+	}
+}
@@ -2,20 +2,28 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/maxpert/marmot/telemetry"
 	"github.com/maxpert/marmot/utils"
 
+	"github.com/maxpert/marmot/admin"
 	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/core"
 	"github.com/maxpert/marmot/db"
 	"github.com/maxpert/marmot/logstream"
+	"github.com/maxpert/marmot/sink"
 	"github.com/maxpert/marmot/snapshot"
 
 	"github.com/asaskevich/EventBus"
+	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -29,7 +37,7 @@ func main() {
 	}
 
 	var writer io.Writer = zerolog.NewConsoleWriter()
-	if cfg.Config.Logging.Format == "json" {
+	if cfg.Config.Logging.Format == cfg.LogFormatJSON {
 		writer = os.Stdout
 	}
 	gLog := zerolog.New(writer).
@@ -38,15 +46,15 @@ func main() {
 		Uint64("node_id", cfg.Config.NodeID).
 		Logger()
 
-	if cfg.Config.Logging.Verbose {
-		log.Logger = gLog.Level(zerolog.DebugLevel)
-	} else {
-		log.Logger = gLog.Level(zerolog.InfoLevel)
-	}
+	log.Logger = gLog.Level(cfg.Config.Logging.GlobalLevel())
 
 	log.Debug().Msg("Initializing telemetry")
 	telemetry.InitializeTelemetry()
 
+	if cfg.Config.Replication.Clock == cfg.ClockHLC {
+		core.ChangeClock = core.NewHybridClock()
+	}
+
 	log.Debug().Str("path", cfg.Config.DBPath).Msg("Opening database")
 	streamDB, err := db.OpenStreamDB(cfg.Config.DBPath)
 	if err != nil {
@@ -54,6 +62,15 @@ func main() {
 		return
 	}
 
+	if *cfg.CleanupFlag && *cfg.DryRunFlag {
+		err = printCleanupPlan(streamDB, os.Stdout)
+		if err != nil {
+			log.Panic().Err(err).Msg("Unable to plan clean up...")
+		}
+
+		return
+	}
+
 	if *cfg.CleanupFlag {
 		err = streamDB.RemoveCDC(true)
 		if err != nil {
@@ -65,12 +82,21 @@ func main() {
 		return
 	}
 
+	if flag.NArg() > 0 {
+		err = runCommand(streamDB, flag.Args(), os.Stdout)
+		if err != nil {
+			log.Panic().Err(err).Msg("Unable to run command")
+		}
+
+		return
+	}
+
 	snpStore, err := snapshot.NewSnapshotStorage()
 	if err != nil {
 		log.Panic().Err(err).Msg("Unable to initialize snapshot storage")
 	}
 
-	replicator, err := logstream.NewReplicator(snapshot.NewNatsDBSnapshot(streamDB, snpStore))
+	replicator, err := logstream.NewReplicator(snapshot.NewNatsDBSnapshot(streamDB, snpStore), streamDB)
 	if err != nil {
 		log.Panic().Err(err).Msg("Unable to initialize replicators")
 	}
@@ -94,21 +120,58 @@ func main() {
 		return
 	}
 
+	tableNames = db.FilterReplicatedTables(tableNames)
+	err = replicator.ValidateTableShards(tableNames)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid table shard configuration")
+		return
+	}
+
 	eventBus := EventBus.New()
 	ctxSt := utils.NewStateContext()
 
-	streamDB.OnChange = onTableChanged(replicator, ctxSt, eventBus, cfg.Config.NodeID)
+	streamDB.OnChange = onTableChanged(replicator, streamDB, ctxSt, eventBus, cfg.Config.NodeID)
+	if cfg.Config.ReplicationLog.BatchingEnabled() {
+		streamDB.OnChangeBatch = onTableChangeBatch(replicator, streamDB, ctxSt, eventBus, cfg.Config.NodeID)
+	}
+	streamDB.OnSchemaChange = onSchemaChanged(replicator, ctxSt, cfg.Config.NodeID)
+	streamDB.ValidateTable = func(name string) error {
+		return replicator.ValidateTableShards([]string{name})
+	}
 	log.Info().Msg("Starting change data capture pipeline...")
 	if err := streamDB.InstallCDC(tableNames); err != nil {
 		log.Error().Err(err).Msg("Unable to install change data capture pipeline")
 		return
 	}
+	log.Info().Strs("tables", streamDB.ReplicatedTables()).Msg("Capturing changes of tables")
+
+	sinks, err := sink.NewSinks()
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to initialize sinks")
+		return
+	}
+
+	dispatcher, err := sink.NewDispatcher(sinks)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to initialize sink dispatcher")
+		return
+	}
 
 	errChan := make(chan error)
-	for i := uint64(0); i < cfg.Config.ReplicationLog.Shards; i++ {
-		go changeListener(streamDB, replicator, ctxSt, eventBus, i+1, errChan)
+	for i := uint64(0); i < cfg.Config.StreamCount(); i++ {
+		go changeListener(streamDB, replicator, ctxSt, eventBus, dispatcher, i+1, errChan)
 	}
 
+	health := logstream.NewHealthGossip(replicator)
+	health.OnHealthChange = onHealthChanged(streamDB)
+	if err := health.Start(); err != nil {
+		log.Error().Err(err).Msg("Unable to start health gossip")
+		return
+	}
+
+	admin.NewServer(replicator, health, streamDB).Start(ctxSt.Done())
+	admin.NewProbeServer(replicator, streamDB).Start(ctxSt.Done())
+
 	sleepTimeout := utils.AutoResetEventTimer(
 		eventBus,
 		"pulse",
@@ -122,6 +185,21 @@ func main() {
 	snapshotTicker := utils.NewTimeoutPublisher(snapshotInterval)
 	defer snapshotTicker.Stop()
 
+	maintenanceInterval := time.Duration(cfg.Config.Maintenance.Interval) * time.Millisecond
+	maintenanceTicker := utils.NewTimeoutPublisher(maintenanceInterval)
+	defer maintenanceTicker.Stop()
+
+	snapshotMaxAge := time.Duration(cfg.Config.Snapshot.MaxAge) * time.Millisecond
+	snapshotAgeCheckInterval := snapshotMaxAge
+	if snapshotAgeCheckInterval > time.Minute {
+		snapshotAgeCheckInterval = time.Minute
+	}
+	snapshotAgeTicker := utils.NewTimeoutPublisher(snapshotAgeCheckInterval)
+	defer snapshotAgeTicker.Stop()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
 	for {
 		select {
 		case err = <-errChan:
@@ -147,6 +225,26 @@ func main() {
 					replicator.SaveSnapshot()
 				}
 			}
+		case <-maintenanceTicker.Channel():
+			if threshold := cfg.Config.Maintenance.IncrementalVacuumFreePages; threshold > 0 {
+				go func() {
+					pages, err := streamDB.IncrementalVacuum(threshold)
+					if err != nil {
+						log.Warn().Err(err).Msg("Unable to run incremental vacuum")
+					} else if pages > 0 {
+						log.Info().Int64("pages", pages).Msg("Incremental vacuum released pages")
+					}
+				}()
+			}
+		case <-snapshotAgeTicker.Channel():
+			if cfg.Config.Snapshot.Enable && cfg.Config.Publish {
+				replicator.SaveSnapshotIfStale(snapshotMaxAge)
+			}
+		case sig := <-signals:
+			log.Info().Str("signal", sig.String()).Msg("Received signal, initiating shutdown")
+			ctxSt.Cancel()
+			gracefulShutdown(dispatcher, replicator, streamDB)
+			os.Exit(0)
 		case <-sleepTimeout.Channel():
 			log.Info().Msg("No more events to process, initiating shutdown")
 			ctxSt.Cancel()
@@ -155,6 +253,7 @@ func main() {
 				replicator.ForceSaveSnapshot()
 			}
 
+			gracefulShutdown(dispatcher, replicator, streamDB)
 			os.Exit(0)
 		}
 	}
@@ -165,18 +264,24 @@ func changeListener(
 	rep *logstream.Replicator,
 	ctxSt *utils.StateContext,
 	events EventBus.BusPublisher,
+	dispatcher *sink.Dispatcher,
 	shard uint64,
 	errChan chan error,
 ) {
 	log.Debug().Uint64("shard", shard).Msg("Listening stream")
-	err := rep.Listen(shard, onChangeEvent(streamDB, ctxSt, events))
+	err := rep.Listen(shard, onChangeEvent(streamDB, ctxSt, events, dispatcher))
 	if err != nil {
 		errChan <- err
 	}
 }
 
-func onChangeEvent(streamDB *db.SqliteStreamDB, ctxSt *utils.StateContext, events EventBus.BusPublisher) func(data []byte) error {
-	return func(data []byte) error {
+func onChangeEvent(
+	streamDB *db.SqliteStreamDB,
+	ctxSt *utils.StateContext,
+	events EventBus.BusPublisher,
+	dispatcher *sink.Dispatcher,
+) func(data []byte, meta *nats.MsgMetadata) error {
+	return func(data []byte, meta *nats.MsgMetadata) error {
 		events.Publish("pulse")
 		if ctxSt.IsCanceled() {
 			return context.Canceled
@@ -189,15 +294,51 @@ func onChangeEvent(streamDB *db.SqliteStreamDB, ctxSt *utils.StateContext, event
 		ev := &logstream.ReplicationEvent[db.ChangeLogEvent]{}
 		err := ev.Unmarshal(data)
 		if err != nil {
-			log.Error().Err(err).Send()
-			return err
+			return fmt.Errorf("%w: %s", logstream.ErrDecodeFailed, err)
 		}
 
-		return streamDB.Replicate(&ev.Payload)
+		payloads := []*db.ChangeLogEvent{&ev.Payload}
+		if len(ev.Batch) != 0 {
+			payloads = make([]*db.ChangeLogEvent, 0, len(ev.Batch))
+			for i := range ev.Batch {
+				payloads = append(payloads, &ev.Batch[i])
+			}
+		}
+
+		// JetStream delivers own changes back regardless of connection echo, they're
+		// already in local DB
+		if !(cfg.Config.NATS.NoEcho && ev.FromNodeId == cfg.Config.NodeID) {
+			pos := db.StreamPosition{Stream: meta.Stream, Seq: meta.Sequence.Stream}
+			err = streamDB.ReplicateBatch(ev.FromNodeId, payloads, pos)
+			if errors.Is(err, db.ErrChangeRejected) || errors.Is(err, db.ErrRowTooLarge) {
+				return fmt.Errorf("%w: %s", logstream.ErrChangeRejected, err)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, payload := range payloads {
+			if payload.Type == db.SchemaChangeType {
+				continue
+			}
+
+			dispatcher.Dispatch(&sink.Event{
+				FromNodeID: ev.FromNodeId,
+				TableName:  payload.TableName,
+				Type:       payload.Type,
+				Key:        streamDB.GetPrimaryKeyMap(payload),
+				Row:        payload.Row,
+				Sequence:   payload.Id,
+			})
+		}
+
+		return nil
 	}
 }
 
-func onTableChanged(r *logstream.Replicator, ctxSt *utils.StateContext, events EventBus.BusPublisher, nodeID uint64) func(event *db.ChangeLogEvent) error {
+func onTableChanged(r *logstream.Replicator, streamDB *db.SqliteStreamDB, ctxSt *utils.StateContext, events EventBus.BusPublisher, nodeID uint64) func(event *db.ChangeLogEvent) error {
 	return func(event *db.ChangeLogEvent) error {
 		events.Publish("pulse")
 		if ctxSt.IsCanceled() {
@@ -218,16 +359,147 @@ func onTableChanged(r *logstream.Replicator, ctxSt *utils.StateContext, events E
 			return err
 		}
 
-		hash, err := event.Hash()
+		key, err := event.PartitionKey()
+		if err != nil {
+			return err
+		}
+
+		token, err := r.Publish(r.ShardOf(event.TableName, key), event.MessageID(nodeID), data)
+		if errors.Is(err, logstream.ErrPublishBuffered) {
+			return nil
+		}
+
 		if err != nil {
 			return err
 		}
 
-		err = r.Publish(hash, data)
+		r.RecordPublished(event.TableName, token)
+		streamDB.RecordPublished(event.TableName, db.StreamPosition{Stream: token.Stream, Seq: token.Sequence})
+		return nil
+	}
+}
+
+// onHealthChanged makes a degraded node read-only so minority side of a partition doesn't
+// accept writes, node is promoted back once it can reach quorum again. Nodes configured as
+// replicas stay replicas.
+func onHealthChanged(streamDB *db.SqliteStreamDB) func(degraded bool) {
+	demoted := false
+	return func(degraded bool) {
+		if degraded && !streamDB.IsReplica() {
+			if err := streamDB.DemoteToReplica(); err != nil {
+				log.Error().Err(err).Msg("Unable to demote degraded node to replica")
+				return
+			}
+
+			demoted = true
+			return
+		}
+
+		// Node might have been promoted through admin API in the meantime
+		if !degraded && demoted {
+			err := streamDB.Promote()
+			if err != nil && !errors.Is(err, db.ErrNotReplica) {
+				log.Error().Err(err).Msg("Unable to promote node after health was restored")
+				return
+			}
+
+			demoted = false
+		}
+	}
+}
+
+// onSchemaChanged publishes schema change to every shard, so it's ordered before later
+// changes of table no matter which shard they're routed to.
+func onSchemaChanged(r *logstream.Replicator, ctxSt *utils.StateContext, nodeID uint64) func(event *db.ChangeLogEvent) error {
+	return func(event *db.ChangeLogEvent) error {
+		if ctxSt.IsCanceled() {
+			return context.Canceled
+		}
+
+		if !cfg.Config.Publish {
+			return nil
+		}
+
+		ev := &logstream.ReplicationEvent[db.ChangeLogEvent]{
+			FromNodeId: nodeID,
+			Payload:    *event,
+		}
+
+		data, err := ev.Marshal()
 		if err != nil {
 			return err
 		}
 
+		for shard := uint64(1); shard <= cfg.Config.StreamCount(); shard++ {
+			_, err = r.Publish(shard, event.MessageID(nodeID), data)
+			if err != nil && !errors.Is(err, logstream.ErrPublishBuffered) {
+				return err
+			}
+		}
+
+		log.Info().Str("table", event.TableName).Msg("Published schema change")
+		return nil
+	}
+}
+
+func onTableChangeBatch(r *logstream.Replicator, streamDB *db.SqliteStreamDB, ctxSt *utils.StateContext, events EventBus.BusPublisher, nodeID uint64) func(batch []*db.ChangeLogEvent) error {
+	return func(batch []*db.ChangeLogEvent) error {
+		events.Publish("pulse")
+		if ctxSt.IsCanceled() {
+			return context.Canceled
+		}
+
+		if !cfg.Config.Publish {
+			return nil
+		}
+
+		// Splitting a batch of atomic transactions across shards would let replicas apply
+		// part of a transaction, so whole batch goes on shard of its first change
+		atomic := cfg.Config.ReplicationLog.AtomicTransactions
+		shardBatches := map[uint64][]db.ChangeLogEvent{}
+		batchShard := uint64(0)
+		for _, event := range batch {
+			if atomic && batchShard != 0 {
+				shardBatches[batchShard] = append(shardBatches[batchShard], *event)
+				continue
+			}
+
+			key, err := event.PartitionKey()
+			if err != nil {
+				return err
+			}
+
+			shard := r.ShardOf(event.TableName, key)
+			shardBatches[shard] = append(shardBatches[shard], *event)
+			batchShard = shard
+		}
+
+		for shard, payloads := range shardBatches {
+			ev := &logstream.ReplicationEvent[db.ChangeLogEvent]{
+				FromNodeId: nodeID,
+				Batch:      payloads,
+			}
+
+			data, err := ev.Marshal()
+			if err != nil {
+				return err
+			}
+
+			token, err := r.Publish(shard, db.BatchMessageID(nodeID, payloads), data)
+			if errors.Is(err, logstream.ErrPublishBuffered) {
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			for _, payload := range payloads {
+				r.RecordPublished(payload.TableName, token)
+				streamDB.RecordPublished(payload.TableName, db.StreamPosition{Stream: token.Stream, Seq: token.Sequence})
+			}
+		}
+
 		return nil
 	}
 }
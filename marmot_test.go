@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxpert/marmot/db"
+	"github.com/rs/zerolog"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	os.Exit(m.Run())
+}
+
+func openReplicatedDB(t *testing.T) (*db.SqliteStreamDB, *sql.DB) {
+	t.Helper()
+
+	// CDC watcher can't be stopped and may reopen database while t.TempDir is removed, which
+	// fails test, so directory is removed on best effort basis instead
+	dir, err := os.MkdirTemp("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	streamDB := openCommandDBAt(t, filepath.Join(dir, "marmot.db"), "CREATE TABLE books(id INTEGER PRIMARY KEY, title TEXT)")
+	if err := streamDB.InstallCDC([]string{"books"}); err != nil {
+		t.Fatal(err)
+	}
+
+	app, err := sql.Open("sqlite3", streamDB.GetPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.Close() })
+
+	return streamDB, app
+}
+
+func TestDegradedNodeIsReadOnly(t *testing.T) {
+	streamDB, app := openReplicatedDB(t)
+	onHealth := onHealthChanged(streamDB)
+
+	onHealth(true)
+	if !streamDB.IsReplica() {
+		t.Fatal("expected degraded node to be demoted to replica")
+	}
+
+	if _, err := app.Exec("INSERT INTO books VALUES (1, 'dune')"); err == nil {
+		t.Fatal("expected local write on degraded node to be rejected")
+	}
+
+	onHealth(false)
+	if streamDB.IsReplica() {
+		t.Fatal("expected node to be promoted once health is restored")
+	}
+
+	if _, err := app.Exec("INSERT INTO books VALUES (1, 'dune')"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfiguredReplicaStaysReplica(t *testing.T) {
+	streamDB, _ := openReplicatedDB(t)
+	if err := streamDB.DemoteToReplica(); err != nil {
+		t.Fatal(err)
+	}
+
+	onHealth := onHealthChanged(streamDB)
+	onHealth(true)
+	onHealth(false)
+	if !streamDB.IsReplica() {
+		t.Fatal("expected replica not to be promoted when health is restored")
+	}
+}
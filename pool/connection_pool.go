@@ -118,6 +118,21 @@ func (q *SQLitePool) Dispose(obj *SQLiteConnection) error {
 	return nil
 }
 
+// Reset waits for every connection to be returned and closes it, next borrow opens database
+// again. Needed once database file is replaced, open connections keep reading replaced file.
+func (q *SQLitePool) Reset() {
+	conns := make([]*SQLiteConnection, 0, cap(q.connections))
+	for i := 0; i < cap(q.connections); i++ {
+		c := <-q.connections
+		c.reset()
+		conns = append(conns, c)
+	}
+
+	for _, c := range conns {
+		q.connections <- c
+	}
+}
+
 func OpenRaw(dns string) (*sql.DB, *sqlite3.SQLiteConn, error) {
 	var rawConn *sqlite3.SQLiteConn
 	d := &sqlite3.SQLiteDriver{
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/core"
+	"github.com/maxpert/marmot/db"
+	"github.com/maxpert/marmot/logstream"
+	"github.com/maxpert/marmot/sink"
+	"github.com/rs/zerolog/log"
+)
+
+type shutdownStage struct {
+	name   string
+	budget time.Duration
+	run    func() error
+}
+
+// gracefulShutdown runs shutdown stages in order, every stage is bounded by its own budget
+// and by what's left of total timeout. Stages exceeding budget are abandoned so shutdown
+// never hangs. Sinks are stopped after NATS drain so changes applied while draining are
+// still delivered to them.
+func gracefulShutdown(dispatcher *sink.Dispatcher, replicator *logstream.Replicator, streamDB *db.SqliteStreamDB) {
+	core.PublishLifecycle(core.ShutdownStarted, nil)
+	c := cfg.Config.Shutdown
+	stages := []shutdownStage{
+		{
+			name:   "nats",
+			budget: time.Duration(c.NATSDrainTimeout) * time.Millisecond,
+			run:    replicator.Drain,
+		},
+		{
+			name:   "sinks",
+			budget: time.Duration(c.SinksTimeout) * time.Millisecond,
+			run: func() error {
+				dispatcher.Stop()
+				return nil
+			},
+		},
+		{
+			name:   "cleanup",
+			budget: time.Duration(c.CleanupTimeout) * time.Millisecond,
+			run: func() error {
+				if !cfg.Config.CleanupOnExit {
+					return nil
+				}
+
+				return streamDB.RemoveCDC(cfg.Config.CleanupTablesOnExit)
+			},
+		},
+		{
+			name:   "db",
+			budget: time.Duration(c.DBFlushTimeout) * time.Millisecond,
+			run:    streamDB.Checkpoint,
+		},
+	}
+
+	runShutdownStages(stages, time.Duration(c.Timeout)*time.Millisecond)
+	log.Info().Msg("Shutdown complete")
+}
+
+// runShutdownStages runs stages in order, budget of every stage is cut down to what's left
+// of timeout.
+func runShutdownStages(stages []shutdownStage, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, stage := range stages {
+		budget := stage.budget
+		if remaining := time.Until(deadline); remaining < budget {
+			budget = remaining
+		}
+
+		runShutdownStage(stage, budget)
+	}
+}
+
+func runShutdownStage(stage shutdownStage, budget time.Duration) {
+	if budget <= 0 {
+		log.Warn().Str("stage", stage.name).Msg("No shutdown time left, skipping stage")
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- stage.run()
+	}()
+
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Warn().Err(err).Str("stage", stage.name).Msg("Shutdown stage failed")
+			return
+		}
+
+		log.Debug().Str("stage", stage.name).Msg("Shutdown stage complete")
+	case <-timer.C:
+		log.Warn().
+			Str("stage", stage.name).
+			Dur("budget", budget).
+			Msg("Shutdown stage exceeded its budget, moving on")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asaskevich/EventBus"
+	"github.com/maxpert/marmot/db"
+	"github.com/maxpert/marmot/sink"
+	"github.com/maxpert/marmot/utils"
+	"github.com/nats-io/nats.go"
+)
+
+func TestSlowShutdownStageBoundedByBudget(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	ran := make([]string, 0)
+	stages := []shutdownStage{
+		{
+			name:   "slow",
+			budget: 100 * time.Millisecond,
+			run: func() error {
+				<-release
+				return nil
+			},
+		},
+		{
+			name:   "next",
+			budget: time.Second,
+			run: func() error {
+				ran = append(ran, "next")
+				return nil
+			},
+		},
+	}
+
+	start := time.Now()
+	runShutdownStages(stages, 5*time.Second)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected slow stage abandoned after its budget, shutdown took %s", elapsed)
+	}
+
+	if len(ran) != 1 {
+		t.Fatalf("expected shutdown to move on to next stage, ran %v", ran)
+	}
+}
+
+func TestShutdownStagesBoundedByTotalTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	skipped := true
+	stages := []shutdownStage{
+		{
+			name:   "slow",
+			budget: 5 * time.Second,
+			run: func() error {
+				<-release
+				return nil
+			},
+		},
+		{
+			name:   "late",
+			budget: time.Second,
+			run: func() error {
+				skipped = false
+				return nil
+			},
+		},
+	}
+
+	start := time.Now()
+	runShutdownStages(stages, 100*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected shutdown bounded by total timeout, took %s", elapsed)
+	}
+
+	if !skipped {
+		t.Fatal("expected stage without time left to be skipped")
+	}
+}
+
+func TestChangeAppliedDuringDrainReachesSinks(t *testing.T) {
+	withReplicationConfig(t)
+	streamDB, _ := openReplicatedDB(t)
+	startTestNATS(t)
+	r := newTestReplicator(t, nil)
+	publishChange(t, r, &db.ChangeLogEvent{Id: 1, Type: "insert", TableName: "books", Row: map[string]any{"id": int64(1), "title": "dune"}})
+
+	delivered := make(chan *sink.Event, 1)
+	hook := sink.NewHook("cache", func(event *sink.Event) error {
+		delivered <- event
+		return nil
+	})
+	dispatcher, err := sink.NewDispatcher([]sink.Sink{hook})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apply := onChangeEvent(streamDB, utils.NewStateContext(), EventBus.New(), dispatcher)
+	applying := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		_ = r.Listen(1, func(data []byte, meta *nats.MsgMetadata) error {
+			close(applying)
+			<-release
+			return apply(data, meta)
+		})
+	}()
+
+	select {
+	case <-applying:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for change to be received")
+	}
+
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		gracefulShutdown(dispatcher, r, streamDB)
+	}()
+
+	// Change is still being applied once NATS connection starts draining
+	deadline := time.Now().Add(10 * time.Second)
+	for r.ConnectionStatus() == nats.CONNECTED {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for NATS drain")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	select {
+	case <-shutdown:
+	case <-time.After(time.Minute):
+		t.Fatal("timed out waiting for shutdown")
+	}
+
+	select {
+	case event := <-delivered:
+		if event.TableName != "books" || event.Type != "insert" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	default:
+		t.Fatal("expected change applied during drain to be delivered to sinks")
+	}
+}
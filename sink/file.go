@@ -0,0 +1,148 @@
+package sink
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/rs/zerolog/log"
+)
+
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+// FileSink appends every event as a JSON line to a file, rotating it once it grows past
+// configured size or age. Rotated files are renamed with a timestamp suffix and optionally
+// gzipped.
+type FileSink struct {
+	lock     *sync.Mutex
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	compress bool
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func NewFileSink(c cfg.FileSinkConfiguration) (*FileSink, error) {
+	s := &FileSink{
+		lock:     &sync.Mutex{},
+		path:     c.Path,
+		maxSize:  c.MaxSize,
+		maxAge:   time.Duration(c.MaxAge) * time.Millisecond,
+		compress: c.Gzip,
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+func (s *FileSink) Deliver(event *Event) error {
+	line, err := json.Marshal(newRecord(event))
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.shouldRotate(int64(len(line))) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) shouldRotate(next int64) bool {
+	if s.size == 0 {
+		return false
+	}
+
+	if s.maxSize > 0 && s.size+next > s.maxSize {
+		return true
+	}
+
+	return s.maxAge > 0 && time.Since(s.openedAt) >= s.maxAge
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.file = f
+	s.size = stat.Size()
+	s.openedAt = time.Now()
+	return nil
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	rotated := fmt.Sprintf("%s.%s", s.path, time.Now().UTC().Format(rotatedTimeFormat))
+	if err := os.Rename(s.path, rotated); err != nil {
+		return err
+	}
+
+	if s.compress {
+		if err := gzipFile(rotated); err != nil {
+			log.Error().Err(err).Str("path", rotated).Msg("Unable to compress rotated sink file")
+		}
+	}
+
+	log.Debug().Str("path", rotated).Msg("Rotated sink file")
+	return s.open()
+}
+
+func gzipFile(p string) error {
+	src, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(p + ".gz")
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	w := gzip.NewWriter(dst)
+	if _, err = io.Copy(w, src); err != nil {
+		return err
+	}
+
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(p)
+}
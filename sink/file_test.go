@@ -0,0 +1,129 @@
+package sink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/maxpert/marmot/cfg"
+)
+
+// readRecords parses every line of a sink file, gzipped or not.
+func readRecords(t *testing.T, path string) []record {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer gz.Close()
+
+		r = gz
+	}
+
+	ret := make([]record, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		rec := record{}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid JSON line %q in %s: %v", scanner.Text(), path, err)
+		}
+
+		ret = append(ret, rec)
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return ret
+}
+
+func TestFileSinkWritesJSONLAndRotates(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "changes.jsonl")
+	s, err := NewFileSink(cfg.FileSinkConfiguration{Path: path, MaxSize: 512, Gzip: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.file.Close() })
+
+	const total = 20
+	for i := 0; i < total; i++ {
+		err := s.Deliver(&Event{
+			FromNodeID: 7,
+			TableName:  "books",
+			Type:       "insert",
+			Key:        map[string]any{"id": i},
+			Row:        map[string]any{"id": i, "title": "dune"},
+			Sequence:   int64(i + 1),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rotated, err := filepath.Glob(path + ".*.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rotated) == 0 {
+		t.Fatal("expected file to be rotated once it reached configured size")
+	}
+
+	// Timestamp suffixes sort oldest first, current file has newest records
+	sort.Strings(rotated)
+	records := make([]record, 0, total)
+	for _, p := range append(rotated, path) {
+		recs := readRecords(t, p)
+		if len(recs) == 0 {
+			t.Fatalf("expected records in %s", p)
+		}
+
+		records = append(records, recs...)
+	}
+
+	for _, p := range rotated {
+		if _, err := os.Stat(strings.TrimSuffix(p, ".gz")); !os.IsNotExist(err) {
+			t.Fatalf("expected uncompressed copy of %s removed", p)
+		}
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.Size() > 512 {
+		t.Fatalf("current file grew to %d bytes past max size", stat.Size())
+	}
+
+	if len(records) != total {
+		t.Fatalf("expected %d records, got %d", total, len(records))
+	}
+
+	for i, rec := range records {
+		if rec.Sequence != int64(i+1) || rec.Table != "books" || rec.Op != "insert" || rec.Source != 7 {
+			t.Fatalf("unexpected record %d: %+v", i, rec)
+		}
+
+		if rec.Key["id"] != float64(i) || rec.Values["title"] != "dune" {
+			t.Fatalf("unexpected key or values in record %d: %+v", i, rec)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package sink
+
+// Hook is an in-process sink invoking a callback for every change applied on this node. Like
+// any sink it runs after change is committed on dispatcher workers, so a slow callback delays
+// other sinks but never replication, unless queue fills up with on_full set to "block".
+type Hook struct {
+	name     string
+	callback func(event *Event) error
+}
+
+func NewHook(name string, callback func(event *Event) error) *Hook {
+	return &Hook{name: name, callback: callback}
+}
+
+func (h *Hook) Name() string {
+	return h.name
+}
+
+func (h *Hook) Deliver(event *Event) error {
+	return h.callback(event)
+}
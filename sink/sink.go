@@ -0,0 +1,223 @@
+package sink
+
+import (
+	"sync"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/maxpert/marmot/telemetry"
+	"github.com/rs/zerolog/log"
+)
+
+type Event struct {
+	FromNodeID uint64
+	TableName  string
+	Type       string
+	Key        map[string]any
+	Row        map[string]any
+	Sequence   int64
+}
+
+// record is JSON representation of an event delivered by sinks
+type record struct {
+	Table    string         `json:"table"`
+	Op       string         `json:"op"`
+	Key      map[string]any `json:"key"`
+	Values   map[string]any `json:"values"`
+	Source   uint64         `json:"source"`
+	Sequence int64          `json:"seq"`
+	Time     time.Time      `json:"time"`
+}
+
+func newRecord(event *Event) *record {
+	return &record{
+		Table:    event.TableName,
+		Op:       event.Type,
+		Key:      event.Key,
+		Values:   event.Row,
+		Source:   event.FromNodeID,
+		Sequence: event.Sequence,
+		Time:     time.Now(),
+	}
+}
+
+type Sink interface {
+	Name() string
+	Deliver(event *Event) error
+}
+
+type statsDispatcher struct {
+	delivered  telemetry.Counter
+	failed     telemetry.Counter
+	dropped    telemetry.Counter
+	saturation telemetry.Gauge
+}
+
+// Dispatcher delivers events to sinks using a fixed number of workers fed by a bounded
+// queue. Once the queue is full dispatching either blocks or drops the event depending
+// on the configured policy, dropped events are written to dropped sink if configured.
+// Ordering of events across workers is not guaranteed.
+type Dispatcher struct {
+	sinks   []Sink
+	queue   chan *Event
+	drop    bool
+	dropped Sink
+	wg      *sync.WaitGroup
+	stats   *statsDispatcher
+	closed  bool
+	lock    *sync.RWMutex
+}
+
+// NewSinks builds all sinks enabled in configuration.
+func NewSinks() ([]Sink, error) {
+	sinks := []Sink{}
+	if cfg.Config.Sinks.File.Enable {
+		s, err := NewFileSink(cfg.Config.Sinks.File)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, s)
+	}
+
+	if cfg.Config.Sinks.Webhook.Enable {
+		sinks = append(sinks, NewWebhookSink(cfg.Config.Sinks.Webhook))
+	}
+
+	return sinks, nil
+}
+
+func NewDispatcher(sinks []Sink) (*Dispatcher, error) {
+	c := cfg.Config.Sinks
+	workers := c.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	queueSize := c.QueueSize
+	if queueSize < 1 {
+		queueSize = 1
+	}
+
+	d := &Dispatcher{
+		sinks: sinks,
+		queue: make(chan *Event, queueSize),
+		drop:  c.OnFull == cfg.SinkOnFullDrop,
+		wg:    &sync.WaitGroup{},
+		lock:  &sync.RWMutex{},
+		stats: &statsDispatcher{
+			delivered:  telemetry.NewCounter("sink_delivered", "number of events delivered to sinks"),
+			failed:     telemetry.NewCounter("sink_failed", "number of failed sink deliveries"),
+			dropped:    telemetry.NewCounter("sink_dropped", "number of events dropped due to full sink queue"),
+			saturation: telemetry.NewGauge("sink_saturation", "ratio of sink queue capacity in use"),
+		},
+	}
+
+	if len(sinks) == 0 {
+		return d, nil
+	}
+
+	if d.drop && c.DroppedPath != "" {
+		dropped, err := NewFileSink(cfg.FileSinkConfiguration{Path: c.DroppedPath})
+		if err != nil {
+			return nil, err
+		}
+
+		d.dropped = dropped
+	}
+
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go d.worker()
+	}
+
+	log.Info().
+		Int("sinks", len(sinks)).
+		Int("workers", workers).
+		Int("queue_size", queueSize).
+		Str("on_full", c.OnFull).
+		Msg("Sink dispatcher started")
+	return d, nil
+}
+
+// Dispatch enqueues event for delivery, returns false if event was dropped.
+func (d *Dispatcher) Dispatch(event *Event) bool {
+	if len(d.sinks) == 0 {
+		return true
+	}
+
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if d.closed {
+		return false
+	}
+
+	if !d.drop {
+		d.queue <- event
+		d.updateSaturation()
+		return true
+	}
+
+	select {
+	case d.queue <- event:
+		d.updateSaturation()
+		return true
+	default:
+		d.stats.dropped.Inc()
+		if d.dropped == nil {
+			log.Warn().
+				Str("table", event.TableName).
+				Msg("Sink queue full, dropping event")
+			return false
+		}
+
+		if err := d.dropped.Deliver(event); err != nil {
+			log.Error().
+				Err(err).
+				Str("table", event.TableName).
+				Msg("Sink queue full, unable to record dropped event")
+		}
+
+		return false
+	}
+}
+
+// Stop stops accepting new events and waits for queued events to be delivered.
+func (d *Dispatcher) Stop() {
+	d.lock.Lock()
+	if d.closed {
+		d.lock.Unlock()
+		return
+	}
+
+	d.closed = true
+	close(d.queue)
+	d.lock.Unlock()
+
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) worker() {
+	defer d.wg.Done()
+	for event := range d.queue {
+		d.updateSaturation()
+		for _, s := range d.sinks {
+			err := s.Deliver(event)
+			if err != nil {
+				d.stats.failed.Inc()
+				log.Error().
+					Err(err).
+					Str("sink", s.Name()).
+					Str("table", event.TableName).
+					Msg("Unable to deliver event to sink")
+				continue
+			}
+
+			d.stats.delivered.Inc()
+		}
+	}
+}
+
+func (d *Dispatcher) updateSaturation() {
+	d.stats.saturation.Set(float64(len(d.queue)) / float64(cap(d.queue)))
+}
@@ -0,0 +1,149 @@
+package sink
+
+import (
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+)
+
+// countingSink records how many deliveries run at the same time.
+type countingSink struct {
+	delay     time.Duration
+	release   chan struct{}
+	inFlight  int32
+	maxFlight int32
+	delivered int32
+}
+
+func (s *countingSink) Name() string {
+	return "counting"
+}
+
+func (s *countingSink) Deliver(event *Event) error {
+	n := atomic.AddInt32(&s.inFlight, 1)
+	defer atomic.AddInt32(&s.inFlight, -1)
+
+	for {
+		max := atomic.LoadInt32(&s.maxFlight)
+		if n <= max || atomic.CompareAndSwapInt32(&s.maxFlight, max, n) {
+			break
+		}
+	}
+
+	if s.release != nil {
+		<-s.release
+	}
+
+	time.Sleep(s.delay)
+	atomic.AddInt32(&s.delivered, 1)
+	return nil
+}
+
+func withSinkConfig(t *testing.T, c cfg.SinkConfiguration) {
+	saved := cfg.Config.Sinks
+	cfg.Config.Sinks = c
+	t.Cleanup(func() {
+		cfg.Config.Sinks = saved
+	})
+}
+
+func TestDispatcherConcurrencyLimit(t *testing.T) {
+	withSinkConfig(t, cfg.SinkConfiguration{Workers: 3, QueueSize: 4, OnFull: cfg.SinkOnFullBlock})
+
+	s := &countingSink{delay: 5 * time.Millisecond}
+	d, err := NewDispatcher([]Sink{s})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if !d.Dispatch(&Event{TableName: "books"}) {
+					t.Error("event dropped in blocking mode")
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	d.Stop()
+
+	if s.delivered != 100 {
+		t.Fatalf("expected 100 deliveries, got %d", s.delivered)
+	}
+
+	if s.maxFlight > 3 {
+		t.Fatalf("%d concurrent deliveries exceed limit of 3 workers", s.maxFlight)
+	}
+}
+
+func TestDispatcherDropsWhenFull(t *testing.T) {
+	withSinkConfig(t, cfg.SinkConfiguration{Workers: 1, QueueSize: 2, OnFull: cfg.SinkOnFullDrop})
+
+	s := &countingSink{release: make(chan struct{})}
+	d, err := NewDispatcher([]Sink{s})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One event is held by the worker, two fill the queue
+	accepted := 0
+	for i := 0; i < 10; i++ {
+		if d.Dispatch(&Event{TableName: "books"}) {
+			accepted++
+		}
+
+		if i == 0 {
+			for atomic.LoadInt32(&s.inFlight) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	close(s.release)
+	d.Stop()
+
+	if accepted != 3 {
+		t.Fatalf("expected 3 accepted events, got %d", accepted)
+	}
+
+	if s.delivered != 3 {
+		t.Fatalf("expected 3 deliveries, got %d", s.delivered)
+	}
+}
+
+func TestDispatcherRecordsDroppedEvents(t *testing.T) {
+	dropped := path.Join(t.TempDir(), "dropped.jsonl")
+	withSinkConfig(t, cfg.SinkConfiguration{Workers: 1, QueueSize: 1, OnFull: cfg.SinkOnFullDrop, DroppedPath: dropped})
+
+	s := &countingSink{release: make(chan struct{})}
+	d, err := NewDispatcher([]Sink{s})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.Dispatch(&Event{TableName: "books", Sequence: 1})
+	for atomic.LoadInt32(&s.inFlight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := int64(2); i <= 4; i++ {
+		d.Dispatch(&Event{TableName: "books", Sequence: i})
+	}
+
+	close(s.release)
+	d.Stop()
+
+	records := readRecords(t, dropped)
+	if len(records) != 2 || records[0].Sequence != 3 || records[1].Sequence != 4 {
+		t.Fatalf("expected events 3 and 4 recorded as dropped, got %+v", records)
+	}
+}
@@ -0,0 +1,108 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/rs/zerolog/log"
+)
+
+const maxWebhookBackoff = 30 * time.Second
+
+// WebhookSink POSTs every event as JSON to configured URL, optionally only for listed tables.
+// Failed requests are retried with exponential backoff, client errors other than 429 are not
+// retried since repeating same request won't succeed.
+type WebhookSink struct {
+	client     *http.Client
+	url        string
+	tables     map[string]bool
+	headers    map[string]string
+	maxRetries int
+	backoff    time.Duration
+}
+
+func NewWebhookSink(c cfg.WebhookSinkConfiguration) *WebhookSink {
+	tables := map[string]bool{}
+	for _, name := range c.Tables {
+		tables[name] = true
+	}
+
+	return &WebhookSink{
+		client:     &http.Client{Timeout: time.Duration(c.Timeout) * time.Millisecond},
+		url:        c.URL,
+		tables:     tables,
+		headers:    c.Headers,
+		maxRetries: c.MaxRetries,
+		backoff:    time.Duration(c.RetryBackoff) * time.Millisecond,
+	}
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *WebhookSink) Deliver(event *Event) error {
+	if len(s.tables) != 0 && !s.tables[event.TableName] {
+		return nil
+	}
+
+	body, err := json.Marshal(newRecord(event))
+	if err != nil {
+		return err
+	}
+
+	backoff := s.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(body)
+		if err == nil {
+			return nil
+		}
+
+		if !retry || attempt >= s.maxRetries {
+			return err
+		}
+
+		log.Debug().
+			Err(err).
+			Int("attempt", attempt).
+			Str("table", event.TableName).
+			Msg("Webhook delivery failed, retrying...")
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxWebhookBackoff {
+			backoff = maxWebhookBackoff
+		}
+	}
+}
+
+// post sends body once, returns true with error if request may succeed when retried.
+func (s *WebhookSink) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("webhook responded with status %d", res.StatusCode)
+}
@@ -0,0 +1,108 @@
+package sink
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/maxpert/marmot/cfg"
+)
+
+// webhookReceiver records JSON records posted to it, failing first requests with given statuses.
+type webhookReceiver struct {
+	lock     *sync.Mutex
+	failures []int
+	requests int
+	records  []record
+	headers  []http.Header
+}
+
+func newWebhookReceiver(t *testing.T, failures ...int) (*webhookReceiver, string) {
+	recv := &webhookReceiver{lock: &sync.Mutex{}, failures: failures}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recv.lock.Lock()
+		defer recv.lock.Unlock()
+
+		recv.requests++
+		if len(recv.failures) != 0 {
+			w.WriteHeader(recv.failures[0])
+			recv.failures = recv.failures[1:]
+			return
+		}
+
+		rec := record{}
+		if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+			t.Error(err)
+		}
+
+		recv.records = append(recv.records, rec)
+		recv.headers = append(recv.headers, r.Header.Clone())
+	}))
+	t.Cleanup(srv.Close)
+
+	return recv, srv.URL
+}
+
+func TestWebhookPostsChangePayloads(t *testing.T) {
+	recv, url := newWebhookReceiver(t)
+	s := NewWebhookSink(cfg.WebhookSinkConfiguration{
+		URL:     url,
+		Tables:  []string{"books"},
+		Headers: map[string]string{"Authorization": "Bearer token"},
+		Timeout: 1000,
+	})
+
+	events := []*Event{
+		{FromNodeID: 2, TableName: "books", Type: "insert", Key: map[string]any{"id": 1}, Row: map[string]any{"id": 1, "title": "dune"}, Sequence: 1},
+		{FromNodeID: 2, TableName: "authors", Type: "insert", Key: map[string]any{"id": 1}, Row: map[string]any{"id": 1}, Sequence: 2},
+		{FromNodeID: 2, TableName: "books", Type: "update", Key: map[string]any{"id": 1}, Row: map[string]any{"id": 1, "title": "emma"}, Sequence: 3},
+		{FromNodeID: 2, TableName: "books", Type: "delete", Key: map[string]any{"id": 1}, Row: map[string]any{"id": 1, "title": "emma"}, Sequence: 4},
+	}
+	for _, event := range events {
+		if err := s.Deliver(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []struct {
+		op    string
+		title string
+		seq   int64
+	}{{"insert", "dune", 1}, {"update", "emma", 3}, {"delete", "emma", 4}}
+	if len(recv.records) != len(expected) {
+		t.Fatalf("expected %d changes of books posted, got %+v", len(expected), recv.records)
+	}
+
+	for i, e := range expected {
+		rec := recv.records[i]
+		if rec.Table != "books" || rec.Op != e.op || rec.Values["title"] != e.title || rec.Key["id"] != float64(1) ||
+			rec.Source != 2 || rec.Sequence != e.seq {
+			t.Errorf("unexpected %s payload %+v", e.op, rec)
+		}
+
+		if recv.headers[i].Get("Authorization") != "Bearer token" || recv.headers[i].Get("Content-Type") != "application/json" {
+			t.Errorf("expected configured headers on %s request, got %v", e.op, recv.headers[i])
+		}
+	}
+}
+
+func TestWebhookRetriesFailedDeliveries(t *testing.T) {
+	recv, url := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	s := NewWebhookSink(cfg.WebhookSinkConfiguration{URL: url, Timeout: 1000, MaxRetries: 2, RetryBackoff: 1})
+
+	if err := s.Deliver(&Event{TableName: "books", Type: "insert"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if recv.requests != 3 || len(recv.records) != 1 {
+		t.Fatalf("expected change delivered on third attempt, got %d requests", recv.requests)
+	}
+
+	recv, url = newWebhookReceiver(t, http.StatusBadRequest)
+	s = NewWebhookSink(cfg.WebhookSinkConfiguration{URL: url, Timeout: 1000, MaxRetries: 2, RetryBackoff: 1})
+	if err := s.Deliver(&Event{TableName: "books", Type: "insert"}); err == nil || recv.requests != 1 {
+		t.Fatalf("expected client error returned without retrying, got %v after %d requests", err, recv.requests)
+	}
+}
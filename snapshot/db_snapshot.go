@@ -33,35 +33,59 @@ func NewNatsDBSnapshot(d *db.SqliteStreamDB, snapshotStorage Storage) *NatsDBSna
 	}
 }
 
-func (n *NatsDBSnapshot) SaveSnapshot() error {
+// SaveSnapshot uploads backup of database, seqs are stream sequences already applied to database.
+func (n *NatsDBSnapshot) SaveSnapshot(seqs map[string]uint64) (*Info, error) {
 	locked := n.mutex.TryLock()
 	if !locked {
-		return ErrPendingSnapshot
+		return nil, ErrPendingSnapshot
 	}
 
 	defer n.mutex.Unlock()
 	tmpSnapshot, err := os.MkdirTemp(os.TempDir(), tempDirPattern)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer cleanupDir(tmpSnapshot)
 
 	bkFilePath := path.Join(tmpSnapshot, snapshotFileName)
-	err = n.db.BackupTo(bkFilePath)
+	seqs, err = n.db.BackupTo(bkFilePath, seqs)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return n.storage.Upload(snapshotFileName, bkFilePath)
+	hash, err := fileHash(bkFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(bkFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = n.storage.Upload(snapshotFileName, bkFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Info{
+		Name:      snapshotFileName,
+		Checksum:  hash,
+		Size:      stat.Size(),
+		SavedAt:   time.Now(),
+		Sequences: seqs,
+	}, nil
 }
 
-func (n *NatsDBSnapshot) RestoreSnapshot() error {
+// RestoreSnapshot replaces database with newest snapshot and returns stream sequences it
+// includes, replication has to resume right after them. Nil is returned without snapshot.
+func (n *NatsDBSnapshot) RestoreSnapshot() (map[string]uint64, error) {
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
 
 	tmpSnapshotPath, err := os.MkdirTemp(os.TempDir(), tempDirPattern)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer cleanupDir(tmpSnapshotPath)
 
@@ -69,21 +93,32 @@ func (n *NatsDBSnapshot) RestoreSnapshot() error {
 	err = n.storage.Download(bkFilePath, snapshotFileName)
 	if err == ErrNoSnapshotFound {
 		log.Warn().Err(err).Msg("System will now continue without restoring snapshot")
-		return nil
+		return nil, nil
 	}
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	log.Info().Str("path", bkFilePath).Msg("Downloaded snapshot, restoring...")
-	err = db.RestoreFrom(n.db.GetPath(), bkFilePath)
+	seqs, err := db.SnapshotSeqs(bkFilePath)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	log.Info().Str("path", bkFilePath).Interface("sequences", seqs).Msg("Downloaded snapshot, restoring...")
+	err = n.db.RestoreFrom(bkFilePath)
+	if err != nil {
+		return nil, err
 	}
 
 	log.Info().Str("path", bkFilePath).Msg("Restore complete...")
-	return nil
+	return seqs, nil
+}
+
+// LastSnapshotTime returns time newest snapshot was saved to storage, ErrNoSnapshotFound
+// is returned if no snapshot was ever saved.
+func (n *NatsDBSnapshot) LastSnapshotTime() (time.Time, error) {
+	return n.storage.LastModified(snapshotFileName)
 }
 
 func cleanupDir(p string) {
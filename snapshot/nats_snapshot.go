@@ -2,6 +2,7 @@ package snapshot
 
 import (
 	"errors"
+	"time"
 
 	"github.com/maxpert/marmot/cfg"
 )
@@ -10,14 +11,26 @@ var ErrInvalidStorageType = errors.New("invalid snapshot storage type")
 var ErrNoSnapshotFound = errors.New("no snapshot found")
 var ErrRequiredParameterMissing = errors.New("required parameter missing")
 
+// Info describes a snapshot saved to storage, Sequences are last sequences of streams
+// included in snapshot.
+type Info struct {
+	Name      string            `json:"name"`
+	Checksum  string            `json:"checksum"`
+	Size      int64             `json:"size"`
+	SavedAt   time.Time         `json:"saved_at"`
+	Sequences map[string]uint64 `json:"sequences,omitempty"`
+}
+
 type NatsSnapshot interface {
-	SaveSnapshot() error
-	RestoreSnapshot() error
+	SaveSnapshot(seqs map[string]uint64) (*Info, error)
+	RestoreSnapshot() (map[string]uint64, error)
+	LastSnapshotTime() (time.Time, error)
 }
 
 type Storage interface {
 	Upload(name, filePath string) error
 	Download(filePath, name string) error
+	LastModified(name string) (time.Time, error)
 }
 
 func NewSnapshotStorage() (Storage, error) {
@@ -91,6 +91,24 @@ func (n *natsStorage) Download(filePath, name string) error {
 	}
 }
 
+func (n *natsStorage) LastModified(name string) (time.Time, error) {
+	blb, err := getBlobStore(n.nc)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	info, err := blb.GetInfo(name)
+	if err == nats.ErrObjectNotFound {
+		return time.Time{}, ErrNoSnapshotFound
+	}
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime, nil
+}
+
 func getBlobStore(conn *nats.Conn) (nats.ObjectStore, error) {
 	js, err := conn.JetStream(nats.MaxWait(30 * time.Second))
 	if err != nil {
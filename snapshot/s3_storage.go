@@ -49,6 +49,24 @@ func (s s3Storage) Download(filePath, name string) error {
 	return err
 }
 
+func (s s3Storage) LastModified(name string) (time.Time, error) {
+	ctx := context.Background()
+	cS3 := cfg.Config.Snapshot.S3
+	bucketPath := fmt.Sprintf("%s/%s", cS3.DirPath, name)
+	info, err := s.mc.StatObject(ctx, cS3.Bucket, bucketPath, minio.StatObjectOptions{})
+	if mErr, ok := err.(minio.ErrorResponse); ok {
+		if mErr.StatusCode == http.StatusNotFound {
+			return time.Time{}, ErrNoSnapshotFound
+		}
+	}
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.LastModified, nil
+}
+
 func newS3Storage() (*s3Storage, error) {
 	c := cfg.Config
 	cS3 := c.Snapshot.S3
@@ -5,6 +5,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"time"
 
 	"github.com/maxpert/marmot/cfg"
 	"github.com/pkg/sftp"
@@ -77,6 +78,20 @@ func (s *sftpStorage) Download(filePath, name string) error {
 	return err
 }
 
+func (s *sftpStorage) LastModified(name string) (time.Time, error) {
+	remotePath := path.Join(s.uploadPath, name)
+	info, err := s.client.Stat(remotePath)
+	if os.IsNotExist(err) {
+		return time.Time{}, ErrNoSnapshotFound
+	}
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
 func newSFTPStorage() (*sftpStorage, error) {
 	// Get the SFTP URL from the environment
 	sftpURL := cfg.Config.Snapshot.SFTP.Url
@@ -86,6 +86,21 @@ func (w *webDAVStorage) Download(filePath, name string) error {
 	return nil
 }
 
+func (w *webDAVStorage) LastModified(name string) (time.Time, error) {
+	completedPath := path.Join(w.path, name)
+	info, err := w.client.Stat(completedPath)
+	if err != nil {
+		if fsErr, ok := err.(*fs.PathError); ok {
+			if wdErr, ok := fsErr.Err.(gowebdav.StatusError); ok && wdErr.Status == 404 {
+				return time.Time{}, ErrNoSnapshotFound
+			}
+		}
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
 func (w *webDAVStorage) makeStoragePath() error {
 	err := w.client.MkdirAll(w.path, 0740)
 	if err == nil {
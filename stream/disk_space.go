@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package stream
+
+import "syscall"
+
+// availableDiskSpace returns bytes available to unprivileged users on filesystem holding dir.
+func availableDiskSpace(dir string) (uint64, error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
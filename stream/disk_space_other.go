@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package stream
+
+import "errors"
+
+// availableDiskSpace isn't supported on this platform, store limit is never checked against disk.
+func availableDiskSpace(_ string) (uint64, error) {
+	return 0, errors.New("checking available disk space is not supported on this platform")
+}
@@ -1,18 +1,28 @@
 package stream
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"net/url"
+	"os"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/maxpert/marmot/cfg"
 	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+var ErrJetStreamNotReady = errors.New("embedded JetStream not ready")
+var ErrClusterSizeNotMet = errors.New("minimum cluster size not reached")
+var ErrInvalidClusterPeer = errors.New("invalid cluster peer")
+
 type embeddedNats struct {
 	server *server.Server
 	lock   *sync.Mutex
@@ -37,6 +47,36 @@ func parseHostAndPort(adr string) (string, int, error) {
 	return host, port, nil
 }
 
+// parseClusterPeers parses comma separated peer URLs, IPv6 hosts have to be bracketed
+// (nats://[fe80::1]:6222). Unlike server.RoutesFromStr malformed peers are reported instead
+// of being passed on as nil routes.
+func parseClusterPeers(peers string) ([]*url.URL, error) {
+	routes := make([]*url.URL, 0)
+	for _, peer := range strings.Split(peers, ",") {
+		peer = strings.TrimSpace(peer)
+		if peer == "" {
+			continue
+		}
+
+		u, err := url.Parse(peer)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidClusterPeer, err)
+		}
+
+		if u.Hostname() == "" || u.Port() == "" {
+			return nil, fmt.Errorf("%w: %s must be URL with host and port", ErrInvalidClusterPeer, peer)
+		}
+
+		if strings.Contains(u.Hostname(), ":") && !strings.HasPrefix(u.Host, "[") {
+			return nil, fmt.Errorf("%w: IPv6 host of %s must be bracketed", ErrInvalidClusterPeer, peer)
+		}
+
+		routes = append(routes, u)
+	}
+
+	return routes, nil
+}
+
 func startEmbeddedServer(nodeName string) (*embeddedNats, error) {
 	embeddedIns.lock.Lock()
 	defer embeddedIns.lock.Unlock()
@@ -56,8 +96,8 @@ func startEmbeddedServer(nodeName string) (*embeddedNats, error) {
 		Port:               port,
 		NoSigs:             true,
 		JetStream:          true,
-		JetStreamMaxMemory: -1,
-		JetStreamMaxStore:  -1,
+		JetStreamMaxMemory: cfg.Config.NATS.JSMaxMemory,
+		JetStreamMaxStore:  cfg.Config.NATS.JSMaxFile,
 		Cluster: server.ClusterOpts{
 			Name: cfg.EmbeddedClusterName,
 		},
@@ -65,7 +105,10 @@ func startEmbeddedServer(nodeName string) (*embeddedNats, error) {
 	}
 
 	if *cfg.ClusterPeersFlag != "" {
-		opts.Routes = server.RoutesFromStr(*cfg.ClusterPeersFlag)
+		opts.Routes, err = parseClusterPeers(*cfg.ClusterPeersFlag)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if *cfg.ClusterAddrFlag != "" {
@@ -99,15 +142,21 @@ func startEmbeddedServer(nodeName string) (*embeddedNats, error) {
 		opts.StoreDir = path.Join(cfg.DataRootDir, "nats", nodeName)
 	}
 
+	warnStoreExceedsDisk(opts.StoreDir, opts.JetStreamMaxStore)
+
 	s, err := server.NewServer(opts)
 	if err != nil {
 		return nil, err
 	}
 
+	// NATS server only emits debug and trace logs when asked to, they're enabled by server
+	// config or by explicitly lowering level of nats logging subsystem
+	level := cfg.Config.Logging.SubsystemLevel(cfg.LogSubsystemNATS)
+	_, override := cfg.Config.Logging.Subsystems[cfg.LogSubsystemNATS]
 	s.SetLogger(
-		&natsLogger{log.With().Str("from", "nats").Logger()},
-		opts.Debug,
-		opts.Trace,
+		&natsLogger{log.With().Str("from", "nats").Logger().Level(level)},
+		opts.Debug || (override && level <= zerolog.DebugLevel),
+		opts.Trace || (override && level <= zerolog.TraceLevel),
 	)
 	s.Start()
 
@@ -115,6 +164,38 @@ func startEmbeddedServer(nodeName string) (*embeddedNats, error) {
 	return embeddedIns, nil
 }
 
+// warnStoreExceedsDisk logs a warning if configured file store limit is larger than space
+// available on disk holding store directory, JetStream would fail writes before hitting limit.
+func warnStoreExceedsDisk(storeDir string, maxStore int64) {
+	if maxStore < 1 {
+		return
+	}
+
+	// Store directory is created by server, check closest existing parent
+	dir := storeDir
+	for {
+		if _, err := os.Stat(dir); err == nil || path.Dir(dir) == dir {
+			break
+		}
+
+		dir = path.Dir(dir)
+	}
+
+	available, err := availableDiskSpace(dir)
+	if err != nil {
+		log.Debug().Err(err).Str("dir", dir).Msg("Unable to check available disk space")
+		return
+	}
+
+	if uint64(maxStore) > available {
+		log.Warn().
+			Int64("js_max_file", maxStore).
+			Uint64("available", available).
+			Str("dir", dir).
+			Msg("JetStream file store limit exceeds available disk space")
+	}
+}
+
 func (e *embeddedNats) prepareConnection(opts ...nats.Option) (*nats.Conn, error) {
 	e.lock.Lock()
 	s := e.server
@@ -124,6 +205,17 @@ func (e *embeddedNats) prepareConnection(opts ...nats.Option) (*nats.Conn, error
 		continue
 	}
 
+	minSize := cfg.Config.NATS.MinClusterSize
+	clusterTimeout := time.Duration(cfg.Config.NATS.ClusterWaitTimeoutSeconds) * time.Second
+	if err := waitClusterSize(s, minSize, clusterTimeout); err != nil {
+		return nil, err
+	}
+
+	timeout := time.Duration(cfg.Config.NATS.JetStreamReadyTimeoutSeconds) * time.Second
+	if err := waitJetStreamReady(s, timeout); err != nil {
+		return nil, err
+	}
+
 	opts = append(opts, nats.InProcessServer(s))
 	for {
 		c, err := nats.Connect("", opts...)
@@ -148,3 +240,62 @@ func (e *embeddedNats) prepareConnection(opts ...nats.Option) (*nats.Conn, error
 		time.Sleep(1 * time.Second)
 	}
 }
+
+// waitClusterSize blocks until routes to at least minSize-1 distinct peers are established.
+func waitClusterSize(s *server.Server, minSize int, timeout time.Duration) error {
+	if minSize < 2 {
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		peers := routedPeers(s)
+		if peers+1 >= minSize {
+			log.Info().Int("members", peers+1).Msg("Minimum cluster size reached...")
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: %d of %d members reachable", ErrClusterSizeNotMet, peers+1, minSize)
+		}
+
+		log.Debug().
+			Int("members", peers+1).
+			Int("min_cluster_size", minSize).
+			Msg("Waiting for cluster members...")
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func routedPeers(s *server.Server) int {
+	routez, err := s.Routez(&server.RoutezOptions{})
+	if err != nil {
+		return 0
+	}
+
+	peers := map[string]bool{}
+	for _, r := range routez.Routes {
+		peers[r.RemoteID] = true
+	}
+
+	return len(peers)
+}
+
+// waitJetStreamReady blocks until embedded JetStream has a current meta leader, so that
+// streams aren't created while assets from a previous run are still being recovered.
+func waitJetStreamReady(s *server.Server, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !s.JetStreamEnabled() || !s.JetStreamIsCurrent() {
+		if time.Now().After(deadline) {
+			return ErrJetStreamNotReady
+		}
+
+		log.Debug().
+			Bool("clustered", s.JetStreamIsClustered()).
+			Msg("Waiting for JetStream meta leader...")
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	log.Debug().Bool("leader", s.JetStreamIsLeader()).Msg("JetStream ready...")
+	return nil
+}
@@ -0,0 +1,191 @@
+package stream
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+func newTestServer(t *testing.T) *server.Server {
+	t.Helper()
+
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		NoSigs:    true,
+		NoLog:     true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func TestWaitJetStreamReadyTimesOut(t *testing.T) {
+	s := newTestServer(t)
+
+	err := waitJetStreamReady(s, 300*time.Millisecond)
+	if !errors.Is(err, ErrJetStreamNotReady) {
+		t.Fatalf("expected %v, got %v", ErrJetStreamNotReady, err)
+	}
+}
+
+func TestWaitJetStreamReadyBlocksUntilStarted(t *testing.T) {
+	s := newTestServer(t)
+
+	delay := 500 * time.Millisecond
+	start := time.Now()
+	go func() {
+		time.Sleep(delay)
+		s.Start()
+	}()
+
+	if err := waitJetStreamReady(s, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(start) < delay {
+		t.Fatalf("returned after %v, before JetStream was started", time.Since(start))
+	}
+
+	if !s.JetStreamEnabled() || !s.JetStreamIsCurrent() {
+		t.Fatal("JetStream isn't ready after wait returned")
+	}
+}
+
+func TestEmbeddedServerJetStreamLimits(t *testing.T) {
+	saved, savedRoot := *cfg.Config, cfg.DataRootDir
+	t.Cleanup(func() {
+		*cfg.Config, cfg.DataRootDir = saved, savedRoot
+	})
+	cfg.DataRootDir = t.TempDir()
+	cfg.Config.NATS.BindAddress = "127.0.0.1:-1"
+	cfg.Config.NATS.JSMaxMemory = 64 << 20
+	cfg.Config.NATS.JSMaxFile = 128 << 20
+
+	embedded, err := startEmbeddedServer("limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		embedded.server.Shutdown()
+		embedded.server = nil
+	})
+
+	if err := waitJetStreamReady(embedded.server, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	js := embedded.server.JetStreamConfig()
+	if js == nil || js.MaxMemory != 64<<20 || js.MaxStore != 128<<20 {
+		t.Fatalf("expected JetStream configured with given limits, got %+v", js)
+	}
+}
+
+func newClusterServer(t *testing.T, routes ...*url.URL) *server.Server {
+	t.Helper()
+
+	s, err := server.NewServer(&server.Options{
+		Host:    "127.0.0.1",
+		Port:    -1,
+		NoSigs:  true,
+		NoLog:   true,
+		Cluster: server.ClusterOpts{Name: "test", Host: "127.0.0.1", Port: -1},
+		Routes:  routes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Start()
+	t.Cleanup(s.Shutdown)
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Error("NATS server not ready")
+	}
+
+	return s
+}
+
+func TestWaitClusterSizeTimesOut(t *testing.T) {
+	s := newClusterServer(t)
+
+	timeout := 500 * time.Millisecond
+	start := time.Now()
+	err := waitClusterSize(s, 2, timeout)
+	if !errors.Is(err, ErrClusterSizeNotMet) {
+		t.Fatalf("expected %v, got %v", ErrClusterSizeNotMet, err)
+	}
+
+	if time.Since(start) < timeout {
+		t.Fatalf("returned after %v, before timeout", time.Since(start))
+	}
+}
+
+func TestWaitClusterSizeBlocksUntilMet(t *testing.T) {
+	s := newClusterServer(t)
+	route, err := url.Parse("nats://" + s.ClusterAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delay := 500 * time.Millisecond
+	start := time.Now()
+	go func() {
+		time.Sleep(delay)
+		newClusterServer(t, route)
+	}()
+
+	if err := waitClusterSize(s, 2, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(start) < delay {
+		t.Fatalf("returned after %v, before second member started", time.Since(start))
+	}
+}
+
+func TestParseClusterPeers(t *testing.T) {
+	routes, err := parseClusterPeers("nats://10.0.0.1:6222, nats://[fe80::1]:6222,,nats://peer-3:6222")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"10.0.0.1:6222", "[fe80::1]:6222", "peer-3:6222"}
+	if len(routes) != len(expected) {
+		t.Fatalf("expected %d routes, got %v", len(expected), routes)
+	}
+
+	for i, route := range routes {
+		if route == nil || route.Host != expected[i] {
+			t.Fatalf("expected route %d to %s, got %v", i, expected[i], route)
+		}
+	}
+
+	if routes[1].Hostname() != "fe80::1" {
+		t.Fatalf("expected IPv6 host unbracketed, got %s", routes[1].Hostname())
+	}
+}
+
+func TestParseClusterPeersRejectsMalformed(t *testing.T) {
+	for _, peers := range []string{
+		"peer-1:6222",
+		"nats://peer-1",
+		"nats://:6222",
+		"nats://peer-1:abc",
+		"nats://fe80::1:6222",
+		"nats://10.0.0.1:6222,nats://peer-2",
+	} {
+		routes, err := parseClusterPeers(peers)
+		if !errors.Is(err, ErrInvalidClusterPeer) {
+			t.Errorf("expected %q rejected with %v, got %v (%v)", peers, ErrInvalidClusterPeer, routes, err)
+		}
+	}
+}
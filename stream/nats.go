@@ -1,6 +1,8 @@
 package stream
 
 import (
+	"crypto/tls"
+	"errors"
 	"strings"
 	"time"
 
@@ -9,6 +11,10 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+const lameDuckFlushTimeout = 5 * time.Second
+
+var ErrIncompleteClientCert = errors.New("nats.cert_file and nats.key_file must be set together")
+
 func Connect() (*nats.Conn, error) {
 	opts := setupConnOptions()
 
@@ -17,22 +23,29 @@ func Connect() (*nats.Conn, error) {
 		return nil, err
 	}
 
-	tls, err := getNatsTLSFromConfig()
+	tlsOpts, err := getNatsTLSFromConfig()
 	if err != nil {
 		return nil, err
 	}
 
-	opts = append(opts, creds...)
-	opts = append(opts, tls...)
+	if cfg.Config.NATS.NoEcho {
+		opts = append(opts, nats.NoEcho())
+	}
+
 	if len(cfg.Config.NATS.URLs) == 0 {
 		embedded, err := startEmbeddedServer(cfg.Config.NodeName())
 		if err != nil {
 			return nil, err
 		}
 
+		// In-process connection never goes through network listener, credentials and TLS
+		// of remote cluster would only break it
 		return embedded.prepareConnection(opts...)
 	}
 
+	opts = append(opts, creds...)
+	opts = append(opts, tlsOpts...)
+
 	url := strings.Join(cfg.Config.NATS.URLs, ", ")
 
 	var conn *nats.Conn
@@ -61,6 +74,10 @@ func getNatsAuthFromConfig() ([]nats.Option, error) {
 		opts = append(opts, opt)
 	}
 
+	if cfg.Config.NATS.Token != "" {
+		opts = append(opts, nats.Token(cfg.Config.NATS.Token))
+	}
+
 	if cfg.Config.NATS.SeedFile != "" {
 		opt, err := nats.NkeyOptionFromSeed(cfg.Config.NATS.SeedFile)
 		if err != nil {
@@ -70,12 +87,26 @@ func getNatsAuthFromConfig() ([]nats.Option, error) {
 		opts = append(opts, opt)
 	}
 
+	if cfg.Config.NATS.CredsFile != "" {
+		opts = append(opts, nats.UserCredentials(cfg.Config.NATS.CredsFile))
+	}
+
 	return opts, nil
 }
 
 func getNatsTLSFromConfig() ([]nats.Option, error) {
 	opts := make([]nats.Option, 0)
 
+	if (cfg.Config.NATS.CertFile == "") != (cfg.Config.NATS.KeyFile == "") {
+		return nil, ErrIncompleteClientCert
+	}
+
+	// Must come first, Secure replaces TLS config that RootCAs and ClientCert add to
+	if cfg.Config.NATS.InsecureSkipVerify {
+		log.Warn().Msg("NATS server certificate verification disabled")
+		opts = append(opts, nats.Secure(&tls.Config{InsecureSkipVerify: true}))
+	}
+
 	if cfg.Config.NATS.CAFile != "" {
 		opt := nats.RootCAs(cfg.Config.NATS.CAFile)
 		opts = append(opts, opt)
@@ -90,11 +121,17 @@ func getNatsTLSFromConfig() ([]nats.Option, error) {
 }
 
 func setupConnOptions() []nats.Option {
-	return []nats.Option{
+	// 0 keeps previous behavior of reconnecting as many times as initial connect is retried
+	maxReconnects := cfg.Config.NATS.MaxReconnects
+	if maxReconnects == 0 {
+		maxReconnects = cfg.Config.NATS.ConnectRetries
+	}
+
+	opts := []nats.Option{
 		nats.Name(cfg.Config.NodeName()),
 		nats.RetryOnFailedConnect(true),
 		nats.ReconnectWait(time.Duration(cfg.Config.NATS.ReconnectWaitSeconds) * time.Second),
-		nats.MaxReconnects(cfg.Config.NATS.ConnectRetries),
+		nats.MaxReconnects(maxReconnects),
 		nats.ClosedHandler(func(nc *nats.Conn) {
 			log.Error().
 				Err(nc.LastError()).
@@ -103,12 +140,34 @@ func setupConnOptions() []nats.Option {
 		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
 			log.Error().
 				Err(err).
+				Uint64("reconnects", nc.Stats().Reconnects).
+				Int("max_reconnects", maxReconnects).
 				Msg("NATS client disconnected")
 		}),
+		nats.LameDuckModeHandler(func(nc *nats.Conn) {
+			// Server will close this connection soon and client reconnects to another
+			// server from discovered pool, flush so in-flight publishes aren't lost
+			log.Warn().
+				Str("url", nc.ConnectedUrl()).
+				Msg("NATS server entered lame duck mode, flushing pending publishes")
+
+			if err := nc.FlushTimeout(lameDuckFlushTimeout); err != nil {
+				log.Warn().
+					Err(err).
+					Msg("Unable to flush pending publishes before lame duck migration")
+			}
+		}),
 		nats.ReconnectHandler(func(nc *nats.Conn) {
 			log.Info().
 				Str("url", nc.ConnectedUrl()).
+				Uint64("reconnects", nc.Stats().Reconnects).
 				Msg("NATS client reconnected")
 		}),
 	}
+
+	if cfg.Config.NATS.PingIntervalSeconds > 0 {
+		opts = append(opts, nats.PingInterval(time.Duration(cfg.Config.NATS.PingIntervalSeconds)*time.Second))
+	}
+
+	return opts
 }
@@ -0,0 +1,143 @@
+package stream
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/nats-io/nats.go"
+)
+
+// fakeServer speaks just enough of NATS protocol to accept one client and notify it
+// about lame duck mode, pings received after notification come from flushing client.
+type fakeServer struct {
+	listener net.Listener
+	conn     chan net.Conn
+	lameDuck chan struct{}
+	pings    chan struct{}
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &fakeServer{
+		listener: listener,
+		conn:     make(chan net.Conn, 1),
+		lameDuck: make(chan struct{}),
+		pings:    make(chan struct{}, 16),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) url() string {
+	return "nats://" + s.listener.Addr().String()
+}
+
+func (s *fakeServer) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, _ = conn.Write([]byte("INFO {\"server_id\":\"fake\",\"version\":\"2.10.4\",\"proto\":1,\"max_payload\":1048576,\"headers\":true}\r\n"))
+	s.conn <- conn
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		if strings.HasPrefix(line, "PING") {
+			_, _ = conn.Write([]byte("PONG\r\n"))
+			select {
+			case <-s.lameDuck:
+				s.pings <- struct{}{}
+			default:
+			}
+		}
+	}
+}
+
+func (s *fakeServer) enterLameDuckMode(conn net.Conn) {
+	close(s.lameDuck)
+	_, _ = conn.Write([]byte("INFO {\"server_id\":\"fake\",\"version\":\"2.10.4\",\"proto\":1,\"max_payload\":1048576,\"headers\":true,\"ldm\":true}\r\n"))
+}
+
+func TestLameDuckModeFlushesPendingPublishes(t *testing.T) {
+	s := newFakeServer(t)
+
+	conn, err := nats.Connect(s.url(), setupConnOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s.enterLameDuckMode(<-s.conn)
+
+	select {
+	case <-s.pings:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected pending publishes to be flushed once server entered lame duck mode")
+	}
+}
+
+func TestNoEchoSkipsOwnPublishes(t *testing.T) {
+	s := newTestServer(t)
+	s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+
+	saved := *cfg.Config
+	t.Cleanup(func() {
+		*cfg.Config = saved
+	})
+	cfg.Config.NATS.URLs = []string{s.ClientURL()}
+
+	for _, noEcho := range []bool{true, false} {
+		cfg.Config.NATS.NoEcho = noEcho
+		conn, err := Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		received := make(chan *nats.Msg, 1)
+		if _, err := conn.ChanSubscribe("changes", received); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := conn.Publish("changes", []byte("change")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := conn.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-received:
+			if noEcho {
+				t.Fatal("expected own publish not delivered with no echo enabled")
+			}
+		case <-time.After(500 * time.Millisecond):
+			if !noEcho {
+				t.Fatal("expected own publish delivered with no echo disabled")
+			}
+		}
+
+		conn.Close()
+	}
+}
@@ -0,0 +1,103 @@
+package telemetry
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/rs/zerolog/log"
+)
+
+var statsdConn net.Conn
+
+type statsdCounter struct {
+	name string
+}
+
+type statsdGauge struct {
+	name string
+}
+
+type statsdHistogram struct {
+	name string
+}
+
+func (c statsdCounter) Inc() {
+	c.Add(1)
+}
+
+func (c statsdCounter) Add(v float64) {
+	statsdSend(c.name, formatStatsdValue(v), "c")
+}
+
+func (g statsdGauge) Set(v float64) {
+	// Signed values are treated as relative change by StatsD, reset before setting
+	if v < 0 {
+		statsdSend(g.name, "0", "g")
+	}
+
+	statsdSend(g.name, formatStatsdValue(v), "g")
+}
+
+func (g statsdGauge) Inc() {
+	g.Add(1)
+}
+
+func (g statsdGauge) Dec() {
+	g.Add(-1)
+}
+
+func (g statsdGauge) Sub(v float64) {
+	g.Add(-v)
+}
+
+func (g statsdGauge) Add(v float64) {
+	if v >= 0 {
+		statsdSend(g.name, "+"+formatStatsdValue(v), "g")
+		return
+	}
+
+	statsdSend(g.name, formatStatsdValue(v), "g")
+}
+
+func (g statsdGauge) SetToCurrentTime() {
+	g.Set(float64(time.Now().Unix()))
+}
+
+// Observe sends value as histogram sample rather than timer, histograms record counts (e.g.
+// batch sizes) and latencies in units other than milliseconds which timers would mislabel.
+func (h statsdHistogram) Observe(v float64) {
+	statsdSend(h.name, formatStatsdValue(v), "h")
+}
+
+func statsdName(name string) string {
+	prefix := cfg.Config.StatsD.Prefix
+	if prefix != "" {
+		prefix += "."
+	}
+
+	return fmt.Sprintf("%s%d.%s", prefix, cfg.Config.NodeID, name)
+}
+
+func statsdSend(name, value, kind string) {
+	_, err := statsdConn.Write([]byte(name + ":" + value + "|" + kind))
+	if err != nil {
+		log.Debug().Err(err).Str("metric", name).Msg("Unable to send StatsD metric")
+	}
+}
+
+func formatStatsdValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func initializeStatsD() {
+	conn, err := net.Dial("udp", cfg.Config.StatsD.Address)
+	if err != nil {
+		log.Error().Err(err).Str("address", cfg.Config.StatsD.Address).Msg("Unable to initialize StatsD")
+		return
+	}
+
+	statsdConn = conn
+}
@@ -0,0 +1,63 @@
+package telemetry
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maxpert/marmot/cfg"
+)
+
+func TestStatsDReceivesUpdates(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	saved := *cfg.Config
+	t.Cleanup(func() {
+		*cfg.Config = saved
+		statsdConn.Close()
+		statsdConn = nil
+	})
+	cfg.Config.NodeID = 7
+	cfg.Config.StatsD.Enable = true
+	cfg.Config.StatsD.Address = listener.LocalAddr().String()
+	cfg.Config.StatsD.Prefix = "marmot"
+
+	InitializeTelemetry()
+	if statsdConn == nil {
+		t.Fatal("expected StatsD connection")
+	}
+
+	NewCounter("published", "").Add(3)
+	gauge := NewGauge("pending", "")
+	gauge.Set(-2)
+	gauge.Inc()
+	NewHistogram("apply_latency", "").Observe(1.5)
+
+	expected := []string{
+		"marmot.7.published:3|c",
+		"marmot.7.pending:0|g",
+		"marmot.7.pending:-2|g",
+		"marmot.7.pending:+1|g",
+		"marmot.7.apply_latency:1.5|h",
+	}
+
+	buf := make([]byte, 1024)
+	for _, packet := range expected {
+		if err := listener.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("expected %q, got %v", packet, err)
+		}
+
+		if got := string(buf[:n]); got != packet {
+			t.Fatalf("expected %q, got %q", packet, got)
+		}
+	}
+}
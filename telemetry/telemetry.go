@@ -54,6 +54,10 @@ func (n NoopStat) Add(float64) {
 }
 
 func NewCounter(name string, help string) Counter {
+	if statsdConn != nil {
+		return statsdCounter{name: statsdName(name)}
+	}
+
 	if registry == nil {
 		return NoopStat{}
 	}
@@ -73,6 +77,10 @@ func NewCounter(name string, help string) Counter {
 }
 
 func NewGauge(name string, help string) Gauge {
+	if statsdConn != nil {
+		return statsdGauge{name: statsdName(name)}
+	}
+
 	if registry == nil {
 		return NoopStat{}
 	}
@@ -92,6 +100,10 @@ func NewGauge(name string, help string) Gauge {
 }
 
 func NewHistogram(name string, help string) Histogram {
+	if statsdConn != nil {
+		return statsdHistogram{name: statsdName(name)}
+	}
+
 	if registry == nil {
 		return NoopStat{}
 	}
@@ -111,6 +123,11 @@ func NewHistogram(name string, help string) Histogram {
 }
 
 func InitializeTelemetry() {
+	if cfg.Config.StatsD.Enable {
+		initializeStatsD()
+		return
+	}
+
 	if !cfg.Config.Prometheus.Enable {
 		return
 	}
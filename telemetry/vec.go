@@ -0,0 +1,110 @@
+package telemetry
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/maxpert/marmot/cfg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Vec is a family of stats partitioned by label values, e.g. one counter per table.
+type Vec[T any] interface {
+	With(labelValues ...string) T
+}
+
+type vecFunc[T any] func(labelValues ...string) T
+
+func (f vecFunc[T]) With(labelValues ...string) T {
+	return f(labelValues...)
+}
+
+func NewCounterVec(name string, help string, labels ...string) Vec[Counter] {
+	if statsdConn != nil {
+		return vecFunc[Counter](func(labelValues ...string) Counter {
+			return statsdCounter{name: statsdLabeledName(name, labelValues)}
+		})
+	}
+
+	if registry == nil {
+		return vecFunc[Counter](func(...string) Counter { return NoopStat{} })
+	}
+
+	ret := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   cfg.Config.Prometheus.Namespace,
+		Subsystem:   cfg.Config.Prometheus.Subsystem,
+		Name:        name,
+		Help:        help,
+		ConstLabels: nodeLabels(),
+	}, labels)
+
+	registry.MustRegister(ret)
+	return vecFunc[Counter](func(labelValues ...string) Counter {
+		return ret.WithLabelValues(labelValues...)
+	})
+}
+
+func NewGaugeVec(name string, help string, labels ...string) Vec[Gauge] {
+	if statsdConn != nil {
+		return vecFunc[Gauge](func(labelValues ...string) Gauge {
+			return statsdGauge{name: statsdLabeledName(name, labelValues)}
+		})
+	}
+
+	if registry == nil {
+		return vecFunc[Gauge](func(...string) Gauge { return NoopStat{} })
+	}
+
+	ret := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   cfg.Config.Prometheus.Namespace,
+		Subsystem:   cfg.Config.Prometheus.Subsystem,
+		Name:        name,
+		Help:        help,
+		ConstLabels: nodeLabels(),
+	}, labels)
+
+	registry.MustRegister(ret)
+	return vecFunc[Gauge](func(labelValues ...string) Gauge {
+		return ret.WithLabelValues(labelValues...)
+	})
+}
+
+func NewHistogramVec(name string, help string, labels ...string) Vec[Histogram] {
+	if statsdConn != nil {
+		return vecFunc[Histogram](func(labelValues ...string) Histogram {
+			return statsdHistogram{name: statsdLabeledName(name, labelValues)}
+		})
+	}
+
+	if registry == nil {
+		return vecFunc[Histogram](func(...string) Histogram { return NoopStat{} })
+	}
+
+	ret := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   cfg.Config.Prometheus.Namespace,
+		Subsystem:   cfg.Config.Prometheus.Subsystem,
+		Name:        name,
+		Help:        help,
+		ConstLabels: nodeLabels(),
+	}, labels)
+
+	registry.MustRegister(ret)
+	return vecFunc[Histogram](func(labelValues ...string) Histogram {
+		return ret.WithLabelValues(labelValues...)
+	})
+}
+
+func nodeLabels() map[string]string {
+	return map[string]string{
+		"node_id": strconv.FormatUint(cfg.Config.NodeID, 10),
+	}
+}
+
+// StatsD has no labels, label values become trailing segments of metric name
+func statsdLabeledName(name string, labelValues []string) string {
+	if len(labelValues) == 0 {
+		return statsdName(name)
+	}
+
+	return statsdName(name + "." + strings.Join(labelValues, "."))
+}
@@ -22,6 +22,10 @@ func (s *StateContext) Cancel() {
 	s.cancel()
 }
 
+func (s *StateContext) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
 func (s *StateContext) IsCanceled() bool {
 	select {
 	case <-s.ctx.Done():